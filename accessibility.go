@@ -0,0 +1,137 @@
+package gtfs
+
+import (
+	"errors"
+)
+
+type Level struct {
+	LevelID    string  `json:"level_id" db:"level_id"`
+	LevelIndex float64 `json:"level_index" db:"level_index"`
+	LevelName  string  `json:"level_name" db:"level_name"`
+}
+
+type StationAccessibility struct {
+	StationID          string `json:"station_id"`
+	WheelchairBoarding int    `json:"wheelchair_boarding"` // The station's own wheelchair_boarding (0 unknown, 1 accessible, 2 not accessible)
+
+	// The child stops (platforms, entrances etc) by whether they are wheelchair accessible
+	AccessibleStops   []string `json:"accessible_stops"`
+	InaccessibleStops []string `json:"inaccessible_stops"`
+	UnknownStops      []string `json:"unknown_stops"`
+
+	// The amount of each type of pathway in the station
+	Walkways    int `json:"walkways"`
+	Stairs      int `json:"stairs"`
+	Travelators int `json:"travelators"`
+	Escalators  int `json:"escalators"`
+	Lifts       int `json:"lifts"`
+	FareGates   int `json:"fare_gates"`
+	ExitGates   int `json:"exit_gates"`
+	StairCount  int `json:"stair_count"` // The total number of steps on the station's stairs (if the feed has them)
+
+	Levels []Level `json:"levels"` // The levels of the station, lowest first
+
+	// Every child stop is known to be accessible
+	FullyAccessible bool `json:"fully_accessible"`
+}
+
+/*
+Get a summary of the accessibility of a station, from its child stops, pathways and levels
+
+Child stops without a wheelchair_boarding value inherit the station's
+*/
+func (v Database) GetStationAccessibility(stationID string) (StationAccessibility, error) {
+	if stationID == "" {
+		return StationAccessibility{}, errors.New("missing station id")
+	}
+	stationID = v.PrefixID(stationID)
+
+	var station struct {
+		WheelchairBoarding int `db:"wheelchair_boarding"`
+	}
+	err := v.db.Get(&station, `SELECT COALESCE(wheelchair_boarding, 0) AS wheelchair_boarding FROM stops WHERE stop_id = ?`, stationID)
+	if err != nil {
+		return StationAccessibility{}, errors.New("no station found with id")
+	}
+
+	accessibility := StationAccessibility{
+		StationID:          stationID,
+		WheelchairBoarding: station.WheelchairBoarding,
+	}
+
+	var children []struct {
+		StopID             string `db:"stop_id"`
+		WheelchairBoarding int    `db:"wheelchair_boarding"`
+	}
+	err = v.db.Select(&children, `SELECT stop_id, COALESCE(wheelchair_boarding, 0) AS wheelchair_boarding FROM stops WHERE parent_station = ? ORDER BY stop_id`, stationID)
+	if err != nil {
+		return StationAccessibility{}, err
+	}
+	for _, child := range children {
+		wheelchairBoarding := child.WheelchairBoarding
+		if wheelchairBoarding == 0 {
+			wheelchairBoarding = station.WheelchairBoarding
+		}
+		switch wheelchairBoarding {
+		case 1:
+			accessibility.AccessibleStops = append(accessibility.AccessibleStops, child.StopID)
+		case 2:
+			accessibility.InaccessibleStops = append(accessibility.InaccessibleStops, child.StopID)
+		default:
+			accessibility.UnknownStops = append(accessibility.UnknownStops, child.StopID)
+		}
+	}
+
+	var pathways []struct {
+		PathwayMode int `db:"pathway_mode"`
+		StairCount  int `db:"stair_count"`
+	}
+	err = v.db.Select(&pathways, `
+		SELECT pathway_mode, COALESCE(stair_count, 0) AS stair_count
+		FROM pathways
+		WHERE from_stop_id IN (SELECT stop_id FROM stops WHERE parent_station = ?)
+		   OR to_stop_id IN (SELECT stop_id FROM stops WHERE parent_station = ?)
+	`, stationID, stationID)
+	if err != nil {
+		return StationAccessibility{}, err
+	}
+	for _, pathway := range pathways {
+		switch pathway.PathwayMode {
+		case 1:
+			accessibility.Walkways++
+		case 2:
+			accessibility.Stairs++
+			// Stairs going down have a negative count
+			if pathway.StairCount < 0 {
+				pathway.StairCount = -pathway.StairCount
+			}
+			accessibility.StairCount += pathway.StairCount
+		case 3:
+			accessibility.Travelators++
+		case 4:
+			accessibility.Escalators++
+		case 5:
+			accessibility.Lifts++
+		case 6:
+			accessibility.FareGates++
+		case 7:
+			accessibility.ExitGates++
+		}
+	}
+
+	err = v.db.Select(&accessibility.Levels, `
+		SELECT DISTINCT l.level_id, l.level_index, COALESCE(l.level_name, '') AS level_name
+		FROM levels l
+		JOIN stops s ON s.level_id = l.level_id
+		WHERE s.parent_station = ? OR s.stop_id = ?
+		ORDER BY l.level_index
+	`, stationID, stationID)
+	if err != nil {
+		return StationAccessibility{}, err
+	}
+
+	accessibility.FullyAccessible = len(accessibility.AccessibleStops) > 0 && len(accessibility.InaccessibleStops) == 0 && len(accessibility.UnknownStops) == 0
+
+	v.stripIDs(&accessibility)
+	return accessibility, nil
+}
@@ -0,0 +1,190 @@
+package gtfs
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+type Agency struct {
+	AgencyId       string `json:"agency_id" db:"agency_id"`
+	AgencyName     string `json:"agency_name" db:"agency_name"`
+	AgencyUrl      string `json:"agency_url" db:"agency_url"`
+	AgencyTimezone string `json:"agency_timezone" db:"agency_timezone"`
+	AgencyLang     string `json:"agency_lang" db:"agency_lang"`
+	AgencyPhone    string `json:"agency_phone" db:"agency_phone"`
+	AgencyFareUrl  string `json:"agency_fare_url" db:"agency_fare_url"`
+	AgencyEmail    string `json:"agency_email" db:"agency_email"`
+}
+
+const agencyColumns = `
+	agency_id,
+	agency_name,
+	agency_url,
+	agency_timezone,
+	COALESCE(agency_lang, '') AS agency_lang,
+	COALESCE(agency_phone, '') AS agency_phone,
+	COALESCE(agency_fare_url, '') AS agency_fare_url,
+	COALESCE(agency_email, '') AS agency_email
+`
+
+/*
+Get all the stored agencies
+*/
+func (v Database) GetAgencies() ([]Agency, error) {
+	agencies, err := v.agencies()
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&agencies)
+	return agencies, nil
+}
+
+/*
+Get all the stored agencies, with their ids as they are stored (see WithIDPrefix)
+*/
+func (v Database) agencies() ([]Agency, error) {
+	var agencies []Agency
+	err := v.db.Select(&agencies, `SELECT `+agencyColumns+` FROM agency ORDER BY agency_name`)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(agencies) == 0 {
+		return nil, errors.New("no agencies found")
+	}
+	return agencies, nil
+}
+
+/*
+Get an agency by its id
+*/
+func (v Database) GetAgencyByID(agencyID string) (Agency, error) {
+	var agency Agency
+	err := v.db.Get(&agency, `SELECT `+agencyColumns+` FROM agency WHERE agency_id = ?`, v.PrefixID(agencyID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Agency{}, errors.New("no agency found with id")
+		}
+		return Agency{}, err
+	}
+	v.stripIDs(&agency)
+	return agency, nil
+}
+
+/*
+Get the timezone of the agency, or nil if it's missing/invalid
+*/
+func (a Agency) Location() *time.Location {
+	if a.AgencyTimezone == "" {
+		return nil
+	}
+	location, err := time.LoadLocation(a.AgencyTimezone)
+	if err != nil {
+		return nil
+	}
+	return location
+}
+
+/*
+The timezones of the agencies by agency id, so they aren't read for every query
+*/
+type locationCache struct {
+	mutex     sync.Mutex
+	locations map[string]*time.Location
+}
+
+/*
+Get the timezone gtfs times should be read in for a stop and/or route
+
+Stop times are always in the timezone of the route's agency (stop_timezone is only for showing the times at the stop),
+so the stop is only used to find an agency serving it when there is no route. Falls back to the feed's (first)
+agency_timezone, and finally the timezone the database was created with
+*/
+func (v Database) locationFor(stopID string, routeID string) *time.Location {
+	var agencyID string
+	var err error
+	if routeID != "" {
+		err = v.db.Get(&agencyID, `SELECT COALESCE(agency_id, '') FROM routes WHERE route_id = ?`, routeID)
+	} else if stopID != "" {
+		err = v.db.Get(&agencyID, `
+			SELECT COALESCE(r.agency_id, '')
+			FROM stop_times st
+			JOIN trips t ON t.trip_id = st.trip_id
+			JOIN routes r ON r.route_id = t.route_id
+			WHERE st.stop_id = ? OR st.stop_id IN (SELECT stop_id FROM stops WHERE parent_station = ?)
+			LIMIT 1
+		`, stopID, stopID)
+	}
+	if err != nil {
+		agencyID = ""
+	}
+
+	if location := v.agencyLocation(agencyID); location != nil {
+		return location
+	}
+	if agencyID != "" {
+		if location := v.agencyLocation(""); location != nil {
+			return location
+		}
+	}
+	return v.timeZone
+}
+
+/*
+Get the timezone of an agency, or the feed's first agency for "" (routes can leave out the agency when the feed only
+has one). nil if it's missing/invalid
+*/
+func (v Database) agencyLocation(agencyID string) *time.Location {
+	var cache *locationCache
+	if v.state != nil {
+		cache = &v.state.locations
+		cache.mutex.Lock()
+		location, found := cache.locations[agencyID]
+		cache.mutex.Unlock()
+		if found {
+			return location
+		}
+	}
+
+	var agencyTimezone string
+	var err error
+	if agencyID != "" {
+		err = v.db.Get(&agencyTimezone, `SELECT COALESCE(agency_timezone, '') FROM agency WHERE agency_id = ?`, agencyID)
+	} else {
+		err = v.db.Get(&agencyTimezone, `SELECT COALESCE(agency_timezone, '') FROM agency LIMIT 1`)
+	}
+	if err != nil || agencyTimezone == "" {
+		return nil
+	}
+	location, err := time.LoadLocation(agencyTimezone)
+	if err != nil {
+		return nil
+	}
+
+	// Only found timezones are cached, a missing agency may just not be imported yet
+	if cache != nil {
+		cache.mutex.Lock()
+		if cache.locations == nil {
+			cache.locations = make(map[string]*time.Location)
+		}
+		cache.locations[agencyID] = location
+		cache.mutex.Unlock()
+	}
+	return location
+}
+
+/*
+Forget the cached agency timezones, as the agencies are being replaced (e.g by a refresh or restore)
+*/
+func (v Database) resetLocations() {
+	if v.state == nil {
+		return
+	}
+
+	cache := &v.state.locations
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.locations = nil
+}
@@ -0,0 +1,139 @@
+package gtfs
+
+import (
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+Attach the alerts affecting each service (its route, trip or stop/station) which are active when it's at the stop, the
+alerts use the realtime feed's ids (see TripMatcher)
+*/
+func attachAlerts(stopTimes []StopTimes, alerts realtime.AlertMap, day ServiceDay, matcher TripMatcher) {
+	for i, stopTime := range stopTimes {
+		at, err := day.ParseTime(stopTime.DepartureTime)
+		if err != nil {
+			continue
+		}
+		stopIDs := []string{matcher.feedID(stopTime.StopId), matcher.feedID(stopTime.StopData.ParentStation)}
+		stopTimes[i].Alerts = alerts.ForService(matcher.feedID(stopTime.TripData.RouteID), matcher.feedID(stopTime.TripID), stopIDs, at)
+	}
+}
+
+/*
+An alert's informed entity with what it refers to from the static data, nil for what it doesn't set (or isn't in the feed)
+*/
+type ResolvedEntity struct {
+	Entity        realtime.InformedEntity `json:"entity"`
+	Stop          *Stop                   `json:"stop,omitempty"`
+	ParentStation *Stop                   `json:"parent_station,omitempty"` // The stop's station, when the stop is a platform
+	Route         *Route                  `json:"route,omitempty"`          // The entity's route, or its trip's
+	Trip          *Trip                   `json:"trip,omitempty"`
+	Agency        *Agency                 `json:"agency,omitempty"` // The entity's agency, or its route's
+}
+
+type ResolvedAlert struct {
+	realtime.Alert
+	Entities []ResolvedEntity `json:"entities"` // In the same order as the informed entities
+}
+
+/*
+Resolve the ids in alerts' informed entities to their stops, routes, trips and agencies, so alert UIs can show names
+and icons (see Route.VehicleType) instead of ids
+*/
+func (v Database) ResolveAlertEntities(alerts realtime.AlertMap) []ResolvedAlert {
+	defer v.observeQuery("ResolveAlertEntities", time.Now())
+
+	// Alerts often share entities, so each id is only looked up once
+	stops := make(map[string]*Stop)
+	routes := make(map[string]*Route)
+	trips := make(map[string]*Trip)
+	agencies := make(map[string]*Agency)
+	getStop := func(stopID string) *Stop {
+		if stop, found := stops[stopID]; found {
+			return stop
+		}
+		stop, err := v.GetStopByStopID(stopID)
+		if err != nil {
+			stop = nil
+		}
+		stops[stopID] = stop
+		return stop
+	}
+	getRoute := func(routeID string) *Route {
+		if route, found := routes[routeID]; found {
+			return route
+		}
+		var found *Route
+		if route, err := v.GetRouteByID(routeID); err == nil {
+			found = &route
+		}
+		routes[routeID] = found
+		return found
+	}
+	getTrip := func(tripID string) *Trip {
+		if trip, found := trips[tripID]; found {
+			return trip
+		}
+		var found *Trip
+		if trip, err := v.GetTripByID(tripID); err == nil {
+			found = &trip
+		}
+		trips[tripID] = found
+		return found
+	}
+	getAgency := func(agencyID string) *Agency {
+		if agency, found := agencies[agencyID]; found {
+			return agency
+		}
+		var found *Agency
+		if agency, err := v.GetAgencyByID(agencyID); err == nil {
+			found = &agency
+		}
+		agencies[agencyID] = found
+		return found
+	}
+
+	resolved := make([]ResolvedAlert, 0, len(alerts))
+	for _, alert := range alerts {
+		resolvedAlert := ResolvedAlert{Alert: alert, Entities: make([]ResolvedEntity, 0, len(alert.InformedEntity))}
+		for _, entity := range alert.InformedEntity {
+			resolvedEntity := ResolvedEntity{Entity: entity}
+			if entity.StopID != "" {
+				resolvedEntity.Stop = getStop(entity.StopID)
+				if resolvedEntity.Stop != nil && resolvedEntity.Stop.ParentStation != "" {
+					resolvedEntity.ParentStation = getStop(resolvedEntity.Stop.ParentStation)
+				}
+			}
+
+			routeID := string(entity.RouteID)
+			if entity.Trip != nil {
+				if entity.Trip.TripID != "" {
+					resolvedEntity.Trip = getTrip(entity.Trip.TripID)
+				}
+				if routeID == "" {
+					routeID = string(entity.Trip.RouteID)
+				}
+				if routeID == "" && resolvedEntity.Trip != nil {
+					routeID = resolvedEntity.Trip.RouteID
+				}
+			}
+			if routeID != "" {
+				resolvedEntity.Route = getRoute(routeID)
+			}
+
+			agencyID := entity.AgencyID
+			if agencyID == "" && resolvedEntity.Route != nil {
+				agencyID = resolvedEntity.Route.AgencyId
+			}
+			if agencyID != "" {
+				resolvedEntity.Agency = getAgency(agencyID)
+			}
+
+			resolvedAlert.Entities = append(resolvedAlert.Entities, resolvedEntity)
+		}
+		resolved = append(resolved, resolvedAlert)
+	}
+	return resolved
+}
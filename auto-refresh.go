@@ -1,26 +1,50 @@
 package gtfs
 
 import (
-	"fmt"
-
 	"github.com/robfig/cron/v3"
 )
 
 func (v Database) EnableAutoUpdateGTFSData() {
-	c := cron.New(cron.WithLocation(v.timeZone))
+	// The writer refreshes read only databases
+	if v.IsReadOnly() {
+		return
+	}
+
+	// Scheduled in the feed's timezone, so the departures roll over at the start of its service day
+	c := cron.New(cron.WithLocation(v.locationFor("", "")))
 
 	// Run at 11 PM every day
 	c.AddFunc("0 23 * * *", func() {
-		fmt.Println("Refreshing database data... (11 PM)")
-		v.refreshDatabaseData()
+		v.scheduledRefresh("11 PM")
 	})
 
 	// Run at 3 AM every day
 	c.AddFunc("0 3 * * *", func() {
-		fmt.Println("Refreshing database data... (3 AM)")
-		v.refreshDatabaseData()
+		v.scheduledRefresh("3 AM")
 	})
 
+	// Roll the departures over to the new day
+	if v.state != nil && v.state.materializedDepartures {
+		c.AddFunc("5 0 * * *", func() {
+			if err := v.MaterializeDepartures(); err != nil {
+				v.logger().Error("failed to materialize departures", "error", err)
+			}
+		})
+	}
+
 	// Start the cron job scheduler
 	c.Start()
 }
+
+func (v Database) scheduledRefresh(schedule string) {
+	// Merged feeds are updated by merging them again
+	if v.isMerged() {
+		v.logger().Info("skipping refresh of merged feeds", "schedule", schedule)
+		return
+	}
+
+	v.logger().Info("refreshing database data", "schedule", schedule)
+	if err := v.refreshDatabaseData(); err != nil {
+		v.logger().Error("failed to refresh database data", "error", err)
+	}
+}
@@ -0,0 +1,231 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+A route serving an autocomplete result, for showing as a colored badge
+*/
+type RouteBadge struct {
+	RouteID   string `json:"route_id"`
+	ShortName string `json:"short_name"`
+	Color     string `json:"color"`      // "RRGGBB", see Route.DisplayColors
+	TextColor string `json:"text_color"` // "RRGGBB"
+}
+
+type AutocompleteResult struct {
+	StopID   string       `json:"stop_id" db:"stop_id"` // The parent station for platforms
+	Name     string       `json:"name" db:"name"`
+	Code     string       `json:"code" db:"code"`
+	StopType string       `json:"stop_type" db:"-"`
+	Lat      float64      `json:"lat" db:"lat"`
+	Lon      float64      `json:"lon" db:"lon"`
+	Routes   []RouteBadge `json:"routes" db:"-"`
+}
+
+/*
+Split a name into the lowercase words it can be found by
+*/
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+/*
+Store the words of each stop's name and its code, and the routes serving each stop, for Autocomplete
+
+Platforms are stored as their parent station, so a station is only suggested once
+*/
+func (v Database) buildStopSearch() error {
+	var stops []struct {
+		StopID        string `db:"stop_id"`
+		ParentStation string `db:"parent_station"`
+		StopName      string `db:"stop_name"`
+		StopCode      string `db:"stop_code"`
+	}
+	err := v.db.Select(&stops, `
+		SELECT stop_id, COALESCE(parent_station, '') AS parent_station, COALESCE(stop_name, '') AS stop_name, COALESCE(stop_code, '') AS stop_code
+		FROM stops
+		WHERE location_type IS NULL OR location_type IN (0, 1)
+	`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM stop_search_tokens; DELETE FROM stop_routes;`); err != nil {
+		return fmt.Errorf("failed to clear stop search: %w", err)
+	}
+	statement, err := tx.Prepare(`INSERT OR IGNORE INTO stop_search_tokens (token, stop_id) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+	for _, stop := range stops {
+		stopID := stop.StopID
+		if stop.ParentStation != "" {
+			stopID = stop.ParentStation
+		}
+		tokens := searchTokens(stop.StopName)
+		if stop.StopCode != "" {
+			tokens = append(tokens, strings.ToLower(stop.StopCode))
+		}
+		for _, token := range tokens {
+			if _, err := statement.Exec(token, stopID); err != nil {
+				return fmt.Errorf("failed to build stop search: %w", err)
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO stop_routes (stop_id, route_id)
+		SELECT DISTINCT COALESCE(NULLIF(s.parent_station, ''), st.stop_id), t.route_id
+		FROM stop_times st
+		JOIN trips t ON st.trip_id = t.trip_id
+		LEFT JOIN stops s ON s.stop_id = st.stop_id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to build stop routes: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+/*
+Suggest stops as a rider types, matching the start of the words in their names (or their codes), e.g "cen sta" finds
+"Central Train Station"
+
+Meant to be called on every keystroke, so it only uses the index built at import. Stations are suggested instead of
+their platforms, busier stops first (see GetStopStats), with the routes serving them for badges
+
+  - limit: how many stops, defaults to 10
+*/
+func (v Database) Autocomplete(query string, limit int) ([]AutocompleteResult, error) {
+	defer v.observeQuery("Autocomplete", time.Now())
+
+	words := searchTokens(query)
+	if len(words) == 0 {
+		return nil, errors.New("missing query")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+
+	// Each word has to be the start of one of the stop's words, found by a range scan of the token index
+	var matches []string
+	var args []interface{}
+	for i, word := range words {
+		matches = append(matches, fmt.Sprintf(`SELECT stop_id, %d AS word FROM stop_search_tokens WHERE token >= ? AND token < ?`, i))
+		args = append(args, word, word+"\U0010FFFF")
+	}
+	args = append(args, len(words), int(Today(v.locationFor("", "")).Weekday()), limit)
+
+	var results []AutocompleteResult
+	err := v.db.Select(&results, `
+		WITH matches AS (`+strings.Join(matches, " UNION ALL ")+`),
+		matched AS (
+			SELECT stop_id FROM matches GROUP BY stop_id HAVING COUNT(DISTINCT word) = ?
+		)
+		SELECT s.stop_id AS stop_id, s.stop_name AS name, COALESCE(s.stop_code, '') AS code, s.stop_lat AS lat, s.stop_lon AS lon
+		FROM matched m
+		JOIN stops s ON s.stop_id = m.stop_id
+		LEFT JOIN stop_stats ss ON ss.stop_id = m.stop_id AND ss.weekday = ?
+		ORDER BY COALESCE(ss.trips, 0) DESC, LENGTH(s.stop_name), s.stop_name
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return []AutocompleteResult{}, nil
+	}
+
+	stopIDs := make([]string, len(results))
+	for i, result := range results {
+		stopIDs[i] = result.StopID
+	}
+	badges := v.routeBadges(stopIDs)
+	modes := v.getStopModes(stopIDs)
+	for i := range results {
+		results[i].Routes = badges[results[i].StopID]
+		if results[i].Routes == nil {
+			results[i].Routes = []RouteBadge{}
+		}
+		results[i].StopType = stopTypeFromModes(modes[results[i].StopID], results[i].Name)
+	}
+
+	v.stripIDs(&results)
+	return results, nil
+}
+
+/*
+Get the badges of the routes serving each of the stops, ordered by their short names
+*/
+func (v Database) routeBadges(stopIDs []string) map[string][]RouteBadge {
+	badges := make(map[string][]RouteBadge)
+
+	rows, err := selectByIDs[struct {
+		StopID  string `db:"stop_id"`
+		RouteID string `db:"route_id"`
+	}](v, `SELECT stop_id, route_id FROM stop_routes WHERE stop_id IN (%s)`, stopIDs)
+	if err != nil {
+		v.logger().Warn("failed to get stop routes", "error", err)
+		return badges
+	}
+	var routeIDs []string
+	for _, row := range rows {
+		routeIDs = append(routeIDs, row.RouteID)
+	}
+	routes, err := v.routesByIDs(routeIDs)
+	if err != nil {
+		v.logger().Warn("failed to get routes for badges", "error", err)
+		return badges
+	}
+
+	for _, row := range rows {
+		route, found := routes[row.RouteID]
+		if !found {
+			continue
+		}
+		badges[row.StopID] = append(badges[row.StopID], RouteBadge{
+			RouteID:   route.RouteId,
+			ShortName: route.RouteShortName,
+			Color:     route.DisplayColors.Color,
+			TextColor: route.DisplayColors.TextColor,
+		})
+	}
+	for _, stopBadges := range badges {
+		sort.Slice(stopBadges, func(i, j int) bool {
+			return naturalLess(stopBadges[i].ShortName, stopBadges[j].ShortName)
+		})
+	}
+	return badges
+}
+
+/*
+Compare route short names so "2" comes before "10"
+*/
+func naturalLess(a, b string) bool {
+	numberA, errA := strconv.Atoi(a)
+	numberB, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return numberA < numberB
+	}
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	return a < b
+}
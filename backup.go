@@ -0,0 +1,199 @@
+package gtfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+	sqlite "modernc.org/sqlite"
+)
+
+type sqliteBackuper interface {
+	NewBackup(dstUri string) (*sqlite.Backup, error)
+	NewRestore(srcUri string) (*sqlite.Backup, error)
+}
+
+/*
+Write a snapshot of the database to w, using sqlite's online backup so queries and refreshes can keep running
+
+The snapshot is a complete sqlite database file, which can be loaded again with RestoreFrom
+*/
+func (v Database) Backup(w io.Writer) error {
+	if w == nil {
+		return errors.New("missing writer")
+	}
+
+	tempFile, err := v.createTempDatabaseFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile)
+
+	err = v.withBackuper(func(conn sqliteBackuper) error {
+		backup, err := conn.NewBackup(tempFile)
+		if err != nil {
+			return err
+		}
+		if _, err := backup.Step(-1); err != nil {
+			backup.Finish()
+			return err
+		}
+		return backup.Finish()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to backup the database: %w", err)
+	}
+
+	file, err := os.Open(tempFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("failed to write the backup: %w", err)
+	}
+	return nil
+}
+
+/*
+Replace the data in the database with a snapshot made by Backup
+
+The snapshot is checked before anything is replaced, and the refresh subscribers are notified once it's restored
+*/
+func (v Database) RestoreFrom(r io.Reader) error {
+	if r == nil {
+		return errors.New("missing reader")
+	}
+	if v.IsReadOnly() {
+		return errors.New("can't restore to a read only database")
+	}
+
+	tempFile, err := v.createTempDatabaseFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile)
+
+	file, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to read the backup: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := checkBackupFile(tempFile); err != nil {
+		return err
+	}
+
+	// The prepared statements and agency timezones use the tables being replaced
+	v.resetStatements()
+	v.resetLocations()
+
+	err = v.withBackuper(func(conn sqliteBackuper) error {
+		restore, err := conn.NewRestore(tempFile)
+		if err != nil {
+			return err
+		}
+		if _, err := restore.Step(-1); err != nil {
+			restore.Finish()
+			return err
+		}
+		return restore.Finish()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore the database: %w", err)
+	}
+
+	// Backups from older versions may not have the non feed tables
+	if err := v.createNotificationsTable(); err != nil {
+		return err
+	}
+	if err := v.createSavedItemsTable(); err != nil {
+		return err
+	}
+	if err := v.createVehiclePositionsTable(); err != nil {
+		return err
+	}
+	if err := v.createDerivedTables(); err != nil {
+		return err
+	}
+
+	v.logger().Info("restored database from backup")
+	v.notifyRefreshed()
+
+	return nil
+}
+
+/*
+Run fn with the sqlite driver connection of one of the pool's connections
+*/
+func (v Database) withBackuper(fn func(conn sqliteBackuper) error) error {
+	conn, err := v.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		backuper, ok := driverConn.(sqliteBackuper)
+		if !ok {
+			return errors.New("database driver doesn't support backups")
+		}
+		return fn(backuper)
+	})
+}
+
+/*
+Create an empty file next to the database for a backup to be written to
+*/
+func (v Database) createTempDatabaseFile() (string, error) {
+	dir := filepath.Join(GetWorkDir(), "gtfs")
+	os.Mkdir(dir, os.ModePerm)
+
+	file, err := os.CreateTemp(dir, "backup-*.db")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %w", err)
+	}
+	name := file.Name()
+	file.Close()
+	return name, nil
+}
+
+/*
+Check a backup file is a valid sqlite database with the gtfs tables
+*/
+func checkBackupFile(path string) error {
+	db, err := sqlx.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.Get(&result, `PRAGMA quick_check`); err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("invalid backup: %s", result)
+	}
+
+	var tables int
+	if err := db.Get(&tables, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('stops', 'stop_times', 'trips', 'routes')`); err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	if tables != 4 {
+		return errors.New("invalid backup: missing gtfs tables")
+	}
+
+	return nil
+}
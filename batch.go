@@ -0,0 +1,201 @@
+package gtfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+How many ids are looked up in each query, well under sqlite's limit on parameters
+*/
+const batchSize = 500
+
+/*
+Get many stops by their ids in one query, by the ids given. Ids which aren't found are left out
+*/
+func (v Database) GetStopsByIDs(stopIDs []string) (map[string]Stop, error) {
+	defer v.observeQuery("GetStopsByIDs", time.Now())
+
+	byID, err := v.stopsByIDs(v.prefixIDs(stopIDs))
+	if err != nil {
+		return nil, err
+	}
+	results := byGivenIDs(v, stopIDs, byID)
+	v.stripIDs(&results)
+	return results, nil
+}
+
+/*
+Get many stops by their ids in the database (with the id prefix, see WithIDPrefix), by id
+*/
+func (v Database) stopsByIDs(stopIDs []string) (map[string]Stop, error) {
+	stops, err := selectByIDs[Stop](v, `
+		SELECT
+			stop_id,
+			stop_code,
+			stop_name,
+			stop_lat,
+			stop_lon,
+			location_type,
+			parent_station,
+			platform_code,
+			zone_id,
+			wheelchair_boarding
+		FROM
+			stops
+		WHERE
+			stop_id IN (%s)
+	`, stopIDs)
+	if err != nil {
+		return nil, err
+	}
+	v.setStopModes(stops)
+
+	byID := make(map[string]Stop, len(stops))
+	for _, stop := range stops {
+		byID[stop.StopId] = stop
+	}
+	return byID, nil
+}
+
+/*
+Get many trips by their ids in one query, by the ids given. Ids which aren't found are left out
+*/
+func (v Database) GetTripsByIDs(tripIDs []string) (map[string]Trip, error) {
+	defer v.observeQuery("GetTripsByIDs", time.Now())
+
+	byID, err := v.tripsByIDs(v.prefixIDs(tripIDs))
+	if err != nil {
+		return nil, err
+	}
+	results := byGivenIDs(v, tripIDs, byID)
+	v.stripIDs(&results)
+	return results, nil
+}
+
+/*
+Get many trips by their ids in the database (with the id prefix, see WithIDPrefix), by id
+*/
+func (v Database) tripsByIDs(tripIDs []string) (map[string]Trip, error) {
+	trips, err := selectByIDs[Trip](v, `
+		SELECT
+			trip_id,
+			route_id,
+			trip_headsign,
+			shape_id,
+			service_id,
+			direction_id,
+			wheelchair_accessible,
+			bikes_allowed
+		FROM
+			trips
+		WHERE
+			trip_id IN (%s)
+	`, tripIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]Trip, len(trips))
+	for _, trip := range trips {
+		byID[trip.TripID] = trip
+	}
+	return byID, nil
+}
+
+/*
+Get many routes by their ids in one query, by the ids given. Ids which aren't found are left out
+*/
+func (v Database) GetRoutesByIDs(routeIDs []string) (map[string]Route, error) {
+	defer v.observeQuery("GetRoutesByIDs", time.Now())
+
+	byID, err := v.routesByIDs(v.prefixIDs(routeIDs))
+	if err != nil {
+		return nil, err
+	}
+	results := byGivenIDs(v, routeIDs, byID)
+	v.stripIDs(&results)
+	return results, nil
+}
+
+/*
+Get many routes by their ids in the database (with the id prefix, see WithIDPrefix), by id
+*/
+func (v Database) routesByIDs(routeIDs []string) (map[string]Route, error) {
+	routes, err := selectByIDs[Route](v, `
+		SELECT
+			route_id,
+			agency_id,
+			route_short_name,
+			route_long_name,
+			route_type,
+			route_color,
+			COALESCE(route_text_color, '') AS route_text_color
+		FROM
+			routes
+		WHERE
+			route_id IN (%s)
+	`, routeIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]Route, len(routes))
+	for _, route := range routes {
+		route.setDerivedFields()
+		byID[route.RouteId] = route
+	}
+	return byID, nil
+}
+
+/*
+Key the results of a lookup by the database's ids by the feed's own ids they were looked up with, see WithIDPrefix
+*/
+func byGivenIDs[T any](v Database, ids []string, byID map[string]T) map[string]T {
+	if v.IDPrefix() == "" {
+		return byID
+	}
+	given := make(map[string]T, len(byID))
+	for _, id := range ids {
+		if result, found := byID[v.PrefixID(id)]; found {
+			given[id] = result
+		}
+	}
+	return given
+}
+
+/*
+Run a query with an "IN (%s)" for the ids, in batches of batchSize. Duplicate ids are only looked up once
+*/
+func selectByIDs[T any](v Database, query string, ids []string) ([]T, error) {
+	seen := make(map[string]bool, len(ids))
+	var unique []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	var results []T
+	for start := 0; start < len(unique); start += batchSize {
+		end := start + batchSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		batch := unique[start:end]
+
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		var rows []T
+		placeholders := "?" + strings.Repeat(", ?", len(batch)-1)
+		if err := v.db.Select(&rows, fmt.Sprintf(query, placeholders), args...); err != nil {
+			return nil, err
+		}
+		results = append(results, rows...)
+	}
+	return results, nil
+}
@@ -0,0 +1,158 @@
+package gtfs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CacheStats struct {
+	Name          string    `json:"name"`
+	Hits          uint64    `json:"hits"`
+	Misses        uint64    `json:"misses"`
+	Refreshes     uint64    `json:"refreshes"`
+	Errors        uint64    `json:"errors"`
+	LastRefreshed time.Time `json:"last_refreshed"`
+	LastError     string    `json:"last_error"`
+}
+
+/*
+A cached value which is loaded on first use and reloaded once it's older than its ttl
+
+Errors from loading are returned to the caller and never cached, so a failed load is retried on the next Get
+*/
+type Cache[T any] struct {
+	name string
+	ttl  time.Duration
+	load func() (T, error)
+
+	mutex   sync.RWMutex
+	value   T
+	loaded  bool
+	expires time.Time
+	stats   CacheStats
+	hits    atomic.Uint64
+}
+
+/*
+Create a cache for a value
+
+  - name: a name for the cache, used in its stats
+  - ttl: how long the value is kept before being reloaded, 0 to keep it until it's refreshed
+  - load: gets the value
+*/
+func NewCache[T any](name string, ttl time.Duration, load func() (T, error)) *Cache[T] {
+	return &Cache[T]{
+		name:  name,
+		ttl:   ttl,
+		load:  load,
+		stats: CacheStats{Name: name},
+	}
+}
+
+/*
+Get the cached value, loading it if it hasn't been loaded or has expired
+*/
+func (c *Cache[T]) Get() (T, error) {
+	c.mutex.RLock()
+	if c.isFresh() {
+		value := c.value
+		c.mutex.RUnlock()
+		c.hits.Add(1)
+		return value, nil
+	}
+	c.mutex.RUnlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Another caller may have loaded it while waiting for the lock
+	if c.isFresh() {
+		c.hits.Add(1)
+		return c.value, nil
+	}
+	c.stats.Misses++
+	return c.refresh()
+}
+
+/*
+Reload the value now, even if the cached value hasn't expired
+*/
+func (c *Cache[T]) ForceRefresh() (T, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.refresh()
+}
+
+/*
+Remove the cached value, so it's loaded on the next Get
+*/
+func (c *Cache[T]) Invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var empty T
+	c.value = empty
+	c.loaded = false
+}
+
+/*
+Reload the value each time notify receives, until it's closed (e.g after the feed data is refreshed)
+*/
+func (c *Cache[T]) RefreshOn(notify <-chan struct{}) {
+	go func() {
+		for range notify {
+			c.ForceRefresh()
+		}
+	}()
+}
+
+/*
+Get the name of the cache
+*/
+func (c *Cache[T]) Name() string {
+	return c.name
+}
+
+/*
+Get the hit/miss statistics of the cache
+*/
+func (c *Cache[T]) Stats() CacheStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	stats := c.stats
+	stats.Hits = c.hits.Load()
+	return stats
+}
+
+// Must be called with the mutex held
+func (c *Cache[T]) isFresh() bool {
+	return c.loaded && (c.ttl <= 0 || time.Now().Before(c.expires))
+}
+
+// Must be called with the write mutex held
+func (c *Cache[T]) refresh() (T, error) {
+	if c.load == nil {
+		var empty T
+		return empty, errors.New("cache has no load function")
+	}
+
+	value, err := c.load()
+	if err != nil {
+		c.stats.Errors++
+		c.stats.LastError = err.Error()
+		var empty T
+		return empty, err
+	}
+
+	c.value = value
+	c.loaded = true
+	c.expires = time.Now().Add(c.ttl)
+	c.stats.Refreshes++
+	c.stats.LastRefreshed = time.Now()
+	c.stats.LastError = ""
+
+	return value, nil
+}
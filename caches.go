@@ -0,0 +1,118 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Package managed caches of commonly used data, see EnableCaches
+*/
+type DatabaseCaches struct {
+	Stops      *Cache[map[string]Stop]   // Every stop by its id
+	Routes     *Cache[[]Route]           // Every route
+	RouteStops *Cache[map[string][]Stop] // The stops of each route in travel order, by "route_id|direction_id"
+}
+
+/*
+Get the stats of all the caches
+*/
+func (c *DatabaseCaches) Stats() []CacheStats {
+	return []CacheStats{c.Stops.Stats(), c.Routes.Stats(), c.RouteStops.Stats()}
+}
+
+/*
+Enable the package managed caches, they are loaded now and reloaded each time the feed data is refreshed
+
+Calling it again returns the already enabled caches
+*/
+func (v Database) EnableCaches() (*DatabaseCaches, error) {
+	if v.state == nil {
+		return nil, errors.New("database wasn't created with New")
+	}
+
+	v.state.mutex.Lock()
+	if v.state.caches != nil {
+		caches := v.state.caches
+		v.state.mutex.Unlock()
+		return caches, nil
+	}
+	caches := &DatabaseCaches{
+		Stops:      NewCache("stops", 0, v.GetStopsMap),
+		Routes:     NewCache("routes", 0, func() ([]Route, error) { return v.GetRoutes() }),
+		RouteStops: NewCache("route_stops", 0, v.getAllRouteStops),
+	}
+	v.state.caches = caches
+	v.state.mutex.Unlock()
+
+	// Warm the caches
+	if _, err := caches.Stops.Get(); err != nil {
+		return caches, err
+	}
+	if _, err := caches.Routes.Get(); err != nil {
+		return caches, err
+	}
+	if _, err := caches.RouteStops.Get(); err != nil {
+		return caches, err
+	}
+
+	for _, refreshOn := range []func(<-chan struct{}){caches.Stops.RefreshOn, caches.Routes.RefreshOn, caches.RouteStops.RefreshOn} {
+		notify, _ := v.RefreshNotifier()
+		refreshOn(notify)
+	}
+
+	return caches, nil
+}
+
+/*
+Get the package managed caches, nil if they haven't been enabled with EnableCaches
+*/
+func (v Database) Caches() *DatabaseCaches {
+	if v.state == nil {
+		return nil
+	}
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	return v.state.caches
+}
+
+/*
+Get all the stops (including child stops) by their stop id
+*/
+func (v Database) GetStopsMap() (map[string]Stop, error) {
+	stops, err := v.GetStops(true)
+	if err != nil {
+		return nil, err
+	}
+
+	stopsMap := make(map[string]Stop, len(stops))
+	for _, stop := range stops {
+		stopsMap[stop.StopId] = stop
+	}
+	return stopsMap, nil
+}
+
+/*
+Get the stops of every route and direction in travel order, by "route_id|direction_id"
+*/
+func (v Database) getAllRouteStops() (map[string][]Stop, error) {
+	var patterns []struct {
+		RouteID     string `db:"route_id"`
+		DirectionID int    `db:"direction_id"`
+	}
+	err := v.db.Select(&patterns, `SELECT DISTINCT route_id, COALESCE(direction_id, 0) AS direction_id FROM trips ORDER BY route_id, direction_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	routeStops := make(map[string][]Stop, len(patterns))
+	for _, pattern := range patterns {
+		stops, err := v.orderedStopsForRouteDirection(pattern.RouteID, pattern.DirectionID)
+		if err != nil {
+			continue
+		}
+		v.stripIDs(&stops)
+		routeStops[fmt.Sprintf("%s|%d", v.StripIDPrefix(pattern.RouteID), pattern.DirectionID)] = stops
+	}
+	return routeStops, nil
+}
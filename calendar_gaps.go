@@ -0,0 +1,286 @@
+package gtfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Dates an agency or route has no services on, when it usually runs on that day of the week. These are often a
+mistake in the agency's calendars (e.g a service_id missing from calendar_dates) rather than a real day off
+*/
+type CalendarGap struct {
+	Type     string   `json:"type"`                // "agency" or "route"
+	ID       string   `json:"id"`                  // The agency or route id
+	Name     string   `json:"name"`                // The agency's name or the route's short name (or long name)
+	AgencyID string   `json:"agency_id,omitempty"` // The route's agency
+	Dates    []string `json:"dates"`               // "20060102"
+}
+
+/*
+The most days FindCalendarGaps looks at, feeds with open ended calendars (e.g to 2099) would take a long time to check
+*/
+const maxCalendarGapDays = 731
+
+type CalendarGapOptions struct {
+	From string // Only report gaps from this date "20060102", defaults to the feed's start
+	To   string // Only report gaps up to this date "20060102", defaults to the feed's end
+}
+
+/*
+Find the dates in the feed's validity window each agency and route has no services on, when it runs on that day of
+the week in at least half of the other weeks (so e.g a route which doesn't run on Sundays isn't reported for every
+Sunday)
+
+A route's gaps leave out the dates its whole agency has a gap, which are reported for the agency. The usual days are
+worked out over the feed's dates (up to two years, starting at most a year before From or today), the options only limit which
+gaps are reported
+*/
+func (v Database) FindCalendarGaps(options CalendarGapOptions) ([]CalendarGap, error) {
+	defer v.observeQuery("FindCalendarGaps", time.Now())
+
+	location := v.locationFor("", "")
+	start, err := v.feedStartDay(location)
+	if err != nil {
+		return nil, err
+	}
+	end, err := v.feedEndDay(location)
+	if err != nil {
+		return nil, err
+	}
+	from := Today(location)
+	if options.From != "" {
+		from, err = ParseServiceDay(options.From, location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if yearBefore := from.AddDays(-365); yearBefore.String() > start.String() {
+		start = yearBefore
+	}
+	if last := start.AddDays(maxCalendarGapDays - 1); last.String() < end.String() {
+		end = last
+	}
+
+	var days []ServiceDay
+	for day := start; day.String() <= end.String(); day = day.AddDays(1) {
+		days = append(days, day)
+	}
+
+	serviceDays, err := v.serviceDays(days)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []struct {
+		RouteID   string `db:"route_id"`
+		AgencyID  string `db:"agency_id"`
+		ShortName string `db:"route_short_name"`
+		LongName  string `db:"route_long_name"`
+		ServiceID string `db:"service_id"`
+	}
+	err = v.db.Select(&routes, `
+		SELECT DISTINCT
+			r.route_id,
+			COALESCE(r.agency_id, '') AS agency_id,
+			COALESCE(r.route_short_name, '') AS route_short_name,
+			COALESCE(r.route_long_name, '') AS route_long_name,
+			t.service_id
+		FROM routes r
+		JOIN trips t ON t.route_id = r.route_id
+		ORDER BY r.route_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var agencies []struct {
+		AgencyID string `db:"agency_id"`
+		Name     string `db:"agency_name"`
+	}
+	if err := v.db.Select(&agencies, `SELECT COALESCE(agency_id, '') AS agency_id, COALESCE(agency_name, '') AS agency_name FROM agency`); err != nil {
+		return nil, err
+	}
+	agencyNames := make(map[string]string)
+	for _, agency := range agencies {
+		agencyNames[agency.AgencyID] = agency.Name
+	}
+	// Routes can leave out the agency when the feed only has one
+	if len(agencies) == 1 {
+		agencyNames[""] = agencies[0].Name
+	}
+
+	// Which of the days each agency and route has services on
+	agencyRuns := make(map[string][]bool)
+	routeRuns := make(map[string][]bool)
+	var routeOrder, agencyOrder []string
+	routeInfo := make(map[string]CalendarGap)
+	for _, route := range routes {
+		if _, found := routeRuns[route.RouteID]; !found {
+			routeRuns[route.RouteID] = make([]bool, len(days))
+			routeOrder = append(routeOrder, route.RouteID)
+			name := route.ShortName
+			if name == "" {
+				name = route.LongName
+			}
+			routeInfo[route.RouteID] = CalendarGap{Type: "route", ID: route.RouteID, Name: name, AgencyID: route.AgencyID}
+		}
+		if _, found := agencyRuns[route.AgencyID]; !found {
+			agencyRuns[route.AgencyID] = make([]bool, len(days))
+			agencyOrder = append(agencyOrder, route.AgencyID)
+		}
+		for i, runs := range serviceDays[route.ServiceID] {
+			if runs {
+				routeRuns[route.RouteID][i] = true
+				agencyRuns[route.AgencyID][i] = true
+			}
+		}
+	}
+	sort.Strings(agencyOrder)
+
+	var gaps []CalendarGap
+	agencyGaps := make(map[string][]string)
+	for _, agencyID := range agencyOrder {
+		dates := calendarGapDates(days, agencyRuns[agencyID], options)
+		agencyGaps[agencyID] = dates
+		if len(dates) > 0 {
+			gaps = append(gaps, CalendarGap{Type: "agency", ID: agencyID, Name: agencyNames[agencyID], Dates: dates})
+		}
+	}
+	for _, routeID := range routeOrder {
+		gap := routeInfo[routeID]
+		for _, date := range calendarGapDates(days, routeRuns[routeID], options) {
+			if !contains(agencyGaps[gap.AgencyID], date) {
+				gap.Dates = append(gap.Dates, date)
+			}
+		}
+		if len(gap.Dates) > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+
+	// The ids are agency or route ids
+	for i := range gaps {
+		gaps[i].ID = v.StripIDPrefix(gaps[i].ID)
+	}
+	v.stripIDs(&gaps)
+	return gaps, nil
+}
+
+/*
+Get the days without services which are usually run on that day of the week, within the options' dates
+*/
+func calendarGapDates(days []ServiceDay, runs []bool, options CalendarGapOptions) []string {
+	var weekdayDays, weekdayRuns [7]int
+	for i, day := range days {
+		weekdayDays[day.Weekday()]++
+		if runs[i] {
+			weekdayRuns[day.Weekday()]++
+		}
+	}
+
+	var dates []string
+	for i, day := range days {
+		weekday := day.Weekday()
+		if runs[i] || weekdayRuns[weekday] == 0 || weekdayRuns[weekday]*2 < weekdayDays[weekday]-1 {
+			continue
+		}
+		date := day.String()
+		if (options.From != "" && date < options.From) || (options.To != "" && date > options.To) {
+			continue
+		}
+		dates = append(dates, date)
+	}
+	return dates
+}
+
+type calendarRow struct {
+	ServiceID string `db:"service_id"`
+	Monday    int    `db:"monday"`
+	Tuesday   int    `db:"tuesday"`
+	Wednesday int    `db:"wednesday"`
+	Thursday  int    `db:"thursday"`
+	Friday    int    `db:"friday"`
+	Saturday  int    `db:"saturday"`
+	Sunday    int    `db:"sunday"`
+	StartDate string `db:"start_date"`
+	EndDate   string `db:"end_date"`
+}
+
+/*
+If the calendar has the service running on a weekday, on a date between its start and end dates
+*/
+func (c calendarRow) runsOn(date string, weekday time.Weekday) bool {
+	runsOn := [7]int{c.Sunday, c.Monday, c.Tuesday, c.Wednesday, c.Thursday, c.Friday, c.Saturday}
+	return date >= strings.TrimSpace(c.StartDate) && date <= strings.TrimSpace(c.EndDate) && runsOn[weekday] == 1
+}
+
+type calendarException struct {
+	ServiceID     string `db:"service_id"`
+	Date          string `db:"date"`
+	ExceptionType int    `db:"exception_type"` // 1 added, 2 removed
+}
+
+/*
+Read all of calendar and calendar_dates
+*/
+func (v Database) readCalendars() ([]calendarRow, []calendarException, error) {
+	var calendars []calendarRow
+	err := v.db.Select(&calendars, `
+		SELECT service_id, monday, tuesday, wednesday, thursday, friday, saturday, sunday, start_date, end_date
+		FROM calendar
+	`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+	var exceptions []calendarException
+	if err := v.db.Select(&exceptions, `SELECT service_id, TRIM(date) AS date, exception_type FROM calendar_dates`); err != nil {
+		return nil, nil, fmt.Errorf("failed to read calendar_dates: %w", err)
+	}
+	return calendars, exceptions, nil
+}
+
+/*
+Get which of the days each service runs on, from calendar and calendar_dates
+*/
+func (v Database) serviceDays(days []ServiceDay) (map[string][]bool, error) {
+	calendars, exceptions, err := v.readCalendars()
+	if err != nil {
+		return nil, err
+	}
+
+	dayIndex := make(map[string]int, len(days))
+	for i, day := range days {
+		dayIndex[day.String()] = i
+	}
+
+	services := make(map[string][]bool)
+	service := func(serviceID string) []bool {
+		if _, found := services[serviceID]; !found {
+			services[serviceID] = make([]bool, len(days))
+		}
+		return services[serviceID]
+	}
+	for _, calendar := range calendars {
+		runs := service(calendar.ServiceID)
+		for i, day := range days {
+			if calendar.runsOn(day.String(), day.Weekday()) {
+				runs[i] = true
+			}
+		}
+	}
+	for _, exception := range exceptions {
+		i, found := dayIndex[exception.Date]
+		if !found {
+			continue
+		}
+		switch exception.ExceptionType {
+		case 1:
+			service(exception.ServiceID)[i] = true
+		case 2:
+			service(exception.ServiceID)[i] = false
+		}
+	}
+	return services, nil
+}
@@ -0,0 +1,339 @@
+/*
+A command line tool for importing, checking and querying a gtfs feed without writing any Go
+
+	gtfs [flags] import
+	gtfs [flags] validate
+	gtfs [flags] departures <stop id> [-date 20060102] [-from 15:04:05] [-limit 10]
+	gtfs [flags] plan <from stop id> <to stop id> [-date 20060102]
+	gtfs [flags] export -o backup.db
+	gtfs [flags] export -format netex -codespace NZ -o netex.xml
+	gtfs [flags] serve [-addr :8080]
+
+The flags (-url, -name, -tz) can also be set with the GTFS_URL, GTFS_NAME and GTFS_TZ environment variables.
+Only import and validate need -url, the other commands open the already imported database (and keep it up to date
+if -url is set)
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/gtfshttp"
+)
+
+func main() {
+	flags := flag.NewFlagSet("gtfs", flag.ExitOnError)
+	feedURL := flags.String("url", os.Getenv("GTFS_URL"), "url of the gtfs zip")
+	name := flags.String("name", envOr("GTFS_NAME", "default"), "name of the database file")
+	tz := flags.String("tz", envOr("GTFS_TZ", "Local"), "timezone to process the feed with")
+	flags.Usage = usage
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	location, err := time.LoadLocation(*tz)
+	if err != nil {
+		fail(fmt.Errorf("invalid timezone: %w", err))
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	if *feedURL != "" || command == "import" || command == "validate" {
+		if err := validateFeedURL(*feedURL); err != nil {
+			fail(err)
+		}
+	}
+	open := func() gtfs.Database {
+		var options []gtfs.Option
+		if *feedURL == "" {
+			// Without a url the feed can't be refreshed, so only the already imported data is used
+			options = append(options, gtfs.WithReadOnly())
+		}
+		db, err := gtfs.New(*feedURL, *name, location, "", options...)
+		if err != nil {
+			if *feedURL == "" {
+				fail(fmt.Errorf("%w (import the feed with -url first)", err))
+			}
+			fail(err)
+		}
+		return db
+	}
+
+	switch command {
+	case "import":
+		err = runImport(open())
+	case "validate":
+		err = runValidate(*feedURL, *name, location)
+	case "departures":
+		err = runDepartures(open(), args)
+	case "plan":
+		err = runPlan(open(), args)
+	case "export":
+		err = runExport(open(), args)
+	case "serve":
+		err = runServe(open(), args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+/*
+Check the feed url is a http(s) url
+*/
+func validateFeedURL(feedURL string) error {
+	if feedURL == "" {
+		return errors.New("missing -url (or GTFS_URL) of the gtfs zip")
+	}
+	parsed, err := url.Parse(feedURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("invalid -url, it must be a http(s) url of the gtfs zip")
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: gtfs [-url url] [-name name] [-tz timezone] <command> [args]
+
+-url is only needed by import and validate, the other commands use the imported database
+
+commands:
+  import                      import the feed (if the imported data is out of date) and print its status
+  validate                    import the feed into a temporary database and print the problems found
+  departures <stop>           print the departures from a stop
+  plan <from stop> <to stop>  print the direct services between two stops
+  export -o <file>            write a snapshot of the database (or -format netex, a NeTEx document) to a file
+  serve                       serve the database as a REST API`)
+}
+
+func runImport(db gtfs.Database) error {
+	status, err := db.Status()
+	if err != nil {
+		return err
+	}
+
+	if _, imported := db.LastImportReport(); !imported {
+		fmt.Println("feed data is already up to date")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "feed version\t%s\n", status.FeedVersion)
+	fmt.Fprintf(w, "valid\t%s - %s\n", status.FeedStartDate, status.FeedEndDate)
+	fmt.Fprintf(w, "up to date\t%t\n", status.UpToDate)
+	fmt.Fprintf(w, "database size\t%d bytes\n", status.DatabaseSize)
+	tables := make([]string, 0, len(status.RowCounts))
+	for table := range status.RowCounts {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Fprintf(w, "%s\t%d rows\n", table, status.RowCounts[table])
+	}
+	return w.Flush()
+}
+
+/*
+Import the feed into a temporary database and print the problems found
+*/
+func runValidate(feedURL, name string, location *time.Location) error {
+	name += "-validate"
+	path := filepath.Join(gtfs.GetWorkDir(), "gtfs", fmt.Sprintf("gtfs-%s.db", name))
+	removeDatabase := func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(path + suffix)
+		}
+	}
+	removeDatabase()
+	defer removeDatabase()
+
+	db, err := gtfs.New(feedURL, name, location, "")
+	if err != nil {
+		return err
+	}
+	report, imported := db.LastImportReport()
+	if !imported {
+		return errors.New("the feed wasn't imported")
+	}
+
+	problems := 0
+	for _, file := range report.Files {
+		for _, row := range file.SkippedRows {
+			fmt.Printf("%s:%d: skipped: %s\n", file.File, row.Line, row.Reason)
+		}
+		for _, row := range file.DuplicateRows {
+			fmt.Printf("%s:%d: duplicate: %s\n", file.File, row.Line, row.Reason)
+		}
+		for _, column := range file.UnknownColumns {
+			fmt.Printf("%s: unknown column: %s\n", file.File, column)
+		}
+		problems += file.Skipped + file.Duplicates
+	}
+
+	if upToDate, err := db.IsFeedDataUpToDate(); err != nil || !upToDate {
+		fmt.Println("feed_info: the feed has expired")
+		problems++
+	}
+
+	// Days off are often real (e.g public holidays), so the gaps are warnings rather than problems
+	gaps, err := db.FindCalendarGaps(gtfs.CalendarGapOptions{})
+	if err != nil {
+		return err
+	}
+	for _, gap := range gaps {
+		fmt.Printf("calendar: warning: %s %s (%s) has no services on %s\n", gap.Type, gap.Name, gap.ID, strings.Join(gap.Dates, ", "))
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Println("no problems found")
+	return nil
+}
+
+func runDepartures(db gtfs.Database, args []string) error {
+	flags := flag.NewFlagSet("departures", flag.ExitOnError)
+	date := flags.String("date", "", "service date (20060102), defaults to today")
+	from := flags.String("from", "", "only departures after this time (15:04:05)")
+	limit := flags.Int("limit", 20, "max departures")
+	stopID, err := positional(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	departures, err := db.GetActiveTripsWithOptions(gtfs.ActiveTripsOptions{
+		StopID: stopID[0],
+		Date:   *date,
+		From:   *from,
+		Limit:  *limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPARTS\tROUTE\tHEADSIGN\tPLATFORM\tTRIP")
+	for _, departure := range departures {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", departure.DepartureTime, departure.TripData.RouteID, departure.TripData.TripHeadsign, departure.Platform, departure.TripID)
+	}
+	return w.Flush()
+}
+
+func runPlan(db gtfs.Database, args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	date := flags.String("date", "", "service date (20060102), defaults to today")
+	stops, err := positional(flags, args, 2)
+	if err != nil {
+		return err
+	}
+
+	services, err := db.GetStopTimesBetweenStops(stops[0], stops[1], *date)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPARTS\tARRIVES\tROUTE\tHEADSIGN\tSTOPS\tTRIP")
+	for _, service := range services {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", service.DepartureTime, service.ArrivalTime, service.Trip.RouteID, service.Trip.TripHeadsign, service.Stops, service.Trip.TripID)
+	}
+	return w.Flush()
+}
+
+func runExport(db gtfs.Database, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the snapshot to")
+	format := flags.String("format", "sqlite", "sqlite (a snapshot of the database) or netex")
+	codespace := flags.String("codespace", "", "the prefix of the netex ids (required for netex)")
+	if _, err := positional(flags, args, 0); err != nil {
+		return err
+	}
+	if *output == "" {
+		return errors.New("missing -o file")
+	}
+	if *format != "sqlite" && *format != "netex" {
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+	if *format == "netex" && *codespace == "" {
+		return errors.New("missing -codespace")
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if *format == "netex" {
+		err = db.ExportNeTEx(file, *codespace)
+	} else {
+		err = db.Backup(file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func runServe(db gtfs.Database, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	cors := flags.String("cors", "*", "allowed origin for cross origin requests, \"\" to disallow them")
+	if _, err := positional(flags, args, 0); err != nil {
+		return err
+	}
+
+	var options []gtfshttp.Option
+	if *cors != "" {
+		options = append(options, gtfshttp.WithCORS(*cors))
+	}
+
+	fmt.Fprintf(os.Stderr, "listening on %s\n", *addr)
+	return http.ListenAndServe(*addr, gtfshttp.New(db, options...))
+}
+
+/*
+Parse the flags of a command, which can be before or after its positional arguments
+*/
+func positional(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+	var values []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		values = append(values, args[0])
+		args = args[1:]
+	}
+	if len(values) != count {
+		return nil, fmt.Errorf("%s takes %d arguments", flags.Name(), count)
+	}
+	return values, nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gtfs:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,151 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+The minimum contrast ratio between text and its background for normal sized text (WCAG 2 level AA)
+*/
+const MinimumTextContrast = 4.5
+
+/*
+The colors to show a route in, normalized and with defaults for the routes without them, see Route.Colors
+*/
+type RouteColors struct {
+	Color      string  `json:"color"`      // "RRGGBB"
+	TextColor  string  `json:"text_color"` // "RRGGBB"
+	Contrast   float64 `json:"contrast"`   // The WCAG contrast ratio of the text color on the color (1-21)
+	Accessible bool    `json:"accessible"` // If the contrast is at least MinimumTextContrast
+}
+
+/*
+The default color of each basic route_type, for routes without a route_color
+*/
+var defaultRouteColors = map[int]string{
+	0:  "00843D", // Tram
+	1:  "0039A6", // Metro
+	2:  "6C2C91", // Rail
+	3:  "0072BC", // Bus
+	4:  "00A6D6", // Ferry
+	5:  "8B4513", // Cable tram
+	6:  "F7941D", // Gondola
+	7:  "A0522D", // Funicular
+	11: "0072BC", // Trolleybus
+	12: "6C2C91", // Monorail
+}
+
+/*
+Normalize a gtfs color to "RRGGBB": without the #, uppercase and expanded from "RGB". "" if it isn't a valid color
+*/
+func NormalizeColor(color string) string {
+	color = strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(color), "#"))
+	if len(color) == 3 {
+		color = string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	}
+	if len(color) != 6 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil {
+		return ""
+	}
+	return color
+}
+
+/*
+Get the WCAG contrast ratio between two colors, from 1 (the same) to 21 (black and white)
+*/
+func ContrastRatio(a, b string) (float64, error) {
+	luminanceA, err := relativeLuminance(a)
+	if err != nil {
+		return 0, err
+	}
+	luminanceB, err := relativeLuminance(b)
+	if err != nil {
+		return 0, err
+	}
+
+	lighter, darker := math.Max(luminanceA, luminanceB), math.Min(luminanceA, luminanceB)
+	return (lighter + 0.05) / (darker + 0.05), nil
+}
+
+/*
+Get the text color (black or white) with the most contrast on a background color
+*/
+func AccessibleTextColor(background string) string {
+	black, err := ContrastRatio(background, "000000")
+	if err != nil {
+		return "FFFFFF"
+	}
+	white, _ := ContrastRatio(background, "FFFFFF")
+	if black > white {
+		return "000000"
+	}
+	return "FFFFFF"
+}
+
+/*
+The relative luminance of a color, https://www.w3.org/TR/WCAG21/#dfn-relative-luminance
+*/
+func relativeLuminance(color string) (float64, error) {
+	normalized := NormalizeColor(color)
+	if normalized == "" {
+		return 0, errors.New("invalid color")
+	}
+	value, _ := strconv.ParseUint(normalized, 16, 32)
+
+	channel := func(shift uint) float64 {
+		c := float64((value>>shift)&0xFF) / 255
+		if c <= 0.03928 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(16) + 0.7152*channel(8) + 0.0722*channel(0), nil
+}
+
+/*
+Get the route's color, normalized ("RRGGBB") and defaulting to a color for its route type
+*/
+func (r Route) Color() string {
+	if color := NormalizeColor(r.RouteColor); color != "" {
+		return color
+	}
+	if color, found := defaultRouteColors[BasicRouteType(r.RouteType)]; found {
+		return color
+	}
+	return "666666"
+}
+
+/*
+Get the route's text color, normalized ("RRGGBB") and defaulting to black or white, whichever is more readable on its color
+*/
+func (r Route) TextColor() string {
+	if color := NormalizeColor(r.RouteTextColor); color != "" {
+		return color
+	}
+	return AccessibleTextColor(r.Color())
+}
+
+/*
+Get the route's colors, with the contrast of its text color
+*/
+func (r Route) Colors() RouteColors {
+	colors := RouteColors{Color: r.Color(), TextColor: r.TextColor()}
+	colors.Contrast, _ = ContrastRatio(colors.Color, colors.TextColor)
+	colors.Contrast = math.Round(colors.Contrast*100) / 100
+	colors.Accessible = colors.Contrast >= MinimumTextContrast
+	return colors
+}
+
+/*
+Set the fields computed from the route's columns
+*/
+func (r *Route) setDerivedFields() {
+	r.VehicleType = RouteTypeName(r.RouteType)
+	r.Category = RouteTypeCategory(r.RouteType)
+	r.DisplayColors = r.Colors()
+}
@@ -0,0 +1,79 @@
+package gtfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Columns computed from the feed's columns, so the gtfs times ("15:04:05", or "5:04:05" in some feeds) can be
+compared and sorted as numbers instead of strings
+
+The date columns don't need one as they're always "20060102", which sorts correctly as text
+*/
+var generatedColumns = []struct {
+	Table      string
+	Column     string
+	Expression string
+}{
+	{"stop_times", "arrival_sec", gtfsTimeSecondsSQL("arrival_time")},
+	{"stop_times", "departure_sec", gtfsTimeSecondsSQL("departure_time")},
+	{"frequencies", "start_sec", gtfsTimeSecondsSQL("start_time")},
+	{"frequencies", "end_sec", gtfsTimeSecondsSQL("end_time")},
+}
+
+/*
+Build the sql converting a gtfs time column into seconds since the start of the service day (NULL if it's empty), see parseGTFSTime
+*/
+func gtfsTimeSecondsSQL(column string) string {
+	return fmt.Sprintf(`CASE WHEN instr(%[1]s, ':') > 0 THEN
+		CAST(substr(%[1]s, 1, instr(%[1]s, ':') - 1) AS INTEGER) * 3600
+		+ CAST(substr(%[1]s, instr(%[1]s, ':') + 1, 2) AS INTEGER) * 60
+		+ CAST(substr(%[1]s, instr(%[1]s, ':') + 4, 2) AS INTEGER)
+	END`, column)
+}
+
+/*
+Add the generated columns to the gtfs tables if they don't have them yet (e.g databases created by older versions)
+*/
+func (v Database) createGeneratedColumns() error {
+	for _, generated := range generatedColumns {
+		var exists bool
+		err := v.db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM pragma_table_xinfo(?) WHERE name = ?)`, generated.Table, generated.Column)
+		if err != nil {
+			return fmt.Errorf("failed to check for column %s.%s: %w", generated.Table, generated.Column, err)
+		}
+		if exists {
+			continue
+		}
+
+		query := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s INTEGER GENERATED ALWAYS AS (%s) VIRTUAL`, generated.Table, generated.Column, generated.Expression)
+		if _, err := v.db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", generated.Table, generated.Column, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+The column type for a column of an extension file, from the gtfs naming conventions
+
+Everything else is TEXT, including the dates and times (see generatedColumns)
+*/
+func extensionColumnType(column string) string {
+	switch {
+	case strings.HasSuffix(column, "_lat"), strings.HasSuffix(column, "_lon"),
+		strings.HasSuffix(column, "_dist_traveled"), strings.HasSuffix(column, "_amount"),
+		strings.HasSuffix(column, "_price"), strings.HasSuffix(column, "_length"):
+		return "REAL"
+	case strings.HasSuffix(column, "_sequence"), strings.HasSuffix(column, "_type"),
+		strings.HasSuffix(column, "_index"), strings.HasSuffix(column, "_count"),
+		strings.HasSuffix(column, "_secs"), strings.HasSuffix(column, "_seconds"),
+		strings.HasSuffix(column, "_duration"), strings.HasSuffix(column, "_allowed"),
+		strings.HasSuffix(column, "_accessible"), column == "direction_id":
+		return "INTEGER"
+	default:
+		return "TEXT"
+	}
+}
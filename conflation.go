@@ -0,0 +1,148 @@
+package gtfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Group stops which are duplicates of each other (e.g a station shared by multiple agencies in a merged feed)
+and store the canonical stop of each group, see GetCanonicalStop
+
+Stops are grouped when they have the same stop_code, or the same name and are within maxDistance meters of each other.
+Child stops belong to the group of their parent station.
+
+The groups are cleared when the feed data is refreshed, so this should be run again after each refresh
+*/
+func (v Database) ConflateStops(maxDistance float64) error {
+	var stops Stops
+	err := v.db.Select(&stops, `
+		SELECT stop_id, stop_code, stop_name, stop_lat, stop_lon, location_type, parent_station
+		FROM stops
+		WHERE parent_station = '' OR parent_station IS NULL
+		ORDER BY stop_id
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Union find of the stops, by index
+	parents := make([]int, len(stops))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+	union := func(a, b int) {
+		rootA, rootB := find(a), find(b)
+		if rootA != rootB {
+			parents[rootB] = rootA
+		}
+	}
+
+	byCode := make(map[string][]int)
+	byName := make(map[string][]int)
+	for i, stop := range stops {
+		if code := strings.TrimSpace(stop.StopCode); code != "" {
+			byCode[code] = append(byCode[code], i)
+		}
+		name := strings.ToLower(strings.TrimSpace(stop.StopName))
+		byName[name] = append(byName[name], i)
+	}
+	for _, group := range byCode {
+		for _, i := range group[1:] {
+			union(group[0], i)
+		}
+	}
+	for _, group := range byName {
+		for x := 0; x < len(group); x++ {
+			for y := x + 1; y < len(group); y++ {
+				a, b := stops[group[x]], stops[group[y]]
+				if calculateDistance(a.StopLat, a.StopLon, b.StopLat, b.StopLon)*1000 <= maxDistance {
+					union(group[x], group[y])
+				}
+			}
+		}
+	}
+
+	// The canonical stop of a group is its first station, or its first stop if it has no stations
+	groups := make(map[int][]int)
+	for i := range stops {
+		root := find(i)
+		groups[root] = append(groups[root], i)
+	}
+	canonical := make(map[string]string, len(stops))
+	for _, group := range groups {
+		sort.Slice(group, func(a, b int) bool {
+			if stops[group[a]].LocationType != stops[group[b]].LocationType {
+				return stops[group[a]].LocationType == 1
+			}
+			return stops[group[a]].StopId < stops[group[b]].StopId
+		})
+		for _, i := range group {
+			canonical[stops[i].StopId] = stops[group[0]].StopId
+		}
+	}
+
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM canonical_stops`); err != nil {
+		return err
+	}
+
+	for stopID, canonicalStopID := range canonical {
+		if _, err := tx.Exec(`INSERT INTO canonical_stops (stop_id, canonical_stop_id) VALUES (?, ?)`, stopID, canonicalStopID); err != nil {
+			return err
+		}
+	}
+
+	// Child stops use the canonical stop of their parent
+	_, err = tx.Exec(`
+		INSERT INTO canonical_stops (stop_id, canonical_stop_id)
+		SELECT s.stop_id, c.canonical_stop_id
+		FROM stops s
+		JOIN canonical_stops c ON c.stop_id = s.parent_station
+	`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+Get the canonical stop for a stop, as grouped by ConflateStops
+
+If the stops haven't been conflated (or the stop isn't a duplicate) the stop itself is returned
+*/
+func (v Database) GetCanonicalStop(stopID string) (*Stop, error) {
+	if stopID == "" {
+		return nil, errors.New("missing stop id")
+	}
+	stopID = v.PrefixID(stopID)
+
+	canonicalStopID := stopID
+	err := v.db.Get(&canonicalStopID, `SELECT canonical_stop_id FROM canonical_stops WHERE stop_id = ?`, stopID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	stop, err := v.stopByID(canonicalStopID)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(stop)
+	return stop, nil
+}
@@ -0,0 +1,175 @@
+package gtfs
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+type Connection struct {
+	StopTimes
+	MinTransferTime int `json:"min_transfer_time"` // Seconds needed to get from the arrival stop to the departure stop
+	WaitTime        int `json:"wait_time"`         // Seconds between arriving and the connection departing
+}
+
+/*
+Get the departures on other routes which can be caught after arriving at a stop on a trip, ordered by departure time
+
+Departures from the arrival stop, its sibling platforms and any stops it has transfers to are included.
+Min transfer times from transfers.txt are honored and transfers marked as not possible (type 3) are skipped.
+
+  - stopID: the stop the trip arrives at (or its parent station)
+  - arrivingTrip: the trip being arrived on, if ServiceDate is "" today is used
+  - window: how long after arriving to look for departures
+*/
+func (v Database) GetConnectionsAtStop(stopID string, arrivingTrip TripInstance, window time.Duration) ([]Connection, error) {
+	defer v.observeQuery("GetConnectionsAtStop", time.Now())
+
+	if stopID == "" || arrivingTrip.TripID == "" {
+		return nil, errors.New("missing stop/trip id")
+	}
+	stopID, arrivingTrip.TripID = v.PrefixID(stopID), v.PrefixID(arrivingTrip.TripID)
+
+	var arrival struct {
+		StopID        string `db:"stop_id"`
+		ParentStation string `db:"parent_station"`
+		ArrivalTime   string `db:"arrival_time"`
+		RouteID       string `db:"route_id"`
+		TripStartTime string `db:"trip_start_time"`
+	}
+	err := v.db.Get(&arrival, `
+		SELECT
+			st.stop_id,
+			s.parent_station,
+			st.arrival_time,
+			t.route_id,
+			(SELECT o.departure_time FROM stop_times o WHERE o.trip_id = st.trip_id ORDER BY o.stop_sequence LIMIT 1) AS trip_start_time
+		FROM stop_times st
+		JOIN stops s ON st.stop_id = s.stop_id
+		JOIN trips t ON st.trip_id = t.trip_id
+		WHERE st.trip_id = ? AND (st.stop_id = ? OR s.parent_station = ?)
+		ORDER BY st.stop_sequence
+		LIMIT 1
+	`, arrivingTrip.TripID, stopID, stopID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("trip doesn't stop at stop")
+		}
+		return nil, err
+	}
+
+	arrivalTime, err := parseGTFSTime(arrival.ArrivalTime)
+	if err != nil {
+		return nil, err
+	}
+	// Frequency based runs are offset from the scheduled times
+	if arrivingTrip.StartTime != "" {
+		scheduledStart, errA := parseGTFSTime(arrival.TripStartTime)
+		instanceStart, errB := parseGTFSTime(arrivingTrip.StartTime)
+		if errA == nil && errB == nil {
+			arrivalTime += instanceStart - scheduledStart
+		}
+	}
+
+	minTransferTimes, err := v.transferStops(arrival.StopID, arrival.ParentStation, arrivingTrip.TripID)
+	if err != nil {
+		return nil, err
+	}
+
+	latestDeparture := arrivalTime + int(window.Seconds())
+
+	var connections []Connection
+	for departureStopID, minTransferTime := range minTransferTimes {
+		earliestDeparture := arrivalTime + minTransferTime
+		if earliestDeparture > latestDeparture {
+			continue
+		}
+
+		services, err := v.activeTrips(ActiveTripsOptions{
+			StopID: departureStopID,
+			Date:   arrivingTrip.ServiceDate,
+			// The filters are exclusive
+			From: formatGTFSTime(earliestDeparture - 1),
+			To:   formatGTFSTime(latestDeparture + 1),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, service := range services {
+			if service.TripData.RouteID == arrival.RouteID || service.IsTerminus {
+				continue
+			}
+			departureTime, err := parseGTFSTime(service.DepartureTime)
+			if err != nil {
+				continue
+			}
+			connections = append(connections, Connection{
+				StopTimes:       service,
+				MinTransferTime: minTransferTime,
+				WaitTime:        departureTime - arrivalTime,
+			})
+		}
+	}
+
+	if len(connections) == 0 {
+		return nil, errors.New("no connections found")
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].WaitTime < connections[j].WaitTime
+	})
+
+	v.stripIDs(&connections)
+	return connections, nil
+}
+
+/*
+Get the stops which can be transferred to from a stop, with the min transfer time (seconds) to each
+*/
+func (v Database) transferStops(stopID, parentStation, fromTripID string) (map[string]int, error) {
+	stops := map[string]int{stopID: 0}
+
+	// Other platforms at the same station
+	if parentStation != "" {
+		var siblings []string
+		err := v.db.Select(&siblings, `SELECT stop_id FROM stops WHERE parent_station = ?`, parentStation)
+		if err != nil {
+			return nil, err
+		}
+		for _, sibling := range siblings {
+			stops[sibling] = 0
+		}
+	}
+
+	var transfers []struct {
+		ToStopID        string `db:"to_stop_id"`
+		TransferType    int    `db:"transfer_type"`
+		MinTransferTime int    `db:"min_transfer_time"`
+	}
+	err := v.db.Select(&transfers, `
+		SELECT to_stop_id, transfer_type, COALESCE(min_transfer_time, 0) AS min_transfer_time
+		FROM transfers
+		WHERE from_stop_id = ? AND (COALESCE(from_trip_id, '') = '' OR from_trip_id = ?) AND COALESCE(to_trip_id, '') = ''
+	`, stopID, fromTripID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, transfer := range transfers {
+		switch transfer.TransferType {
+		case 3:
+			// Transfers aren't possible
+			delete(stops, transfer.ToStopID)
+		case 2:
+			stops[transfer.ToStopID] = transfer.MinTransferTime
+		default:
+			if _, ok := stops[transfer.ToStopID]; !ok {
+				stops[transfer.ToStopID] = 0
+			}
+		}
+	}
+
+	return stops, nil
+}
@@ -8,11 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 )
 
 func fetchZip(url string) ([]byte, error) {
@@ -33,6 +36,11 @@ func fetchZip(url string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
+	// Error pages aren't feeds, they would replace the feed data with nothing
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, errors.New("error reading http response body")
@@ -64,123 +72,409 @@ var defaultTableNames = []string{
 	"feed_info",
 }
 
-func writeFilesToDB(zipData []byte, v Database) error {
-	db := v.db
+/*
+The files a feed zip must have to replace the feed data, it also needs calendar.txt or calendar_dates.txt
+*/
+var requiredFeedFiles = []string{
+	"agency",
+	"stops",
+	"routes",
+	"trips",
+	"stop_times",
+}
+
+/*
+Check a feed zip can be read and has the required files, before the feed data is replaced with it
+*/
+func checkFeedZip(zipData []byte) error {
 	reader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 	if err != nil {
 		return errors.New("error reading GTFS zip file")
 	}
 
+	var found []string
 	for _, file := range reader.File {
-		fmt.Println("Processing file:", file.Name)
+		if !file.FileInfo().IsDir() && isCSVFile(file.Name) {
+			found = append(found, feedFileTable(file.Name))
+		}
+	}
+	for _, table := range requiredFeedFiles {
+		if !contains(found, table) {
+			return fmt.Errorf("%s.txt isn't in the zip", table)
+		}
+	}
+	if !contains(found, "calendar") && !contains(found, "calendar_dates") {
+		return errors.New("calendar.txt or calendar_dates.txt isn't in the zip")
+	}
+	return nil
+}
 
+/*
+How many rows are parsed in each chunk, large files (e.g stop_times) are written in chunks so other files can be written in between
+*/
+const importChunkSize = 10000
+
+/*
+A feed file being imported
+*/
+type importFile struct {
+	file    *zip.File
+	table   string
+	headers []string
+	logger  *slog.Logger
+
+	idPrefix  string
+	idColumns []int // The columns prefixed with idPrefix, see WithIDPrefix
+
+	report FileImportReport
+}
+
+/*
+Rows parsed from a file, ready to be inserted
+*/
+type importChunk struct {
+	file    *importFile
+	records [][]string
+	lines   []int
+	skipped []string // Why the parser skipped a row, for the nil records
+	last    bool     // The file has no more rows
+}
+
+/*
+Write the files in the feed zip to the database, only the files for the tables given (if any)
+
+The files are parsed concurrently and their rows are written by a single writer (sqlite only allows one at a time), in one
+transaction so nothing is changed if the import fails. The data being replaced is cleared by clear in the same transaction
+(it can be nil)
+*/
+func writeFilesToDB(zipData []byte, v Database, clear func(tx *sql.Tx) error, tables ...string) (ImportReport, error) {
+	report := ImportReport{Started: time.Now()}
+
+	reader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return report, errors.New("error reading GTFS zip file")
+	}
+
+	// The tables are created before anything is written, so the schema doesn't change while the files are imported
+	var files []*importFile
+	for _, file := range reader.File {
 		if file.FileInfo().IsDir() || !isCSVFile(file.Name) {
-			fmt.Println("Skipping non-CSV or directory file:", file.Name)
+			v.logger().Debug("skipping non-csv or directory file", "file", file.Name)
+			continue
+		}
+		if len(tables) > 0 && !contains(tables, feedFileTable(file.Name)) {
 			continue
 		}
 
-		var tableName = strings.ToLower(strings.TrimSuffix(filepath.Base(file.Name), ".txt"))
-
-		fmt.Println("Opening file:", file.Name)
-		f, err := file.Open()
+		importFile, err := v.prepareImportFile(file)
 		if err != nil {
-			return fmt.Errorf("error opening file %s: %v", file.Name, err)
+			return report, err
 		}
-		defer f.Close()
-
-		fmt.Println("Reading CSV content from file:", file.Name)
-		csvReader := csv.NewReader(f)
+		if importFile != nil {
+			files = append(files, importFile)
+		}
+	}
 
-		tx, err := db.Begin() // Start transaction for better performance
-		if err != nil {
-			return fmt.Errorf("error starting transaction: %v", err)
+	tx, err := v.db.Begin()
+	if err != nil {
+		return report, fmt.Errorf("error starting transaction: %v", err)
+	}
+	if clear != nil {
+		if err := clear(tx); err != nil {
+			tx.Rollback()
+			return report, err
 		}
+	}
 
-		// Read file line by line instead of loading all into memory
-		headers, err := csvReader.Read()
-		if err != nil {
-			return fmt.Errorf("error reading csv headers from %s: %v", file.Name, err)
+	chunks := make(chan importChunk, runtime.NumCPU())
+	done := make(chan struct{})
+
+	var parseErr error
+	var parseErrOnce sync.Once
+	var wg sync.WaitGroup
+
+	workers := make(chan struct{}, runtime.NumCPU())
+	for _, file := range files {
+		wg.Add(1)
+		go func(file *importFile) {
+			defer wg.Done()
+
+			select {
+			case workers <- struct{}{}:
+			case <-done:
+				return
+			}
+			defer func() { <-workers }()
+
+			if err := parseImportFile(file, v.lazyQuotes(), chunks, done); err != nil {
+				parseErrOnce.Do(func() { parseErr = err })
+			}
+		}(file)
+	}
+	go func() {
+		wg.Wait()
+		close(chunks)
+	}()
+
+	writeErr := v.writeImportChunks(tx, chunks)
+	if writeErr != nil {
+		// Stop the parsers and let them finish
+		close(done)
+		for range chunks {
 		}
+	}
 
-		fmt.Println("Headers from file:", headers)
+	for _, file := range files {
+		report.Files = append(report.Files, file.report)
+	}
+	report.Finished = time.Now()
 
-		if !contains(defaultTableNames, tableName) {
-			v.createTableIfNotExists(tableName, headers)
-		} else {
-			columns, err := v.getTableColumns(tableName)
-			if err != nil {
-				log.Panicln(err)
+	if writeErr == nil {
+		writeErr = parseErr
+	}
+	if writeErr != nil {
+		tx.Rollback()
+		return report, writeErr
+	}
+	if err := tx.Commit(); err != nil {
+		return report, fmt.Errorf("error committing transaction: %v", err)
+	}
+	return report, nil
+}
+
+/*
+Create the table for a feed file (or add its extra columns), nil is returned if the file should be skipped
+*/
+func (v Database) prepareImportFile(file *zip.File) (*importFile, error) {
+	var tableName = feedFileTable(file.Name)
+	logger := v.logger().With("file", file.Name, "table", tableName)
+	logger.Debug("processing file")
+
+	f, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %v", file.Name, err)
+	}
+	defer f.Close()
+
+	headers, err := newFeedCSVReader(f, v.lazyQuotes()).Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv headers from %s: %v", file.Name, err)
+	}
+	for i := range headers {
+		headers[i] = strings.TrimSpace(headers[i])
+	}
+
+	logger.Debug("read headers", "headers", headers)
+
+	report := FileImportReport{File: file.Name, Table: tableName}
+
+	if !contains(defaultTableNames, tableName) {
+		if err := v.createTableIfNotExists(tableName, headers); err != nil {
+			// Only skip the extension file, the rest of the feed can still be used
+			logger.Warn("skipping file", "error", err)
+			return nil, nil
+		}
+	} else {
+		columns, err := v.getTableColumns(tableName)
+		if err != nil {
+			return nil, err
+		}
+		specColumns := defaultTableColumns()[tableName]
+		for _, a := range headers {
+			if len(specColumns) > 0 && !contains(specColumns, a) {
+				report.UnknownColumns = append(report.UnknownColumns, a)
 			}
-			for _, a := range headers {
-				if !contains(columns, a) {
-					v.createExtraColumn(tableName, a)
+			if !contains(columns, a) {
+				if err := v.createExtraColumn(tableName, a); err != nil {
+					logger.Warn("failed to add column", "column", a, "error", err)
 				}
 			}
 		}
+	}
 
-		// Read each record (line by line)
-		for {
-			record, err := csvReader.Read()
-			if err == io.EOF {
-				break // End of file
+	importFile := &importFile{file: file, table: tableName, headers: headers, logger: logger, report: report, idPrefix: v.IDPrefix()}
+	if importFile.idPrefix != "" {
+		for i, header := range headers {
+			if contains(mergeIDColumns, header) {
+				importFile.idColumns = append(importFile.idColumns, i)
 			}
-			if err != nil {
-				fmt.Println("Error reading record:", err)
-				return fmt.Errorf("error reading csv file %s: %v", file.Name, err)
+		}
+	}
+	return importFile, nil
+}
+
+/*
+Read the rows of a file and send them to the writer in chunks, until the file ends or done is closed
+*/
+func parseImportFile(file *importFile, lazyQuotes bool, chunks chan<- importChunk, done <-chan struct{}) error {
+	f, err := file.file.Open()
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %v", file.file.Name, err)
+	}
+	defer f.Close()
+
+	csvReader := newFeedCSVReader(f, lazyQuotes)
+
+	// The headers were read when the table was created
+	if _, err := csvReader.Read(); err != nil {
+		return fmt.Errorf("error reading csv headers from %s: %v", file.file.Name, err)
+	}
+
+	send := func(chunk importChunk) bool {
+		select {
+		case chunks <- chunk:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	chunk := importChunk{file: file}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break // End of file
+		}
+		if err != nil {
+			// Malformed rows are skipped, the reader can carry on from the next line
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				file.logger.Warn("skipping malformed row", "line", parseErr.Line, "error", err)
+				chunk.records = append(chunk.records, nil)
+				chunk.lines = append(chunk.lines, parseErr.Line)
+				chunk.skipped = append(chunk.skipped, parseErr.Err.Error())
+				continue
 			}
+			return fmt.Errorf("error reading csv file %s: %v", file.file.Name, err)
+		}
+		line, _ := csvReader.FieldPos(0)
+		if len(record) > len(file.headers) {
+			file.logger.Warn("skipping row with more fields than headers", "line", line)
+			chunk.records = append(chunk.records, nil)
+			chunk.lines = append(chunk.lines, line)
+			chunk.skipped = append(chunk.skipped, "more fields than headers")
+			continue
+		}
 
-			// Convert record into CSVRecord for insertion
-			var row []CSVRecord
-			for i, value := range record {
-				row = append(row, CSVRecord{Header: headers[i], Data: value})
+		for _, column := range file.idColumns {
+			if column < len(record) {
+				record[column] = prefixID(file.idPrefix, record[column])
 			}
+		}
 
-			// Insert into DB
-			insertRecord(tx, tableName, row)
+		chunk.records = append(chunk.records, record)
+		chunk.lines = append(chunk.lines, line)
+		chunk.skipped = append(chunk.skipped, "")
+		if len(chunk.records) >= importChunkSize {
+			if !send(chunk) {
+				return nil
+			}
+			chunk = importChunk{file: file}
 		}
+	}
+
+	chunk.last = true
+	send(chunk)
+	return nil
+}
 
-		// Commit the transaction after processing the file
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("error committing transaction: %v", err)
+/*
+Insert the chunks of rows from the parsers in the import's transaction
+*/
+func (v Database) writeImportChunks(tx *sql.Tx, chunks <-chan importChunk) error {
+	for chunk := range chunks {
+		if err := v.writeImportChunk(tx, chunk); err != nil {
+			return err
 		}
 
-		fmt.Println("Finished processing file:", file.Name)
+		if chunk.last {
+			file := chunk.file
+			if m := v.metrics(); m != nil {
+				m.RowsImported(file.table, file.report.Rows)
+			}
+			file.logger.Info("imported file", "rows", file.report.Rows, "skipped", file.report.Skipped, "duplicates", file.report.Duplicates)
+		}
 	}
 
 	return nil
 }
 
-func insertRecord(tx *sql.Tx, tableName string, record []CSVRecord) {
-	headers := getHeaders(record)
+func (v Database) writeImportChunk(tx *sql.Tx, chunk importChunk) error {
+	file := chunk.file
+
+	// Rows can have fewer fields than the headers, so there's a statement for each amount of fields
+	statements := make(map[int]*sql.Stmt)
+	defer func() {
+		for _, statement := range statements {
+			statement.Close()
+		}
+	}()
+
+	for i, record := range chunk.records {
+		if record == nil {
+			file.report.skip(chunk.lines[i], chunk.skipped[i])
+			continue
+		}
+
+		statement, ok := statements[len(record)]
+		if !ok {
+			var err error
+			statement, err = tx.Prepare(insertStatement(file.table, file.headers[:len(record)], v.duplicatePolicy() == DuplicatesUpsert))
+			if err != nil {
+				return fmt.Errorf("failed to prepare insert into table %s: %w", file.table, err)
+			}
+			statements[len(record)] = statement
+		}
+
+		values := make([]interface{}, len(record))
+		for i, value := range record {
+			values[i] = value
+		}
+		if _, err := statement.Exec(values...); err != nil {
+			if isDuplicateKeyError(err) {
+				if v.duplicatePolicy() == DuplicatesFail {
+					return fmt.Errorf("duplicate row in %s on line %d: %w", file.file.Name, chunk.lines[i], err)
+				}
+				file.logger.Debug("skipping duplicate row", "line", chunk.lines[i])
+				file.report.duplicate(chunk.lines[i], err.Error())
+				continue
+			}
+
+			err = fmt.Errorf("failed to insert record into table %s: %w", file.table, err)
+			file.logger.Warn("skipping row", "line", chunk.lines[i], "error", err)
+			file.report.skip(chunk.lines[i], err.Error())
+			continue
+		}
+		file.report.Rows++
+	}
+
+	return nil
+}
+
+func insertStatement(tableName string, headers []string, replace bool) string {
 	placeholders := make([]string, len(headers))
 	for i := range placeholders {
 		placeholders[i] = "?"
 	}
 
-	insertSQL := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s);`,
+	insert := "INSERT"
+	if replace {
+		insert = "INSERT OR REPLACE"
+	}
+
+	return fmt.Sprintf(`%s INTO %s (%s) VALUES (%s);`,
+		insert,
 		tableName,
 		strings.Join(headers, ", "),
 		strings.Join(placeholders, ", "),
 	)
-
-	var values []interface{}
-	for _, field := range record {
-		values = append(values, field.Data)
-	}
-
-	//fmt.Println("Inserting record into table:", tableName)
-	_, err := tx.Exec(insertSQL, values...)
-	if err != nil {
-		log.Fatalf("Failed to insert record into table %s: %v", tableName, err)
-	}
 }
 
-func getHeaders(record []CSVRecord) []string {
-	var headers []string
-	for _, field := range record {
-		headers = append(headers, field.Header)
-	}
-	return headers
+/*
+The table a feed file is imported into, e.g "stop_times" for "gtfs/stop_times.txt"
+*/
+func feedFileTable(fileName string) string {
+	return strings.ToLower(strings.TrimSuffix(filepath.Base(fileName), ".txt"))
 }
 
 func isCSVFile(fileName string) bool {
@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -14,35 +14,92 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
-func newDatabase(url string, databaseName string, tz *time.Location, mailToEmail string) (Database, error) {
-	if url == "" {
-		return Database{}, errors.New("missing url")
-	}
+func newDatabase(url string, databaseName string, tz *time.Location, mailToEmail string, options ...Option) (Database, error) {
 	if len(databaseName) < 3 {
 		return Database{}, errors.New("database name to short >3")
 	}
 
-	os.Mkdir(filepath.Join(GetWorkDir(), "gtfs"), os.ModePerm)
+	settings := defaultDatabaseOptions()
+	for _, option := range options {
+		option(&settings)
+	}
 
-	db, err := sqlx.Open("sqlite", filepath.Join(GetWorkDir(), "gtfs", fmt.Sprintf("gtfs-%s.db", databaseName)))
-	if err != nil {
-		fmt.Println(err)
-		panic("Failed to open the database")
+	// Read only databases are never refreshed, so don't need the url
+	if url == "" && !settings.readOnly {
+		return Database{}, errors.New("missing url")
 	}
 
-	// Enable WAL mode
-	_, err = db.Exec("PRAGMA journal_mode = WAL;")
+	path := filepath.Join(GetWorkDir(), "gtfs", fmt.Sprintf("gtfs-%s.db", databaseName))
+	if settings.readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return Database{}, fmt.Errorf("can't open missing database read only: %w", err)
+		}
+	} else {
+		os.Mkdir(filepath.Join(GetWorkDir(), "gtfs"), os.ModePerm)
+	}
+
+	db, err := sqlx.Open("sqlite", settings.dataSource(path))
 	if err != nil {
-		panic("Failed to set WAL mode")
+		return Database{}, fmt.Errorf("failed to open the database: %w", err)
+	}
+	if settings.maxOpenConns > 0 {
+		db.SetMaxOpenConns(settings.maxOpenConns)
+	}
+	if settings.maxIdleConns > 0 {
+		db.SetMaxIdleConns(settings.maxIdleConns)
+	}
+
+	// Check the database can be opened with the pragmas
+	if err := db.Ping(); err != nil {
+		return Database{}, fmt.Errorf("failed to open the database: %w", err)
 	}
 
 	// Initialize the Database struct
-	database := Database{db: db, url: url, timeZone: tz, mailToEmail: mailToEmail}
+	database := Database{db: db, url: url, timeZone: tz, mailToEmail: mailToEmail, state: newDatabaseState()}
+	database.state.name = databaseName
+	database.state.readOnly = settings.readOnly
+	database.state.maintenance = settings.maintenance
+	database.state.materializedDepartures = settings.materializedDepartures
+	database.state.integrityCheck = settings.integrityCheck
+	database.state.idPrefix = settings.idPrefix
+	database.state.lazyQuotes = settings.lazyQuotes
+	database.state.duplicatePolicy = settings.duplicatePolicy
+	database.state.userData = settings.userData
+	database.state.occupancyProvider = settings.occupancyProvider
+	if settings.logger != nil {
+		database.state.logger = settings.logger.With("feed", databaseName)
+	} else {
+		database.state.logger = slog.Default().With("feed", databaseName)
+	}
+
+	if settings.readOnly {
+		return database, nil
+	}
+
+	// Non feed tables are created here as they must exist even if the feed data is never refreshed
+	if err := database.createNotificationsTable(); err != nil {
+		return Database{}, err
+	}
+	if err := database.createSavedItemsTable(); err != nil {
+		return Database{}, err
+	}
+	if err := database.createVehiclePositionsTable(); err != nil {
+		return Database{}, err
+	}
+	if err := database.createDerivedTables(); err != nil {
+		return Database{}, err
+	}
+	if err := database.loadMerged(); err != nil {
+		return Database{}, err
+	}
+
 	return database, nil
 }
 
-func (v Database) createDefaultGTFSTables() {
-	query := `
+/*
+The tables of the gtfs spec, extra columns in the feed files are added to them when they are imported
+*/
+const defaultGTFSSchema = `
 		-- Table: agency
 		CREATE TABLE IF NOT EXISTS agency (
 			agency_id TEXT PRIMARY KEY,
@@ -241,56 +298,63 @@ func (v Database) createDefaultGTFSTables() {
 			feed_contact_url TEXT DEFAULT ''
 		);
 
-		-- Table: notifications
-		CREATE TABLE IF NOT EXISTS notifications (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,    -- Auto-incrementing primary key
-			endpoint TEXT NOT NULL,                   -- Make endpoint NOT NULL if required
-			p256dh TEXT NOT NULL DEFAULT '',
-			auth TEXT NOT NULL DEFAULT '',
-			stop TEXT NOT NULL DEFAULT '',
-			recent_notifications TEXT DEFAULT '',
-			created INTEGER NOT NULL DEFAULT '',
-			CONSTRAINT unique_notification UNIQUE (endpoint, p256dh, auth, stop)  -- Composite unique constraint
-		);
-
-	`
+`
 
-	_, err := v.db.Exec(query)
+func (v Database) createDefaultGTFSTables() error {
+	_, err := v.db.Exec(defaultGTFSSchema)
 	if err != nil {
-		log.Panicf("%s", err.Error())
+		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	return nil
 }
 
-func (v Database) deleteOldData() error {
-	// Query to get all table names from the sqlite_master table
-	rows, err := v.db.Query("SELECT name FROM sqlite_master WHERE type='table'")
+/*
+Delete the feed data (and the data derived from it), in the import's transaction so it's kept if the import fails
+*/
+func (v Database) deleteOldData(tx *sql.Tx) error {
+	var tables []string
+	rows, err := tx.Query("SELECT name FROM sqlite_master WHERE type='table'")
 	if err != nil {
 		return fmt.Errorf("failed to fetch tables: %w", err)
 	}
-	defer rows.Close()
-
-	// Iterate over the tables and delete data from each
 	for rows.Next() {
 		var tableName string
 		if err := rows.Scan(&tableName); err != nil {
+			rows.Close()
 			return fmt.Errorf("failed to scan table name: %w", err)
 		}
+		tables = append(tables, tableName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to fetch tables: %w", err)
+	}
 
+	for _, tableName := range tables {
 		// Skip system tables that don't need data deletion
 		if tableName == "sqlite_sequence" || tableName == "sqlite_master" {
 			continue
 		}
 
+		// Skip tables which aren't from the feed (e.g notifications) so they survive a refresh
+		if contains(nonFeedTableNames, tableName) {
+			continue
+		}
+
+		// Skip the R-tree's own tables, they're cleared with the R-tree
+		if contains(rtreeShadowTableNames, tableName) {
+			continue
+		}
+
 		// Delete data from the table
 		query := fmt.Sprintf("DELETE FROM %s", tableName)
-		_, err := v.db.Exec(query)
-		if err != nil {
+		if _, err := tx.Exec(query); err != nil {
 			return fmt.Errorf("failed to delete data from table %s: %w", tableName, err)
 		}
 	}
 
-	fmt.Println("Old data deleted successfully")
+	v.logger().Debug("old data deleted")
 	return nil
 }
 
@@ -347,7 +411,7 @@ func (v Database) createExtraColumn(tableName string, columnName string) error {
 
 	// Construct the SQL query with sanitized table and column names
 	alterTableSQL := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s TEXT;`, tableName, columnName)
-	fmt.Println("Executing SQL:", alterTableSQL)
+	v.logger().Debug("executing sql", "sql", alterTableSQL)
 
 	// Execute the query using sqlx
 	_, err := db.Exec(alterTableSQL)
@@ -358,36 +422,36 @@ func (v Database) createExtraColumn(tableName string, columnName string) error {
 	return nil
 }
 
-func (v Database) createTableIfNotExists(tableName string, headers []string) {
+func (v Database) createTableIfNotExists(tableName string, headers []string) error {
 	db := v.db
 
 	// Validate the table name using regex to ensure it contains only valid characters
 	validName := regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 	if !validName.MatchString(tableName) {
-		log.Fatalf("Invalid table name: %s", tableName)
+		return fmt.Errorf("invalid table name: %s", tableName)
 	}
 
 	// Validate and sanitize the headers (column names)
 	for _, header := range headers {
 		if !validName.MatchString(header) {
-			log.Fatalf("Invalid column name: %s", header)
+			return fmt.Errorf("invalid column name: %s", header)
 		}
 	}
 
 	// Construct columns part of the CREATE TABLE statement
 	var columns []string
 	for _, header := range headers {
-		columns = append(columns, fmt.Sprintf("%s TEXT", header))
+		columns = append(columns, fmt.Sprintf("%s %s", header, extensionColumnType(header)))
 	}
 
 	// Construct the CREATE TABLE SQL with sanitized table and column names
 	createTableSQL := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s);`, tableName, strings.Join(columns, ", "))
-	fmt.Println("Executing SQL:", createTableSQL)
+	v.logger().Debug("executing sql", "sql", createTableSQL)
 
 	// Execute the table creation SQL
 	_, err := db.Exec(createTableSQL)
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+		return fmt.Errorf("failed to create table %s: %w", tableName, err)
 	}
 
 	// Create index for columns ending with "_id"
@@ -396,44 +460,126 @@ func (v Database) createTableIfNotExists(tableName string, headers []string) {
 			// Sanitize the index name as well
 			indexName := fmt.Sprintf("idx_%s_%s", tableName, header)
 			if !validName.MatchString(indexName) {
-				log.Fatalf("Invalid index name: %s", indexName)
+				return fmt.Errorf("invalid index name: %s", indexName)
 			}
 			indexSQL := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (%s);`, indexName, tableName, header)
-			fmt.Println("Executing SQL:", indexSQL)
+			v.logger().Debug("executing sql", "sql", indexSQL)
 
 			_, err := db.Exec(indexSQL)
 			if err != nil {
-				log.Fatalf("Failed to create index on column %s: %v", header, err)
+				return fmt.Errorf("failed to create index on column %s: %w", header, err)
 			}
 		}
 	}
-}
 
-func (v Database) refreshDatabaseData() {
-	fmt.Println("Updating database data...")
+	return nil
+}
 
-	err := v.deleteOldData()
-	if err != nil {
-		log.Printf("Failed to delete old data: %v \n(Old data may not exist yet)", err)
+func (v Database) refreshDatabaseData() error {
+	if v.IsReadOnly() {
+		return errors.New("can't refresh a read only database")
+	}
+	// Its url only has one of the feeds
+	if v.isMerged() {
+		return errors.New("can't refresh merged feeds, merge them again")
 	}
 
-	v.createDefaultGTFSTables()
-	v.createIndexes()
+	v.logger().Info("updating database data")
+	start := time.Now()
 
-	// Fetch and write new data
+	// A failed fetch (or a zip which isn't a feed) keeps the old data, it's only replaced once the new data is written
 	data, err := fetchZip(v.url)
 	if err != nil {
-		log.Fatalf("Failed to fetch new data: %v", err)
+		v.observeImport(start, err)
+		v.setRefreshResult(err)
+		v.logger().Error("failed to fetch new data", "error", err)
+		return fmt.Errorf("failed to fetch new data: %w", err)
+	}
+	return v.importFeedZip(data, start, false)
+}
+
+/*
+Replace the feed data with a feed zip's, then build the derived data and tell the refresh subscribers
+
+The old data is deleted and the new data written in one transaction, so the old data is kept if the import fails (and is
+what queries see until it's done)
+
+  - merged: the zip is feeds merged by MergeFeedZips
+*/
+func (v Database) importFeedZip(data []byte, start time.Time, merged bool) error {
+	if err := checkFeedZip(data); err != nil {
+		v.observeImport(start, err)
+		v.setRefreshResult(err)
+		v.logger().Error("invalid feed zip", "error", err)
+		return fmt.Errorf("invalid feed zip: %w", err)
+	}
+
+	// The prepared statements and agency timezones use the tables being replaced
+	v.resetStatements()
+	v.resetLocations()
+
+	if err := v.createDefaultGTFSTables(); err != nil {
+		v.observeImport(start, err)
+		v.setRefreshResult(err)
+		return err
+	}
+	if err := v.createIndexes(); err != nil {
+		v.observeImport(start, err)
+		v.setRefreshResult(err)
+		return err
 	}
-	err = writeFilesToDB(data, v)
+
+	report, err := writeFilesToDB(data, v, func(tx *sql.Tx) error {
+		if err := v.deleteOldData(tx); err != nil {
+			return err
+		}
+		return writeMerged(tx, merged)
+	})
+	v.setImportReport(report)
 	if err != nil {
-		log.Fatalf("Failed to write new data to the database: %v", err)
+		v.observeImport(start, err)
+		v.setRefreshResult(err)
+		v.logger().Error("failed to write new data to the database", "error", err)
+		return fmt.Errorf("failed to write new data to the database: %w", err)
+	}
+	v.setMerged(merged)
+	// Queries during the import could have cached the old agencies' timezones
+	v.resetLocations()
+
+	// A failed check fails the refresh once the rest is done, as the new data is kept
+	var integrityErr error
+	if v.state.integrityCheck != nil {
+		report.Integrity, integrityErr = v.checkImportIntegrity(v.state.integrityCheck.fail)
+		v.setImportReport(report)
 	}
 
-	fmt.Println("Data updated successfully.")
+	v.buildDerivedData()
+
+	if err := v.runMaintenance(v.state.maintenance); err != nil {
+		v.logger().Warn("failed to run database maintenance", "error", err)
+	}
+
+	if integrityErr != nil {
+		v.observeImport(start, integrityErr)
+		v.setRefreshResult(integrityErr)
+		v.logger().Error("feed failed the integrity check", "error", integrityErr)
+		return integrityErr
+	}
+
+	v.observeImport(start, nil)
+	v.setRefreshResult(nil)
+	v.notifyRefreshed()
+
+	v.logger().Info("data updated successfully", "duration", time.Since(start))
+	return nil
 }
 
-func (v Database) createIndexes() {
+func (v Database) createIndexes() error {
+	// Some of the indexes are on the generated columns
+	if err := v.createGeneratedColumns(); err != nil {
+		return err
+	}
+
 	query := `
 		-- Indexes for agency table
 		CREATE UNIQUE INDEX IF NOT EXISTS idx_agency_agency_id ON agency (agency_id);
@@ -455,8 +601,18 @@ func (v Database) createIndexes() {
 
 		-- Indexes for stop_times table
 		CREATE UNIQUE INDEX IF NOT EXISTS idx_stop_times_trip_id_sequence ON stop_times (trip_id, stop_sequence);
-		CREATE INDEX IF NOT EXISTS idx_stop_times_stop_id ON stop_times (stop_id);
-		CREATE INDEX IF NOT EXISTS idx_stop_times_trip_id ON stop_times (trip_id);
+
+		-- Covering indexes for stop_times, so the departures/arrivals at a stop are a range scan and
+		-- the first/last stop of each trip is found without reading the table
+		CREATE INDEX IF NOT EXISTS idx_stop_times_stop_departure_sec ON stop_times (stop_id, departure_sec, trip_id, stop_sequence);
+		CREATE INDEX IF NOT EXISTS idx_stop_times_stop_arrival_sec ON stop_times (stop_id, arrival_sec, trip_id, stop_sequence);
+		CREATE INDEX IF NOT EXISTS idx_stop_times_trip_covering ON stop_times (trip_id, stop_sequence, stop_id, arrival_time, departure_time);
+
+		-- Replaced by the covering indexes (they are prefixes of them, or on the text times)
+		DROP INDEX IF EXISTS idx_stop_times_stop_id;
+		DROP INDEX IF EXISTS idx_stop_times_trip_id;
+		DROP INDEX IF EXISTS idx_stop_times_stop_departure;
+		DROP INDEX IF EXISTS idx_stop_times_stop_arrival;
 
 		-- Additional indexes for query optimization
 		CREATE INDEX IF NOT EXISTS idx_routes_trip ON trips (route_id, trip_id); -- Optimizes joining routes and trips
@@ -494,13 +650,12 @@ func (v Database) createIndexes() {
 
 		-- Indexes for levels table
 		CREATE UNIQUE INDEX IF NOT EXISTS idx_levels_level_id ON levels (level_id);
-
-		-- Indexes for notifications table
-		CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_stop ON notifications (stop);
 	`
 
 	_, err := v.db.Exec(query)
 	if err != nil {
-		log.Panicf("%s", err.Error())
+		return fmt.Errorf("failed to create indexes: %w", err)
 	}
+
+	return nil
 }
@@ -0,0 +1,138 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Departure struct {
+	ServiceDate   string `json:"service_date" db:"service_date"` // "20060102"
+	StopID        string `json:"stop_id" db:"stop_id"`
+	DepartureTime string `json:"departure_time" db:"-"`            // "15:04:05", can be over 24:00:00 for services after midnight
+	DepartureSec  int    `json:"departure_sec" db:"departure_sec"` // Seconds since the start of the service day
+	TripID        string `json:"trip_id" db:"trip_id"`
+	RouteID       string `json:"route_id" db:"route_id"`
+	Headsign      string `json:"headsign" db:"headsign"` // The stop headsign, or the trip headsign if the stop doesn't have one
+}
+
+/*
+Write the departures from every stop on the given service dates to the departures table, replacing the dates which were there before
+
+Defaults to today and tomorrow (in the feed's timezone). This is run after each refresh and each night when
+WithMaterializedDepartures is used, so GetDepartures is an index lookup instead of joining the whole timetable
+*/
+func (v Database) MaterializeDepartures(dates ...time.Time) error {
+	if v.IsReadOnly() {
+		return errors.New("can't materialize departures in a read only database")
+	}
+
+	location := v.locationFor("", "")
+	var days []ServiceDay
+	for _, date := range dates {
+		days = append(days, ServiceDayOf(date, location))
+	}
+	if len(days) == 0 {
+		today := Today(location)
+		days = []ServiceDay{today, today.AddDays(1)}
+	}
+
+	start := time.Now()
+
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM departures`); err != nil {
+		return fmt.Errorf("failed to clear departures: %w", err)
+	}
+
+	for _, day := range days {
+		servicesQuery, args := activeServicesQuery(day)
+		query := servicesQuery + `
+		INSERT OR IGNORE INTO departures (service_date, stop_id, departure_sec, trip_id, route_id, headsign)
+		SELECT
+			?,
+			st.stop_id,
+			st.departure_sec,
+			t.trip_id,
+			t.route_id,
+			COALESCE(NULLIF(st.stop_headsign, ''), t.trip_headsign, '')
+		FROM trips t
+		JOIN adjusted_services a ON t.service_id = a.service_id
+		JOIN stop_times st ON t.trip_id = st.trip_id
+		WHERE st.departure_sec IS NOT NULL
+		`
+		args = append(args, day.String())
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to materialize departures: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	v.logger().Info("materialized departures", "dates", len(days), "duration", time.Since(start))
+	return nil
+}
+
+/*
+Get the next departures from a stop (or the child stops of a station) from the departures table, see MaterializeDepartures
+
+Departures on the next service date are included once the given date's run out
+
+  - stopID: the stop to get the departures from
+  - from: only departures after this time
+  - limit: the max amount of departures to get, 0 for no limit
+*/
+func (v Database) GetDepartures(stopID string, from time.Time, limit int) ([]Departure, error) {
+	defer v.observeQuery("GetDepartures", time.Now())
+
+	if stopID == "" {
+		return nil, errors.New("missing stop id")
+	}
+	stopID = v.PrefixID(stopID)
+
+	day := ServiceDayOf(from, v.locationFor(stopID, ""))
+	serviceDate := day.String()
+	nextServiceDate := day.AddDays(1).String()
+	fromSec := day.Seconds(from)
+
+	var materialized bool
+	if err := v.db.Get(&materialized, `SELECT EXISTS (SELECT 1 FROM departures WHERE service_date = ?)`, serviceDate); err != nil {
+		return nil, err
+	}
+	if !materialized {
+		return nil, errors.New("departures haven't been materialized for the date")
+	}
+
+	query := `
+		SELECT service_date, stop_id, departure_sec, trip_id, route_id, headsign
+		FROM departures
+		WHERE stop_id IN (SELECT ? UNION SELECT stop_id FROM stops WHERE parent_station = ?)
+		  AND ((service_date = ? AND departure_sec >= ?) OR service_date = ?)
+		ORDER BY service_date, departure_sec
+	`
+	args := []interface{}{stopID, stopID, serviceDate, fromSec, nextServiceDate}
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	var departures []Departure
+	if err := v.db.Select(&departures, query, args...); err != nil {
+		return nil, err
+	}
+	if len(departures) == 0 {
+		return nil, errors.New("no departures found")
+	}
+
+	for i := range departures {
+		departures[i].DepartureTime = formatGTFSTime(departures[i].DepartureSec)
+	}
+
+	v.stripIDs(&departures)
+	return departures, nil
+}
@@ -0,0 +1,293 @@
+package gtfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Tables built from the feed data by the package (not imported from the feed), these are cleared when the feed data is refreshed
+*/
+var derivedTableNames = []string{
+	"canonical_stops",
+	"stop_modes",
+	"departures",
+	"extents",
+	"stop_stats",
+	"stop_search_tokens",
+	"stop_routes",
+	"shape_segments",
+	"feed_meta", // Facts about the imported data, e.g that feeds were merged into it (see MergeFeeds)
+}
+
+/*
+The tables SQLite keeps the shape_segments R-tree in, these are cleared with it so are left alone
+*/
+var rtreeShadowTableNames = []string{
+	"shape_segments_node",
+	"shape_segments_parent",
+	"shape_segments_rowid",
+}
+
+/*
+How each derived table is built and the feed tables it's built from, in the order they're built
+*/
+var derivedBuilds = []struct {
+	Name   string
+	Tables []string
+	Build  func(v Database) error
+}{
+	{"stop modes", []string{"stops", "stop_times", "trips", "routes"}, Database.buildStopModes},
+	{"extents", []string{"stops", "stop_times", "trips", "shapes"}, Database.buildExtents},
+	{"stop stats", []string{"stops", "stop_times", "trips", "calendar"}, Database.buildStopStats},
+	{"stop search", []string{"stops", "stop_times", "trips"}, Database.buildStopSearch},
+	{"shape segments", []string{"shapes"}, Database.buildShapeSegments},
+}
+
+/*
+Build the derived tables from the feed data, only those built from the changed tables if any are given
+*/
+func (v Database) buildDerivedData(changedTables ...string) {
+	for _, build := range derivedBuilds {
+		if len(changedTables) > 0 && !containsAny(build.Tables, changedTables) {
+			continue
+		}
+		if err := build.Build(v); err != nil {
+			v.logger().Warn("failed to build "+build.Name, "error", err)
+		}
+	}
+
+	departureTables := []string{"stops", "stop_times", "trips", "routes", "calendar", "calendar_dates", "frequencies"}
+	if v.state.materializedDepartures && (len(changedTables) == 0 || containsAny(departureTables, changedTables)) {
+		if err := v.MaterializeDepartures(); err != nil {
+			v.logger().Warn("failed to materialize departures", "error", err)
+		}
+	}
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, value := range wanted {
+		if contains(values, value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Create the tables which are built from the feed data
+*/
+func (v Database) createDerivedTables() error {
+	query := `
+		CREATE TABLE IF NOT EXISTS feed_meta (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE TABLE IF NOT EXISTS canonical_stops (
+			stop_id TEXT PRIMARY KEY,
+			canonical_stop_id TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_canonical_stops_canonical_stop_id ON canonical_stops (canonical_stop_id);
+
+		CREATE TABLE IF NOT EXISTS stop_modes (
+			stop_id TEXT NOT NULL,
+			route_type INTEGER NOT NULL,
+			PRIMARY KEY (stop_id, route_type)
+		);
+
+		CREATE TABLE IF NOT EXISTS departures (
+			service_date TEXT NOT NULL,
+			stop_id TEXT NOT NULL,
+			departure_sec INTEGER NOT NULL,
+			trip_id TEXT NOT NULL,
+			route_id TEXT NOT NULL,
+			headsign TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (stop_id, service_date, departure_sec, trip_id)
+		) WITHOUT ROWID;
+		CREATE INDEX IF NOT EXISTS idx_departures_service_date ON departures (service_date);
+
+		CREATE TABLE IF NOT EXISTS extents (
+			route_id TEXT PRIMARY KEY, -- '' for the whole feed
+			min_lat REAL NOT NULL,
+			min_lon REAL NOT NULL,
+			max_lat REAL NOT NULL,
+			max_lon REAL NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS stop_stats (
+			stop_id TEXT NOT NULL,
+			weekday INTEGER NOT NULL, -- 0 for sunday
+			routes INTEGER NOT NULL,
+			trips INTEGER NOT NULL,
+			peak_hour INTEGER NOT NULL,
+			peak_hour_trips INTEGER NOT NULL,
+			PRIMARY KEY (stop_id, weekday)
+		) WITHOUT ROWID;
+
+		CREATE TABLE IF NOT EXISTS stop_search_tokens (
+			token TEXT NOT NULL, -- A lowercase word of the stop's name, or its code
+			stop_id TEXT NOT NULL,
+			PRIMARY KEY (token, stop_id)
+		) WITHOUT ROWID;
+
+		CREATE TABLE IF NOT EXISTS stop_routes (
+			stop_id TEXT NOT NULL,
+			route_id TEXT NOT NULL,
+			PRIMARY KEY (stop_id, route_id)
+		) WITHOUT ROWID;
+
+		-- Each pair of consecutive shape points, in an R-tree so the shapes passing a point can be found quickly
+		CREATE VIRTUAL TABLE IF NOT EXISTS shape_segments USING rtree (
+			id,
+			min_lat, max_lat,
+			min_lon, max_lon,
+			+shape_id TEXT,
+			+from_lat REAL,
+			+from_lon REAL,
+			+to_lat REAL,
+			+to_lon REAL
+		);
+	`
+	if _, err := v.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create derived tables: %w", err)
+	}
+	return nil
+}
+
+/*
+Store the route types serving each stop, parent stations get the route types of their child stops
+*/
+func (v Database) buildStopModes() error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM stop_modes;
+
+		INSERT OR IGNORE INTO stop_modes (stop_id, route_type)
+		SELECT DISTINCT st.stop_id, r.route_type
+		FROM stop_times st
+		JOIN trips t ON st.trip_id = t.trip_id
+		JOIN routes r ON t.route_id = r.route_id;
+
+		INSERT OR IGNORE INTO stop_modes (stop_id, route_type)
+		SELECT DISTINCT s.parent_station, m.route_type
+		FROM stop_modes m
+		JOIN stops s ON s.stop_id = m.stop_id
+		WHERE s.parent_station != '';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to build stop modes: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+/*
+The mode of transport for each basic route_type (extended route types use theirs, see BasicRouteType), in the order modes
+are preferred for a stop's type
+*/
+var routeTypeModes = []struct {
+	Mode       string
+	RouteTypes []int
+}{
+	{"train", []int{2, 7}},
+	{"metro", []int{1, 12}},
+	{"tram", []int{0, 5}},
+	{"ferry", []int{4}},
+	{"gondola", []int{6}},
+	{"trolleybus", []int{11}},
+	{"bus", []int{3}},
+}
+
+func containsRouteType(routeTypes []int, routeType int) bool {
+	for _, t := range routeTypes {
+		if t == routeType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Get the modes of transport serving each of the stops, in order of preference
+*/
+func (v Database) getStopModes(stopIDs []string) map[string][]string {
+	modes := make(map[string][]string)
+	if len(stopIDs) == 0 {
+		return modes
+	}
+
+	var rows []struct {
+		StopID    string `db:"stop_id"`
+		RouteType int    `db:"route_type"`
+	}
+	query := `SELECT stop_id, route_type FROM stop_modes`
+	var args []interface{}
+	// Large lists of stops are quicker to get with the whole table (and could go over the max query variables)
+	if len(stopIDs) <= 500 {
+		query += ` WHERE stop_id IN (?` + strings.Repeat(", ?", len(stopIDs)-1) + `)`
+		for _, stopID := range stopIDs {
+			args = append(args, stopID)
+		}
+	}
+	if err := v.db.Select(&rows, query, args...); err != nil {
+		return modes
+	}
+
+	routeTypes := make(map[string][]int)
+	for _, row := range rows {
+		routeTypes[row.StopID] = append(routeTypes[row.StopID], row.RouteType)
+	}
+	for stopID, types := range routeTypes {
+		for _, mode := range routeTypeModes {
+			for _, routeType := range types {
+				if containsRouteType(mode.RouteTypes, BasicRouteType(routeType)) {
+					modes[stopID] = append(modes[stopID], mode.Mode)
+					break
+				}
+			}
+		}
+	}
+
+	return modes
+}
+
+/*
+Set the StopModes and StopType of the stops, from the routes serving them
+*/
+func (v Database) setStopModes(stops []Stop) {
+	var stopIDs []string
+	for _, stop := range stops {
+		stopIDs = append(stopIDs, stop.StopId)
+	}
+	modes := v.getStopModes(stopIDs)
+
+	for i := range stops {
+		stops[i].StopModes = modes[stops[i].StopId]
+		stops[i].StopType = stopTypeFromModes(stops[i].StopModes, stops[i].StopName)
+	}
+}
+
+/*
+Set the StopModes and StopType of a stop, from the routes serving it
+*/
+func (v Database) setStopMode(stop *Stop) {
+	stops := []Stop{*stop}
+	v.setStopModes(stops)
+	*stop = stops[0]
+}
+
+/*
+The type of a stop is its preferred mode, falling back to guessing from its name if no routes serve it
+*/
+func stopTypeFromModes(modes []string, stopName string) string {
+	if len(modes) > 0 {
+		return modes[0]
+	}
+	return typeOfStop(stopName)
+}
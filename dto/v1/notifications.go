@@ -0,0 +1,46 @@
+package v1
+
+import "github.com/jfmow/gtfs"
+
+/*
+A notification about a service, e.g as the body of a webhook
+*/
+type Notification struct {
+	Title    string                `json:"title"`
+	Body     string                `json:"body"`
+	Service  NotificationService   `json:"service"`
+	Services []NotificationService `json:"services"` // Every service when several notifications were combined into one, else just the one
+}
+
+type NotificationService struct {
+	Type          string `json:"type"` // "cancelled", "delayed", "skipped", "platform_changed" or "alert"
+	AlertID       string `json:"alert_id,omitempty"`
+	TripID        string `json:"trip_id"`
+	StopID        string `json:"stop_id"`
+	RouteID       string `json:"route_id"`
+	DepartureTime string `json:"departure_time"` // "15:04:05", can be over 24:00:00
+}
+
+func FromNotification(notification gtfs.Notification) Notification {
+	converted := Notification{
+		Title:    notification.Title,
+		Body:     notification.Body,
+		Service:  fromNotificationData(notification.Data),
+		Services: convertAll(notification.Services, fromNotificationData),
+	}
+	if len(converted.Services) == 0 {
+		converted.Services = []NotificationService{converted.Service}
+	}
+	return converted
+}
+
+func fromNotificationData(data gtfs.NotificationData) NotificationService {
+	return NotificationService{
+		Type:          data.Type,
+		AlertID:       data.AlertID,
+		TripID:        data.TripID,
+		StopID:        data.StopID,
+		RouteID:       data.RouteID,
+		DepartureTime: data.DepartureTime,
+	}
+}
@@ -0,0 +1,162 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+The realtime state of a trip
+*/
+type TripUpdate struct {
+	TripID    string     `json:"trip_id"`
+	RouteID   string     `json:"route_id,omitempty"`
+	StartDate string     `json:"start_date,omitempty"` // "20060102"
+	StartTime string     `json:"start_time,omitempty"` // "15:04:05"
+	Canceled  bool       `json:"canceled"`
+	Delay     int64      `json:"delay"` // Seconds, negative when early
+	VehicleID string     `json:"vehicle_id,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	StopID            string     `json:"stop_id,omitempty"` // The stop the update is for
+	StopSequence      int64      `json:"stop_sequence,omitempty"`
+	StopSkipped       bool       `json:"stop_skipped"`
+	ExpectedArrival   *time.Time `json:"expected_arrival,omitempty"`
+	ExpectedDeparture *time.Time `json:"expected_departure,omitempty"`
+}
+
+func FromTripUpdate(update realtime.TripUpdate) TripUpdate {
+	return TripUpdate{
+		TripID:            update.Trip.TripID,
+		RouteID:           string(update.Trip.RouteID),
+		StartDate:         update.Trip.StartDate,
+		StartTime:         update.Trip.StartTime,
+		Canceled:          update.Trip.ScheduleRelationship == 3,
+		Delay:             update.Delay,
+		VehicleID:         update.Vehicle.ID,
+		Timestamp:         unixTime(update.Timestamp),
+		StopID:            update.StopTimeUpdate.StopID,
+		StopSequence:      update.StopTimeUpdate.StopSequence,
+		StopSkipped:       update.StopTimeUpdate.ScheduleRelationship == 1,
+		ExpectedArrival:   unixTime(update.StopTimeUpdate.Arrival.Time),
+		ExpectedDeparture: unixTime(update.StopTimeUpdate.Departure.Time),
+	}
+}
+
+/*
+Convert the trip updates, in no particular order
+*/
+func FromTripUpdates(updates realtime.TripUpdatesMap) []TripUpdate {
+	converted := make([]TripUpdate, 0, len(updates))
+	for _, update := range updates {
+		converted = append(converted, FromTripUpdate(update))
+	}
+	return converted
+}
+
+type Vehicle struct {
+	ID              string     `json:"id"`
+	Label           string     `json:"label,omitempty"`
+	LicensePlate    string     `json:"license_plate,omitempty"`
+	TripID          string     `json:"trip_id,omitempty"`
+	RouteID         string     `json:"route_id,omitempty"`
+	StartDate       string     `json:"start_date,omitempty"` // "20060102"
+	StartTime       string     `json:"start_time,omitempty"` // "15:04:05"
+	Lat             float64    `json:"lat"`
+	Lon             float64    `json:"lon"`
+	Speed           float64    `json:"speed"`            // Meters per second
+	OccupancyStatus int        `json:"occupancy_status"` // The gtfs-realtime OccupancyStatus
+	Timestamp       *time.Time `json:"timestamp,omitempty"`
+}
+
+func FromVehicle(vehicle realtime.Vehicle) Vehicle {
+	return Vehicle{
+		ID:              vehicle.Vehicle.ID,
+		Label:           vehicle.Vehicle.Label,
+		LicensePlate:    vehicle.Vehicle.LicensePlate,
+		TripID:          vehicle.Trip.TripID,
+		RouteID:         string(vehicle.Trip.RouteID),
+		StartDate:       vehicle.Trip.StartDate,
+		StartTime:       vehicle.Trip.StartTime,
+		Lat:             vehicle.Position.Latitude,
+		Lon:             vehicle.Position.Longitude,
+		Speed:           vehicle.Position.Speed,
+		OccupancyStatus: vehicle.OccupancyStatus,
+		Timestamp:       unixTime(vehicle.Timestamp),
+	}
+}
+
+/*
+Convert the vehicles, in no particular order
+*/
+func FromVehicles(vehicles realtime.VehiclesMap) []Vehicle {
+	converted := make([]Vehicle, 0, len(vehicles))
+	for _, vehicle := range vehicles {
+		converted = append(converted, FromVehicle(vehicle))
+	}
+	return converted
+}
+
+type Alert struct {
+	ID            string            `json:"id"`
+	Cause         string            `json:"cause,omitempty"`
+	Effect        string            `json:"effect,omitempty"`
+	Header        map[string]string `json:"header"`      // The text by language, "" when the language isn't set
+	Description   map[string]string `json:"description"` // The text by language, "" when the language isn't set
+	ActivePeriods []ActivePeriod    `json:"active_periods"`
+	StopIDs       []string          `json:"stop_ids"`
+	RouteIDs      []string          `json:"route_ids"`
+	TripIDs       []string          `json:"trip_ids"`
+	AgencyIDs     []string          `json:"agency_ids"`
+}
+
+type ActivePeriod struct {
+	Start *time.Time `json:"start,omitempty"` // Unset when it's been active since before the feed
+	End   *time.Time `json:"end,omitempty"`   // Unset until it's known when it ends
+}
+
+func FromAlert(alert realtime.Alert) Alert {
+	converted := Alert{
+		ID:            alert.ID,
+		Cause:         alert.Cause,
+		Effect:        alert.Effect,
+		Header:        translations(alert.HeaderText),
+		Description:   translations(alert.DescriptionText),
+		ActivePeriods: []ActivePeriod{},
+		StopIDs:       []string{},
+		RouteIDs:      []string{},
+		TripIDs:       []string{},
+		AgencyIDs:     []string{},
+	}
+	for _, period := range alert.ActivePeriod {
+		converted.ActivePeriods = append(converted.ActivePeriods, ActivePeriod{Start: unixTime(period.Start), End: unixTime(period.End)})
+	}
+	for _, entity := range alert.InformedEntity {
+		if entity.StopID != "" {
+			converted.StopIDs = append(converted.StopIDs, entity.StopID)
+		}
+		if entity.RouteID != "" {
+			converted.RouteIDs = append(converted.RouteIDs, string(entity.RouteID))
+		}
+		if entity.Trip != nil && entity.Trip.TripID != "" {
+			converted.TripIDs = append(converted.TripIDs, entity.Trip.TripID)
+		}
+		if entity.AgencyID != "" {
+			converted.AgencyIDs = append(converted.AgencyIDs, entity.AgencyID)
+		}
+	}
+	return converted
+}
+
+func FromAlerts(alerts realtime.AlertMap) []Alert {
+	return convertAll([]realtime.Alert(alerts), FromAlert)
+}
+
+func translations(text realtime.Text) map[string]string {
+	converted := make(map[string]string, len(text.Translation))
+	for _, translation := range text.Translation {
+		converted[translation.Language] = translation.Text
+	}
+	return converted
+}
@@ -0,0 +1,224 @@
+package v1
+
+import "github.com/jfmow/gtfs"
+
+type Agency struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Timezone string `json:"timezone"`
+	Language string `json:"language,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	FareURL  string `json:"fare_url,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+func FromAgency(agency gtfs.Agency) Agency {
+	return Agency{
+		ID:       agency.AgencyId,
+		Name:     agency.AgencyName,
+		URL:      agency.AgencyUrl,
+		Timezone: agency.AgencyTimezone,
+		Language: agency.AgencyLang,
+		Phone:    agency.AgencyPhone,
+		FareURL:  agency.AgencyFareUrl,
+		Email:    agency.AgencyEmail,
+	}
+}
+
+func FromAgencies(agencies []gtfs.Agency) []Agency {
+	return convertAll(agencies, FromAgency)
+}
+
+type Stop struct {
+	ID                 string   `json:"id"`
+	Code               string   `json:"code,omitempty"`
+	Name               string   `json:"name"`
+	Lat                float64  `json:"lat"`
+	Lon                float64  `json:"lon"`
+	LocationType       int      `json:"location_type"` // 0 stop/platform, 1 station, 2 entrance, 3 generic node, 4 boarding area
+	ParentStationID    string   `json:"parent_station_id,omitempty"`
+	Platform           string   `json:"platform,omitempty"`
+	WheelchairBoarding int      `json:"wheelchair_boarding"` // 0 unknown, 1 accessible, 2 not accessible
+	ZoneID             string   `json:"zone_id,omitempty"`
+	Mode               string   `json:"mode,omitempty"` // The preferred mode of the stop e.g "train"
+	Modes              []string `json:"modes"`          // Every mode serving the stop
+}
+
+func FromStop(stop gtfs.Stop) Stop {
+	return Stop{
+		ID:                 stop.StopId,
+		Code:               stop.StopCode,
+		Name:               stop.StopName,
+		Lat:                stop.StopLat,
+		Lon:                stop.StopLon,
+		LocationType:       stop.LocationType,
+		ParentStationID:    stop.ParentStation,
+		Platform:           stop.PlatformNumber,
+		WheelchairBoarding: stop.WheelChairBoarding,
+		ZoneID:             stop.ZoneID,
+		Mode:               stop.StopType,
+		Modes:              orEmpty(stop.StopModes),
+	}
+}
+
+func FromStops(stops []gtfs.Stop) []Stop {
+	return convertAll(stops, FromStop)
+}
+
+type Route struct {
+	ID        string `json:"id"`
+	AgencyID  string `json:"agency_id,omitempty"`
+	ShortName string `json:"short_name"`
+	LongName  string `json:"long_name"`
+	Type      int    `json:"type"`            // The gtfs route_type
+	Vehicle   string `json:"vehicle"`         // The route_type as a name e.g "Bus"
+	Category  string `json:"category"`        // rail, bus, water or other
+	Color     string `json:"color,omitempty"` // "RRGGBB", without a #
+	TextColor string `json:"text_color,omitempty"`
+}
+
+func FromRoute(route gtfs.Route) Route {
+	return Route{
+		ID:        route.RouteId,
+		AgencyID:  route.AgencyId,
+		ShortName: route.RouteShortName,
+		LongName:  route.RouteLongName,
+		Type:      route.RouteType,
+		Vehicle:   route.VehicleType,
+		Category:  route.Category,
+		Color:     gtfs.NormalizeColor(route.RouteColor),
+		TextColor: gtfs.NormalizeColor(route.RouteTextColor),
+	}
+}
+
+func FromRoutes(routes []gtfs.Route) []Route {
+	return convertAll(routes, FromRoute)
+}
+
+type Trip struct {
+	ID                   string `json:"id"`
+	RouteID              string `json:"route_id"`
+	ServiceID            string `json:"service_id"`
+	DirectionID          int    `json:"direction_id"`
+	Headsign             string `json:"headsign,omitempty"`
+	ShapeID              string `json:"shape_id,omitempty"`
+	WheelchairAccessible int    `json:"wheelchair_accessible"` // 0 unknown, 1 accessible, 2 not accessible
+	BikesAllowed         int    `json:"bikes_allowed"`         // 0 unknown, 1 allowed, 2 not allowed
+}
+
+func FromTrip(trip gtfs.Trip) Trip {
+	return Trip{
+		ID:                   trip.TripID,
+		RouteID:              trip.RouteID,
+		ServiceID:            trip.ServiceID,
+		DirectionID:          trip.DirectionID,
+		Headsign:             trip.TripHeadsign,
+		ShapeID:              trip.ShapeID,
+		WheelchairAccessible: trip.WheelchairAccessible,
+		BikesAllowed:         trip.BikesAllowed,
+	}
+}
+
+func FromTrips(trips []gtfs.Trip) []Trip {
+	return convertAll(trips, FromTrip)
+}
+
+/*
+A trip stopping at a stop, e.g a departure on a departure board
+*/
+type StopTime struct {
+	TripID        string `json:"trip_id"`
+	ServiceDate   string `json:"service_date,omitempty"` // "20060102"
+	StopID        string `json:"stop_id"`
+	StopSequence  int    `json:"stop_sequence"`
+	ArrivalTime   string `json:"arrival_time"`   // "15:04:05", can be over 24:00:00
+	DepartureTime string `json:"departure_time"` // "15:04:05", can be over 24:00:00
+	Headsign      string `json:"headsign,omitempty"`
+	Platform      string `json:"platform,omitempty"`
+	IsOrigin      bool   `json:"is_origin"`
+	IsTerminus    bool   `json:"is_terminus"`
+	RealtimeOnly  bool   `json:"realtime_only"` // An ADDED or DUPLICATED trip which isn't in the static feed
+
+	Stop  Stop  `json:"stop"`
+	Trip  Trip  `json:"trip"`
+	Route Route `json:"route"` // Only the id and color are set
+
+	ContinuesAs *TripContinuation `json:"continues_as,omitempty"`
+	Realtime    *TripUpdate       `json:"realtime,omitempty"`
+	Alerts      []Alert           `json:"alerts,omitempty"` // The active alerts for the route, trip or stop
+	Occupancy   *Occupancy        `json:"occupancy,omitempty"`
+}
+
+type Occupancy struct {
+	Status     int    `json:"status"`               // The gtfs-realtime OccupancyStatus
+	Percentage *int   `json:"percentage,omitempty"` // How full it is (0-100+), when known
+	Source     string `json:"source,omitempty"`
+}
+
+func FromStopTime(stopTime gtfs.StopTimes) StopTime {
+	headsign := stopTime.StopHeadsign
+	if headsign == "" {
+		headsign = stopTime.TripData.TripHeadsign
+	}
+
+	converted := StopTime{
+		TripID:        stopTime.TripID,
+		ServiceDate:   stopTime.Instance.ServiceDate,
+		StopID:        stopTime.StopId,
+		StopSequence:  stopTime.StopSequence,
+		ArrivalTime:   stopTime.ArrivalTime,
+		DepartureTime: stopTime.DepartureTime,
+		Headsign:      headsign,
+		Platform:      stopTime.Platform,
+		IsOrigin:      stopTime.IsOrigin,
+		IsTerminus:    stopTime.IsTerminus,
+		RealtimeOnly:  stopTime.RealtimeOnly,
+		Stop:          FromStop(stopTime.StopData),
+		Trip:          FromTrip(stopTime.TripData),
+		Route:         Route{ID: stopTime.TripData.RouteID, Color: gtfs.NormalizeColor(stopTime.RouteColor)},
+	}
+	if stopTime.ContinuesAs != nil {
+		continuation := FromTripContinuation(*stopTime.ContinuesAs)
+		converted.ContinuesAs = &continuation
+	}
+	if stopTime.Realtime != nil {
+		update := FromTripUpdate(*stopTime.Realtime)
+		converted.Realtime = &update
+	}
+	if len(stopTime.Alerts) > 0 {
+		converted.Alerts = FromAlerts(stopTime.Alerts)
+	}
+	if stopTime.Occupancy != nil {
+		converted.Occupancy = &Occupancy{Status: stopTime.Occupancy.Status, Percentage: stopTime.Occupancy.Percentage, Source: stopTime.Occupancy.Source}
+	}
+	return converted
+}
+
+func FromStopTimes(stopTimes []gtfs.StopTimes) []StopTime {
+	return convertAll(stopTimes, FromStopTime)
+}
+
+/*
+The trip a vehicle continues as after the end of another
+*/
+type TripContinuation struct {
+	Trip          Trip   `json:"trip"`
+	Route         Route  `json:"route"`
+	DepartureTime string `json:"departure_time"` // When the trip leaves its first stop
+}
+
+func FromTripContinuation(continuation gtfs.TripContinuation) TripContinuation {
+	return TripContinuation{
+		Trip:          FromTrip(continuation.Trip),
+		Route:         FromRoute(continuation.Route),
+		DepartureTime: continuation.DepartureTime,
+	}
+}
+
+func orEmpty[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -0,0 +1,47 @@
+/*
+Stable JSON contracts for APIs built on the gtfs package
+
+The gtfs and realtime structs follow the feed (and database) naming, which changes as the package grows. The
+types here don't: within v1 fields are only ever added, never renamed, retyped or removed, so API builders can
+expose them without their clients breaking on upgrades
+
+	stops, _ := db.GetStops(false)
+	json.NewEncoder(w).Encode(v1.FromStops(stops))
+
+The json conventions of every type:
+
+  - names are snake_case, ids are always "id" on the type itself and "<type>_id" when referencing another type
+  - times are RFC 3339 (time.Time), gtfs service times stay "15:04:05" strings as they can be over 24:00:00
+  - optional values (and ones which are usually empty) are omitted when empty, everything else is always present
+  - lists are always present, [] rather than null
+*/
+package v1
+
+import "time"
+
+/*
+The version of the contracts in this package
+*/
+const Version = "v1"
+
+/*
+Convert each item, always returning a non nil slice so lists are encoded as []
+*/
+func convertAll[T any, R any](items []T, convert func(T) R) []R {
+	converted := make([]R, 0, len(items))
+	for _, item := range items {
+		converted = append(converted, convert(item))
+	}
+	return converted
+}
+
+/*
+A unix timestamp as a time, nil if it's unset (0)
+*/
+func unixTime(timestamp int64) *time.Time {
+	if timestamp <= 0 {
+		return nil
+	}
+	t := time.Unix(timestamp, 0).UTC()
+	return &t
+}
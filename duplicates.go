@@ -0,0 +1,56 @@
+package gtfs
+
+import (
+	"errors"
+
+	sqlite "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+/*
+What's done with rows which have the same key as a row already imported (e.g a stop listed twice), see WithDuplicatePolicy
+*/
+type DuplicatePolicy int
+
+const (
+	DuplicatesFirstWins DuplicatePolicy = iota // Keep the first row, the rest are listed in the import report (the default)
+	DuplicatesUpsert                           // Replace the row with the later one
+	DuplicatesFail                             // Stop the import with an error
+)
+
+/*
+How rows with duplicate keys in the feed are handled when it's imported, defaults to DuplicatesFirstWins
+*/
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(o *databaseOptions) {
+		o.duplicatePolicy = policy
+	}
+}
+
+func (v Database) duplicatePolicy() DuplicatePolicy {
+	if v.state == nil {
+		return DuplicatesFirstWins
+	}
+	return v.state.duplicatePolicy
+}
+
+/*
+Check if an insert failed because the row's key is already in the table
+*/
+func isDuplicateKeyError(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+/*
+Record a row with a duplicate key in the report of a file
+*/
+func (r *FileImportReport) duplicate(line int, reason string) {
+	r.Duplicates++
+	if len(r.DuplicateRows) < maxReportedSkippedRows {
+		r.DuplicateRows = append(r.DuplicateRows, SkippedRow{Line: line, Reason: reason})
+	}
+}
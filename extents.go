@@ -0,0 +1,117 @@
+package gtfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+The bounding box of the feed's (or a route's) stops and shapes, e.g for a map's initial viewport
+*/
+type Extent struct {
+	MinLat float64 `json:"min_lat" db:"min_lat"`
+	MinLon float64 `json:"min_lon" db:"min_lon"`
+	MaxLat float64 `json:"max_lat" db:"max_lat"`
+	MaxLon float64 `json:"max_lon" db:"max_lon"`
+}
+
+/*
+The middle of the extent (lat, lon)
+*/
+func (e Extent) Center() (float64, float64) {
+	return (e.MinLat + e.MaxLat) / 2, (e.MinLon + e.MaxLon) / 2
+}
+
+/*
+The points of each route's stops and shapes, and of every stop and shape for the feed (an empty route id).
+Points at 0,0 are left out, as they're missing locations rather than stops in the Gulf of Guinea
+*/
+const extentPointsQuery = `
+	WITH route_points AS (
+		SELECT r.route_id, s.stop_lat AS lat, s.stop_lon AS lon
+		FROM (SELECT DISTINCT t.route_id, st.stop_id FROM trips t JOIN stop_times st ON t.trip_id = st.trip_id) r
+		JOIN stops s ON s.stop_id = r.stop_id
+		UNION ALL
+		SELECT t.route_id, sh.shape_pt_lat, sh.shape_pt_lon
+		FROM (SELECT DISTINCT route_id, shape_id FROM trips WHERE COALESCE(shape_id, '') != '') t
+		JOIN shapes sh ON sh.shape_id = t.shape_id
+	),
+	points AS (
+		SELECT route_id, lat, lon FROM route_points
+		UNION ALL
+		SELECT '', stop_lat, stop_lon FROM stops
+		UNION ALL
+		SELECT '', shape_pt_lat, shape_pt_lon FROM shapes
+	)
+`
+
+/*
+Store the extent of the feed and of each route, so they don't need every stop and shape point scanned each time
+*/
+func (v Database) buildExtents() error {
+	_, err := v.db.Exec(`DELETE FROM extents; ` + extentPointsQuery + `
+		INSERT INTO extents (route_id, min_lat, min_lon, max_lat, max_lon)
+		SELECT route_id, MIN(lat), MIN(lon), MAX(lat), MAX(lon)
+		FROM points
+		WHERE lat IS NOT NULL AND lon IS NOT NULL AND NOT (lat = 0 AND lon = 0)
+		GROUP BY route_id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to build extents: %w", err)
+	}
+	return nil
+}
+
+/*
+Get the bounding box of all the feed's stops and shapes
+*/
+func (v Database) GetFeedExtent() (Extent, error) {
+	defer v.observeQuery("GetFeedExtent", time.Now())
+	return v.getExtent("")
+}
+
+/*
+Get the bounding box of the stops a route serves and its trips' shapes
+*/
+func (v Database) GetRouteExtent(routeID string) (Extent, error) {
+	defer v.observeQuery("GetRouteExtent", time.Now())
+
+	if routeID == "" {
+		return Extent{}, errors.New("missing route id")
+	}
+	return v.getExtent(v.PrefixID(routeID))
+}
+
+func (v Database) getExtent(routeID string) (Extent, error) {
+	var extent Extent
+	err := v.db.Get(&extent, `SELECT min_lat, min_lon, max_lat, max_lon FROM extents WHERE route_id = ?`, routeID)
+	if err == nil {
+		return extent, nil
+	}
+	if err != sql.ErrNoRows {
+		return Extent{}, err
+	}
+
+	// Databases imported before extents were stored don't have them until the next refresh
+	var found struct {
+		Extent
+		Points int `db:"points"`
+	}
+	err = v.db.Get(&found, extentPointsQuery+`
+		SELECT COALESCE(MIN(lat), 0) AS min_lat, COALESCE(MIN(lon), 0) AS min_lon, COALESCE(MAX(lat), 0) AS max_lat, COALESCE(MAX(lon), 0) AS max_lon, COUNT(*) AS points
+		FROM points
+		WHERE route_id = ? AND lat IS NOT NULL AND lon IS NOT NULL AND NOT (lat = 0 AND lon = 0)
+	`, routeID)
+	if err != nil {
+		return Extent{}, err
+	}
+	if found.Points == 0 {
+		if routeID != "" {
+			return Extent{}, errors.New("route not found")
+		}
+		return Extent{}, errors.New("the feed doesn't have any stops")
+	}
+	return found.Extent, nil
+}
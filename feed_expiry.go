@@ -0,0 +1,272 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FeedEventType string
+
+const (
+	FeedExpiring         FeedEventType = "expiring"            // The feed ends within FeedExpiryOptions.WarnDays
+	FeedExpired          FeedEventType = "expired"             // The feed has ended
+	FeedCoverageGap      FeedEventType = "coverage_gap"        // Days before the feed ends which have no services
+	FeedEndDateMovedBack FeedEventType = "end_date_moved_back" // A refresh moved the feed's end date earlier
+	FeedCalendarGap      FeedEventType = "calendar_gap"        // Days an agency or route unexpectedly has no services, see FindCalendarGaps
+)
+
+type FeedEvent struct {
+	Type                FeedEventType `json:"type"`
+	Message             string        `json:"message"`
+	FeedEndDate         string        `json:"feed_end_date"`                    // "20060102"
+	PreviousFeedEndDate string        `json:"previous_feed_end_date,omitempty"` // Set for FeedEndDateMovedBack
+	DaysLeft            int           `json:"days_left"`                        // Days until the feed ends, 0 on the last day
+	Dates               []string      `json:"dates,omitempty"`                  // The days without services for FeedCoverageGap and FeedCalendarGap
+	AgencyID            string        `json:"agency_id,omitempty"`              // The agency with the gap for FeedCalendarGap
+	RouteID             string        `json:"route_id,omitempty"`               // The route with the gap for FeedCalendarGap, "" for the whole agency
+}
+
+type FeedExpiryOptions struct {
+	WarnDays      int           // Warn when the feed ends within this many days, defaults to 7
+	CoverageDays  int           // How many days ahead to check have services, defaults to 14
+	CheckInterval time.Duration // How often WatchFeedExpiry checks (besides after each refresh), defaults to 24h
+}
+
+func (o FeedExpiryOptions) withDefaults() FeedExpiryOptions {
+	if o.WarnDays <= 0 {
+		o.WarnDays = 7
+	}
+	if o.CoverageDays <= 0 {
+		o.CoverageDays = 14
+	}
+	if o.CheckInterval <= 0 {
+		o.CheckInterval = 24 * time.Hour
+	}
+	return o
+}
+
+/*
+Check if the feed is about to end (or has) and if any of the coming days have no services (at all, or for an agency
+or route which usually runs that day), so stale upstream data is noticed before riders see empty departure boards
+
+Uses feed_info's feed_end_date, or the last date in the calendars if the feed doesn't have one
+*/
+func (v Database) CheckFeedExpiry(options FeedExpiryOptions) ([]FeedEvent, error) {
+	options = options.withDefaults()
+
+	location := v.locationFor("", "")
+	today := Today(location)
+	end, err := v.feedEndDay(location)
+	if err != nil {
+		return nil, err
+	}
+
+	daysLeft := today.DaysUntil(end)
+
+	var events []FeedEvent
+	switch {
+	case daysLeft < 0:
+		events = append(events, FeedEvent{
+			Type:        FeedExpired,
+			Message:     fmt.Sprintf("the feed ended on %s", end),
+			FeedEndDate: end.String(),
+		})
+		// There's no coverage to check
+		return events, nil
+	case daysLeft <= options.WarnDays:
+		events = append(events, FeedEvent{
+			Type:        FeedExpiring,
+			Message:     fmt.Sprintf("the feed ends in %d days (%s)", daysLeft, end),
+			FeedEndDate: end.String(),
+			DaysLeft:    daysLeft,
+		})
+	}
+
+	var gaps []string
+	last := today.AddDays(options.CoverageDays - 1)
+	if end.String() < last.String() {
+		last = end
+	}
+	for day := today; day.String() <= last.String(); day = day.AddDays(1) {
+		servicesQuery, args := activeServicesQuery(day)
+		var services int
+		if err := v.db.Get(&services, servicesQuery+` SELECT COUNT(*) FROM adjusted_services`, args...); err != nil {
+			return nil, fmt.Errorf("failed to check services on %s: %w", day, err)
+		}
+		if services == 0 {
+			gaps = append(gaps, day.String())
+		}
+	}
+	if len(gaps) > 0 {
+		events = append(events, FeedEvent{
+			Type:        FeedCoverageGap,
+			Message:     fmt.Sprintf("no services run on %s", strings.Join(gaps, ", ")),
+			FeedEndDate: end.String(),
+			DaysLeft:    daysLeft,
+			Dates:       gaps,
+		})
+	}
+
+	calendarGaps, err := v.FindCalendarGaps(CalendarGapOptions{From: today.String(), To: last.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check calendar gaps: %w", err)
+	}
+	for _, gap := range calendarGaps {
+		// The days nothing runs are already reported for the whole feed
+		var dates []string
+		for _, date := range gap.Dates {
+			if !contains(gaps, date) {
+				dates = append(dates, date)
+			}
+		}
+		if len(dates) == 0 {
+			continue
+		}
+
+		event := FeedEvent{
+			Type:        FeedCalendarGap,
+			Message:     fmt.Sprintf("%s %s has no services on %s", gap.Type, gap.Name, strings.Join(dates, ", ")),
+			FeedEndDate: end.String(),
+			DaysLeft:    daysLeft,
+			Dates:       dates,
+			AgencyID:    gap.AgencyID,
+		}
+		if gap.Type == "agency" {
+			event.AgencyID = gap.ID
+		} else {
+			event.RouteID = gap.ID
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+/*
+Watch the feed for the problems found by CheckFeedExpiry, checking now, after each refresh (see RefreshNotifier)
+and every CheckInterval. Also sends FeedEndDateMovedBack when a refresh moves the feed's end date earlier
+
+Returns the events and a func to stop watching (which closes the channel)
+*/
+func (v Database) WatchFeedExpiry(options FeedExpiryOptions) (<-chan FeedEvent, func()) {
+	options = options.withDefaults()
+
+	events := make(chan FeedEvent, 16)
+	done := make(chan struct{})
+	refreshed, stopRefreshes := v.RefreshNotifier()
+
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(options.CheckInterval)
+		defer ticker.Stop()
+
+		var previousEndDate string
+		check := func() bool {
+			found, err := v.CheckFeedExpiry(options)
+			if err != nil {
+				v.logger().Warn("failed to check feed expiry", "error", err)
+				return true
+			}
+
+			if endDate, err := v.feedEndDay(v.locationFor("", "")); err == nil {
+				if previousEndDate != "" && endDate.String() < previousEndDate {
+					found = append(found, FeedEvent{
+						Type:                FeedEndDateMovedBack,
+						Message:             fmt.Sprintf("the feed's end date moved back from %s to %s", previousEndDate, endDate),
+						FeedEndDate:         endDate.String(),
+						PreviousFeedEndDate: previousEndDate,
+					})
+				}
+				previousEndDate = endDate.String()
+			}
+
+			for _, event := range found {
+				v.logger().Warn("feed problem found", "type", event.Type, "message", event.Message)
+				select {
+				case events <- event:
+				case <-done:
+					return false
+				}
+			}
+			return true
+		}
+
+		if !check() {
+			return
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-refreshed:
+				if !ok || !check() {
+					return
+				}
+			case <-ticker.C:
+				if !check() {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			close(done)
+			stopRefreshes()
+		})
+	}
+}
+
+/*
+Get the first day of the feed, from feed_info or else the calendars
+*/
+func (v Database) feedStartDay(location *time.Location) (ServiceDay, error) {
+	var startDate string
+	err := v.db.Get(&startDate, `SELECT COALESCE(feed_start_date, '') FROM feed_info LIMIT 1`)
+	if err != nil || startDate == "" {
+		err = v.db.Get(&startDate, `
+			SELECT COALESCE(MIN(date), '') FROM (
+				SELECT start_date AS date FROM calendar
+				UNION ALL
+				SELECT date FROM calendar_dates WHERE exception_type = 1
+			)
+		`)
+		if err != nil {
+			return ServiceDay{}, err
+		}
+	}
+	if startDate == "" {
+		return ServiceDay{}, errors.New("the feed doesn't have a start date")
+	}
+	return ParseServiceDay(startDate, location)
+}
+
+/*
+Get the last day of the feed, from feed_info or else the calendars
+*/
+func (v Database) feedEndDay(location *time.Location) (ServiceDay, error) {
+	var endDate string
+	err := v.db.Get(&endDate, `SELECT COALESCE(feed_end_date, '') FROM feed_info LIMIT 1`)
+	if err != nil || endDate == "" {
+		err = v.db.Get(&endDate, `
+			SELECT COALESCE(MAX(date), '') FROM (
+				SELECT end_date AS date FROM calendar
+				UNION ALL
+				SELECT date FROM calendar_dates WHERE exception_type = 1
+			)
+		`)
+		if err != nil {
+			return ServiceDay{}, err
+		}
+	}
+	if endDate == "" {
+		return ServiceDay{}, errors.New("the feed doesn't have an end date")
+	}
+	return ParseServiceDay(endDate, location)
+}
@@ -0,0 +1,178 @@
+package gtfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type GeocodeResult struct {
+	Name string  `json:"name"` // The full name of the place found, e.g "1 Queen Street, Auckland Central, Auckland"
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+}
+
+/*
+Turns addresses into coordinates, e.g for finding the stops near an address
+*/
+type Geocoder interface {
+	// The places matching an address, best match first
+	Geocode(address string) ([]GeocodeResult, error)
+}
+
+/*
+A Geocoder using a Nominatim server (https://nominatim.org), e.g "https://nominatim.openstreetmap.org"
+
+The public OpenStreetMap server allows at most one request a second and needs a UserAgent identifying the app
+*/
+type NominatimGeocoder struct {
+	BaseURL      string
+	UserAgent    string
+	CountryCodes []string // Only find places in these countries (ISO 3166-1 alpha-2), e.g the feed's
+	Limit        int      // How many places to return, defaults to 5
+
+	HTTPClient *http.Client // Defaults to a client with a 10s timeout
+}
+
+func (g NominatimGeocoder) Geocode(address string) ([]GeocodeResult, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return nil, errors.New("missing address")
+	}
+	if !strings.HasPrefix(g.BaseURL, "http://") && !strings.HasPrefix(g.BaseURL, "https://") {
+		return nil, errors.New("invalid geocoder url")
+	}
+	limit := g.Limit
+	if limit <= 0 {
+		limit = 5
+	}
+
+	query := url.Values{}
+	query.Set("q", address)
+	query.Set("format", "jsonv2")
+	query.Set("limit", strconv.Itoa(limit))
+	if len(g.CountryCodes) > 0 {
+		query.Set("countrycodes", strings.ToLower(strings.Join(g.CountryCodes, ",")))
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(g.BaseURL, "/")+"/search?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.UserAgent != "" {
+		req.Header.Set("User-Agent", g.UserAgent)
+	}
+
+	client := g.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geocoder responded with status %d", resp.StatusCode)
+	}
+
+	// Nominatim returns the coordinates as strings
+	var places []struct {
+		DisplayName string `json:"display_name"`
+		Lat         string `json:"lat"`
+		Lon         string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return nil, fmt.Errorf("failed to decode geocoder response: %w", err)
+	}
+
+	results := make([]GeocodeResult, 0, len(places))
+	for _, place := range places {
+		lat, errLat := strconv.ParseFloat(place.Lat, 64)
+		lon, errLon := strconv.ParseFloat(place.Lon, 64)
+		if errLat != nil || errLon != nil {
+			continue
+		}
+		results = append(results, GeocodeResult{Name: place.DisplayName, Lat: lat, Lon: lon})
+	}
+	return results, nil
+}
+
+type AddressStop struct {
+	Stop     Stop    `json:"stop"`
+	Distance float64 `json:"distance"` // How far the stop is from the address (m)
+}
+
+type AddressStops struct {
+	Place GeocodeResult `json:"place"` // Where the address was geocoded to
+	Stops []AddressStop `json:"stops"` // Closest first
+}
+
+/*
+Find the stops near an address, to start or end a journey at
+
+Uses the geocoder's best match for the address. Platforms are returned rather than their stations, as they're where
+riders board
+
+  - radius: how far from the address to look for stops (m)
+  - limit: how many stops, defaults to 10
+*/
+func (v Database) StopsNearAddress(geocoder Geocoder, address string, radius float64, limit int) (AddressStops, error) {
+	defer v.observeQuery("StopsNearAddress", time.Now())
+
+	if geocoder == nil {
+		return AddressStops{}, errors.New("missing geocoder")
+	}
+	if radius <= 0 {
+		return AddressStops{}, errors.New("invalid radius")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+
+	places, err := geocoder.Geocode(address)
+	if err != nil {
+		return AddressStops{}, err
+	}
+	if len(places) == 0 {
+		return AddressStops{}, errors.New("address not found")
+	}
+	place := places[0]
+
+	// Narrow the stops down with a bounding box before working out their actual distance, the same as GetNearbyDepartures
+	latDelta := radius / 111320
+	lonDelta := radius / (111320 * math.Max(math.Cos(place.Lat*math.Pi/180), 0.01))
+	var stops Stops
+	err = v.db.Select(&stops, `
+		SELECT stop_id, stop_code, stop_name, stop_lat, stop_lon, location_type, parent_station, platform_code, zone_id, wheelchair_boarding
+		FROM stops
+		WHERE COALESCE(location_type, 0) = 0
+		  AND stop_lat BETWEEN ? AND ?
+		  AND stop_lon BETWEEN ? AND ?
+	`, place.Lat-latDelta, place.Lat+latDelta, place.Lon-lonDelta, place.Lon+lonDelta)
+	if err != nil {
+		return AddressStops{}, err
+	}
+
+	nearby := AddressStops{Place: place, Stops: []AddressStop{}}
+	for _, stop := range stops {
+		distance := calculateDistance(place.Lat, place.Lon, stop.StopLat, stop.StopLon) * 1000
+		if distance <= radius {
+			nearby.Stops = append(nearby.Stops, AddressStop{Stop: stop, Distance: distance})
+		}
+	}
+	sort.Slice(nearby.Stops, func(i, j int) bool {
+		return nearby.Stops[i].Distance < nearby.Stops[j].Distance
+	})
+	if len(nearby.Stops) > limit {
+		nearby.Stops = nearby.Stops[:limit]
+	}
+	v.stripIDs(&nearby)
+	return nearby, nil
+}
@@ -0,0 +1,202 @@
+package gtfs
+
+import (
+	"strings"
+	"time"
+)
+
+type FeatureCollection struct {
+	Type     string    `json:"type"` // "FeatureCollection"
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string      `json:"type"` // "Feature"
+	ID         string      `json:"id,omitempty"`
+	Geometry   Geometry    `json:"geometry"`
+	Properties interface{} `json:"properties"`
+}
+
+type Geometry struct {
+	Type        string      `json:"type"`        // "Point", "LineString" or "MultiLineString"
+	Coordinates interface{} `json:"coordinates"` // [lon, lat] for points, lists of them for lines
+}
+
+/*
+How shapes are written as GeoJSON, coordinates are [lon, lat] by default
+*/
+type GeoJSONOptions struct {
+	// Add each point's shape_dist_traveled as a third coordinate, [lon, lat, dist]. RFC 7946 only allows elevation
+	// there, so strict renderers reject it
+	DistanceCoordinates bool
+	// Add each point's shape_dist_traveled to the properties as "dist_traveled"
+	DistanceProperty bool
+}
+
+type StopProperties struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Code     string   `json:"code"`
+	StopType string   `json:"stop_type"`
+	Modes    []string `json:"modes"`
+	Parent   string   `json:"parent,omitempty"` // The parent station, for platforms
+}
+
+type RouteProperties struct {
+	ID        string `json:"id"`
+	ShortName string `json:"short_name"`
+	LongName  string `json:"long_name"`
+	Mode      string `json:"mode"`       // See Route.VehicleType
+	Category  string `json:"category"`   // See Route.Category
+	Color     string `json:"color"`      // "#RRGGBB", see Route.DisplayColors
+	TextColor string `json:"text_color"` // "#RRGGBB"
+
+	DistTraveled [][]float64 `json:"dist_traveled,omitempty"` // For each line, with GeoJSONOptions.DistanceProperty
+}
+
+type ShapeProperties struct {
+	ID           string    `json:"id"`
+	DistTraveled []float64 `json:"dist_traveled,omitempty"` // With GeoJSONOptions.DistanceProperty
+}
+
+func NewFeatureCollection(features []Feature) FeatureCollection {
+	if features == nil {
+		features = []Feature{}
+	}
+	return FeatureCollection{Type: "FeatureCollection", Features: features}
+}
+
+/*
+A Point feature
+*/
+func PointFeature(id string, lat, lon float64, properties interface{}) Feature {
+	return Feature{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   Geometry{Type: "Point", Coordinates: []float64{lon, lat}},
+		Properties: properties,
+	}
+}
+
+/*
+Get the stops as Point features, with their id, name, code and modes as the properties
+*/
+func StopsToGeoJSON(stops []Stop) FeatureCollection {
+	features := make([]Feature, 0, len(stops))
+	for _, stop := range stops {
+		modes := stop.StopModes
+		if modes == nil {
+			modes = []string{}
+		}
+		features = append(features, PointFeature(stop.StopId, stop.StopLat, stop.StopLon, StopProperties{
+			ID:       stop.StopId,
+			Name:     stop.StopName,
+			Code:     stop.StopCode,
+			StopType: stop.StopType,
+			Modes:    modes,
+			Parent:   stop.ParentStation,
+		}))
+	}
+	return NewFeatureCollection(features)
+}
+
+/*
+Get a shape as a LineString feature
+*/
+func ShapeToGeoJSON(shapeID string, points []ShapePoint, options ...GeoJSONOptions) Feature {
+	option := firstGeoJSONOptions(options)
+	properties := ShapeProperties{ID: shapeID}
+	if option.DistanceProperty {
+		properties.DistTraveled = shapeDistances(points)
+	}
+	return Feature{
+		Type:       "Feature",
+		ID:         shapeID,
+		Geometry:   Geometry{Type: "LineString", Coordinates: shapeCoordinates(points, option)},
+		Properties: properties,
+	}
+}
+
+func firstGeoJSONOptions(options []GeoJSONOptions) GeoJSONOptions {
+	if len(options) == 0 {
+		return GeoJSONOptions{}
+	}
+	return options[0]
+}
+
+func shapeCoordinates(points []ShapePoint, options GeoJSONOptions) [][]float64 {
+	coordinates := make([][]float64, len(points))
+	for i, point := range points {
+		coordinates[i] = []float64{point.Lon, point.Lat}
+		if options.DistanceCoordinates {
+			coordinates[i] = append(coordinates[i], point.ShapeDistTraveled)
+		}
+	}
+	return coordinates
+}
+
+func shapeDistances(points []ShapePoint) []float64 {
+	distances := make([]float64, len(points))
+	for i, point := range points {
+		distances[i] = point.ShapeDistTraveled
+	}
+	return distances
+}
+
+/*
+Get the routes as MultiLineString features of their trips' shapes, with their names, mode and colors as the properties
+
+Routes without shapes have no lines
+*/
+func (v Database) RoutesToGeoJSON(routes []Route, options ...GeoJSONOptions) (FeatureCollection, error) {
+	defer v.observeQuery("RoutesToGeoJSON", time.Now())
+
+	option := firstGeoJSONOptions(options)
+	// The routes have the feed's own ids, see WithIDPrefix
+	routeIDs := make([]string, len(routes))
+	for i, route := range routes {
+		routeIDs[i] = v.PrefixID(route.RouteId)
+	}
+	routeShapes, err := selectByIDs[struct {
+		RouteID string `db:"route_id"`
+		ShapeID string `db:"shape_id"`
+	}](v, `SELECT DISTINCT route_id, shape_id FROM trips WHERE COALESCE(shape_id, '') != '' AND route_id IN (%s)`, routeIDs)
+	if err != nil {
+		return FeatureCollection{}, err
+	}
+	shapeIDs := make(map[string][]string)
+	for _, routeShape := range routeShapes {
+		shapeIDs[routeShape.RouteID] = append(shapeIDs[routeShape.RouteID], routeShape.ShapeID)
+	}
+
+	features := make([]Feature, 0, len(routes))
+	for _, route := range routes {
+		properties := RouteProperties{
+			ID:        route.RouteId,
+			ShortName: route.RouteShortName,
+			LongName:  route.RouteLongName,
+			Mode:      strings.ToLower(route.VehicleType),
+			Category:  route.Category,
+			Color:     "#" + route.DisplayColors.Color,
+			TextColor: "#" + route.DisplayColors.TextColor,
+		}
+		lines := [][][]float64{}
+		for _, shapeID := range shapeIDs[v.PrefixID(route.RouteId)] {
+			points, err := v.shape(shapeID)
+			if err != nil {
+				continue
+			}
+			lines = append(lines, shapeCoordinates(points, option))
+			if option.DistanceProperty {
+				properties.DistTraveled = append(properties.DistTraveled, shapeDistances(points))
+			}
+		}
+		features = append(features, Feature{
+			Type:       "Feature",
+			ID:         route.RouteId,
+			Geometry:   Geometry{Type: "MultiLineString", Coordinates: lines},
+			Properties: properties,
+		})
+	}
+	return NewFeatureCollection(features), nil
+}
@@ -0,0 +1,432 @@
+package gtfsgraphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+The result of a query, see https://spec.graphql.org/October2021/#sec-Response-Format
+*/
+type Response struct {
+	Data   interface{} `json:"data"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+type Error struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path,omitempty"` // The response keys of the field which failed (without list indexes, the field failed for every item)
+}
+
+/*
+An object type of the schema, its fields are resolved for every object of the type at each level of the query at once
+*/
+type objectType struct {
+	name   string
+	fields map[string]field
+}
+
+type field struct {
+	typ  string // The object type of the results, "" for scalars
+	list bool
+
+	/*
+		Resolve the field for each of the parents, returning a result for each in the same order. A list field's results
+		are []interface{}, and nil results are null
+	*/
+	resolve func(r *request, parents []interface{}, args arguments) ([]interface{}, error)
+}
+
+/*
+An object in the response, its fields are kept in the order they were asked for
+*/
+type object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newObject() *object {
+	return &object{values: make(map[string]interface{})}
+}
+
+func (o *object) set(key string, value interface{}) {
+	if _, found := o.values[key]; !found {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		encodedValue, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(encodedKey)
+		buffer.WriteByte(':')
+		buffer.Write(encodedValue)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+/*
+A field with the same response key can be asked for more than once (e.g in fragments), they're merged into one
+*/
+type collectedField struct {
+	key        string
+	name       string
+	arguments  map[string]interface{}
+	selections []selection
+}
+
+/*
+Run an operation from the document, the only one if operationName is ""
+*/
+func (r *request) execute(doc *document, operationName string) (*object, error) {
+	var op *operation
+	for _, candidate := range doc.operations {
+		if candidate.name == operationName || (operationName == "" && len(doc.operations) == 1) {
+			op = candidate
+			break
+		}
+	}
+	if op == nil {
+		if operationName == "" {
+			return nil, errors.New("operationName is required when the document has more than one operation")
+		}
+		return nil, fmt.Errorf("unknown operation %q", operationName)
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("%s operations aren't supported, only queries", op.kind)
+	}
+
+	for _, definition := range op.variables {
+		if _, found := r.variables[definition.name]; !found && definition.defaultValue != nil {
+			r.variables[definition.name] = definition.defaultValue
+		}
+	}
+	r.fragments = doc.fragments
+
+	results, err := r.executeSelections(r.schema["Query"], []interface{}{nil}, op.selections, nil)
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+/*
+Resolve the selections on every parent (all of the type given) at once, returning each parent's object
+
+Each field is resolved for all the parents together, and the objects it returns (from every parent) have their own
+selections resolved together too, so the queries are batched by level rather than made for each object
+*/
+func (r *request) executeSelections(typ objectType, parents []interface{}, selections []selection, path []string) ([]*object, error) {
+	fields, err := r.collectFields(typ, selections, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*object, len(parents))
+	for i := range objects {
+		objects[i] = newObject()
+	}
+
+	for _, collected := range fields {
+		fieldPath := append(append([]string{}, path...), collected.key)
+		if collected.name == "__typename" {
+			for _, o := range objects {
+				o.set(collected.key, typ.name)
+			}
+			continue
+		}
+
+		f, found := typ.fields[collected.name]
+		if !found {
+			return nil, fmt.Errorf("cannot query field %q on type %q", collected.name, typ.name)
+		}
+		if f.typ != "" && len(collected.selections) == 0 {
+			return nil, fmt.Errorf("field %q of type %q must have a selection of subfields", collected.name, f.typ)
+		}
+		if f.typ == "" && len(collected.selections) > 0 {
+			return nil, fmt.Errorf("field %q must not have a selection since it has no subfields", collected.name)
+		}
+
+		args, err := r.arguments(collected.arguments)
+		if err != nil {
+			return nil, err
+		}
+		results, err := f.resolve(r, parents, args)
+		if err != nil {
+			// The field is null for every parent, the rest of the query still runs
+			r.errors = append(r.errors, Error{Message: err.Error(), Path: fieldPath})
+			for _, o := range objects {
+				o.set(collected.key, nil)
+			}
+			continue
+		}
+
+		if f.typ == "" {
+			for i, o := range objects {
+				o.set(collected.key, results[i])
+			}
+			continue
+		}
+
+		values, err := r.executeChildren(r.schema[f.typ], f.list, results, collected.selections, fieldPath)
+		if err != nil {
+			return nil, err
+		}
+		for i, o := range objects {
+			o.set(collected.key, values[i])
+		}
+	}
+	return objects, nil
+}
+
+/*
+Resolve the selections on the objects a field returned for each parent, flattening the lists so every object is
+resolved in one go
+*/
+func (r *request) executeChildren(typ objectType, list bool, results []interface{}, selections []selection, path []string) ([]interface{}, error) {
+	var children []interface{}
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if list {
+			children = append(children, result.([]interface{})...)
+		} else {
+			children = append(children, result)
+		}
+	}
+
+	objects, err := r.executeSelections(typ, children, selections, path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(results))
+	next := 0
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		if !list {
+			values[i] = objects[next]
+			next++
+			continue
+		}
+		items := result.([]interface{})
+		value := make([]interface{}, len(items))
+		for j := range items {
+			value[j] = objects[next]
+			next++
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+/*
+Get the fields to resolve from the selections, expanding the fragments which apply to the type and leaving out the
+fields skipped by @skip/@include
+*/
+func (r *request) collectFields(typ objectType, selections []selection, fields []*collectedField, visited map[string]bool) ([]*collectedField, error) {
+	for _, s := range selections {
+		include, err := r.included(s.directives)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case s.spread != "":
+			if visited[s.spread] {
+				continue
+			}
+			visited[s.spread] = true
+			frag, found := r.fragments[s.spread]
+			if !found {
+				return nil, fmt.Errorf("unknown fragment %q", s.spread)
+			}
+			if frag.typeCondition != typ.name {
+				continue
+			}
+			if fields, err = r.collectFields(typ, frag.selections, fields, visited); err != nil {
+				return nil, err
+			}
+		case s.inline:
+			if s.typeCondition != "" && s.typeCondition != typ.name {
+				continue
+			}
+			if fields, err = r.collectFields(typ, s.selections, fields, visited); err != nil {
+				return nil, err
+			}
+		default:
+			merged := false
+			for _, collected := range fields {
+				if collected.key == s.key() {
+					if collected.name != s.name {
+						return nil, fmt.Errorf("fields %q conflict because %s and %s are different fields", s.key(), collected.name, s.name)
+					}
+					collected.selections = append(collected.selections, s.selections...)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				fields = append(fields, &collectedField{
+					key:        s.key(),
+					name:       s.name,
+					arguments:  s.arguments,
+					selections: append([]selection{}, s.selections...),
+				})
+			}
+		}
+	}
+	return fields, nil
+}
+
+/*
+Check the @skip and @include directives of a selection
+*/
+func (r *request) included(directives []directive) (bool, error) {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		args, err := r.arguments(d.arguments)
+		if err != nil {
+			return false, err
+		}
+		value, ok := args["if"].(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a boolean if argument", d.name)
+		}
+		if (d.name == "skip") == value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+/*
+Replace the variables in the arguments with their values
+*/
+func (r *request) arguments(values map[string]interface{}) (arguments, error) {
+	args := make(arguments, len(values))
+	for name, value := range values {
+		resolved, err := r.value(value)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = resolved
+	}
+	return args, nil
+}
+
+func (r *request) value(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case variable:
+		return r.variables[string(value)], nil
+	case enumValue:
+		return string(value), nil
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			resolved, err := r.value(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = resolved
+		}
+		return list, nil
+	case map[string]interface{}:
+		return r.arguments(value)
+	}
+	return value, nil
+}
+
+/*
+The arguments of a field, with the variables replaced
+*/
+type arguments map[string]interface{}
+
+func (a arguments) has(name string) bool {
+	return a[name] != nil
+}
+
+func (a arguments) string(name string) (string, error) {
+	switch value := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	}
+	return "", fmt.Errorf("argument %q must be a string", name)
+}
+
+/*
+Get a list of strings, a single string is a list of one (as graphql coerces it)
+*/
+func (a arguments) strings(name string) ([]string, error) {
+	switch value := a[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		list := make([]string, len(value))
+		for i, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument %q must be a list of strings", name)
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("argument %q must be a list of strings", name)
+}
+
+/*
+Get an int argument, the variables are decoded from json so their numbers are float64
+*/
+func (a arguments) int(name string, defaultValue int64) (int64, error) {
+	switch value := a[name].(type) {
+	case nil:
+		return defaultValue, nil
+	case int64:
+		return value, nil
+	case float64:
+		if value == float64(int64(value)) {
+			return int64(value), nil
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n, nil
+		}
+	case string:
+		// Long scalars (e.g unix times) are often sent as strings
+		var n int64
+		if _, err := fmt.Sscan(strings.TrimSpace(value), &n); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an int", name)
+}
@@ -0,0 +1,154 @@
+/*
+A GraphQL endpoint for a gtfs Database, with the OpenTripPlanner (OTP) index schema's names so transit frontends which
+already speak OTP's GraphQL can be pointed at it
+
+	db, _ := gtfs.New(url, "auckland", tz, "")
+	http.Handle("/graphql", gtfsgraphql.New(db))
+
+	{
+	  stop(id: "8220") {
+	    name
+	    stoptimesWithoutPatterns(numberOfDepartures: 5) {
+	      scheduledDeparture realtimeDeparture serviceDay headsign
+	      trip { route { shortName mode } }
+	    }
+	  }
+	}
+
+The queries are stop(id), stops(ids, name), station(id), stations(ids, name), route(id), routes(ids, name), trip(id),
+trips(ids), agency(id) and agencies, with their nested Stop, Route, Trip, Stoptime and Agency objects. Only the
+commonly used fields of OTP's types are included, and ids are the feed's own (not OTP's "FeedId:id")
+
+Each field is resolved for every object at the same level of the query at once, and the stops, routes, trips and agencies
+they reference are loaded in batches (see gtfs.Database.GetStopsByIDs) and cached for the rest of the query, so the
+queries made don't grow with the number of results
+
+Queries are sent as GET ?query=&variables=&operationName= or POSTed as json. Introspection (__schema, __type) and
+mutations/subscriptions aren't supported
+*/
+package gtfsgraphql
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+)
+
+type Server struct {
+	db     gtfs.Database
+	schema map[string]objectType
+	logger *slog.Logger
+
+	tripUpdates func() (realtime.TripUpdatesMap, error)
+}
+
+/*
+An optional setting for New
+*/
+type Option func(*Server)
+
+/*
+Create a GraphQL server for the database, see the package docs for the schema
+*/
+func New(db gtfs.Database, options ...Option) *Server {
+	server := &Server{
+		db:     db,
+		schema: newSchema(),
+		logger: slog.Default(),
+	}
+	for _, option := range options {
+		option(server)
+	}
+	return server
+}
+
+/*
+Attach the trip updates from the feed to the stop times, for their realtime fields (e.g realtimeDeparture)
+
+	feed, _ := rt.TripUpdates(tripUpdatesURL)
+	server := gtfsgraphql.New(db, gtfsgraphql.WithTripUpdates(feed.GetTripUpdates))
+*/
+func WithTripUpdates(tripUpdates func() (realtime.TripUpdatesMap, error)) Option {
+	return func(s *Server) {
+		s.tripUpdates = tripUpdates
+	}
+}
+
+/*
+Log with the given logger instead of slog.Default()
+*/
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+/*
+Run a query
+
+  - variables: the values of the query's variables, can be nil
+  - operationName: the operation to run, can be "" if the query only has one
+*/
+func (s *Server) Execute(query string, variables map[string]interface{}, operationName string) Response {
+	doc, err := parse(query)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	r := newRequest(s, variables)
+	data, err := r.execute(doc, operationName)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+	return Response{Data: data, Errors: r.errors}
+}
+
+type requestBody struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body requestBody
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		body.Query = query.Get("query")
+		body.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &body.Variables); err != nil {
+				writeJSON(w, http.StatusBadRequest, Response{Errors: []Error{{Message: "invalid variables"}}})
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Errors: []Error{{Message: "invalid request body"}}})
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Errors: []Error{{Message: "method not allowed"}}})
+		return
+	}
+	if body.Query == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Errors: []Error{{Message: "missing query"}}})
+		return
+	}
+
+	response := s.Execute(body.Query, body.Variables, body.OperationName)
+	for _, err := range response.Errors {
+		s.logger.Debug("graphql query failed", "error", err.Message, "path", err.Path)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
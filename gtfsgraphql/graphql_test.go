@@ -0,0 +1,178 @@
+package gtfsgraphql
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type testNode struct {
+	name     string
+	children []*testNode
+}
+
+/*
+Run a query against a schema of nodes with children, counting how many times the children are resolved
+*/
+func runTestQuery(t *testing.T, query string, variables map[string]interface{}) (string, int) {
+	t.Helper()
+
+	root := &testNode{name: "root", children: []*testNode{
+		{name: "a", children: []*testNode{{name: "a1"}, {name: "a2"}}},
+		{name: "b", children: []*testNode{{name: "b1"}}},
+	}}
+	childCalls := 0
+	schema := map[string]objectType{
+		"Query": {name: "Query", fields: map[string]field{
+			"root": rootObject("Node", func(r *request, args arguments) (*testNode, error) {
+				return root, nil
+			}),
+		}},
+		"Node": {name: "Node", fields: map[string]field{
+			"name":     scalar(func(node *testNode) interface{} { return node.name }),
+			"greeting": scalar(func(node *testNode) interface{} { return "hi " + node.name }),
+			"children": {typ: "Node", list: true, resolve: func(r *request, parents []interface{}, args arguments) ([]interface{}, error) {
+				childCalls++
+				limit, err := args.int("limit", 10)
+				if err != nil {
+					return nil, err
+				}
+				results := make([]interface{}, len(parents))
+				for i, parent := range parents {
+					children := parent.(*testNode).children
+					if int64(len(children)) > limit {
+						children = children[:limit]
+					}
+					results[i] = interfaces(children)
+				}
+				return results, nil
+			}},
+		}},
+	}
+
+	doc, err := parse(query)
+	if err != nil {
+		return "error: " + err.Error(), childCalls
+	}
+	r := &request{schema: schema, variables: variables}
+	if r.variables == nil {
+		r.variables = make(map[string]interface{})
+	}
+	data, err := r.execute(doc, "")
+	if err != nil {
+		return "error: " + err.Error(), childCalls
+	}
+	encoded, err := json.Marshal(Response{Data: data, Errors: r.errors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded), childCalls
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{
+			name:  "nested lists in order",
+			query: `{ root { name children { name children { name } } } }`,
+			want:  `{"data":{"root":{"name":"root","children":[{"name":"a","children":[{"name":"a1"},{"name":"a2"}]},{"name":"b","children":[{"name":"b1"}]}]}}}`,
+		},
+		{
+			name:  "aliases and arguments",
+			query: `{ root { first: children(limit: 1) { name } all: children { name } } }`,
+			want:  `{"data":{"root":{"first":[{"name":"a"}],"all":[{"name":"a"},{"name":"b"}]}}}`,
+		},
+		{
+			name:      "variables and defaults",
+			query:     `query Q($limit: Int = 1, $show: Boolean!) { root { children(limit: $limit) { name greeting @include(if: $show) } } }`,
+			variables: map[string]interface{}{"show": false},
+			want:      `{"data":{"root":{"children":[{"name":"a"}]}}}`,
+		},
+		{
+			name:      "variables from json",
+			query:     `query Q($limit: Int) { root { children(limit: $limit) { name } } }`,
+			variables: map[string]interface{}{"limit": float64(1)},
+			want:      `{"data":{"root":{"children":[{"name":"a"}]}}}`,
+		},
+		{
+			name:  "fragments, inline fragments and __typename",
+			query: `{ root { ...N ... on Node { greeting } ... @skip(if: true) { children { name } } } } fragment N on Node { __typename name }`,
+			want:  `{"data":{"root":{"__typename":"Node","name":"root","greeting":"hi root"}}}`,
+		},
+		{
+			name: "strings, comments and commas",
+			query: `# comment
+				{ root, { name, greeting } }`,
+			want: `{"data":{"root":{"name":"root","greeting":"hi root"}}}`,
+		},
+		{
+			name:  "field errors",
+			query: `{ root { name children(limit: "x") { name } } }`,
+			want:  `{"data":{"root":{"name":"root","children":null}},"errors":[{"message":"argument \"limit\" must be an int","path":["root","children"]}]}`,
+		},
+		{
+			name:  "unknown field",
+			query: `{ root { nope } }`,
+			want:  `error: cannot query field "nope" on type "Node"`,
+		},
+		{
+			name:  "missing subfields",
+			query: `{ root }`,
+			want:  `error: field "root" of type "Node" must have a selection of subfields`,
+		},
+		{
+			name:  "mutations",
+			query: `mutation { root { name } }`,
+			want:  `error: mutation operations aren't supported, only queries`,
+		},
+		{
+			name:  "syntax error",
+			query: `{ root { name }`,
+			want:  `error: syntax error: unexpected end of the document`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _ := runTestQuery(t, test.query, test.variables)
+			if got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+/*
+Each level of the query is resolved for all its objects at once, not for each object
+*/
+func TestExecuteBatchesLevels(t *testing.T) {
+	_, calls := runTestQuery(t, `{ root { children { children { children { name } } } } }`, nil)
+	if calls != 3 {
+		t.Errorf("children resolved %d times, want 3 (once per level)", calls)
+	}
+}
+
+func TestParseStrings(t *testing.T) {
+	doc, err := parse(`{ a(s: "tab\there é \"q\"", b: """
+		block "string"
+		  indented
+	""") { b } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arguments := doc.operations[0].selections[0].arguments
+	if got, want := arguments["s"], "tab\there é \"q\""; got != want {
+		t.Errorf("string got %q, want %q", got, want)
+	}
+	if got, want := arguments["b"], "block \"string\"\n  indented"; got != want {
+		t.Errorf("block string got %q, want %q", got, want)
+	}
+
+	if _, err := parse(`{ a(s: "unterminated) { b } }`); err == nil || !strings.Contains(err.Error(), "unterminated") {
+		t.Errorf("unterminated string got error %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package gtfsgraphql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+The state of one query, the objects it loads are cached until it's finished
+*/
+type request struct {
+	db        gtfs.Database
+	schema    map[string]objectType
+	variables map[string]interface{}
+	fragments map[string]*fragment
+	errors    []Error
+
+	stops    *cache[gtfs.Stop]
+	routes   *cache[gtfs.Route]
+	trips    *cache[gtfs.Trip]
+	agencies *cache[gtfs.Agency]
+
+	tripUpdates     func() realtime.TripUpdatesMap
+	allAgencies     func() ([]gtfs.Agency, error)
+	routesByAgency  func() (map[string][]gtfs.Route, error)
+	serviceLocation func() *time.Location
+}
+
+func newRequest(s *Server, variables map[string]interface{}) *request {
+	if variables == nil {
+		variables = make(map[string]interface{})
+	}
+	r := &request{
+		db:        s.db,
+		schema:    s.schema,
+		variables: variables,
+		stops:     newCache(s.db.GetStopsByIDs),
+		routes:    newCache(s.db.GetRoutesByIDs),
+		trips:     newCache(s.db.GetTripsByIDs),
+	}
+
+	r.tripUpdates = sync.OnceValue(func() realtime.TripUpdatesMap {
+		if s.tripUpdates == nil {
+			return nil
+		}
+		updates, err := s.tripUpdates()
+		if err != nil {
+			// The stop times are still returned, just without their realtime data
+			s.logger.Warn("getting the trip updates", "error", err)
+			return nil
+		}
+		return updates
+	})
+	r.allAgencies = sync.OnceValues(s.db.GetAgencies)
+	r.agencies = newCache(func(ids []string) (map[string]gtfs.Agency, error) {
+		agencies, err := r.allAgencies()
+		if err != nil {
+			return nil, err
+		}
+		byID := make(map[string]gtfs.Agency, len(agencies))
+		for _, agency := range agencies {
+			byID[agency.AgencyId] = agency
+		}
+		return byID, nil
+	})
+	r.routesByAgency = sync.OnceValues(func() (map[string][]gtfs.Route, error) {
+		routes, err := orNotFound(s.db.GetRoutes())
+		if err != nil {
+			return nil, err
+		}
+		byAgency := make(map[string][]gtfs.Route)
+		for _, route := range routes {
+			byAgency[route.AgencyId] = append(byAgency[route.AgencyId], route)
+			r.routes.prime(route.RouteId, route)
+		}
+		return byAgency, nil
+	})
+	r.serviceLocation = sync.OnceValue(func() *time.Location {
+		// The service days' times (e.g serviceDay) are in the feed's timezone, from its agencies
+		agencies, _ := r.allAgencies()
+		for _, agency := range agencies {
+			if location := agency.Location(); location != nil {
+				return location
+			}
+		}
+		return time.UTC
+	})
+	return r
+}
+
+/*
+Objects loaded by id, each id is only fetched once per query (even if it wasn't found)
+*/
+type cache[T any] struct {
+	values map[string]*T // nil for the ids which weren't found
+	fetch  func(ids []string) (map[string]T, error)
+}
+
+func newCache[T any](fetch func(ids []string) (map[string]T, error)) *cache[T] {
+	return &cache[T]{values: make(map[string]*T), fetch: fetch}
+}
+
+/*
+Get the objects by id, fetching the ones which haven't been loaded yet in one batch. The results are in the order of
+the ids, nil where they weren't found
+*/
+func (c *cache[T]) load(ids []string) ([]*T, error) {
+	var missing []string
+	queued := make(map[string]bool)
+	for _, id := range ids {
+		if _, found := c.values[id]; !found && id != "" && !queued[id] {
+			missing = append(missing, id)
+			queued[id] = true
+		}
+	}
+	if len(missing) > 0 {
+		fetched, err := c.fetch(missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range missing {
+			if value, found := fetched[id]; found {
+				c.values[id] = &value
+			} else {
+				c.values[id] = nil
+			}
+		}
+	}
+
+	results := make([]*T, len(ids))
+	for i, id := range ids {
+		results[i] = c.values[id]
+	}
+	return results, nil
+}
+
+/*
+Add an object loaded some other way (e.g in a list), so it isn't fetched again
+*/
+func (c *cache[T]) prime(id string, value T) {
+	if _, found := c.values[id]; !found {
+		c.values[id] = &value
+	}
+}
@@ -0,0 +1,704 @@
+package gtfsgraphql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	variables  []variableDefinition
+	selections []selection
+}
+
+type variableDefinition struct {
+	name         string
+	defaultValue interface{} // nil if it doesn't have one
+}
+
+type fragment struct {
+	typeCondition string
+	selections    []selection
+}
+
+/*
+A field, a fragment spread (...Name) or an inline fragment (... on Type { })
+*/
+type selection struct {
+	alias      string
+	name       string
+	arguments  map[string]interface{}
+	directives []directive
+	selections []selection
+
+	spread        string // The fragment's name, if it's a spread
+	inline        bool
+	typeCondition string // Of an inline fragment, "" if it applies to every type
+}
+
+type directive struct {
+	name      string
+	arguments map[string]interface{}
+}
+
+/*
+The response key of a field, its alias if it has one
+*/
+func (s selection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+/*
+Values in a document are parsed to these (as well as nil, bool, int64, float64, string, []interface{} and
+map[string]interface{}), and replaced with the variables' values when the operation is executed
+*/
+type (
+	variable  string
+	enumValue string
+)
+
+/*
+Parse a graphql document (executable definitions only, type system definitions aren't supported)
+*/
+func parse(source string) (*document, error) {
+	p := &parser{lexer: lexer{source: source}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &document{fragments: make(map[string]*fragment)}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunctuator, "{"):
+			selections, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: selections})
+		case p.peek(tokenName, "query"), p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			op, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(tokenName, "fragment"):
+			name, frag, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, found := doc.fragments[name]; found {
+				return nil, fmt.Errorf("there can only be one fragment named %q", name)
+			}
+			doc.fragments[name] = frag
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("the document has no operations")
+	}
+	return doc, nil
+}
+
+type parser struct {
+	lexer lexer
+	token token
+}
+
+func (p *parser) next() error {
+	token, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.token = token
+	return nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+func (p *parser) unexpected() error {
+	if p.token.kind == tokenEOF {
+		return errors.New("syntax error: unexpected end of the document")
+	}
+	return fmt.Errorf("syntax error: unexpected %q at %d", p.token.value, p.token.position)
+}
+
+/*
+Skip the punctuator if it's next, reporting if it was
+*/
+func (p *parser) skip(punctuator string) (bool, error) {
+	if !p.peek(tokenPunctuator, punctuator) {
+		return false, nil
+	}
+	return true, p.next()
+}
+
+func (p *parser) expect(punctuator string) error {
+	if !p.peek(tokenPunctuator, punctuator) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) expectName() (string, error) {
+	if p.token.kind != tokenName {
+		return "", p.unexpected()
+	}
+	name := p.token.value
+	return name, p.next()
+}
+
+func (p *parser) parseOperation() (*operation, error) {
+	op := &operation{kind: p.token.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.token.kind == tokenName {
+		op.name = p.token.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if found, err := p.skip("("); err != nil {
+		return nil, err
+	} else if found {
+		for !p.peek(tokenPunctuator, ")") {
+			definition, err := p.parseVariableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, definition)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *parser) parseVariableDefinition() (variableDefinition, error) {
+	if err := p.expect("$"); err != nil {
+		return variableDefinition{}, err
+	}
+	name, err := p.expectName()
+	if err != nil {
+		return variableDefinition{}, err
+	}
+	if err := p.expect(":"); err != nil {
+		return variableDefinition{}, err
+	}
+	// The type isn't checked, the values are coerced when the arguments are read
+	if err := p.skipType(); err != nil {
+		return variableDefinition{}, err
+	}
+
+	definition := variableDefinition{name: name}
+	if found, err := p.skip("="); err != nil {
+		return variableDefinition{}, err
+	} else if found {
+		if definition.defaultValue, err = p.parseValue(true); err != nil {
+			return variableDefinition{}, err
+		}
+	}
+	if _, err := p.parseDirectives(); err != nil {
+		return variableDefinition{}, err
+	}
+	return definition, nil
+}
+
+func (p *parser) skipType() error {
+	if found, err := p.skip("["); err != nil {
+		return err
+	} else if found {
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return err
+	}
+	_, err := p.skip("!")
+	return err
+}
+
+func (p *parser) parseFragment() (string, *fragment, error) {
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.expectName()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" {
+		return "", nil, errors.New("syntax error: a fragment can't be named \"on\"")
+	}
+	if !p.peek(tokenName, "on") {
+		return "", nil, p.unexpected()
+	}
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	typeCondition, err := p.expectName()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := p.parseDirectives(); err != nil {
+		return "", nil, err
+	}
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return "", nil, err
+	}
+	return name, &fragment{typeCondition: typeCondition, selections: selections}, nil
+}
+
+func (p *parser) parseSelectionSet() ([]selection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []selection
+	for !p.peek(tokenPunctuator, "}") {
+		s, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, errors.New("syntax error: empty selection set")
+	}
+	return selections, p.next()
+}
+
+func (p *parser) parseSelection() (selection, error) {
+	if found, err := p.skip("..."); err != nil {
+		return selection{}, err
+	} else if found {
+		return p.parseFragmentSelection()
+	}
+
+	var s selection
+	name, err := p.expectName()
+	if err != nil {
+		return selection{}, err
+	}
+	if found, err := p.skip(":"); err != nil {
+		return selection{}, err
+	} else if found {
+		s.alias = name
+		if name, err = p.expectName(); err != nil {
+			return selection{}, err
+		}
+	}
+	s.name = name
+
+	if s.arguments, err = p.parseArguments(); err != nil {
+		return selection{}, err
+	}
+	if s.directives, err = p.parseDirectives(); err != nil {
+		return selection{}, err
+	}
+	if p.peek(tokenPunctuator, "{") {
+		if s.selections, err = p.parseSelectionSet(); err != nil {
+			return selection{}, err
+		}
+	}
+	return s, nil
+}
+
+/*
+Parse a fragment spread or inline fragment, after the "..."
+*/
+func (p *parser) parseFragmentSelection() (selection, error) {
+	var s selection
+	var err error
+	if p.token.kind == tokenName && p.token.value != "on" {
+		s.spread = p.token.value
+		if err := p.next(); err != nil {
+			return selection{}, err
+		}
+		s.directives, err = p.parseDirectives()
+		return s, err
+	}
+
+	s.inline = true
+	if p.peek(tokenName, "on") {
+		if err := p.next(); err != nil {
+			return selection{}, err
+		}
+		if s.typeCondition, err = p.expectName(); err != nil {
+			return selection{}, err
+		}
+	}
+	if s.directives, err = p.parseDirectives(); err != nil {
+		return selection{}, err
+	}
+	s.selections, err = p.parseSelectionSet()
+	return s, err
+}
+
+func (p *parser) parseArguments() (map[string]interface{}, error) {
+	if found, err := p.skip("("); err != nil || !found {
+		return nil, err
+	}
+	arguments := make(map[string]interface{})
+	for !p.peek(tokenPunctuator, ")") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if arguments[name], err = p.parseValue(false); err != nil {
+			return nil, err
+		}
+	}
+	return arguments, p.next()
+}
+
+func (p *parser) parseDirectives() ([]directive, error) {
+	var directives []directive
+	for p.peek(tokenPunctuator, "@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		arguments, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, directive{name: name, arguments: arguments})
+	}
+	return directives, nil
+}
+
+/*
+Parse a value, constant values (e.g variable defaults) can't have variables in them
+*/
+func (p *parser) parseValue(constant bool) (interface{}, error) {
+	token := p.token
+	switch token.kind {
+	case tokenPunctuator:
+		switch token.value {
+		case "$":
+			if constant {
+				return nil, p.unexpected()
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			name, err := p.expectName()
+			return variable(name), err
+		case "[":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			list := []interface{}{}
+			for !p.peek(tokenPunctuator, "]") {
+				item, err := p.parseValue(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, p.next()
+		case "{":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			object := make(map[string]interface{})
+			for !p.peek(tokenPunctuator, "}") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if object[name], err = p.parseValue(constant); err != nil {
+					return nil, err
+				}
+			}
+			return object, p.next()
+		}
+	case tokenInt:
+		value, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %s", token.value)
+		}
+		return value, p.next()
+	case tokenFloat:
+		value, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %s", token.value)
+		}
+		return value, p.next()
+	case tokenString:
+		return token.value, p.next()
+	case tokenName:
+		var value interface{}
+		switch token.value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			value = enumValue(token.value)
+		}
+		return value, p.next()
+	}
+	return nil, p.unexpected()
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind     tokenKind
+	value    string // The string's value (unescaped) for strings
+	position int
+}
+
+type lexer struct {
+	source   string
+	position int
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipIgnored()
+	start := l.position
+	if start >= len(l.source) {
+		return token{kind: tokenEOF, position: start}, nil
+	}
+
+	c := l.source[start]
+	switch {
+	case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+		l.position++
+		return token{kind: tokenPunctuator, value: string(c), position: start}, nil
+	case c == '.':
+		if !strings.HasPrefix(l.source[start:], "...") {
+			return token{}, fmt.Errorf("syntax error: unexpected \".\" at %d", start)
+		}
+		l.position += 3
+		return token{kind: tokenPunctuator, value: "...", position: start}, nil
+	case c == '_' || isLetter(c):
+		for l.position < len(l.source) && (l.source[l.position] == '_' || isLetter(l.source[l.position]) || isDigit(l.source[l.position])) {
+			l.position++
+		}
+		return token{kind: tokenName, value: l.source[start:l.position], position: start}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		if strings.HasPrefix(l.source[start:], `"""`) {
+			return l.blockString()
+		}
+		return l.string()
+	}
+	return token{}, fmt.Errorf("syntax error: unexpected %q at %d", c, start)
+}
+
+/*
+Skip whitespace, commas and comments
+*/
+func (l *lexer) skipIgnored() {
+	for l.position < len(l.source) {
+		switch l.source[l.position] {
+		case ' ', '\t', '\n', '\r', ',':
+			l.position++
+		case '#':
+			for l.position < len(l.source) && l.source[l.position] != '\n' && l.source[l.position] != '\r' {
+				l.position++
+			}
+		default:
+			if strings.HasPrefix(l.source[l.position:], "\ufeff") {
+				l.position += len("\ufeff")
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.position
+	kind := tokenInt
+	if l.source[l.position] == '-' {
+		l.position++
+	}
+	if !l.digits() {
+		return token{}, fmt.Errorf("syntax error: invalid number at %d", start)
+	}
+	if l.position < len(l.source) && l.source[l.position] == '.' {
+		kind = tokenFloat
+		l.position++
+		if !l.digits() {
+			return token{}, fmt.Errorf("syntax error: invalid number at %d", start)
+		}
+	}
+	if l.position < len(l.source) && (l.source[l.position] == 'e' || l.source[l.position] == 'E') {
+		kind = tokenFloat
+		l.position++
+		if l.position < len(l.source) && (l.source[l.position] == '+' || l.source[l.position] == '-') {
+			l.position++
+		}
+		if !l.digits() {
+			return token{}, fmt.Errorf("syntax error: invalid number at %d", start)
+		}
+	}
+	return token{kind: kind, value: l.source[start:l.position], position: start}, nil
+}
+
+func (l *lexer) digits() bool {
+	start := l.position
+	for l.position < len(l.source) && isDigit(l.source[l.position]) {
+		l.position++
+	}
+	return l.position > start
+}
+
+func (l *lexer) string() (token, error) {
+	start := l.position
+	l.position++ // The opening quote
+	var value strings.Builder
+	for l.position < len(l.source) {
+		c := l.source[l.position]
+		switch c {
+		case '"':
+			l.position++
+			return token{kind: tokenString, value: value.String(), position: start}, nil
+		case '\n', '\r':
+			return token{}, fmt.Errorf("syntax error: unterminated string at %d", start)
+		case '\\':
+			if l.position+1 >= len(l.source) {
+				return token{}, fmt.Errorf("syntax error: unterminated string at %d", start)
+			}
+			escaped := l.source[l.position+1]
+			l.position += 2
+			switch escaped {
+			case '"', '\\', '/':
+				value.WriteByte(escaped)
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case 'u':
+				if l.position+4 > len(l.source) {
+					return token{}, fmt.Errorf("syntax error: invalid unicode escape at %d", l.position)
+				}
+				code, err := strconv.ParseUint(l.source[l.position:l.position+4], 16, 32)
+				if err != nil {
+					return token{}, fmt.Errorf("syntax error: invalid unicode escape at %d", l.position)
+				}
+				value.WriteRune(rune(code))
+				l.position += 4
+			default:
+				return token{}, fmt.Errorf("syntax error: invalid escape \\%c at %d", escaped, l.position-2)
+			}
+		default:
+			value.WriteByte(c)
+			l.position++
+		}
+	}
+	return token{}, fmt.Errorf("syntax error: unterminated string at %d", start)
+}
+
+/*
+Lex a """block string""", removing the common indentation and the blank first and last lines
+*/
+func (l *lexer) blockString() (token, error) {
+	start := l.position
+	l.position += 3
+	end := l.position
+	for ; !strings.HasPrefix(l.source[end:], `"""`); end++ {
+		if end >= len(l.source) {
+			return token{}, fmt.Errorf("syntax error: unterminated string at %d", start)
+		}
+		if strings.HasPrefix(l.source[end:], `\"""`) {
+			end += 3
+		}
+	}
+	raw := strings.ReplaceAll(l.source[l.position:end], `\"""`, `"""`)
+	l.position = end + 3
+
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return token{kind: tokenString, value: strings.Join(lines, "\n"), position: start}, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
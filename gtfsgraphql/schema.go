@@ -0,0 +1,716 @@
+package gtfsgraphql
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+OTP's TransitMode of each basic route_type (see gtfs.BasicRouteType)
+*/
+var routeModes = map[int]string{
+	0:  "TRAM",
+	1:  "SUBWAY",
+	2:  "RAIL",
+	3:  "BUS",
+	4:  "FERRY",
+	5:  "CABLE_CAR",
+	6:  "GONDOLA",
+	7:  "FUNICULAR",
+	11: "TROLLEYBUS",
+	12: "MONORAIL",
+}
+
+/*
+OTP's TransitMode of each of the stop's modes (see gtfs.Stop.StopType)
+*/
+var stopModes = map[string]string{
+	"train":      "RAIL",
+	"metro":      "SUBWAY",
+	"tram":       "TRAM",
+	"ferry":      "FERRY",
+	"gondola":    "GONDOLA",
+	"trolleybus": "TROLLEYBUS",
+	"bus":        "BUS",
+}
+
+/*
+A stop time of a trip on a service day, from the departures or the trip's progress
+*/
+type stoptime struct {
+	stopID       string
+	tripID       string
+	headsign     string
+	stopPosition int
+	day          gtfs.ServiceDay
+
+	scheduledArrival   int // Seconds since the start of the service day
+	scheduledDeparture int
+	arrivalDelay       int // Seconds, negative when early
+	departureDelay     int
+	realtime           bool
+	realtimeState      string // SCHEDULED, UPDATED, CANCELED or ADDED
+}
+
+func newSchema() map[string]objectType {
+	types := []objectType{
+		{name: "Query", fields: map[string]field{
+			"stop": rootObject("Stop", func(r *request, args arguments) (*gtfs.Stop, error) {
+				return loadOne(r.stops, args)
+			}),
+			"stops": rootList("Stop", func(r *request, args arguments) ([]*gtfs.Stop, error) {
+				return findStops(r, args, false)
+			}),
+			"station": rootObject("Stop", func(r *request, args arguments) (*gtfs.Stop, error) {
+				stop, err := loadOne(r.stops, args)
+				if err != nil || stop == nil || stop.LocationType != 1 {
+					return nil, err
+				}
+				return stop, nil
+			}),
+			"stations": rootList("Stop", func(r *request, args arguments) ([]*gtfs.Stop, error) {
+				return findStops(r, args, true)
+			}),
+			"route": rootObject("Route", func(r *request, args arguments) (*gtfs.Route, error) {
+				return loadOne(r.routes, args)
+			}),
+			"routes": rootList("Route", findRoutes),
+			"trip": rootObject("Trip", func(r *request, args arguments) (*gtfs.Trip, error) {
+				return loadOne(r.trips, args)
+			}),
+			"trips": rootList("Trip", findTrips),
+			"agency": rootObject("Agency", func(r *request, args arguments) (*gtfs.Agency, error) {
+				return loadOne(r.agencies, args)
+			}),
+			"agencies": rootList("Agency", func(r *request, args arguments) ([]*gtfs.Agency, error) {
+				agencies, err := r.allAgencies()
+				return pointers(agencies), err
+			}),
+		}},
+
+		{name: "Stop", fields: map[string]field{
+			"gtfsId":       scalar(func(stop *gtfs.Stop) interface{} { return stop.StopId }),
+			"name":         scalar(func(stop *gtfs.Stop) interface{} { return stop.StopName }),
+			"code":         scalar(func(stop *gtfs.Stop) interface{} { return orNull(stop.StopCode) }),
+			"lat":          scalar(func(stop *gtfs.Stop) interface{} { return stop.StopLat }),
+			"lon":          scalar(func(stop *gtfs.Stop) interface{} { return stop.StopLon }),
+			"zoneId":       scalar(func(stop *gtfs.Stop) interface{} { return orNull(stop.ZoneID) }),
+			"platformCode": scalar(func(stop *gtfs.Stop) interface{} { return orNull(stop.PlatformNumber) }),
+			"locationType": scalar(func(stop *gtfs.Stop) interface{} {
+				switch stop.LocationType {
+				case 1:
+					return "STATION"
+				case 2:
+					return "ENTRANCE"
+				}
+				return "STOP"
+			}),
+			"wheelchairBoarding": scalar(func(stop *gtfs.Stop) interface{} {
+				return accessibility(stop.WheelChairBoarding, "POSSIBLE", "NOT_POSSIBLE")
+			}),
+			"vehicleMode": scalar(func(stop *gtfs.Stop) interface{} { return orNull(stopModes[stop.StopType]) }),
+			"parentStation": reference("Stop", func(r *request) *cache[gtfs.Stop] { return r.stops }, func(stop *gtfs.Stop) string {
+				return stop.ParentStation
+			}),
+			"stops": each("Stop", func(r *request, stop *gtfs.Stop, args arguments) ([]*gtfs.Stop, error) {
+				if stop.LocationType != 1 {
+					return nil, nil
+				}
+				children, err := orNotFound(r.db.GetChildStopsByParentStopID(stop.StopId))
+				if err != nil {
+					return nil, err
+				}
+				return primeStops(r, children), nil
+			}),
+			"routes":                   each("Route", stopRoutes),
+			"stoptimesWithoutPatterns": each("Stoptime", stoptimesWithoutPatterns),
+		}},
+
+		{name: "Route", fields: map[string]field{
+			"gtfsId":    scalar(func(route *gtfs.Route) interface{} { return route.RouteId }),
+			"shortName": scalar(func(route *gtfs.Route) interface{} { return orNull(route.RouteShortName) }),
+			"longName":  scalar(func(route *gtfs.Route) interface{} { return orNull(route.RouteLongName) }),
+			"type":      scalar(func(route *gtfs.Route) interface{} { return route.RouteType }),
+			"mode": scalar(func(route *gtfs.Route) interface{} {
+				return orNull(routeModes[gtfs.BasicRouteType(route.RouteType)])
+			}),
+			"color":     scalar(func(route *gtfs.Route) interface{} { return orNull(route.RouteColor) }),
+			"textColor": scalar(func(route *gtfs.Route) interface{} { return orNull(route.RouteTextColor) }),
+			"agency": reference("Agency", func(r *request) *cache[gtfs.Agency] { return r.agencies }, func(route *gtfs.Route) string {
+				return route.AgencyId
+			}),
+			"stops": each("Stop", func(r *request, route *gtfs.Route, args arguments) ([]*gtfs.Stop, error) {
+				stops, err := orNotFound(r.db.GetStopsByRouteId(route.RouteId))
+				if err != nil {
+					return nil, err
+				}
+				return primeStops(r, stops), nil
+			}),
+			"trips": each("Trip", func(r *request, route *gtfs.Route, args arguments) ([]*gtfs.Trip, error) {
+				results, err := orNotFound(r.db.FindTrips(gtfs.TripFilter{RouteID: route.RouteId}))
+				if err != nil {
+					return nil, err
+				}
+				return primeTrips(r, results), nil
+			}),
+		}},
+
+		{name: "Trip", fields: map[string]field{
+			"gtfsId":       scalar(func(trip *gtfs.Trip) interface{} { return trip.TripID }),
+			"tripHeadsign": scalar(func(trip *gtfs.Trip) interface{} { return orNull(trip.TripHeadsign) }),
+			"directionId":  scalar(func(trip *gtfs.Trip) interface{} { return strconv.Itoa(trip.DirectionID) }),
+			"serviceId":    scalar(func(trip *gtfs.Trip) interface{} { return trip.ServiceID }),
+			"shapeId":      scalar(func(trip *gtfs.Trip) interface{} { return orNull(trip.ShapeID) }),
+			"wheelchairAccessible": scalar(func(trip *gtfs.Trip) interface{} {
+				return accessibility(trip.WheelchairAccessible, "POSSIBLE", "NOT_POSSIBLE")
+			}),
+			"bikesAllowed": scalar(func(trip *gtfs.Trip) interface{} {
+				return accessibility(trip.BikesAllowed, "ALLOWED", "NOT_ALLOWED")
+			}),
+			"route": reference("Route", func(r *request) *cache[gtfs.Route] { return r.routes }, func(trip *gtfs.Trip) string {
+				return trip.RouteID
+			}),
+			"stops": each("Stop", func(r *request, trip *gtfs.Trip, args arguments) ([]*gtfs.Stop, error) {
+				stops, err := orNotFound(r.db.GetStopsForTripID(trip.TripID))
+				if err != nil {
+					return nil, err
+				}
+				return primeStops(r, stops), nil
+			}),
+			"stoptimes": each("Stoptime", tripStoptimes),
+		}},
+
+		{name: "Stoptime", fields: map[string]field{
+			"scheduledArrival":   scalar(func(st *stoptime) interface{} { return st.scheduledArrival }),
+			"scheduledDeparture": scalar(func(st *stoptime) interface{} { return st.scheduledDeparture }),
+			"realtimeArrival":    scalar(func(st *stoptime) interface{} { return st.scheduledArrival + st.arrivalDelay }),
+			"realtimeDeparture":  scalar(func(st *stoptime) interface{} { return st.scheduledDeparture + st.departureDelay }),
+			"arrivalDelay":       scalar(func(st *stoptime) interface{} { return st.arrivalDelay }),
+			"departureDelay":     scalar(func(st *stoptime) interface{} { return st.departureDelay }),
+			"realtime":           scalar(func(st *stoptime) interface{} { return st.realtime }),
+			"realtimeState":      scalar(func(st *stoptime) interface{} { return st.realtimeState }),
+			"serviceDay":         scalar(func(st *stoptime) interface{} { return st.day.Start().Unix() }),
+			"headsign":           scalar(func(st *stoptime) interface{} { return orNull(st.headsign) }),
+			"stopPosition":       scalar(func(st *stoptime) interface{} { return st.stopPosition }),
+			"stop": reference("Stop", func(r *request) *cache[gtfs.Stop] { return r.stops }, func(st *stoptime) string {
+				return st.stopID
+			}),
+			"trip": reference("Trip", func(r *request) *cache[gtfs.Trip] { return r.trips }, func(st *stoptime) string {
+				return st.tripID
+			}),
+		}},
+
+		{name: "Agency", fields: map[string]field{
+			"gtfsId":   scalar(func(agency *gtfs.Agency) interface{} { return agency.AgencyId }),
+			"name":     scalar(func(agency *gtfs.Agency) interface{} { return agency.AgencyName }),
+			"url":      scalar(func(agency *gtfs.Agency) interface{} { return agency.AgencyUrl }),
+			"timezone": scalar(func(agency *gtfs.Agency) interface{} { return agency.AgencyTimezone }),
+			"lang":     scalar(func(agency *gtfs.Agency) interface{} { return orNull(agency.AgencyLang) }),
+			"phone":    scalar(func(agency *gtfs.Agency) interface{} { return orNull(agency.AgencyPhone) }),
+			"fareUrl":  scalar(func(agency *gtfs.Agency) interface{} { return orNull(agency.AgencyFareUrl) }),
+			"routes": each("Route", func(r *request, agency *gtfs.Agency, args arguments) ([]*gtfs.Route, error) {
+				byAgency, err := r.routesByAgency()
+				if err != nil {
+					return nil, err
+				}
+				return pointers(byAgency[agency.AgencyId]), nil
+			}),
+		}},
+	}
+
+	schema := make(map[string]objectType, len(types))
+	for _, typ := range types {
+		schema[typ.name] = typ
+	}
+	return schema
+}
+
+/*
+The stops (or stations) by ids, name or all of them
+*/
+func findStops(r *request, args arguments, stations bool) ([]*gtfs.Stop, error) {
+	ids, err := args.strings("ids")
+	if err != nil {
+		return nil, err
+	}
+	name, err := args.string("name")
+	if err != nil {
+		return nil, err
+	}
+
+	var stops []*gtfs.Stop
+	switch {
+	case args.has("ids"):
+		if stops, err = r.stops.load(ids); err != nil {
+			return nil, err
+		}
+	case name != "":
+		results, err := orNotFound(r.db.SearchForStopsByName(name, true))
+		if err != nil {
+			return nil, err
+		}
+		found := make([]gtfs.Stop, len(results))
+		for i, result := range results {
+			found[i] = result.Stop
+		}
+		stops = primeStops(r, found)
+	default:
+		all, err := orNotFound(r.db.GetStops(true))
+		if err != nil {
+			return nil, err
+		}
+		stops = primeStops(r, all)
+	}
+
+	filtered := stops[:0]
+	for _, stop := range stops {
+		if stop != nil && (stop.LocationType == 1) == stations {
+			filtered = append(filtered, stop)
+		}
+	}
+	return filtered, nil
+}
+
+/*
+The routes by ids, or with the name in their short or long name (case-insensitive), or all of them
+*/
+func findRoutes(r *request, args arguments) ([]*gtfs.Route, error) {
+	ids, err := args.strings("ids")
+	if err != nil {
+		return nil, err
+	}
+	name, err := args.string("name")
+	if err != nil {
+		return nil, err
+	}
+	if args.has("ids") {
+		routes, err := r.routes.load(ids)
+		return withoutNil(routes), err
+	}
+
+	all, err := orNotFound(r.db.GetRoutes())
+	if err != nil {
+		return nil, err
+	}
+	routes := primeRoutes(r, all)
+	if name == "" {
+		return routes, nil
+	}
+	name = strings.ToLower(name)
+	filtered := routes[:0]
+	for _, route := range routes {
+		if strings.Contains(strings.ToLower(route.RouteShortName), name) || strings.Contains(strings.ToLower(route.RouteLongName), name) {
+			filtered = append(filtered, route)
+		}
+	}
+	return filtered, nil
+}
+
+/*
+The trips by ids, or all of them
+*/
+func findTrips(r *request, args arguments) ([]*gtfs.Trip, error) {
+	ids, err := args.strings("ids")
+	if err != nil {
+		return nil, err
+	}
+	if args.has("ids") {
+		trips, err := r.trips.load(ids)
+		return withoutNil(trips), err
+	}
+
+	results, err := orNotFound(r.db.FindTrips(gtfs.TripFilter{}))
+	if err != nil {
+		return nil, err
+	}
+	return primeTrips(r, results), nil
+}
+
+/*
+The routes stopping at a stop, or at any of a station's stops
+*/
+func stopRoutes(r *request, stop *gtfs.Stop, args arguments) ([]*gtfs.Route, error) {
+	stopIDs := []string{stop.StopId}
+	if stop.LocationType == 1 {
+		children, err := orNotFound(r.db.GetChildStopsByParentStopID(stop.StopId))
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			stopIDs = append(stopIDs, child.StopId)
+		}
+	}
+
+	var routes []gtfs.Route
+	seen := make(map[string]bool)
+	for _, stopID := range stopIDs {
+		found, err := orNotFound(r.db.GetRoutesByStopId(stopID))
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range found {
+			if !seen[route.RouteId] {
+				seen[route.RouteId] = true
+				routes = append(routes, route)
+			}
+		}
+	}
+	return primeRoutes(r, routes), nil
+}
+
+/*
+The next departures from a stop (or each of a station's stops)
+
+  - startTime: unix time to get the departures from, defaults to now
+  - timeRange: seconds after startTime to get the departures for, defaults to a day
+  - numberOfDepartures: defaults to 5
+*/
+func stoptimesWithoutPatterns(r *request, stop *gtfs.Stop, args arguments) ([]*stoptime, error) {
+	startTime, err := args.int("startTime", 0)
+	if err != nil {
+		return nil, err
+	}
+	timeRange, err := args.int("timeRange", 24*60*60)
+	if err != nil {
+		return nil, err
+	}
+	count, err := args.int("numberOfDepartures", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if startTime > 0 {
+		start = time.Unix(startTime, 0)
+	}
+	day := gtfs.ServiceDayOf(start, r.serviceLocation())
+	departures, err := orNotFound(r.db.GetActiveTripsWithOptions(gtfs.ActiveTripsOptions{
+		StopID:      stop.StopId,
+		ByStation:   stop.LocationType == 1,
+		Date:        day.String(),
+		From:        day.FormatTime(start),
+		To:          day.FormatTime(start.Add(time.Duration(timeRange) * time.Second)),
+		Limit:       int(count),
+		TripUpdates: r.tripUpdates(),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	stoptimes := make([]*stoptime, 0, len(departures))
+	for _, departure := range departures {
+		if departure.TripData.TripID != "" {
+			r.trips.prime(departure.TripData.TripID, departure.TripData)
+		}
+		if departure.StopData.StopId != "" {
+			r.stops.prime(departure.StopData.StopId, departure.StopData)
+		}
+
+		departureDay := day
+		if departure.Instance.ServiceDate != "" {
+			if departureDay, err = gtfs.ParseServiceDay(departure.Instance.ServiceDate, day.Location()); err != nil {
+				return nil, err
+			}
+		}
+		st, err := departureStoptime(departure, departureDay)
+		if err != nil {
+			return nil, err
+		}
+		stoptimes = append(stoptimes, st)
+	}
+	return stoptimes, nil
+}
+
+func departureStoptime(departure gtfs.StopTimes, day gtfs.ServiceDay) (*stoptime, error) {
+	arrival, err := day.ParseTime(departure.ArrivalTime)
+	if err != nil {
+		return nil, err
+	}
+	departs, err := day.ParseTime(departure.DepartureTime)
+	if err != nil {
+		return nil, err
+	}
+
+	headsign := departure.StopHeadsign
+	if headsign == "" {
+		headsign = departure.TripData.TripHeadsign
+	}
+	st := &stoptime{
+		stopID:             departure.StopId,
+		tripID:             departure.TripID,
+		headsign:           headsign,
+		stopPosition:       departure.StopSequence,
+		day:                day,
+		scheduledArrival:   day.Seconds(arrival),
+		scheduledDeparture: day.Seconds(departs),
+		realtimeState:      "SCHEDULED",
+	}
+	if departure.RealtimeOnly {
+		st.realtimeState = "ADDED"
+	}
+
+	// The realtime delay is carried on to the stop (the update may be for an earlier stop)
+	if update := departure.Realtime; update != nil {
+		st.realtime = true
+		delay := update.Delay
+		if update.StopTimeUpdate.Departure.Delay != 0 {
+			delay = update.StopTimeUpdate.Departure.Delay
+		} else if update.StopTimeUpdate.Arrival.Delay != 0 {
+			delay = update.StopTimeUpdate.Arrival.Delay
+		}
+		st.arrivalDelay = int(delay)
+		st.departureDelay = int(delay)
+		st.realtimeState = realtimeState(update, departure.RealtimeOnly)
+	}
+	return st, nil
+}
+
+func realtimeState(update *realtime.TripUpdate, added bool) string {
+	switch {
+	case update.Trip.ScheduleRelationship == 3:
+		return "CANCELED"
+	case update.Trip.ScheduleRelationship == 1 || added:
+		return "ADDED"
+	}
+	return "UPDATED"
+}
+
+/*
+The stop times of the trip's current (or next) run, predicted from the trip updates
+*/
+func tripStoptimes(r *request, trip *gtfs.Trip, args arguments) ([]*stoptime, error) {
+	updates := r.tripUpdates()
+	progress, err := r.db.GetTripProgress(trip.TripID, gtfs.TripRealtime{TripUpdates: updates})
+	if err != nil {
+		return nil, err
+	}
+	day, err := gtfs.ParseServiceDay(progress.ServiceDate, r.serviceLocation())
+	if err != nil {
+		return nil, err
+	}
+
+	state := "SCHEDULED"
+	if update, found := updates[trip.TripID]; found {
+		state = realtimeState(&update, false)
+	}
+
+	stops := progress.PassedStops
+	if progress.CurrentStop != nil {
+		stops = append(stops, *progress.CurrentStop)
+	}
+	if progress.NextStop != nil {
+		stops = append(stops, *progress.NextStop)
+	}
+	stops = append(stops, progress.UpcomingStops...)
+
+	stoptimes := make([]*stoptime, len(stops))
+	for i, stop := range stops {
+		r.stops.prime(stop.Stop.StopId, stop.Stop)
+
+		arrival, err := day.ParseTime(stop.ArrivalTime)
+		if err != nil {
+			return nil, err
+		}
+		departure, err := day.ParseTime(stop.DepartureTime)
+		if err != nil {
+			return nil, err
+		}
+		st := &stoptime{
+			stopID:             stop.Stop.StopId,
+			tripID:             trip.TripID,
+			headsign:           trip.TripHeadsign,
+			stopPosition:       stop.StopSequence,
+			day:                day,
+			scheduledArrival:   day.Seconds(arrival),
+			scheduledDeparture: day.Seconds(departure),
+			realtime:           progress.Realtime,
+			realtimeState:      "SCHEDULED",
+		}
+		if progress.Realtime {
+			st.realtimeState = state
+		}
+		if stop.PredictedArrival != nil {
+			st.arrivalDelay = day.Seconds(*stop.PredictedArrival) - st.scheduledArrival
+		}
+		if stop.PredictedDeparture != nil {
+			st.departureDelay = day.Seconds(*stop.PredictedDeparture) - st.scheduledDeparture
+		}
+		stoptimes[i] = st
+	}
+	return stoptimes, nil
+}
+
+/*
+The database's list queries fail with "no ... found" when there's nothing to return, which is an empty list here
+*/
+func orNotFound[T any](values []T, err error) ([]T, error) {
+	if err != nil && strings.HasPrefix(err.Error(), "no ") && strings.Contains(err.Error(), " found") {
+		return nil, nil
+	}
+	return values, err
+}
+
+/*
+A scalar field read from each parent
+*/
+func scalar[T any](get func(parent T) interface{}) field {
+	return field{resolve: func(r *request, parents []interface{}, args arguments) ([]interface{}, error) {
+		results := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			results[i] = get(parent.(T))
+		}
+		return results, nil
+	}}
+}
+
+/*
+A field referencing an object by its id, the objects for every parent are loaded in one batch
+*/
+func reference[T, R any](typ string, loader func(r *request) *cache[R], id func(parent T) string) field {
+	return field{typ: typ, resolve: func(r *request, parents []interface{}, args arguments) ([]interface{}, error) {
+		ids := make([]string, len(parents))
+		for i, parent := range parents {
+			ids[i] = id(parent.(T))
+		}
+		loaded, err := loader(r).load(ids)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]interface{}, len(parents))
+		for i, value := range loaded {
+			if value != nil {
+				results[i] = value
+			}
+		}
+		return results, nil
+	}}
+}
+
+/*
+A list field got for each parent on its own, for the queries which can't be batched
+*/
+func each[T, R any](typ string, get func(r *request, parent T, args arguments) ([]R, error)) field {
+	return field{typ: typ, list: true, resolve: func(r *request, parents []interface{}, args arguments) ([]interface{}, error) {
+		results := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			values, err := get(r, parent.(T), args)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = interfaces(values)
+		}
+		return results, nil
+	}}
+}
+
+func rootObject[R any](typ string, get func(r *request, args arguments) (*R, error)) field {
+	return field{typ: typ, resolve: func(r *request, parents []interface{}, args arguments) ([]interface{}, error) {
+		value, err := get(r, args)
+		if err != nil || value == nil {
+			return []interface{}{nil}, err
+		}
+		return []interface{}{value}, nil
+	}}
+}
+
+func rootList[R any](typ string, get func(r *request, args arguments) ([]R, error)) field {
+	return field{typ: typ, list: true, resolve: func(r *request, parents []interface{}, args arguments) ([]interface{}, error) {
+		values, err := get(r, args)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{interfaces(values)}, nil
+	}}
+}
+
+/*
+Load the object with the id argument, nil if it isn't found
+*/
+func loadOne[T any](c *cache[T], args arguments) (*T, error) {
+	id, err := args.string("id")
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, errors.New("missing id")
+	}
+	loaded, err := c.load([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	return loaded[0], nil
+}
+
+func primeStops(r *request, stops []gtfs.Stop) []*gtfs.Stop {
+	for _, stop := range stops {
+		r.stops.prime(stop.StopId, stop)
+	}
+	return pointers(stops)
+}
+
+func primeRoutes(r *request, routes []gtfs.Route) []*gtfs.Route {
+	for _, route := range routes {
+		r.routes.prime(route.RouteId, route)
+	}
+	return pointers(routes)
+}
+
+func primeTrips(r *request, results []gtfs.TripSearchResult) []*gtfs.Trip {
+	trips := make([]*gtfs.Trip, len(results))
+	for i, result := range results {
+		r.trips.prime(result.TripID, result.Trip)
+		trips[i] = &results[i].Trip
+	}
+	return trips
+}
+
+func pointers[T any](values []T) []*T {
+	results := make([]*T, len(values))
+	for i := range values {
+		results[i] = &values[i]
+	}
+	return results
+}
+
+func interfaces[T any](values []T) []interface{} {
+	results := make([]interface{}, len(values))
+	for i, value := range values {
+		results[i] = value
+	}
+	return results
+}
+
+func withoutNil[T any](values []*T) []*T {
+	results := values[:0]
+	for _, value := range values {
+		if value != nil {
+			results = append(results, value)
+		}
+	}
+	return results
+}
+
+/*
+OTP's enum for the gtfs accessibility fields (0 no information, 1 yes, 2 no)
+*/
+func accessibility(value int, yes, no string) string {
+	switch value {
+	case 1:
+		return yes
+	case 2:
+		return no
+	}
+	return "NO_INFORMATION"
+}
+
+func orNull(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
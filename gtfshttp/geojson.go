@@ -0,0 +1,46 @@
+package gtfshttp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+)
+
+type FeatureCollection = gtfs.FeatureCollection
+type Feature = gtfs.Feature
+type Geometry = gtfs.Geometry
+
+func stopsGeoJSON(stops []gtfs.Stop) FeatureCollection {
+	collection := gtfs.NewFeatureCollection(nil)
+	for _, stop := range stops {
+		collection.Features = append(collection.Features, gtfs.PointFeature(stop.StopId, stop.StopLat, stop.StopLon, stop))
+	}
+	return collection
+}
+
+func vehiclesGeoJSON(vehicles []realtime.Vehicle) FeatureCollection {
+	collection := gtfs.NewFeatureCollection(nil)
+	for _, vehicle := range vehicles {
+		collection.Features = append(collection.Features, gtfs.PointFeature(vehicle.Vehicle.ID, vehicle.Position.Latitude, vehicle.Position.Longitude, vehicle))
+	}
+	return collection
+}
+
+/*
+Get how shapes should be written from the request, "dist=coordinates" for [lon, lat, dist] coordinates or
+"dist=properties" for the distances in the properties
+*/
+func geoJSONOptions(r *http.Request) gtfs.GeoJSONOptions {
+	var options gtfs.GeoJSONOptions
+	for _, dist := range strings.Split(r.URL.Query().Get("dist"), ",") {
+		switch dist {
+		case "coordinates":
+			options.DistanceCoordinates = true
+		case "properties":
+			options.DistanceProperty = true
+		}
+	}
+	return options
+}
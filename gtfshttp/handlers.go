@@ -0,0 +1,678 @@
+package gtfshttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+)
+
+func (s *Server) routes() {
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/stops", s.handleStops)
+	s.mux.HandleFunc("/stops/", s.handleStop)
+	s.mux.HandleFunc("/search/stops", s.handleSearchStops)
+	s.mux.HandleFunc("/routes", s.handleRoutes)
+	s.mux.HandleFunc("/routes/", s.handleRoute)
+	s.mux.HandleFunc("/trips", s.handleTrips)
+	s.mux.HandleFunc("/trips/", s.handleTrip)
+	s.mux.HandleFunc("/vehicles", s.handleVehicles)
+	s.mux.HandleFunc("/alerts", s.handleAlerts)
+	s.mux.HandleFunc("/autocomplete", s.handleAutocomplete)
+	s.mux.HandleFunc("/nearby", s.handleNearby)
+	s.mux.HandleFunc("/nearby/routes", s.handleNearbyRoutes)
+	s.mux.HandleFunc("/extent", s.handleExtent)
+	s.mux.HandleFunc("/service-changes", s.handleServiceChanges)
+}
+
+/*
+GET /status
+*/
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.db.Status()
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+/*
+GET /stops?children=true&accessible=true&format=geojson
+*/
+func (s *Server) handleStops(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	includeChildren := query.Get("children") == "true"
+
+	var stops []gtfs.Stop
+	var err error
+	if query.Get("accessible") == "true" {
+		stops, err = s.db.GetAccessibleStops(includeChildren, s.page(r))
+	} else {
+		stops, err = s.db.GetStops(includeChildren, s.page(r))
+	}
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+
+	if query.Get("format") == "geojson" {
+		writeJSON(w, http.StatusOK, stopsGeoJSON(stops))
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmpty(stops))
+}
+
+/*
+GET /stops/{id}, /stops/{id}/children, /stops/{id}/routes, /stops/{id}/departures?date=20060102&from=15:04:05&limit=10&station=true,
+/stops/{id}/timetable?date=20060102, /stops/{id}/stats?date=20060102
+*/
+func (s *Server) handleStop(w http.ResponseWriter, r *http.Request) {
+	stopID, action := splitPath(r.URL, "/stops/")
+	if stopID == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch action {
+	case "":
+		stop, err := s.db.GetStopByStopID(stopID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "stop not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, stop)
+	case "children":
+		stops, err := s.db.GetChildStopsByParentStopID(stopID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, orEmpty(stops))
+	case "routes":
+		routes, err := s.db.GetRouteDirectionsByStopId(stopID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, orEmpty(routes))
+	case "departures":
+		s.handleDepartures(w, r, stopID)
+	case "timetable":
+		timetable, err := s.db.GetStopTimetable(stopID, r.URL.Query().Get("date"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, timetable)
+	case "stats":
+		stats, err := s.db.GetStopStats(stopID, r.URL.Query().Get("date"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) handleDepartures(w http.ResponseWriter, r *http.Request, stopID string) {
+	query := r.URL.Query()
+
+	options := gtfs.ActiveTripsOptions{
+		StopID:    stopID,
+		ByStation: query.Get("station") == "true",
+		Date:      query.Get("date"),
+		From:      query.Get("from"),
+		To:        query.Get("to"),
+		Limit:     s.page(r).Limit,
+	}
+	if s.tripUpdates != nil {
+		if updates, err := s.tripUpdates(); err == nil {
+			options.TripUpdates = updates
+		}
+	}
+	if s.alerts != nil {
+		if alerts, err := s.alerts(); err == nil {
+			options.Alerts = alerts
+		}
+	}
+
+	departures, err := s.db.GetActiveTripsWithOptions(options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmpty(departures))
+}
+
+/*
+GET /search/stops?q=central&children=true, /search/stops?q=central&ranked=true&lat=-36.84&lon=174.76&limit=20
+
+Ranked results are ordered by their text match, how busy the stop is and how close it is to lat/lon (if given)
+*/
+func (s *Server) handleSearchStops(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("q") == "" {
+		writeError(w, http.StatusBadRequest, "missing q")
+		return
+	}
+
+	if query.Get("ranked") == "true" {
+		options := gtfs.StopSearchOptions{IncludeChildStops: query.Get("children") == "true"}
+		if query.Get("lat") != "" || query.Get("lon") != "" {
+			lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+			lon, errLon := strconv.ParseFloat(query.Get("lon"), 64)
+			if errLat != nil || errLon != nil {
+				writeError(w, http.StatusBadRequest, "invalid lat/lon")
+				return
+			}
+			options.Lat, options.Lon = &lat, &lon
+		}
+		if limit, err := strconv.Atoi(query.Get("limit")); err == nil {
+			options.Limit = limit
+		}
+		results, err := s.db.SearchStopsRanked(query.Get("q"), options)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	results, err := s.db.SearchForStopsByName(query.Get("q"), query.Get("children") == "true", s.page(r))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmpty(results))
+}
+
+/*
+GET /autocomplete?q=cen+sta&limit=10
+*/
+func (s *Server) handleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	results, err := s.db.Autocomplete(query.Get("q"), limit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+/*
+GET /routes?q=&category=rail&format=geojson&dist=properties
+*/
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if search := r.URL.Query().Get("q"); search != "" {
+		routes, err := s.db.SearchForRouteByID(search, s.page(r))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, orEmpty(routes))
+		return
+	}
+
+	var routes []gtfs.Route
+	var err error
+	if category := r.URL.Query().Get("category"); category != "" {
+		routes, err = s.db.GetRoutesByCategory(category, s.page(r))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	} else {
+		routes, err = s.db.GetRoutes(s.page(r))
+		if err != nil {
+			s.serverError(w, err)
+			return
+		}
+	}
+	if r.URL.Query().Get("format") == "geojson" {
+		collection, err := s.db.RoutesToGeoJSON(routes, geoJSONOptions(r))
+		if err != nil {
+			s.serverError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, collection)
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmpty(routes))
+}
+
+/*
+GET /routes/{id}, /routes/{id}/stops, /routes/{id}/vehicles, /routes/{id}/extent,
+/routes/{id}/timetable?direction=0&date=20060102&format=csv
+*/
+func (s *Server) handleRoute(w http.ResponseWriter, r *http.Request) {
+	routeID, action := splitPath(r.URL, "/routes/")
+	if routeID == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch action {
+	case "":
+		route, err := s.db.GetRouteByID(routeID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "route not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, route)
+	case "stops":
+		stops, err := s.db.GetStopsByRouteId(routeID, s.page(r))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if r.URL.Query().Get("format") == "geojson" {
+			writeJSON(w, http.StatusOK, stopsGeoJSON(stops))
+			return
+		}
+		writeJSON(w, http.StatusOK, orEmpty(stops))
+	case "vehicles":
+		if s.vehicles == nil {
+			writeError(w, http.StatusNotFound, "vehicles aren't available")
+			return
+		}
+		vehicles, err := s.vehicles()
+		if err != nil {
+			s.serverError(w, err)
+			return
+		}
+		routeVehicles, err := s.db.GetVehiclesForRoute(routeID, vehicles)
+		if err != nil {
+			s.serverError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, routeVehicles)
+	case "extent":
+		extent, err := s.db.GetRouteExtent(routeID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, extent)
+	case "timetable":
+		query := r.URL.Query()
+		directionID, _ := strconv.Atoi(query.Get("direction"))
+		timetable, err := s.db.GetRouteTimetable(routeID, directionID, query.Get("date"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if query.Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			if err := timetable.WriteCSV(w); err != nil {
+				s.logger.Warn("failed to write route timetable", "route_id", routeID, "error", err)
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, timetable)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+/*
+GET /trips?route_id=&date=20060102&direction=0&headsign=&wheelchair=true&bikes=true&from=15:04:05&to=15:04:05
+*/
+func (s *Server) handleTrips(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := gtfs.TripFilter{
+		RouteID:              query.Get("route_id"),
+		Date:                 query.Get("date"),
+		Headsign:             query.Get("headsign"),
+		WheelchairAccessible: query.Get("wheelchair") == "true",
+		BikesAllowed:         query.Get("bikes") == "true",
+		From:                 query.Get("from"),
+		To:                   query.Get("to"),
+	}
+	if query.Has("direction") {
+		directionID, err := strconv.Atoi(query.Get("direction"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid direction")
+			return
+		}
+		filter.DirectionID = &directionID
+	}
+
+	trips, err := s.db.FindTrips(filter, s.page(r))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, orEmpty(trips))
+}
+
+/*
+GET /trips/{id}, /trips/{id}/stops, /trips/{id}/progress, /trips/{id}/playback?date=20060102,
+/trips/{id}/shape?from=STOP&to=STOP&format=geojson&dist=coordinates
+*/
+func (s *Server) handleTrip(w http.ResponseWriter, r *http.Request) {
+	tripID, action := splitPath(r.URL, "/trips/")
+	if tripID == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch action {
+	case "":
+		trip, err := s.db.GetTripByID(tripID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "trip not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, trip)
+	case "stops":
+		stops, err := s.db.GetStopsForTripID(tripID, s.page(r))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, orEmpty(stops))
+	case "playback":
+		playback, err := s.db.GetVehiclePlayback(tripID, r.URL.Query().Get("date"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, playback)
+	case "progress":
+		progress, err := s.db.GetTripProgress(tripID, s.realtimeData())
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, progress)
+	case "shape":
+		query := r.URL.Query()
+		points, err := s.db.GetShapeSegment(tripID, query.Get("from"), query.Get("to"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if query.Get("format") == "geojson" {
+			writeJSON(w, http.StatusOK, gtfs.ShapeToGeoJSON(tripID, points, geoJSONOptions(r)))
+			return
+		}
+		writeJSON(w, http.StatusOK, points)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+/*
+GET /extent
+*/
+func (s *Server) handleExtent(w http.ResponseWriter, r *http.Request) {
+	extent, err := s.db.GetFeedExtent()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, extent)
+}
+
+/*
+The most the nearby handlers look around, so a request can't scan the whole feed
+*/
+const (
+	maxNearbyRadius = 2000.0        // Meters
+	maxNearbyWindow = 3 * time.Hour // How far ahead departures are looked for
+)
+
+/*
+GET /nearby?lat=-36.85&lon=174.76&radius=500&window=1h, the radius can be up to 2000 and the window up to 3h
+*/
+func (s *Server) handleNearby(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, errLon := strconv.ParseFloat(query.Get("lon"), 64)
+	if errLat != nil || errLon != nil {
+		writeError(w, http.StatusBadRequest, "invalid lat/lon")
+		return
+	}
+	radius := 500.0
+	if value := query.Get("radius"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid radius")
+			return
+		}
+		radius = parsed
+	}
+	if radius <= 0 || radius > maxNearbyRadius {
+		writeError(w, http.StatusBadRequest, "radius must be between 0 and 2000 meters")
+		return
+	}
+	window := time.Hour
+	if value := query.Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid window")
+			return
+		}
+		window = parsed
+	}
+	if window <= 0 || window > maxNearbyWindow {
+		writeError(w, http.StatusBadRequest, "window must be between 0 and 3h")
+		return
+	}
+
+	nearby, err := s.db.GetNearbyDepartures(lat, lon, radius, window, s.realtimeData())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, nearby)
+}
+
+/*
+GET /nearby/routes?lat=-36.85&lon=174.76&radius=50, the radius can be up to 2000
+*/
+func (s *Server) handleNearbyRoutes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, errLon := strconv.ParseFloat(query.Get("lon"), 64)
+	if errLat != nil || errLon != nil {
+		writeError(w, http.StatusBadRequest, "invalid lat/lon")
+		return
+	}
+	radius := 50.0
+	if value := query.Get("radius"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid radius")
+			return
+		}
+		radius = parsed
+	}
+	if radius <= 0 || radius > maxNearbyRadius {
+		writeError(w, http.StatusBadRequest, "radius must be between 0 and 2000 meters")
+		return
+	}
+
+	routes, err := s.db.GetRoutesNear(lat, lon, radius)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+/*
+Get the realtime data from the feeds which are available, leaving out any which fail
+*/
+func (s *Server) realtimeData() gtfs.TripRealtime {
+	var rt gtfs.TripRealtime
+	if s.tripUpdates != nil {
+		rt.TripUpdates, _ = s.tripUpdates()
+	}
+	if s.vehicles != nil {
+		rt.Vehicles, _ = s.vehicles()
+	}
+	if s.alerts != nil {
+		rt.Alerts, _ = s.alerts()
+	}
+	return rt
+}
+
+/*
+GET /vehicles?route_id=&format=geojson
+*/
+func (s *Server) handleVehicles(w http.ResponseWriter, r *http.Request) {
+	if s.vehicles == nil {
+		writeError(w, http.StatusNotFound, "vehicles aren't available")
+		return
+	}
+
+	vehiclesMap, err := s.vehicles()
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+
+	routeID := r.URL.Query().Get("route_id")
+	vehicles := []realtime.Vehicle{}
+	for _, vehicle := range vehiclesMap {
+		if routeID != "" && string(vehicle.Trip.RouteID) != routeID {
+			continue
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+	sort.Slice(vehicles, func(i, j int) bool {
+		return vehicles[i].Vehicle.ID < vehicles[j].Vehicle.ID
+	})
+	vehicles = paginate(vehicles, s.page(r))
+
+	if r.URL.Query().Get("format") == "geojson" {
+		writeJSON(w, http.StatusOK, vehiclesGeoJSON(vehicles))
+		return
+	}
+	writeJSON(w, http.StatusOK, vehicles)
+}
+
+/*
+GET /alerts?resolve=true
+
+With resolve, each alert has its informed entities' stops, routes, trips and agencies
+*/
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if s.alerts == nil {
+		writeError(w, http.StatusNotFound, "alerts aren't available")
+		return
+	}
+
+	alerts, err := s.alerts()
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	if r.URL.Query().Get("resolve") == "true" {
+		writeJSON(w, http.StatusOK, paginate(s.db.ResolveAlertEntities(alerts), s.page(r)))
+		return
+	}
+	writeJSON(w, http.StatusOK, paginate(orEmpty([]realtime.Alert(alerts)), s.page(r)))
+}
+
+/*
+GET /service-changes?days=7
+*/
+func (s *Server) handleServiceChanges(w http.ResponseWriter, r *http.Request) {
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	changes, err := s.db.GetUpcomingServiceChanges(days)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+/*
+Get the page from the limit and offset query parameters, the limit is capped at the max page size
+*/
+func (s *Server) page(r *http.Request) gtfs.Page {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	offset, _ := strconv.Atoi(query.Get("offset"))
+
+	if limit <= 0 || (s.maxPageSize > 0 && limit > s.maxPageSize) {
+		limit = s.maxPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return gtfs.Page{Limit: limit, Offset: offset}
+}
+
+func paginate[T any](items []T, page gtfs.Page) []T {
+	if page.Offset >= len(items) {
+		return []T{}
+	}
+	items = items[page.Offset:]
+	if page.Limit > 0 && page.Limit < len(items) {
+		items = items[:page.Limit]
+	}
+	return items
+}
+
+/*
+Split "/stops/{id}/{action}" into the id and action
+
+The raw path is split, so ids with a "/" in them work when it's escaped ("/stops/a%2Fb/routes"). Both are "" if
+the id isn't escaped properly
+*/
+func splitPath(u *url.URL, prefix string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(u.EscapedPath(), prefix), "/", 2)
+	id, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", ""
+	}
+	if len(parts) == 1 {
+		return id, ""
+	}
+	action, err := url.PathUnescape(strings.TrimSuffix(parts[1], "/"))
+	if err != nil {
+		return "", ""
+	}
+	return id, action
+}
+
+/*
+Lists are always encoded as [], not null
+*/
+func orEmpty[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
+
+func (s *Server) serverError(w http.ResponseWriter, err error) {
+	s.logger.Error("request failed", "error", err)
+	writeError(w, http.StatusInternalServerError, "an error occurred")
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,171 @@
+/*
+A ready made REST server for a gtfs Database (and optionally its realtime feeds)
+
+	db, _ := gtfs.New(url, "auckland", tz, "")
+	server := gtfshttp.New(db, gtfshttp.WithCORS("*"))
+	http.ListenAndServe(":8080", server)
+
+Every endpoint is a GET returning JSON, lists take limit and offset query parameters and the stop and vehicle
+lists can be returned as GeoJSON with format=geojson
+*/
+package gtfshttp
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+)
+
+type Server struct {
+	db     gtfs.Database
+	mux    *http.ServeMux
+	logger *slog.Logger
+
+	allowedOrigins []string
+	maxPageSize    int
+
+	realtimeFeeds *realtimeFeeds // From WithRealtime, resolved once every option is applied
+	vehicles      func() (realtime.VehiclesMap, error)
+	tripUpdates   func() (realtime.TripUpdatesMap, error)
+	alerts        func() (realtime.AlertMap, error)
+}
+
+type realtimeFeeds struct {
+	rt                                     realtime.RealtimeS
+	vehiclesURL, tripUpdatesURL, alertsURL string
+}
+
+/*
+An optional setting for New
+*/
+type Option func(*Server)
+
+/*
+Create a server for the database, see the package docs for the endpoints
+*/
+func New(db gtfs.Database, options ...Option) *Server {
+	server := &Server{
+		db:          db,
+		mux:         http.NewServeMux(),
+		logger:      slog.Default(),
+		maxPageSize: 500,
+	}
+	for _, option := range options {
+		option(server)
+	}
+
+	server.resolveRealtime()
+	server.routes()
+	return server
+}
+
+/*
+Serve the realtime vehicles, trip updates and alerts from the feeds, a url can be "" if the feed isn't available
+
+The trip updates are attached to the departures
+*/
+func WithRealtime(rt realtime.RealtimeS, vehiclesURL, tripUpdatesURL, alertsURL string) Option {
+	return func(s *Server) {
+		s.realtimeFeeds = &realtimeFeeds{rt: rt, vehiclesURL: vehiclesURL, tripUpdatesURL: tripUpdatesURL, alertsURL: alertsURL}
+	}
+}
+
+/*
+Set up the realtime feeds from WithRealtime, after the options so the feeds which can't be served are logged with the
+server's logger (see WithLogger) whatever order the options are given in
+*/
+func (s *Server) resolveRealtime() {
+	feeds := s.realtimeFeeds
+	if feeds == nil {
+		return
+	}
+	if feeds.vehiclesURL != "" {
+		if feed, err := feeds.rt.Vehicles(feeds.vehiclesURL); err == nil {
+			s.vehicles = feed.GetVehicles
+		} else {
+			s.logger.Warn("not serving vehicles", "error", err)
+		}
+	}
+	if feeds.tripUpdatesURL != "" {
+		if feed, err := feeds.rt.TripUpdates(feeds.tripUpdatesURL); err == nil {
+			s.tripUpdates = feed.GetTripUpdates
+		} else {
+			s.logger.Warn("not serving trip updates", "error", err)
+		}
+	}
+	if feeds.alertsURL != "" {
+		if feed, err := feeds.rt.Alerts(feeds.alertsURL); err == nil {
+			s.alerts = feed.GetAlerts
+		} else {
+			s.logger.Warn("not serving alerts", "error", err)
+		}
+	}
+}
+
+/*
+Allow cross origin requests from the origins, "*" allows any origin
+*/
+func WithCORS(origins ...string) Option {
+	return func(s *Server) {
+		s.allowedOrigins = origins
+	}
+}
+
+/*
+The max results a list endpoint returns, defaults to 500
+*/
+func WithMaxPageSize(size int) Option {
+	return func(s *Server) {
+		s.maxPageSize = size
+	}
+}
+
+/*
+Log with the given logger instead of slog.Default()
+*/
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := s.allowedOrigin(r.Header.Get("Origin")); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+/*
+Get the Access-Control-Allow-Origin for a request's origin, "" if it isn't allowed
+*/
+func (s *Server) allowedOrigin(origin string) string {
+	for _, allowed := range s.allowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
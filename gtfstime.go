@@ -0,0 +1,41 @@
+package gtfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Parse a gtfs time ("15:04:05", can be over 24:00:00 for services after midnight) into seconds since the start of the service day
+*/
+func parseGTFSTime(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid gtfs time: %s", value)
+	}
+
+	var seconds int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid gtfs time: %s", value)
+		}
+		switch i {
+		case 0:
+			seconds += n * 3600
+		case 1:
+			seconds += n * 60
+		case 2:
+			seconds += n
+		}
+	}
+	return seconds, nil
+}
+
+/*
+Format seconds since the start of the service day as a gtfs time ("15:04:05")
+*/
+func formatGTFSTime(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, (seconds%3600)/60, seconds%60)
+}
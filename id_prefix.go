@@ -0,0 +1,115 @@
+package gtfs
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+The names of the fields with lists of stop ids, the other fields with ids are named after their column (see
+mergeIDColumns) or are lists of them (e.g stop_ids)
+*/
+var stopListFields = []string{"accessible_stops", "inaccessible_stops", "unknown_stops"}
+
+/*
+The realtime feeds' types (e.g alerts attached to services) have the feed's own ids, which are never prefixed
+*/
+var realtimePkgPath = reflect.TypeOf(realtime.Trip{}).PkgPath()
+
+/*
+Remove the id prefix (see WithIDPrefix) from the ids in a method's result, so the ids the methods return are the feed's
+own ids, the same as the ones they take
+
+The fields with ids are found by their json tag, else their db tag, else their name (e.g "stop_id", "ParentStation" or
+"StopIDs"), the same goes for the keys of maps (e.g geojson properties). value must be a pointer to the result
+*/
+func (v Database) stripIDs(value interface{}) {
+	prefix := v.IDPrefix()
+	if prefix == "" {
+		return
+	}
+	stripIDValue(reflect.ValueOf(value), "", prefix)
+}
+
+func stripIDValue(value reflect.Value, name string, prefix string) {
+	switch value.Kind() {
+	case reflect.Pointer:
+		if !value.IsNil() {
+			stripIDValue(value.Elem(), name, prefix)
+		}
+	case reflect.Interface:
+		// The value in an interface can't be set, it's replaced with a stripped copy
+		if value.IsNil() || !value.CanSet() {
+			return
+		}
+		stripped := reflect.New(value.Elem().Type()).Elem()
+		stripped.Set(value.Elem())
+		stripIDValue(stripped, name, prefix)
+		value.Set(stripped)
+	case reflect.Struct:
+		valueType := value.Type()
+		if valueType.PkgPath() == realtimePkgPath {
+			return
+		}
+		for i := 0; i < valueType.NumField(); i++ {
+			if field := valueType.Field(i); field.IsExported() {
+				stripIDValue(value.Field(i), idFieldName(field), prefix)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			stripIDValue(value.Index(i), name, prefix)
+		}
+	case reflect.Map:
+		// Map values can't be set either, and the keys are left as they are (e.g the ids a method was given)
+		iter := value.MapRange()
+		for iter.Next() {
+			elemName := name
+			if iter.Key().Kind() == reflect.String {
+				elemName = iter.Key().String()
+			}
+			stripped := reflect.New(iter.Value().Type()).Elem()
+			stripped.Set(iter.Value())
+			stripIDValue(stripped, elemName, prefix)
+			value.SetMapIndex(iter.Key(), stripped)
+		}
+	case reflect.String:
+		if value.CanSet() && isIDField(name) {
+			value.SetString(strings.TrimPrefix(value.String(), prefix))
+		}
+	}
+}
+
+/*
+Get the name of a field, from its json tag, else its db tag, else its name in snake case
+*/
+func idFieldName(field reflect.StructField) string {
+	for _, key := range []string{"json", "db"} {
+		if tag, _, _ := strings.Cut(field.Tag.Get(key), ","); tag != "" && tag != "-" {
+			return tag
+		}
+	}
+	return snakeCase(strings.ReplaceAll(field.Name, "ID", "Id"))
+}
+
+func isIDField(name string) bool {
+	return contains(mergeIDColumns, name) || contains(mergeIDColumns, strings.TrimSuffix(name, "s")) ||
+		name == "parent_station_id" || name == "station_id" || contains(stopListFields, name)
+}
+
+func snakeCase(name string) string {
+	var builder strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				builder.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
@@ -0,0 +1,68 @@
+package gtfs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+/*
+The ids the methods return must be the feed's own ids, so they can be passed straight back to the methods taking ids
+*/
+func TestIDPrefixRoundTrip(t *testing.T) {
+	db := newTestDatabase(t, "id-prefix", WithIDPrefix("bus:"))
+
+	stops, err := db.GetStops(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stop := range stops {
+		if strings.HasPrefix(stop.StopId, "bus:") || strings.HasPrefix(stop.ParentStation, "bus:") {
+			t.Errorf("stop %s (parent %q) has the id prefix", stop.StopId, stop.ParentStation)
+		}
+		found, err := db.GetStopByStopID(stop.StopId)
+		if err != nil {
+			t.Errorf("GetStopByStopID(%q): %v", stop.StopId, err)
+			continue
+		}
+		if found.StopId != stop.StopId {
+			t.Errorf("GetStopByStopID(%q) got stop %s", stop.StopId, found.StopId)
+		}
+	}
+
+	routes, err := db.GetRoutesByStopId("C1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range routes {
+		if _, err := db.GetRouteByID(route.RouteId); err != nil {
+			t.Errorf("GetRouteByID(%q): %v", route.RouteId, err)
+		}
+	}
+
+	services, err := db.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "P1", ByStation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) == 0 {
+		t.Fatal("no services found at P1")
+	}
+	for _, service := range services {
+		trip, err := db.GetTripByID(service.TripID)
+		if err != nil {
+			t.Errorf("GetTripByID(%q): %v", service.TripID, err)
+			continue
+		}
+		if _, err := db.GetServiceByTripAndStop(trip.TripID, service.StopId, ""); err != nil {
+			t.Errorf("GetServiceByTripAndStop(%q, %q): %v", trip.TripID, service.StopId, err)
+		}
+	}
+
+	encoded, err := json.Marshal([]interface{}{stops, routes, services})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encoded), "bus:") {
+		t.Errorf("results have the id prefix: %s", encoded)
+	}
+}
@@ -0,0 +1,128 @@
+package gtfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+The max skipped rows listed for each file in an import report, the rest are only counted
+*/
+const maxReportedSkippedRows = 100
+
+type SkippedRow struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type FileImportReport struct {
+	File           string       `json:"file"`
+	Table          string       `json:"table"`
+	Rows           int          `json:"rows"`            // The rows imported
+	Skipped        int          `json:"skipped"`         // The rows which couldn't be imported
+	SkippedRows    []SkippedRow `json:"skipped_rows"`    // Why rows were skipped (up to the first 100 of each file)
+	Duplicates     int          `json:"duplicates"`      // The rows with the same key as an earlier row, see WithDuplicatePolicy
+	DuplicateRows  []SkippedRow `json:"duplicate_rows"`  // Up to the first 100 of each file
+	UnknownColumns []string     `json:"unknown_columns"` // Columns which aren't in the gtfs spec, they're still imported
+}
+
+type ImportReport struct {
+	Started  time.Time          `json:"started"`
+	Finished time.Time          `json:"finished"`
+	Files    []FileImportReport `json:"files"`
+
+	Integrity *IntegrityReport `json:"integrity,omitempty"` // With WithIntegrityCheck
+}
+
+/*
+Get the report of the last import by this process, false if there hasn't been one
+*/
+func (v Database) LastImportReport() (ImportReport, bool) {
+	if v.state == nil {
+		return ImportReport{}, false
+	}
+
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	if v.state.lastImportReport == nil {
+		return ImportReport{}, false
+	}
+	return *v.state.lastImportReport, true
+}
+
+func (v Database) setImportReport(report ImportReport) {
+	if v.state == nil {
+		return
+	}
+
+	v.state.mutex.Lock()
+	v.state.lastImportReport = &report
+	v.state.mutex.Unlock()
+}
+
+/*
+Record a skipped row in the report of a file
+*/
+func (r *FileImportReport) skip(line int, reason string) {
+	r.Skipped++
+	if len(r.SkippedRows) < maxReportedSkippedRows {
+		r.SkippedRows = append(r.SkippedRows, SkippedRow{Line: line, Reason: reason})
+	}
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+/*
+Create a csv reader for a feed file, ignoring the UTF-8 byte order mark some feeds start their files with
+*/
+func newFeedCSVReader(r io.Reader, lazyQuotes bool) *csv.Reader {
+	buffered := bufio.NewReader(r)
+	if start, err := buffered.Peek(len(utf8BOM)); err == nil && bytes.Equal(start, utf8BOM) {
+		buffered.Discard(len(utf8BOM))
+	}
+
+	csvReader := csv.NewReader(buffered)
+	// Rows with the wrong amount of fields are checked (and skipped) when they're imported
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = lazyQuotes
+	return csvReader
+}
+
+var (
+	specColumns     map[string][]string
+	specColumnsOnce sync.Once
+)
+
+/*
+Get the columns of each of the gtfs spec tables (without any extra columns added from feeds)
+*/
+func defaultTableColumns() map[string][]string {
+	specColumnsOnce.Do(func() {
+		specColumns = make(map[string][]string)
+
+		db, err := sqlx.Open("sqlite", ":memory:")
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		// Each connection has its own in memory database
+		db.SetMaxOpenConns(1)
+
+		if _, err := db.Exec(defaultGTFSSchema); err != nil {
+			return
+		}
+		for _, table := range defaultTableNames {
+			var columns []string
+			if err := db.Select(&columns, `SELECT name FROM pragma_table_info(?)`, table); err == nil {
+				specColumns[table] = columns
+			}
+		}
+	})
+	return specColumns
+}
@@ -0,0 +1,167 @@
+package gtfs
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+How many of the broken values are listed for each problem, the rest are only counted
+*/
+const maxIntegrityExamples = 10
+
+/*
+References between the feed's files which have to be found (see IntegrityProblem), empty values are allowed where the
+gtfs spec makes the field optional
+*/
+var integrityReferences = []struct {
+	Table, Column string
+	References    string // What the value has to be in, e.g "trips.trip_id"
+	Query         string // The values which aren't found, with how many rows have each
+}{
+	{"stop_times", "trip_id", "trips.trip_id", `
+		SELECT st.trip_id AS value, COUNT(*) AS rows FROM stop_times st
+		WHERE NOT EXISTS (SELECT 1 FROM trips t WHERE t.trip_id = st.trip_id) GROUP BY st.trip_id`},
+	{"stop_times", "stop_id", "stops.stop_id", `
+		SELECT st.stop_id AS value, COUNT(*) AS rows FROM stop_times st
+		WHERE NOT EXISTS (SELECT 1 FROM stops s WHERE s.stop_id = st.stop_id) GROUP BY st.stop_id`},
+	{"trips", "route_id", "routes.route_id", `
+		SELECT t.route_id AS value, COUNT(*) AS rows FROM trips t
+		WHERE NOT EXISTS (SELECT 1 FROM routes r WHERE r.route_id = t.route_id) GROUP BY t.route_id`},
+	// Services can be only in calendar_dates
+	{"trips", "service_id", "calendar.service_id or calendar_dates.service_id", `
+		SELECT t.service_id AS value, COUNT(*) AS rows FROM trips t
+		WHERE NOT EXISTS (SELECT 1 FROM calendar c WHERE c.service_id = t.service_id)
+		  AND NOT EXISTS (SELECT 1 FROM calendar_dates cd WHERE cd.service_id = t.service_id)
+		GROUP BY t.service_id`},
+	{"trips", "shape_id", "shapes.shape_id", `
+		SELECT t.shape_id AS value, COUNT(*) AS rows FROM trips t
+		WHERE COALESCE(t.shape_id, '') != '' AND NOT EXISTS (SELECT 1 FROM shapes sh WHERE sh.shape_id = t.shape_id)
+		GROUP BY t.shape_id`},
+	{"routes", "agency_id", "agency.agency_id", `
+		SELECT r.agency_id AS value, COUNT(*) AS rows FROM routes r
+		WHERE COALESCE(r.agency_id, '') != '' AND NOT EXISTS (SELECT 1 FROM agency a WHERE a.agency_id = r.agency_id)
+		GROUP BY r.agency_id`},
+	{"stops", "parent_station", "stops.stop_id", `
+		SELECT s.parent_station AS value, COUNT(*) AS rows FROM stops s
+		WHERE COALESCE(s.parent_station, '') != '' AND NOT EXISTS (SELECT 1 FROM stops p WHERE p.stop_id = s.parent_station)
+		GROUP BY s.parent_station`},
+	{"frequencies", "trip_id", "trips.trip_id", `
+		SELECT f.trip_id AS value, COUNT(*) AS rows FROM frequencies f
+		WHERE NOT EXISTS (SELECT 1 FROM trips t WHERE t.trip_id = f.trip_id) GROUP BY f.trip_id`},
+	{"transfers", "from_stop_id", "stops.stop_id", `
+		SELECT tr.from_stop_id AS value, COUNT(*) AS rows FROM transfers tr
+		WHERE COALESCE(tr.from_stop_id, '') != '' AND NOT EXISTS (SELECT 1 FROM stops s WHERE s.stop_id = tr.from_stop_id)
+		GROUP BY tr.from_stop_id`},
+	{"transfers", "to_stop_id", "stops.stop_id", `
+		SELECT tr.to_stop_id AS value, COUNT(*) AS rows FROM transfers tr
+		WHERE COALESCE(tr.to_stop_id, '') != '' AND NOT EXISTS (SELECT 1 FROM stops s WHERE s.stop_id = tr.to_stop_id)
+		GROUP BY tr.to_stop_id`},
+	{"pathways", "from_stop_id", "stops.stop_id", `
+		SELECT p.from_stop_id AS value, COUNT(*) AS rows FROM pathways p
+		WHERE NOT EXISTS (SELECT 1 FROM stops s WHERE s.stop_id = p.from_stop_id) GROUP BY p.from_stop_id`},
+	{"pathways", "to_stop_id", "stops.stop_id", `
+		SELECT p.to_stop_id AS value, COUNT(*) AS rows FROM pathways p
+		WHERE NOT EXISTS (SELECT 1 FROM stops s WHERE s.stop_id = p.to_stop_id) GROUP BY p.to_stop_id`},
+	{"fare_rules", "fare_id", "fare_attributes.fare_id", `
+		SELECT fr.fare_id AS value, COUNT(*) AS rows FROM fare_rules fr
+		WHERE NOT EXISTS (SELECT 1 FROM fare_attributes fa WHERE fa.fare_id = fr.fare_id) GROUP BY fr.fare_id`},
+	{"fare_rules", "route_id", "routes.route_id", `
+		SELECT fr.route_id AS value, COUNT(*) AS rows FROM fare_rules fr
+		WHERE COALESCE(fr.route_id, '') != '' AND NOT EXISTS (SELECT 1 FROM routes r WHERE r.route_id = fr.route_id)
+		GROUP BY fr.route_id`},
+}
+
+/*
+Rows referencing something which isn't in the feed, e.g stop times for a trip which isn't in trips.txt. Queries leave
+these rows out, so they show up as missing results rather than errors
+*/
+type IntegrityProblem struct {
+	Table      string   `json:"table"`
+	Column     string   `json:"column"`
+	References string   `json:"references"` // What the column's values have to be in, e.g "trips.trip_id"
+	Rows       int      `json:"rows"`       // How many rows reference something missing
+	Values     int      `json:"values"`     // How many different missing values they reference
+	Examples   []string `json:"examples"`   // Some of the missing values (up to 10)
+}
+
+type IntegrityReport struct {
+	Checked  time.Time          `json:"checked"`
+	Problems []IntegrityProblem `json:"problems"`
+}
+
+/*
+If any references are broken
+*/
+func (r IntegrityReport) HasProblems() bool {
+	return len(r.Problems) > 0
+}
+
+/*
+Check the references between the feed's files are all found, tables which aren't in the database are skipped
+
+Unlike sqlite's foreign key check, this allows what the gtfs spec allows, e.g services only in calendar_dates
+*/
+func (v Database) CheckIntegrity() (IntegrityReport, error) {
+	defer v.observeQuery("CheckIntegrity", time.Now())
+
+	var tables []string
+	if err := v.db.Select(&tables, `SELECT name FROM sqlite_master WHERE type = 'table'`); err != nil {
+		return IntegrityReport{}, err
+	}
+
+	report := IntegrityReport{Checked: time.Now(), Problems: []IntegrityProblem{}}
+	for _, reference := range integrityReferences {
+		if !contains(tables, reference.Table) {
+			continue
+		}
+
+		var missing []struct {
+			Value string `db:"value"`
+			Rows  int    `db:"rows"`
+		}
+		if err := v.db.Select(&missing, reference.Query); err != nil {
+			return IntegrityReport{}, fmt.Errorf("failed to check %s.%s: %w", reference.Table, reference.Column, err)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		problem := IntegrityProblem{
+			Table:      reference.Table,
+			Column:     reference.Column,
+			References: reference.References,
+			Values:     len(missing),
+			Examples:   []string{},
+		}
+		for _, value := range missing {
+			problem.Rows += value.Rows
+			if len(problem.Examples) < maxIntegrityExamples {
+				// The columns are all ids
+				problem.Examples = append(problem.Examples, v.StripIDPrefix(value.Value))
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	return report, nil
+}
+
+/*
+Check the feed's integrity after it's imported, failing the refresh if there are problems and fail is set
+*/
+func (v Database) checkImportIntegrity(fail bool) (*IntegrityReport, error) {
+	report, err := v.CheckIntegrity()
+	if err != nil {
+		v.logger().Warn("failed to check feed integrity", "error", err)
+		return nil, nil
+	}
+	for _, problem := range report.Problems {
+		v.logger().Warn("feed has broken references", "table", problem.Table, "column", problem.Column,
+			"references", problem.References, "rows", problem.Rows, "examples", problem.Examples)
+	}
+	if fail && report.HasProblems() {
+		return &report, fmt.Errorf("feed has broken references in %d columns", len(report.Problems))
+	}
+	return &report, nil
+}
@@ -0,0 +1,154 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+/*
+Where a leg's distance came from
+*/
+const (
+	DistanceFromShapeDistTraveled = "shape_dist_traveled" // The stop times' shape_dist_traveled, scaled to km by the shape's length
+	DistanceFromShape             = "shape"               // The stops' positions along the trip's shape
+	DistanceFromStops             = "stops"               // Straight lines between the stops, for trips without a shape
+)
+
+type LegMetrics struct {
+	TripID        string  `json:"trip_id"`
+	FromStopID    string  `json:"from_stop_id"`
+	ToStopID      string  `json:"to_stop_id"`
+	DepartureTime string  `json:"departure_time"` // "15:04:05" from the from stop
+	ArrivalTime   string  `json:"arrival_time"`   // "15:04:05" at the to stop
+	Duration      int     `json:"duration"`       // Scheduled seconds from departing to arriving
+	Stops         int     `json:"stops"`          // How many stops the trip makes after the from stop, including the to stop
+	Distance      float64 `json:"distance"`       // km
+	DistanceFrom  string  `json:"distance_from"`  // DistanceFromShapeDistTraveled, DistanceFromShape or DistanceFromStops
+}
+
+/*
+Get the scheduled duration, number of stops and distance of riding a trip from one stop to another, e.g for fares and
+journey summaries
+
+The stops can be parent stations, their platforms the trip stops at are used
+*/
+func (v Database) GetLegMetrics(tripID, fromStopID, toStopID string) (LegMetrics, error) {
+	defer v.observeQuery("GetLegMetrics", time.Now())
+
+	trip, stopTimes, from, to, err := v.getTripLeg(tripID, fromStopID, toStopID)
+	if err != nil {
+		return LegMetrics{}, err
+	}
+
+	metrics := LegMetrics{
+		TripID:        trip.TripID,
+		FromStopID:    stopTimes[from].StopID,
+		ToStopID:      stopTimes[to].StopID,
+		DepartureTime: stopTimes[from].DepartureTime,
+		ArrivalTime:   stopTimes[to].ArrivalTime,
+		Stops:         to - from,
+	}
+	departure, errDeparture := parseGTFSTime(metrics.DepartureTime)
+	arrival, errArrival := parseGTFSTime(metrics.ArrivalTime)
+	if errDeparture == nil && errArrival == nil {
+		metrics.Duration = arrival - departure
+	}
+
+	line, err := v.tripPolyline(trip)
+	if err != nil {
+		return LegMetrics{}, err
+	}
+	fromAlong, toAlong, distanceFrom, err := v.legAlong(trip, line, stopTimes, from, to)
+	if err != nil {
+		return LegMetrics{}, err
+	}
+	metrics.Distance = math.Round((toAlong-fromAlong)*1000) / 1000
+	metrics.DistanceFrom = distanceFrom
+
+	v.stripIDs(&metrics)
+	return metrics, nil
+}
+
+type legStopTime struct {
+	StopID            string  `db:"stop_id"`
+	ParentStation     string  `db:"parent_station"`
+	ArrivalTime       string  `db:"arrival_time"`
+	DepartureTime     string  `db:"departure_time"`
+	ShapeDistTraveled float64 `db:"shape_dist_traveled"`
+	HasShapeDist      bool    `db:"has_shape_dist"`
+}
+
+/*
+Get a trip, its stop times and the indexes of the stop times riding it from one stop to another
+
+The stops can be parent stations. The to stop is the first one after the from stop, so trips looping back through a stop
+get the shortest ride
+*/
+func (v Database) getTripLeg(tripID, fromStopID, toStopID string) (Trip, []legStopTime, int, int, error) {
+	tripID, fromStopID, toStopID = v.PrefixID(tripID), v.PrefixID(fromStopID), v.PrefixID(toStopID)
+	trip, err := v.tripByID(tripID)
+	if err != nil {
+		return Trip{}, nil, 0, 0, errors.New("trip not found")
+	}
+
+	var stopTimes []legStopTime
+	err = v.db.Select(&stopTimes, `
+		SELECT st.stop_id, COALESCE(s.parent_station, '') AS parent_station,
+			COALESCE(st.arrival_time, '') AS arrival_time, COALESCE(st.departure_time, '') AS departure_time,
+			COALESCE(st.shape_dist_traveled, 0) AS shape_dist_traveled, st.shape_dist_traveled IS NOT NULL AS has_shape_dist
+		FROM stop_times st
+		LEFT JOIN stops s ON s.stop_id = st.stop_id
+		WHERE st.trip_id = ?
+		ORDER BY st.stop_sequence
+	`, tripID)
+	if err != nil {
+		return Trip{}, nil, 0, 0, err
+	}
+
+	from, to := -1, -1
+	for i, stopTime := range stopTimes {
+		matches := func(stopID string) bool {
+			return stopTime.StopID == stopID || (stopTime.ParentStation != "" && stopTime.ParentStation == stopID)
+		}
+		if from == -1 && matches(fromStopID) {
+			from = i
+		} else if from != -1 && matches(toStopID) {
+			to = i
+			break
+		}
+	}
+	if from == -1 || to == -1 {
+		return Trip{}, nil, 0, 0, errors.New("the trip doesn't go from the stop to the other stop")
+	}
+
+	return trip, stopTimes, from, to, nil
+}
+
+/*
+Get how far along the trip's line (km) the from and to stop times of a leg are, and where the distances came from (see
+DistanceFromShape)
+*/
+func (v Database) legAlong(trip Trip, line polyline, stopTimes []legStopTime, from, to int) (float64, float64, string, error) {
+	// shape_dist_traveled is in the feed's own units, so it's scaled by the shape's length
+	var shapeDistTotal float64
+	if trip.ShapeID != "" && stopTimes[from].HasShapeDist && stopTimes[to].HasShapeDist && stopTimes[to].ShapeDistTraveled > stopTimes[from].ShapeDistTraveled {
+		v.db.Get(&shapeDistTotal, `SELECT COALESCE(MAX(shape_dist_traveled), 0) FROM shapes WHERE shape_id = ?`, trip.ShapeID)
+	}
+	if shapeDistTotal > 0 && line.length() > 0 {
+		scale := line.length() / shapeDistTotal
+		return stopTimes[from].ShapeDistTraveled * scale, stopTimes[to].ShapeDistTraveled * scale, DistanceFromShapeDistTraveled, nil
+	}
+
+	// Otherwise each stop is found along the line after the one before it, so loops don't match the wrong pass
+	stops, err := v.stopsForTrip(trip.TripID)
+	if err != nil || len(stops) != len(stopTimes) {
+		return 0, 0, "", errors.New("no stops found for trip")
+	}
+	distances := stopDistancesAlong(line, stops)
+	distanceFrom := DistanceFromStops
+	if trip.ShapeID != "" {
+		distanceFrom = DistanceFromShape
+	}
+	return distances[from], distances[to], distanceFrom, nil
+}
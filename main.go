@@ -8,11 +8,19 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+/*
+A gtfs feed's database
+
+Safe to copy and to use from multiple goroutines, including while the data is refreshed. Copies share everything which
+changes (caches, subscribers, metrics etc) through the state pointer, the rest is set once by New
+*/
 type Database struct {
 	db          *sqlx.DB
 	url         string
 	timeZone    *time.Location
 	mailToEmail string
+
+	state *databaseState
 }
 
 /*
@@ -25,22 +33,38 @@ type Database struct {
   - tz: the timezone to process gtfs with
 
   - mailToEmail: the email to use with notifications (e.g hi@example.com (NOT: mailto:hi@example.com))
+
+  - options: optional settings e.g WithLogger
 */
-func New(url string, databaseName string, tz *time.Location, mailToEmail string) (Database, error) {
-	database, err := newDatabase(url, databaseName, tz, mailToEmail)
+func New(url string, databaseName string, tz *time.Location, mailToEmail string, options ...Option) (Database, error) {
+	database, err := newDatabase(url, databaseName, tz, mailToEmail, options...)
 	if err != nil {
-		panic(err)
+		return Database{}, err
 	}
 
-	// Check if the feed data is still up to date
+	// The writer keeps read only databases up to date
+	if database.IsReadOnly() {
+		return database, nil
+	}
+
+	// Check if the feed data is still up to date, merged feeds aren't refreshed from the url (see MergeFeeds)
 	isUpToDate, err := database.IsFeedDataUpToDate()
 
-	if !isUpToDate || err != nil {
-		fmt.Println("Feed data is not up to date.")
-		database.refreshDatabaseData()
+	if database.isMerged() {
+		database.logger().Info("feed data is merged, skipping refresh")
+		if err := database.createIndexes(); err != nil {
+			return Database{}, err
+		}
+	} else if !isUpToDate || err != nil {
+		database.logger().Info("feed data is not up to date")
+		if err := database.refreshDatabaseData(); err != nil {
+			return Database{}, err
+		}
 	} else {
-		fmt.Println("Feed data is still up to date.")
-		database.createIndexes()
+		database.logger().Info("feed data is still up to date")
+		if err := database.createIndexes(); err != nil {
+			return Database{}, err
+		}
 	}
 
 	database.EnableAutoUpdateGTFSData()
@@ -48,6 +72,13 @@ func New(url string, databaseName string, tz *time.Location, mailToEmail string)
 	return database, nil
 }
 
+/*
+Check if the database was opened read only (see WithReadOnly)
+*/
+func (v Database) IsReadOnly() bool {
+	return v.state != nil && v.state.readOnly
+}
+
 func (v Database) IsFeedDataUpToDate() (bool, error) {
 	// Parse the feed_end_date to a time.Time object
 	feedEndTime, err := v.FeedEndDate()
@@ -0,0 +1,58 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+What is run on the database after each refresh, see WithMaintenance
+*/
+type MaintenanceOptions struct {
+	Vacuum  bool // Reclaim the space left by the deleted feed data, the file stops growing with each refresh
+	Analyze bool // Update the statistics sqlite's query planner uses to choose indexes
+}
+
+func defaultMaintenanceOptions() MaintenanceOptions {
+	return MaintenanceOptions{Vacuum: true, Analyze: true}
+}
+
+/*
+Reclaim the unused space in the database file, update the query planner statistics and checkpoint the WAL
+
+This is run after each refresh (see WithMaintenance), queries are blocked while the database is vacuumed
+*/
+func (v Database) Maintenance() error {
+	return v.runMaintenance(MaintenanceOptions{Vacuum: true, Analyze: true})
+}
+
+func (v Database) runMaintenance(options MaintenanceOptions) error {
+	if v.IsReadOnly() {
+		return errors.New("can't run maintenance on a read only database")
+	}
+	if !options.Vacuum && !options.Analyze {
+		return nil
+	}
+
+	start := time.Now()
+
+	if options.Vacuum {
+		if _, err := v.db.Exec(`VACUUM`); err != nil {
+			return fmt.Errorf("failed to vacuum the database: %w", err)
+		}
+	}
+	if options.Analyze {
+		if _, err := v.db.Exec(`ANALYZE`); err != nil {
+			return fmt.Errorf("failed to analyze the database: %w", err)
+		}
+	}
+
+	// Vacuuming writes the whole database through the WAL, so truncate it afterwards
+	if _, err := v.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("failed to checkpoint the database: %w", err)
+	}
+
+	v.logger().Info("database maintenance finished", "vacuum", options.Vacuum, "analyze", options.Analyze, "duration", time.Since(start))
+	return nil
+}
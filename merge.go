@@ -0,0 +1,455 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+How close (m) stops in different feeds with the same name and location type have to be to be merged into one stop
+*/
+const mergedStopDistance = 10
+
+/*
+The columns with ids, which are prefixed with their feed's number when feeds are merged (or with the prefix from
+WithIDPrefix) so they don't clash
+*/
+var mergeIDColumns = []string{
+	"agency_id", "stop_id", "parent_station", "from_stop_id", "to_stop_id", "route_id", "from_route_id", "to_route_id",
+	"trip_id", "from_trip_id", "to_trip_id", "service_id", "shape_id", "block_id", "zone_id", "origin_id",
+	"destination_id", "contains_id", "fare_id", "level_id", "pathway_id", "attribution_id", "network_id", "area_id",
+	"from_area_id", "to_area_id", "fare_media_id", "fare_product_id", "leg_group_id", "from_leg_group_id",
+	"to_leg_group_id", "rider_category_id", "location_group_id", "location_id", "booking_rule_id",
+	"pickup_booking_rule_id", "drop_off_booking_rule_id", "record_id",
+}
+
+/*
+The columns which reference a stop
+*/
+var mergeStopColumns = []string{"stop_id", "parent_station", "from_stop_id", "to_stop_id"}
+
+/*
+The files whose empty agency_id means the feed's only agency, which is given an id so it doesn't clash with the other
+feeds' (attributions with no agency_id aren't for an agency)
+*/
+var mergeAgencyFiles = []string{"agency", "routes", "fare_attributes"}
+
+/*
+The id given to a feed's only agency when it doesn't have one, after the feed's prefix
+*/
+const mergedAgencyID = "agency"
+
+/*
+A csv file of a feed being merged
+*/
+type mergeFile struct {
+	headers []string
+	rows    [][]string
+}
+
+func (f *mergeFile) column(name string) int {
+	for i, header := range f.headers {
+		if header == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *mergeFile) value(row []string, name string) string {
+	if i := f.column(name); i != -1 && i < len(row) {
+		return strings.TrimSpace(row[i])
+	}
+	return ""
+}
+
+/*
+Combine feeds published separately (e.g a region's buses, trains and ferries) into one feed zip
+
+  - Every id is prefixed with its feed's number ("1:", "2:" etc in the order given, see MergedFeedPrefix), so they
+    don't clash. Realtime feeds use the unprefixed ids, see MergedFeedTripMatcher
+  - A feed's only agency is given the id "1:agency" etc if it doesn't have one
+  - Agencies with the same name and url are merged into the first feed's agency
+  - Stops with the same name and location type within 10m of each other are merged into the first feed's stop, use
+    ConflateStops for stops which are near each other but not the same
+  - feed_info.txt is merged into one row covering all of the feeds' dates
+*/
+func MergeFeedZips(srcs ...[]byte) ([]byte, error) {
+	if len(srcs) == 0 {
+		return nil, errors.New("missing feeds")
+	}
+
+	merged := make(map[string]*mergeFile)
+	var fileNames []string
+	var feedInfos []*mergeFile
+
+	keptStops := make(map[string][]mergeStop) // By lowercase name
+	keptAgencies := make(map[string]string)   // By name and url, to the kept agency id
+
+	for i, src := range srcs {
+		prefix := MergedFeedPrefix(i + 1)
+		files, err := readMergeFiles(src)
+		if err != nil {
+			return nil, fmt.Errorf("feed %d: %w", i+1, err)
+		}
+		for _, name := range mergeAgencyFiles {
+			if file, found := files[name]; found {
+				file.setDefault("agency_id", mergedAgencyID)
+			}
+		}
+
+		// Find this feed's agencies and stops which are duplicates of earlier feeds', before anything references them
+		agencyIDs := make(map[string]string)
+		if agencies, found := files["agency"]; found {
+			var rows [][]string
+			for _, row := range agencies.rows {
+				id := prefixID(prefix, agencies.value(row, "agency_id"))
+				key := strings.ToLower(agencies.value(row, "agency_name")) + "|" + strings.ToLower(agencies.value(row, "agency_url"))
+				if kept, found := keptAgencies[key]; found {
+					agencyIDs[id] = kept
+					continue
+				}
+				keptAgencies[key] = id
+				rows = append(rows, row)
+			}
+			agencies.rows = rows
+		}
+		stopIDs := make(map[string]string)
+		if stops, found := files["stops"]; found {
+			var rows [][]string
+			var added []mergeStop
+			for _, row := range stops.rows {
+				stop := mergeStop{
+					id:           prefixID(prefix, stops.value(row, "stop_id")),
+					name:         strings.ToLower(stops.value(row, "stop_name")),
+					locationType: stops.value(row, "location_type"),
+				}
+				if stop.locationType == "" {
+					stop.locationType = "0"
+				}
+				stop.lat, _ = strconv.ParseFloat(stops.value(row, "stop_lat"), 64)
+				stop.lon, _ = strconv.ParseFloat(stops.value(row, "stop_lon"), 64)
+				if kept, found := stop.duplicateOf(keptStops[stop.name]); found {
+					stopIDs[stop.id] = kept
+					continue
+				}
+				added = append(added, stop)
+				rows = append(rows, row)
+			}
+			// Only stops in earlier feeds are merged, a feed's own stops are all kept
+			for _, stop := range added {
+				keptStops[stop.name] = append(keptStops[stop.name], stop)
+			}
+			stops.rows = rows
+		}
+
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			file := files[name]
+			if name == "feed_info" {
+				feedInfos = append(feedInfos, file)
+				continue
+			}
+
+			for _, row := range file.rows {
+				for column, header := range file.headers {
+					if column >= len(row) || !contains(mergeIDColumns, header) {
+						continue
+					}
+					id := prefixID(prefix, row[column])
+					if header == "agency_id" {
+						if kept, found := agencyIDs[id]; found {
+							id = kept
+						}
+					}
+					if contains(mergeStopColumns, header) {
+						if kept, found := stopIDs[id]; found {
+							id = kept
+						}
+					}
+					row[column] = id
+				}
+			}
+
+			target, found := merged[name]
+			if !found {
+				target = &mergeFile{}
+				merged[name] = target
+				fileNames = append(fileNames, name)
+			}
+			target.append(file)
+		}
+	}
+
+	if len(feedInfos) > 0 {
+		merged["feed_info"] = mergeFeedInfo(feedInfos)
+		fileNames = append(fileNames, "feed_info")
+	}
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, name := range fileNames {
+		f, err := writer.Create(name + ".txt")
+		if err != nil {
+			return nil, err
+		}
+		csvWriter := csv.NewWriter(f)
+		csvWriter.Write(merged[name].headers)
+		csvWriter.WriteAll(merged[name].rows)
+		if err := csvWriter.Error(); err != nil {
+			return nil, fmt.Errorf("failed to write %s.txt: %w", name, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Merge feeds into the database, replacing its feed data, see MergeFeedZips
+
+The database isn't refreshed from its url once feeds are merged into it (the scheduled refreshes are skipped), run this
+again with the feeds' new zips to update it. Each feed's realtime data is matched to its trips with
+MergedFeedTripMatcher, or ActiveTripsOptions.Feed
+*/
+func MergeFeeds(dst Database, srcs ...[]byte) error {
+	if dst.IsReadOnly() {
+		return errors.New("can't merge into a read only database")
+	}
+
+	start := time.Now()
+	merged, err := MergeFeedZips(srcs...)
+	if err != nil {
+		return err
+	}
+
+	dst.logger().Info("importing merged feeds", "feeds", len(srcs))
+	return dst.importFeedZip(merged, start, true)
+}
+
+/*
+Get the prefix added to the ids of one of the merged feeds, "1:" for the first feed given to MergeFeeds
+*/
+func MergedFeedPrefix(feed int) string {
+	return strconv.Itoa(feed) + ":"
+}
+
+/*
+Record that feeds were merged into the database in feed_meta, so it's still known after a restart. It's written in the
+import's transaction after the old feed data (and the row) are deleted, so a database refreshed from its url isn't merged
+anymore
+*/
+func writeMerged(tx *sql.Tx, merged bool) error {
+	if !merged {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO feed_meta (key, value) VALUES ('merged', '1')`); err != nil {
+		return fmt.Errorf("failed to record the merged feeds: %w", err)
+	}
+	return nil
+}
+
+func (v Database) setMerged(merged bool) {
+	if v.state == nil {
+		return
+	}
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	v.state.merged = merged
+}
+
+/*
+Read if feeds were merged into the database from feed_meta, see writeMerged
+*/
+func (v Database) loadMerged() error {
+	var merged bool
+	if err := v.db.Get(&merged, `SELECT EXISTS (SELECT 1 FROM feed_meta WHERE key = 'merged')`); err != nil {
+		return fmt.Errorf("failed to read the feed meta: %w", err)
+	}
+	v.state.merged = merged
+	return nil
+}
+
+/*
+Check if feeds were merged into the database, see MergeFeeds
+*/
+func (v Database) isMerged() bool {
+	if v.state == nil {
+		return false
+	}
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	return v.state.merged
+}
+
+func prefixID(prefix, id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return ""
+	}
+	return prefix + id
+}
+
+type mergeStop struct {
+	id, name, locationType string
+	lat, lon               float64
+}
+
+/*
+Find an earlier feed's stop (from those with the same name) which is the same stop, its id and true if there is one
+*/
+func (s mergeStop) duplicateOf(stops []mergeStop) (string, bool) {
+	if s.name == "" {
+		return "", false
+	}
+	for _, kept := range stops {
+		if kept.name == s.name && kept.locationType == s.locationType &&
+			calculateDistance(kept.lat, kept.lon, s.lat, s.lon)*1000 <= mergedStopDistance {
+			return kept.id, true
+		}
+	}
+	return "", false
+}
+
+/*
+Set a column's empty values (adding the column if the file doesn't have it)
+*/
+func (f *mergeFile) setDefault(name, value string) {
+	column := f.column(name)
+	if column == -1 {
+		f.append(&mergeFile{headers: []string{name}})
+		column = f.column(name)
+	}
+	for i, row := range f.rows {
+		for len(row) <= column {
+			row = append(row, "")
+		}
+		if strings.TrimSpace(row[column]) == "" {
+			row[column] = value
+		}
+		f.rows[i] = row
+	}
+}
+
+/*
+Add the rows of another feed's file, adding any columns this one doesn't have
+*/
+func (f *mergeFile) append(other *mergeFile) {
+	positions := make([]int, len(other.headers))
+	for i, header := range other.headers {
+		position := f.column(header)
+		if position == -1 {
+			f.headers = append(f.headers, header)
+			for j := range f.rows {
+				f.rows[j] = append(f.rows[j], "")
+			}
+			position = len(f.headers) - 1
+		}
+		positions[i] = position
+	}
+
+	for _, row := range other.rows {
+		merged := make([]string, len(f.headers))
+		for i, value := range row {
+			if i < len(positions) {
+				merged[positions[i]] = value
+			}
+		}
+		f.rows = append(f.rows, merged)
+	}
+}
+
+/*
+Merge the feeds' feed_info into the first feed's row, covering all of their dates, with their versions joined by "+"
+*/
+func mergeFeedInfo(feedInfos []*mergeFile) *mergeFile {
+	merged := &mergeFile{}
+	var versions []string
+	var startDate, endDate string
+	for _, feedInfo := range feedInfos {
+		if len(feedInfo.rows) == 0 {
+			continue
+		}
+		row := feedInfo.rows[0]
+		if len(merged.rows) == 0 {
+			merged.append(&mergeFile{headers: feedInfo.headers, rows: [][]string{row}})
+		}
+		if version := feedInfo.value(row, "feed_version"); version != "" {
+			versions = append(versions, version)
+		}
+		// Dates are "20060102" so they compare as strings
+		if date := feedInfo.value(row, "feed_start_date"); date != "" && (startDate == "" || date < startDate) {
+			startDate = date
+		}
+		if date := feedInfo.value(row, "feed_end_date"); date != "" && date > endDate {
+			endDate = date
+		}
+	}
+	if len(merged.rows) == 0 {
+		return merged
+	}
+
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if merged.column(name) == -1 {
+			merged.append(&mergeFile{headers: []string{name}})
+		}
+		merged.rows[0][merged.column(name)] = value
+	}
+	set("feed_version", strings.Join(versions, "+"))
+	set("feed_start_date", startDate)
+	set("feed_end_date", endDate)
+	return merged
+}
+
+/*
+Read the csv files of a feed zip, by their table name
+*/
+func readMergeFiles(src []byte) (map[string]*mergeFile, error) {
+	reader, err := zip.NewReader(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		return nil, errors.New("error reading GTFS zip file")
+	}
+
+	files := make(map[string]*mergeFile)
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() || !isCSVFile(file.Name) {
+			continue
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening file %s: %v", file.Name, err)
+		}
+		records, err := newFeedCSVReader(f, true).ReadAll()
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error reading %s: %v", file.Name, err)
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		headers := records[0]
+		for i := range headers {
+			headers[i] = strings.TrimSpace(headers[i])
+		}
+		files[feedFileTable(file.Name)] = &mergeFile{headers: headers, rows: records[1:]}
+	}
+	return files, nil
+}
@@ -0,0 +1,285 @@
+package gtfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Receives measurements of the database, e.g to export them to prometheus (see MetricsRegistry)
+*/
+type Metrics interface {
+	// Called after the feed data has been refreshed (or failed to)
+	ImportFinished(duration time.Duration, err error)
+	// Called after each file of the feed is imported
+	RowsImported(table string, rows int)
+	// Called after a query api (e.g GetActiveTrips) returns
+	QueryFinished(api string, duration time.Duration)
+	// Called after a notification has been sent to a client (or failed to after retrying)
+	NotificationSent(channel string, err error)
+}
+
+/*
+Set where the measurements of the database are sent, nil to stop sending them
+*/
+func (v Database) SetMetrics(m Metrics) {
+	if v.state == nil {
+		return
+	}
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	v.state.metrics = m
+}
+
+func (v Database) metrics() Metrics {
+	if v.state == nil {
+		return nil
+	}
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	return v.state.metrics
+}
+
+/*
+Record how long a query api took, use with defer at the start of the api
+
+	defer v.observeQuery("GetStops", time.Now())
+*/
+func (v Database) observeQuery(api string, start time.Time) {
+	if m := v.metrics(); m != nil {
+		m.QueryFinished(api, time.Since(start))
+	}
+}
+
+func (v Database) observeImport(start time.Time, err error) {
+	if m := v.metrics(); m != nil {
+		m.ImportFinished(time.Since(start), err)
+	}
+}
+
+/*
+Buckets (seconds) of the duration histograms
+*/
+var metricsBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30, 120, 600}
+
+type histogram struct {
+	counts []uint64 // By bucket
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricsBuckets))
+	}
+	for i, bucket := range metricsBuckets {
+		if seconds <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+/*
+An in memory store of metrics which can be served in the prometheus text format
+
+It implements both Metrics and realtime.Metrics
+
+	registry := gtfs.NewMetricsRegistry()
+	db.SetMetrics(registry)
+	realtime.SetMetrics(registry)
+	http.Handle("/metrics", registry)
+*/
+type MetricsRegistry struct {
+	mutex sync.Mutex
+
+	imports        map[string]uint64 // By result
+	importDuration histogram
+	rowsImported   map[string]uint64 // By table
+	queries        map[string]*histogram
+	fetches        map[[2]string]uint64 // By feed and result
+	fetchDuration  map[string]*histogram
+	notifications  map[[2]string]uint64 // By channel and result
+	caches         []func() []CacheStats
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		imports:       make(map[string]uint64),
+		rowsImported:  make(map[string]uint64),
+		queries:       make(map[string]*histogram),
+		fetches:       make(map[[2]string]uint64),
+		fetchDuration: make(map[string]*histogram),
+		notifications: make(map[[2]string]uint64),
+	}
+}
+
+func (r *MetricsRegistry) ImportFinished(duration time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.imports[metricsResult(err)]++
+	r.importDuration.observe(duration.Seconds())
+}
+
+func (r *MetricsRegistry) RowsImported(table string, rows int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rowsImported[table] += uint64(rows)
+}
+
+func (r *MetricsRegistry) QueryFinished(api string, duration time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.queries[api] == nil {
+		r.queries[api] = &histogram{}
+	}
+	r.queries[api].observe(duration.Seconds())
+}
+
+func (r *MetricsRegistry) NotificationSent(channel string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.notifications[[2]string{channel, metricsResult(err)}]++
+}
+
+func (r *MetricsRegistry) FetchFinished(feed string, url string, duration time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.fetches[[2]string{feed, metricsResult(err)}]++
+	if r.fetchDuration[feed] == nil {
+		r.fetchDuration[feed] = &histogram{}
+	}
+	r.fetchDuration[feed].observe(duration.Seconds())
+}
+
+/*
+Include the hit/miss stats of caches in the metrics
+*/
+func (r *MetricsRegistry) TrackCaches(stats func() []CacheStats) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.caches = append(r.caches, stats)
+}
+
+/*
+Write the metrics in the prometheus text format
+*/
+func (r *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	// The caches can record queries while loading, so get their stats before locking
+	r.mutex.Lock()
+	cacheStatsFuncs := append([]func() []CacheStats(nil), r.caches...)
+	r.mutex.Unlock()
+	var cacheStats []CacheStats
+	for _, stats := range cacheStatsFuncs {
+		cacheStats = append(cacheStats, stats()...)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# TYPE gtfs_imports_total counter\n")
+	for _, result := range sortedKeys(r.imports) {
+		fmt.Fprintf(&b, "gtfs_imports_total{result=%q} %d\n", result, r.imports[result])
+	}
+	b.WriteString("# TYPE gtfs_import_duration_seconds histogram\n")
+	writeHistogram(&b, "gtfs_import_duration_seconds", "", &r.importDuration)
+
+	b.WriteString("# TYPE gtfs_rows_imported_total counter\n")
+	for _, table := range sortedKeys(r.rowsImported) {
+		fmt.Fprintf(&b, "gtfs_rows_imported_total{table=%q} %d\n", table, r.rowsImported[table])
+	}
+
+	b.WriteString("# TYPE gtfs_query_duration_seconds histogram\n")
+	for _, api := range sortedKeys(r.queries) {
+		writeHistogram(&b, "gtfs_query_duration_seconds", fmt.Sprintf("api=%q", api), r.queries[api])
+	}
+
+	b.WriteString("# TYPE gtfs_realtime_fetches_total counter\n")
+	for _, key := range sortedPairKeys(r.fetches) {
+		fmt.Fprintf(&b, "gtfs_realtime_fetches_total{feed=%q,result=%q} %d\n", key[0], key[1], r.fetches[key])
+	}
+	b.WriteString("# TYPE gtfs_realtime_fetch_duration_seconds histogram\n")
+	for _, feed := range sortedKeys(r.fetchDuration) {
+		writeHistogram(&b, "gtfs_realtime_fetch_duration_seconds", fmt.Sprintf("feed=%q", feed), r.fetchDuration[feed])
+	}
+
+	b.WriteString("# TYPE gtfs_notifications_total counter\n")
+	for _, key := range sortedPairKeys(r.notifications) {
+		fmt.Fprintf(&b, "gtfs_notifications_total{channel=%q,result=%q} %d\n", key[0], key[1], r.notifications[key])
+	}
+
+	b.WriteString("# TYPE gtfs_cache_hits_total counter\n# TYPE gtfs_cache_misses_total counter\n")
+	for _, stats := range cacheStats {
+		fmt.Fprintf(&b, "gtfs_cache_hits_total{cache=%q} %d\n", stats.Name, stats.Hits)
+		fmt.Fprintf(&b, "gtfs_cache_misses_total{cache=%q} %d\n", stats.Name, stats.Misses)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+/*
+Serve the metrics in the prometheus text format
+*/
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WritePrometheus(w)
+}
+
+func writeHistogram(b *strings.Builder, name string, labels string, h *histogram) {
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+	for i, bucket := range metricsBuckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, separator, bucket, count)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func metricsResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPairKeys(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
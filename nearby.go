@@ -0,0 +1,116 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+How fast people walk (km/h), for the walking times to nearby stops
+*/
+const walkingSpeed = 4.8
+
+type NearbyStation struct {
+	Station     Stop        `json:"station"`      // The parent station, or the stop itself if it isn't part of one
+	Distance    float64     `json:"distance"`     // How far the closest of its stops is (m)
+	WalkingTime int         `json:"walking_time"` // Minutes to walk to the closest of its stops
+	Departures  []StopTimes `json:"departures"`   // The departures from all of its stops, in time order
+}
+
+/*
+Get the departures from the stops around a point, grouped by station and sorted by how far away they are
+
+  - radius: how far from the point to look for stops (m)
+  - window: how far ahead to get the departures for
+  - rt: the realtime data to attach to the departures, can be empty
+*/
+func (v Database) GetNearbyDepartures(lat, lon, radius float64, window time.Duration, rt TripRealtime) ([]NearbyStation, error) {
+	defer v.observeQuery("GetNearbyDepartures", time.Now())
+
+	if radius <= 0 {
+		return nil, errors.New("invalid radius")
+	}
+	if window <= 0 {
+		return nil, errors.New("invalid window")
+	}
+
+	// Narrow the stops down with a bounding box before working out their actual distance
+	latDelta := radius / 111320
+	lonDelta := radius / (111320 * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+	var stops Stops
+	err := v.db.Select(&stops, `
+		SELECT stop_id, stop_code, stop_name, stop_lat, stop_lon, location_type, parent_station, platform_code, zone_id, wheelchair_boarding
+		FROM stops
+		WHERE COALESCE(location_type, 0) = 0
+		  AND stop_lat BETWEEN ? AND ?
+		  AND stop_lon BETWEEN ? AND ?
+	`, lat-latDelta, lat+latDelta, lon-lonDelta, lon+lonDelta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the stops by their station, keeping the closest distance
+	stations := make(map[string]*NearbyStation)
+	var stationIDs []string
+	for _, stop := range stops {
+		distance := calculateDistance(lat, lon, stop.StopLat, stop.StopLon) * 1000
+		if distance > radius {
+			continue
+		}
+
+		stationID := stop.StopId
+		if stop.ParentStation != "" {
+			stationID = stop.ParentStation
+		}
+		station, found := stations[stationID]
+		if !found {
+			station = &NearbyStation{Station: stop, Distance: distance, Departures: []StopTimes{}}
+			if stop.ParentStation != "" {
+				if parent, err := v.stopByID(stop.ParentStation); err == nil {
+					station.Station = *parent
+				}
+			}
+			stations[stationID] = station
+			stationIDs = append(stationIDs, stationID)
+		}
+		station.Distance = math.Min(station.Distance, distance)
+	}
+
+	nearby := make([]NearbyStation, 0, len(stationIDs))
+	for _, stationID := range stationIDs {
+		station := stations[stationID]
+
+		location := v.locationFor(stationID, "")
+		now := time.Now().In(location)
+		day := ServiceDayOf(now, location)
+		from := day.FormatTime(now)
+		to := formatGTFSTime(day.Seconds(now.Add(window)))
+
+		departures, err := v.activeTrips(ActiveTripsOptions{
+			StopID:      stationID,
+			ByStation:   true,
+			Date:        day.String(),
+			From:        from,
+			To:          to,
+			TripUpdates: rt.TripUpdates,
+			Alerts:      rt.Alerts,
+		})
+		if err != nil {
+			v.logger().Warn("failed to get nearby departures", "stop_id", stationID, "error", err)
+		} else if departures != nil {
+			station.Departures = departures
+		}
+
+		station.Distance = math.Round(station.Distance)
+		station.WalkingTime = int(math.Ceil(station.Distance / 1000 / walkingSpeed * 60))
+		nearby = append(nearby, *station)
+	}
+
+	sort.SliceStable(nearby, func(i, j int) bool {
+		return nearby[i].Distance < nearby[j].Distance
+	})
+	v.stripIDs(&nearby)
+	return nearby, nil
+}
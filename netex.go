@@ -0,0 +1,659 @@
+package gtfs
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const netexNamespace = "http://www.netex.org.uk/netex"
+
+/*
+Write the feed as a NeTEx PublicationDelivery document to w, for data portals which require NeTEx instead of gtfs
+
+  - codespace: the prefix of every NeTEx id (e.g "NZ"), ids are "<codespace>:<type>:<gtfs id>"
+
+Only a basic publication is written: the agencies (operators), stops (stop places and quays), routes (lines),
+stop patterns (service journey patterns), calendars (day types) and trips (service journeys with their times).
+Fares, shapes, transfers and pathways aren't included
+*/
+func (v Database) ExportNeTEx(w io.Writer, codespace string) error {
+	if w == nil {
+		return errors.New("missing writer")
+	}
+	if codespace == "" {
+		return errors.New("missing codespace")
+	}
+
+	agencies, err := v.agencies()
+	if err != nil {
+		return fmt.Errorf("failed to get agencies: %w", err)
+	}
+	if len(agencies) == 0 {
+		return errors.New("no agencies found")
+	}
+
+	var stops []netexStop
+	err = v.db.Select(&stops, `
+		SELECT stop_id, COALESCE(stop_code, '') AS stop_code, COALESCE(stop_name, '') AS stop_name, COALESCE(stop_lat, 0) AS stop_lat,
+			COALESCE(stop_lon, 0) AS stop_lon, COALESCE(location_type, 0) AS location_type, COALESCE(parent_station, '') AS parent_station,
+			COALESCE(platform_code, '') AS platform_code
+		FROM stops ORDER BY stop_id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to get stops: %w", err)
+	}
+
+	var routes []netexRoute
+	err = v.db.Select(&routes, `
+		SELECT route_id, COALESCE(agency_id, '') AS agency_id, route_short_name, route_long_name, route_type, COALESCE(route_color, '') AS route_color
+		FROM routes ORDER BY route_id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to get routes: %w", err)
+	}
+
+	n := &netexWriter{encoder: xml.NewEncoder(w), codespace: codespace, idPrefix: v.IDPrefix()}
+	n.encoder.Indent("", "  ")
+	io.WriteString(w, xml.Header)
+
+	n.start("PublicationDelivery", xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: netexNamespace}, xml.Attr{Name: xml.Name{Local: "version"}, Value: "1.1"})
+	n.text("PublicationTimestamp", time.Now().Format("2006-01-02T15:04:05"))
+	n.text("ParticipantRef", codespace)
+	n.start("dataObjects")
+	n.start("CompositeFrame", n.idAttrs("CompositeFrame", "1")...)
+	n.start("frames")
+
+	n.writeResourceFrame(agencies)
+	n.writeSiteFrame(stops)
+	if n.err == nil {
+		n.err = v.writeNeTExServiceFrame(n, agencies, routes, stops)
+	}
+	if n.err == nil {
+		n.err = v.writeNeTExCalendarFrame(n)
+	}
+	if n.err == nil {
+		n.err = v.writeNeTExTimetableFrame(n)
+	}
+
+	n.end("frames")
+	n.end("CompositeFrame")
+	n.end("dataObjects")
+	n.end("PublicationDelivery")
+
+	if n.err == nil {
+		n.err = n.encoder.Flush()
+	}
+	if n.err != nil {
+		return fmt.Errorf("failed to export netex: %w", n.err)
+	}
+	return nil
+}
+
+type netexStop struct {
+	StopId        string  `db:"stop_id"`
+	StopCode      string  `db:"stop_code"`
+	StopName      string  `db:"stop_name"`
+	StopLat       float64 `db:"stop_lat"`
+	StopLon       float64 `db:"stop_lon"`
+	LocationType  int     `db:"location_type"`
+	ParentStation string  `db:"parent_station"`
+	PlatformCode  string  `db:"platform_code"`
+}
+
+type netexRoute struct {
+	RouteId        string `db:"route_id"`
+	AgencyId       string `db:"agency_id"`
+	RouteShortName string `db:"route_short_name"`
+	RouteLongName  string `db:"route_long_name"`
+	RouteType      int    `db:"route_type"`
+	RouteColor     string `db:"route_color"`
+}
+
+/*
+A trip with its stop times, read in order from stop_times
+*/
+type netexTrip struct {
+	TripID        string
+	RouteID       string
+	ServiceID     string
+	DirectionID   int
+	Headsign      string
+	StopIDs       []string
+	ArrivalSecs   []sql.NullInt64
+	DepartureSecs []sql.NullInt64
+}
+
+/*
+Trips with the same route, direction and stops share a journey pattern
+*/
+func (t netexTrip) patternKey() string {
+	return t.RouteID + "|" + strconv.Itoa(t.DirectionID) + "|" + strings.Join(t.StopIDs, "|")
+}
+
+/*
+Writes the document, keeping the first error so each element doesn't need checking
+*/
+type netexWriter struct {
+	encoder   *xml.Encoder
+	codespace string
+	idPrefix  string // Removed from the gtfs ids, so they are the feed's own ids (see WithIDPrefix)
+	err       error
+
+	patterns map[string]string // Journey pattern ids by netexTrip.patternKey
+}
+
+func (n *netexWriter) id(kind, id string) string {
+	return n.codespace + ":" + kind + ":" + strings.TrimPrefix(id, n.idPrefix)
+}
+
+func (n *netexWriter) idAttrs(kind, id string) []xml.Attr {
+	return []xml.Attr{
+		{Name: xml.Name{Local: "id"}, Value: n.id(kind, id)},
+		{Name: xml.Name{Local: "version"}, Value: "1"},
+	}
+}
+
+func (n *netexWriter) start(name string, attrs ...xml.Attr) {
+	if n.err == nil {
+		n.err = n.encoder.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}, Attr: attrs})
+	}
+}
+
+func (n *netexWriter) end(name string) {
+	if n.err == nil {
+		n.err = n.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+	}
+}
+
+func (n *netexWriter) text(name, value string) {
+	if n.err == nil {
+		n.err = n.encoder.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}})
+	}
+}
+
+/*
+An empty element referencing another element, e.g <LineRef ref="NZ:Line:1"/>
+*/
+func (n *netexWriter) ref(name, kind, id string) {
+	n.start(name, xml.Attr{Name: xml.Name{Local: "ref"}, Value: n.id(kind, id)})
+	n.end(name)
+}
+
+func (n *netexWriter) location(lat, lon float64) {
+	n.start("Centroid")
+	n.start("Location")
+	n.text("Longitude", strconv.FormatFloat(lon, 'f', -1, 64))
+	n.text("Latitude", strconv.FormatFloat(lat, 'f', -1, 64))
+	n.end("Location")
+	n.end("Centroid")
+}
+
+/*
+The agencies as operators
+*/
+func (n *netexWriter) writeResourceFrame(agencies []Agency) {
+	n.start("ResourceFrame", n.idAttrs("ResourceFrame", "1")...)
+	n.start("organisations")
+	for _, agency := range agencies {
+		n.start("Operator", n.idAttrs("Operator", netexAgencyID(agency.AgencyId))...)
+		n.text("Name", agency.AgencyName)
+		if agency.AgencyUrl != "" || agency.AgencyPhone != "" || agency.AgencyEmail != "" {
+			n.start("ContactDetails")
+			if agency.AgencyEmail != "" {
+				n.text("Email", agency.AgencyEmail)
+			}
+			if agency.AgencyPhone != "" {
+				n.text("Phone", agency.AgencyPhone)
+			}
+			if agency.AgencyUrl != "" {
+				n.text("Url", agency.AgencyUrl)
+			}
+			n.end("ContactDetails")
+		}
+		n.end("Operator")
+	}
+	n.end("organisations")
+	n.end("ResourceFrame")
+}
+
+/*
+The stations as stop places containing their platforms/stops as quays
+
+Stops without a parent station become a stop place with a single quay of the same id
+*/
+func (n *netexWriter) writeSiteFrame(stops []netexStop) {
+	quays := make(map[string][]netexStop)
+	for _, stop := range stops {
+		if stop.LocationType == 0 && stop.ParentStation != "" {
+			quays[stop.ParentStation] = append(quays[stop.ParentStation], stop)
+		}
+	}
+
+	n.start("SiteFrame", n.idAttrs("SiteFrame", "1")...)
+	n.start("stopPlaces")
+	for _, stop := range stops {
+		var stopQuays []netexStop
+		switch {
+		case stop.LocationType == 1:
+			stopQuays = quays[stop.StopId]
+		case stop.LocationType == 0 && stop.ParentStation == "":
+			stopQuays = []netexStop{stop}
+		default:
+			continue
+		}
+
+		n.start("StopPlace", n.idAttrs("StopPlace", stop.StopId)...)
+		n.text("Name", stop.StopName)
+		n.location(stop.StopLat, stop.StopLon)
+		if stop.StopCode != "" {
+			n.text("PublicCode", stop.StopCode)
+		}
+		if len(stopQuays) > 0 {
+			n.start("quays")
+			for _, quay := range stopQuays {
+				n.start("Quay", n.idAttrs("Quay", quay.StopId)...)
+				n.text("Name", quay.StopName)
+				n.location(quay.StopLat, quay.StopLon)
+				if quay.PlatformCode != "" {
+					n.text("PublicCode", quay.PlatformCode)
+				}
+				n.end("Quay")
+			}
+			n.end("quays")
+		}
+		n.end("StopPlace")
+	}
+	n.end("stopPlaces")
+	n.end("SiteFrame")
+}
+
+/*
+The routes as lines, the stops trips can stop at as scheduled stop points (assigned to their quays),
+and a journey pattern for each distinct sequence of stops
+*/
+func (v Database) writeNeTExServiceFrame(n *netexWriter, agencies []Agency, routes []netexRoute, stops []netexStop) error {
+	n.start("ServiceFrame", n.idAttrs("ServiceFrame", "1")...)
+
+	n.start("lines")
+	for _, route := range routes {
+		agencyID := route.AgencyId
+		if agencyID == "" {
+			// The agency can only be left out when the feed has one
+			agencyID = agencies[0].AgencyId
+		}
+
+		name := route.RouteLongName
+		if name == "" {
+			name = route.RouteShortName
+		}
+
+		n.start("Line", n.idAttrs("Line", route.RouteId)...)
+		n.text("Name", name)
+		n.text("TransportMode", netexTransportMode(route.RouteType))
+		if route.RouteShortName != "" {
+			n.text("PublicCode", route.RouteShortName)
+		}
+		n.ref("OperatorRef", "Operator", netexAgencyID(agencyID))
+		if color := NormalizeColor(route.RouteColor); color != "" {
+			n.start("Presentation")
+			n.text("Colour", color)
+			n.end("Presentation")
+		}
+		n.end("Line")
+	}
+	n.end("lines")
+
+	n.start("scheduledStopPoints")
+	for _, stop := range stops {
+		if stop.LocationType != 0 {
+			continue
+		}
+		n.start("ScheduledStopPoint", n.idAttrs("ScheduledStopPoint", stop.StopId)...)
+		n.text("Name", stop.StopName)
+		n.end("ScheduledStopPoint")
+	}
+	n.end("scheduledStopPoints")
+
+	n.start("stopAssignments")
+	order := 0
+	for _, stop := range stops {
+		if stop.LocationType != 0 {
+			continue
+		}
+		order++
+		attrs := append(n.idAttrs("PassengerStopAssignment", stop.StopId), xml.Attr{Name: xml.Name{Local: "order"}, Value: strconv.Itoa(order)})
+		n.start("PassengerStopAssignment", attrs...)
+		n.ref("ScheduledStopPointRef", "ScheduledStopPoint", stop.StopId)
+		n.ref("QuayRef", "Quay", stop.StopId)
+		n.end("PassengerStopAssignment")
+	}
+	n.end("stopAssignments")
+
+	n.patterns = make(map[string]string)
+	n.start("journeyPatterns")
+	err := v.forEachNeTExTrip(func(trip netexTrip) error {
+		key := trip.patternKey()
+		if _, ok := n.patterns[key]; ok {
+			return n.err
+		}
+		patternID := trip.RouteID + "-" + strconv.Itoa(len(n.patterns)+1)
+		n.patterns[key] = patternID
+
+		n.start("ServiceJourneyPattern", n.idAttrs("ServiceJourneyPattern", patternID)...)
+		n.text("DirectionType", netexDirectionType(trip.DirectionID))
+		n.start("pointsInSequence")
+		for i, stopID := range trip.StopIDs {
+			attrs := append(n.idAttrs("StopPointInJourneyPattern", patternID+"-"+strconv.Itoa(i+1)), xml.Attr{Name: xml.Name{Local: "order"}, Value: strconv.Itoa(i + 1)})
+			n.start("StopPointInJourneyPattern", attrs...)
+			n.ref("ScheduledStopPointRef", "ScheduledStopPoint", stopID)
+			n.end("StopPointInJourneyPattern")
+		}
+		n.end("pointsInSequence")
+		n.end("ServiceJourneyPattern")
+		return n.err
+	})
+	if err != nil {
+		return err
+	}
+	n.end("journeyPatterns")
+
+	n.end("ServiceFrame")
+	return n.err
+}
+
+/*
+The services as day types, with the calendar's date range as operating periods and calendar_dates as dated exceptions
+*/
+func (v Database) writeNeTExCalendarFrame(n *netexWriter) error {
+	var calendars []struct {
+		ServiceID string `db:"service_id"`
+		Monday    bool   `db:"monday"`
+		Tuesday   bool   `db:"tuesday"`
+		Wednesday bool   `db:"wednesday"`
+		Thursday  bool   `db:"thursday"`
+		Friday    bool   `db:"friday"`
+		Saturday  bool   `db:"saturday"`
+		Sunday    bool   `db:"sunday"`
+		StartDate string `db:"start_date"`
+		EndDate   string `db:"end_date"`
+	}
+	err := v.db.Select(&calendars, `SELECT service_id, monday, tuesday, wednesday, thursday, friday, saturday, sunday, start_date, end_date FROM calendar ORDER BY service_id`)
+	if err != nil {
+		return fmt.Errorf("failed to get calendars: %w", err)
+	}
+
+	var calendarDates []struct {
+		ServiceID     string `db:"service_id"`
+		Date          string `db:"date"`
+		ExceptionType int    `db:"exception_type"`
+	}
+	err = v.db.Select(&calendarDates, `SELECT service_id, date, exception_type FROM calendar_dates ORDER BY service_id, date`)
+	if err != nil {
+		return fmt.Errorf("failed to get calendar dates: %w", err)
+	}
+
+	// Services can be only in calendar_dates
+	days := make(map[string][]string)
+	for _, calendar := range calendars {
+		var weekdays []string
+		for day, runs := range map[string]bool{
+			"Monday": calendar.Monday, "Tuesday": calendar.Tuesday, "Wednesday": calendar.Wednesday, "Thursday": calendar.Thursday,
+			"Friday": calendar.Friday, "Saturday": calendar.Saturday, "Sunday": calendar.Sunday,
+		} {
+			if runs {
+				weekdays = append(weekdays, day)
+			}
+		}
+		sort.Slice(weekdays, func(i, j int) bool {
+			return netexWeekdayOrder[weekdays[i]] < netexWeekdayOrder[weekdays[j]]
+		})
+		days[calendar.ServiceID] = weekdays
+	}
+	for _, calendarDate := range calendarDates {
+		if _, ok := days[calendarDate.ServiceID]; !ok {
+			days[calendarDate.ServiceID] = nil
+		}
+	}
+	serviceIDs := make([]string, 0, len(days))
+	for serviceID := range days {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+
+	n.start("ServiceCalendarFrame", n.idAttrs("ServiceCalendarFrame", "1")...)
+
+	n.start("dayTypes")
+	for _, serviceID := range serviceIDs {
+		n.start("DayType", n.idAttrs("DayType", serviceID)...)
+		if weekdays := days[serviceID]; len(weekdays) > 0 {
+			n.start("properties")
+			n.start("PropertyOfDay")
+			n.text("DaysOfWeek", strings.Join(weekdays, " "))
+			n.end("PropertyOfDay")
+			n.end("properties")
+		}
+		n.end("DayType")
+	}
+	n.end("dayTypes")
+
+	if len(calendars) > 0 {
+		n.start("operatingPeriods")
+		for _, calendar := range calendars {
+			n.start("OperatingPeriod", n.idAttrs("OperatingPeriod", calendar.ServiceID)...)
+			n.text("FromDate", netexDate(calendar.StartDate)+"T00:00:00")
+			n.text("ToDate", netexDate(calendar.EndDate)+"T00:00:00")
+			n.end("OperatingPeriod")
+		}
+		n.end("operatingPeriods")
+	}
+
+	n.start("dayTypeAssignments")
+	order := 0
+	assignment := func(id string) {
+		order++
+		attrs := append(n.idAttrs("DayTypeAssignment", id), xml.Attr{Name: xml.Name{Local: "order"}, Value: strconv.Itoa(order)})
+		n.start("DayTypeAssignment", attrs...)
+	}
+	for _, calendar := range calendars {
+		assignment(calendar.ServiceID)
+		n.ref("OperatingPeriodRef", "OperatingPeriod", calendar.ServiceID)
+		n.ref("DayTypeRef", "DayType", calendar.ServiceID)
+		n.end("DayTypeAssignment")
+	}
+	for _, calendarDate := range calendarDates {
+		assignment(calendarDate.ServiceID + "-" + calendarDate.Date)
+		n.text("Date", netexDate(calendarDate.Date))
+		n.ref("DayTypeRef", "DayType", calendarDate.ServiceID)
+		n.text("isAvailable", strconv.FormatBool(calendarDate.ExceptionType == 1))
+		n.end("DayTypeAssignment")
+	}
+	n.end("dayTypeAssignments")
+
+	n.end("ServiceCalendarFrame")
+	return n.err
+}
+
+/*
+The trips as service journeys, with their times at each stop of their journey pattern
+*/
+func (v Database) writeNeTExTimetableFrame(n *netexWriter) error {
+	n.start("TimetableFrame", n.idAttrs("TimetableFrame", "1")...)
+	n.start("vehicleJourneys")
+
+	err := v.forEachNeTExTrip(func(trip netexTrip) error {
+		patternID := n.patterns[trip.patternKey()]
+
+		n.start("ServiceJourney", n.idAttrs("ServiceJourney", trip.TripID)...)
+		if trip.Headsign != "" {
+			n.text("Name", trip.Headsign)
+		}
+		n.start("dayTypes")
+		n.ref("DayTypeRef", "DayType", trip.ServiceID)
+		n.end("dayTypes")
+		n.ref("ServiceJourneyPatternRef", "ServiceJourneyPattern", patternID)
+		n.ref("LineRef", "Line", trip.RouteID)
+		n.start("passingTimes")
+		for i := range trip.StopIDs {
+			n.start("TimetabledPassingTime")
+			n.ref("StopPointInJourneyPatternRef", "StopPointInJourneyPattern", patternID+"-"+strconv.Itoa(i+1))
+			if arrival := trip.ArrivalSecs[i]; arrival.Valid {
+				n.text("ArrivalTime", formatGTFSTime(int(arrival.Int64)%86400))
+				if days := arrival.Int64 / 86400; days > 0 {
+					n.text("ArrivalDayOffset", strconv.FormatInt(days, 10))
+				}
+			}
+			if departure := trip.DepartureSecs[i]; departure.Valid {
+				n.text("DepartureTime", formatGTFSTime(int(departure.Int64)%86400))
+				if days := departure.Int64 / 86400; days > 0 {
+					n.text("DepartureDayOffset", strconv.FormatInt(days, 10))
+				}
+			}
+			n.end("TimetabledPassingTime")
+		}
+		n.end("passingTimes")
+		n.end("ServiceJourney")
+		return n.err
+	})
+	if err != nil {
+		return err
+	}
+
+	n.end("vehicleJourneys")
+	n.end("TimetableFrame")
+	return n.err
+}
+
+/*
+Call fn for each trip (in trip id order) with its stop times, without loading every stop time into memory
+*/
+func (v Database) forEachNeTExTrip(fn func(trip netexTrip) error) error {
+	rows, err := v.db.Queryx(`
+		SELECT st.trip_id, st.stop_id, st.arrival_sec, st.departure_sec,
+			t.route_id, t.service_id, COALESCE(t.direction_id, 0), COALESCE(t.trip_headsign, '')
+		FROM stop_times st
+		JOIN trips t ON t.trip_id = st.trip_id
+		ORDER BY st.trip_id, st.stop_sequence
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to get stop times: %w", err)
+	}
+	defer rows.Close()
+
+	var trip netexTrip
+	for rows.Next() {
+		var row netexTrip
+		var stopID string
+		var arrival, departure sql.NullInt64
+		if err := rows.Scan(&row.TripID, &stopID, &arrival, &departure, &row.RouteID, &row.ServiceID, &row.DirectionID, &row.Headsign); err != nil {
+			return err
+		}
+
+		if row.TripID != trip.TripID {
+			if trip.TripID != "" {
+				if err := fn(trip); err != nil {
+					return err
+				}
+			}
+			trip = row
+		}
+		trip.StopIDs = append(trip.StopIDs, stopID)
+		trip.ArrivalSecs = append(trip.ArrivalSecs, arrival)
+		trip.DepartureSecs = append(trip.DepartureSecs, departure)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if trip.TripID != "" {
+		return fn(trip)
+	}
+	return nil
+}
+
+var netexWeekdayOrder = map[string]int{
+	"Monday": 0, "Tuesday": 1, "Wednesday": 2, "Thursday": 3, "Friday": 4, "Saturday": 5, "Sunday": 6,
+}
+
+/*
+Feeds with a single agency can leave out its id
+*/
+func netexAgencyID(agencyID string) string {
+	if agencyID == "" {
+		return "default"
+	}
+	return agencyID
+}
+
+/*
+Format a gtfs date ("20060102") as a NeTEx date ("2006-01-02")
+*/
+func netexDate(date string) string {
+	if parsed, err := time.Parse("20060102", date); err == nil {
+		return parsed.Format("2006-01-02")
+	}
+	return date
+}
+
+func netexDirectionType(directionID int) string {
+	if directionID == 1 {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+/*
+Get the NeTEx transport mode of a gtfs route_type, including the extended route types
+*/
+func netexTransportMode(routeType int) string {
+	switch routeType {
+	case 0:
+		return "tram"
+	case 1:
+		return "metro"
+	case 2, 12:
+		return "rail"
+	case 3:
+		return "bus"
+	case 4:
+		return "water"
+	case 5:
+		return "tram"
+	case 6:
+		return "cableway"
+	case 7:
+		return "funicular"
+	case 11:
+		return "trolleyBus"
+	}
+
+	switch {
+	case routeType >= 100 && routeType < 200:
+		return "rail"
+	case routeType >= 200 && routeType < 300:
+		return "coach"
+	case routeType >= 400 && routeType < 500:
+		return "metro"
+	case routeType >= 700 && routeType < 800:
+		return "bus"
+	case routeType == 800:
+		return "trolleyBus"
+	case routeType >= 900 && routeType < 1000:
+		return "tram"
+	case routeType >= 1100 && routeType < 1200:
+		return "air"
+	case routeType >= 1000 && routeType < 1300:
+		return "water"
+	case routeType >= 1300 && routeType < 1400:
+		return "cableway"
+	case routeType >= 1400 && routeType < 1500:
+		return "funicular"
+	}
+	return "other"
+}
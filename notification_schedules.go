@@ -0,0 +1,190 @@
+package gtfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+When a client wants to be notified, so they only get notifications about the services they actually catch
+
+The times are in the schedule's timezone (the stop's or route's timezone if it's not set)
+*/
+type NotificationSchedule struct {
+	Windows    []NotificationWindow `json:"windows,omitempty"`     // Only notify about services departing in one of these windows, any service if there are none
+	QuietStart string               `json:"quiet_start,omitempty"` // Don't send notifications from this time "15:04"...
+	QuietEnd   string               `json:"quiet_end,omitempty"`   // ...until this time "15:04", can be the next day (e.g 22:00 to 07:00)
+	Timezone   string               `json:"timezone,omitempty"`    // e.g "Pacific/Auckland"
+
+	location *time.Location
+}
+
+/*
+A time of the day on some days of the week, e.g weekdays 07:00-09:30
+*/
+type NotificationWindow struct {
+	Days  []time.Weekday `json:"days,omitempty"` // Every day if empty
+	Start string         `json:"start"`          // "15:04"
+	End   string         `json:"end"`            // "15:04", can be the next day (e.g 23:00 to 01:00)
+}
+
+/*
+Set when a client wants to be notified about a stop, route or trip (only the exact combination it was added with)
+
+An empty schedule notifies the client about every service at any time
+*/
+func (v Database) SetNotificationClientSchedule(endpoint string, target NotificationTarget, schedule NotificationSchedule) error {
+	if err := target.validate(); err != nil {
+		return err
+	}
+	if err := schedule.validate(); err != nil {
+		return err
+	}
+	target = v.prefixTarget(target)
+
+	windows := ""
+	if len(schedule.Windows) > 0 {
+		encoded, err := json.Marshal(schedule.Windows)
+		if err != nil {
+			return err
+		}
+		windows = string(encoded)
+	}
+
+	result, err := v.db.Exec(`
+		UPDATE notifications
+		SET windows = ?, quiet_start = ?, quiet_end = ?, timezone = ?
+		WHERE endpoint = ? AND stop = ? AND route = ? AND trip = ?
+	`, windows, schedule.QuietStart, schedule.QuietEnd, schedule.Timezone, endpoint, target.StopID, target.RouteID, target.TripID)
+	if err != nil {
+		return fmt.Errorf("failed to set notification client schedule: %w", err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return errors.New("no notification client found")
+	}
+	return nil
+}
+
+func (s NotificationSchedule) validate() error {
+	if (s.QuietStart == "") != (s.QuietEnd == "") {
+		return errors.New("quiet hours need a start and end")
+	}
+	if s.QuietStart != "" {
+		if _, err := parseClockTime(s.QuietStart); err != nil {
+			return errors.New("invalid quiet hours start")
+		}
+		if _, err := parseClockTime(s.QuietEnd); err != nil {
+			return errors.New("invalid quiet hours end")
+		}
+	}
+	for _, window := range s.Windows {
+		if _, err := parseClockTime(window.Start); err != nil {
+			return errors.New("invalid window start")
+		}
+		if _, err := parseClockTime(window.End); err != nil {
+			return errors.New("invalid window end")
+		}
+		for _, day := range window.Days {
+			if day < time.Sunday || day > time.Saturday {
+				return errors.New("invalid window day")
+			}
+		}
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return errors.New("invalid timezone")
+		}
+	}
+	return nil
+}
+
+/*
+Read the schedule's columns, the timezone is loaded once here rather than for every service
+*/
+func parseNotificationSchedule(windows, quietStart, quietEnd, timezone string) NotificationSchedule {
+	schedule := NotificationSchedule{QuietStart: quietStart, QuietEnd: quietEnd, Timezone: timezone}
+	if windows != "" {
+		json.Unmarshal([]byte(windows), &schedule.Windows)
+	}
+	if timezone != "" {
+		schedule.location, _ = time.LoadLocation(timezone)
+	}
+	return schedule
+}
+
+/*
+If a client can be notified now about a service departing at a time, times are read in the service's timezone if the
+schedule doesn't have one
+*/
+func (s NotificationSchedule) allows(departure time.Time, now time.Time) bool {
+	location := s.location
+	if location == nil {
+		location = departure.Location()
+	}
+
+	if s.QuietStart != "" {
+		start, _ := parseClockTime(s.QuietStart)
+		end, _ := parseClockTime(s.QuietEnd)
+		if clockTimeBetween(clockTimeOf(now.In(location)), start, end) {
+			return false
+		}
+	}
+
+	if len(s.Windows) == 0 {
+		return true
+	}
+	departure = departure.In(location)
+	clock := clockTimeOf(departure)
+	for _, window := range s.Windows {
+		start, _ := parseClockTime(window.Start)
+		end, _ := parseClockTime(window.End)
+		if !clockTimeBetween(clock, start, end) {
+			continue
+		}
+		// A window past midnight is on the day it started
+		day := departure.Weekday()
+		if end < start && clock < end {
+			day = (day + 6) % 7
+		}
+		if len(window.Days) == 0 || containsWeekday(window.Days, day) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Parse a time of the day "15:04" as minutes since midnight
+*/
+func parseClockTime(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func clockTimeOf(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+/*
+If a time of the day is from start until end, which wraps past midnight if end is before start
+*/
+func clockTimeBetween(clock, start, end int) bool {
+	if start <= end {
+		return clock >= start && clock < end
+	}
+	return clock >= start || clock < end
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
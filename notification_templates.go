@@ -0,0 +1,246 @@
+package gtfs
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+)
+
+/*
+The text templates used to build notifications in a language
+
+Templates are go text/templates executed with NotificationTemplateData, e.g "The {{.Time}} {{.RouteName}} to {{.Headsign}} has been cancelled".
+CombinedTitle is used when multiple notifications are sent as one notification and can also use {{.Count}}.
+The cancelled and combined templates are required, the others default to the english ones.
+*/
+type NotificationTemplates struct {
+	CancelledTitle string
+	CancelledBody  string
+	CombinedTitle  string
+
+	DelayedTitle         string // Can use {{.Delay}}, the minutes late
+	DelayedBody          string
+	SkippedTitle         string
+	SkippedBody          string
+	PlatformChangedTitle string // Can use {{.Platform}} and {{.PreviousPlatform}}
+	PlatformChangedBody  string
+	AlertTitle           string // Can use {{.AlertHeader}} and {{.AlertDescription}}
+	AlertBody            string
+}
+
+type NotificationTemplateData struct {
+	Type      string // What the notification is about, e.g NotificationCancelled
+	TripID    string
+	StopID    string
+	StopName  string
+	RouteID   string
+	RouteName string
+	Headsign  string
+	Time      string
+	Count     int
+
+	Delay            int    // Minutes late, for delays
+	Platform         string // The platform the service leaves from
+	PreviousPlatform string // The platform the service was going to leave from, for platform changes
+	AlertID          string
+	AlertHeader      string
+	AlertDescription string
+}
+
+/*
+The data sent with the notification
+*/
+func (d NotificationTemplateData) notificationData() NotificationData {
+	return NotificationData{
+		Type:          d.Type,
+		AlertID:       d.AlertID,
+		TripID:        d.TripID,
+		StopID:        d.StopID,
+		RouteID:       d.RouteID,
+		DepartureTime: d.Time,
+	}
+}
+
+func containsNotification(services []NotificationTemplateData, key string) bool {
+	for _, service := range services {
+		if notificationKey(service.notificationData()) == key {
+			return true
+		}
+	}
+	return false
+}
+
+type notificationTemplates struct {
+	titles        map[string]*template.Template // By notification type
+	bodies        map[string]*template.Template
+	combinedTitle *template.Template
+}
+
+var defaultNotificationTemplateText = NotificationTemplates{
+	CancelledTitle:       "{{.Headsign}} cancelled",
+	CancelledBody:        "The {{.Time}} service to {{.Headsign}} has been cancelled",
+	CombinedTitle:        "{{.Count}} service changes",
+	DelayedTitle:         "{{.Headsign}} delayed",
+	DelayedBody:          "The {{.Time}} service to {{.Headsign}} is running {{.Delay}} minutes late",
+	SkippedTitle:         "{{.Headsign}} not stopping",
+	SkippedBody:          "The {{.Time}} service to {{.Headsign}} won't stop at {{.StopName}}",
+	PlatformChangedTitle: "{{.Headsign}} platform change",
+	PlatformChangedBody:  "The {{.Time}} service to {{.Headsign}} now leaves from platform {{.Platform}}",
+	AlertTitle:           "{{.AlertHeader}}",
+	AlertBody:            "{{if .AlertDescription}}{{.AlertDescription}}{{else}}{{.AlertHeader}}{{end}}",
+}
+
+var defaultNotificationTemplates = mustParseNotificationTemplates(defaultNotificationTemplateText)
+
+/*
+Set the templates used for clients with a language
+
+Use "" to replace the default (english) templates, which are used when there are none for a clients language.
+A client with the language "mi-NZ" will use the "mi-NZ" templates, then "mi", then the default.
+*/
+func (n *Notifier) SetTemplates(language string, templates NotificationTemplates) error {
+	parsed, err := parseNotificationTemplates(templates)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.templates[strings.ToLower(language)] = parsed
+	return nil
+}
+
+func parseNotificationTemplates(templates NotificationTemplates) (notificationTemplates, error) {
+	if templates.CancelledTitle == "" || templates.CancelledBody == "" || templates.CombinedTitle == "" {
+		return notificationTemplates{}, errors.New("missing notification template")
+	}
+
+	byType := []struct {
+		Type, Title, Body, DefaultTitle, DefaultBody string
+	}{
+		{NotificationCancelled, templates.CancelledTitle, templates.CancelledBody, "", ""},
+		{NotificationDelayed, templates.DelayedTitle, templates.DelayedBody, defaultNotificationTemplateText.DelayedTitle, defaultNotificationTemplateText.DelayedBody},
+		{NotificationSkipped, templates.SkippedTitle, templates.SkippedBody, defaultNotificationTemplateText.SkippedTitle, defaultNotificationTemplateText.SkippedBody},
+		{NotificationPlatformChanged, templates.PlatformChangedTitle, templates.PlatformChangedBody, defaultNotificationTemplateText.PlatformChangedTitle, defaultNotificationTemplateText.PlatformChangedBody},
+		{NotificationAlert, templates.AlertTitle, templates.AlertBody, defaultNotificationTemplateText.AlertTitle, defaultNotificationTemplateText.AlertBody},
+	}
+
+	parsed := notificationTemplates{
+		titles: make(map[string]*template.Template),
+		bodies: make(map[string]*template.Template),
+	}
+	for _, t := range byType {
+		if t.Title == "" {
+			t.Title = t.DefaultTitle
+		}
+		if t.Body == "" {
+			t.Body = t.DefaultBody
+		}
+		title, err := template.New(t.Type + "_title").Parse(t.Title)
+		if err != nil {
+			return notificationTemplates{}, err
+		}
+		body, err := template.New(t.Type + "_body").Parse(t.Body)
+		if err != nil {
+			return notificationTemplates{}, err
+		}
+		parsed.titles[t.Type], parsed.bodies[t.Type] = title, body
+	}
+
+	var err error
+	if parsed.combinedTitle, err = template.New("combined_title").Parse(templates.CombinedTitle); err != nil {
+		return notificationTemplates{}, err
+	}
+	return parsed, nil
+}
+
+func mustParseNotificationTemplates(templates NotificationTemplates) notificationTemplates {
+	parsed, err := parseNotificationTemplates(templates)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+/*
+Get the templates for a language, falling back to the base language and then the default
+*/
+func (n *Notifier) templatesFor(language string) notificationTemplates {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	language = strings.ToLower(language)
+	if templates, found := n.templates[language]; found {
+		return templates
+	}
+	if base, _, found := strings.Cut(language, "-"); found {
+		if templates, found := n.templates[base]; found {
+			return templates
+		}
+	}
+	return n.templates[""]
+}
+
+/*
+Build the notification for one or more changes to services, multiple are combined into one notification
+*/
+func (n *Notifier) buildNotification(language string, services []NotificationTemplateData) (Notification, error) {
+	templates := n.templatesFor(language)
+
+	var notification Notification
+	var lines []string
+	for _, service := range services {
+		body, err := executeNotificationTemplate(templates.body(service.Type), service)
+		if err != nil {
+			return Notification{}, err
+		}
+		lines = append(lines, body)
+
+		data := service.notificationData()
+		if len(services) > 1 {
+			notification.Services = append(notification.Services, data)
+		} else {
+			notification.Data = data
+		}
+	}
+
+	var err error
+	if len(services) == 1 {
+		notification.Title, err = executeNotificationTemplate(templates.title(services[0].Type), services[0])
+	} else {
+		notification.Data = notification.Services[0]
+		notification.Title, err = executeNotificationTemplate(templates.combinedTitle, NotificationTemplateData{Count: len(services)})
+	}
+	if err != nil {
+		return Notification{}, err
+	}
+	notification.Body = strings.Join(lines, "\n")
+
+	n.db.stripIDs(&notification)
+	return notification, nil
+}
+
+/*
+The templates for a type of notification, cancelled if it doesn't have a type
+*/
+func (t notificationTemplates) title(notificationType string) *template.Template {
+	if title, found := t.titles[notificationType]; found {
+		return title
+	}
+	return t.titles[NotificationCancelled]
+}
+
+func (t notificationTemplates) body(notificationType string) *template.Template {
+	if body, found := t.bodies[notificationType]; found {
+		return body
+	}
+	return t.bodies[NotificationCancelled]
+}
+
+func executeNotificationTemplate(tmpl *template.Template, data NotificationTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
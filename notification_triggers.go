@@ -0,0 +1,158 @@
+package gtfs
+
+import (
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+What a notification is about
+*/
+const (
+	NotificationCancelled       = "cancelled"        // The service was cancelled
+	NotificationDelayed         = "delayed"          // The service is running late at the stop
+	NotificationSkipped         = "skipped"          // The service won't stop at the stop
+	NotificationPlatformChanged = "platform_changed" // The service is leaving from another platform of the station
+	NotificationAlert           = "alert"            // A service alert affects the service at the stop
+)
+
+/*
+What clients are notified about, see Notifier.SetTriggers. By default only cancellations are sent
+*/
+type NotificationTriggers struct {
+	Cancellations   bool
+	Delay           time.Duration // Notify when a service is running at least this late at the stop, 0 to not notify about delays
+	SkippedStops    bool
+	PlatformChanges bool
+	Alerts          bool // Needs the alerts passed to Notify
+}
+
+var defaultNotificationTriggers = NotificationTriggers{Cancellations: true}
+
+/*
+Set what clients are notified about, each trigger has its own templates (see NotificationTemplates)
+*/
+func (n *Notifier) SetTriggers(triggers NotificationTriggers) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.triggers = triggers
+}
+
+func (n *Notifier) getTriggers() NotificationTriggers {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.triggers
+}
+
+/*
+Get the notifications the triggers fire for a service at a stop
+
+  - update: the service's trip update, nil if it doesn't have one
+  - alerts: the active service alerts
+  - matcher: converts between the realtime feed's ids and the database's
+*/
+func (n *Notifier) serviceNotifications(triggers NotificationTriggers, service StopTimes, update *realtime.TripUpdate, alerts realtime.AlertMap, now time.Time, matcher TripMatcher) []NotificationTemplateData {
+	base := NotificationTemplateData{
+		TripID:   service.TripID,
+		StopID:   service.StopId,
+		StopName: service.StopData.StopName,
+		RouteID:  service.TripData.RouteID,
+		Headsign: service.TripData.TripHeadsign,
+		Time:     service.DepartureTime,
+		Platform: service.StopData.PlatformNumber,
+	}
+
+	var found []NotificationTemplateData
+	if update != nil {
+		stopTimeUpdate := update.StopTimeUpdate
+		updateStopID := matcher.prefixID(stopTimeUpdate.StopID)
+		atStop := updateStopID == service.StopId || (stopTimeUpdate.StopSequence != 0 && int(stopTimeUpdate.StopSequence) == service.StopSequence)
+
+		switch {
+		case update.Trip.ScheduleRelationship == 3:
+			if triggers.Cancellations {
+				data := base
+				data.Type = NotificationCancelled
+				found = append(found, data)
+			}
+			// Nothing else matters for a cancelled service
+			return found
+		case atStop && stopTimeUpdate.ScheduleRelationship == 1:
+			if triggers.SkippedStops {
+				data := base
+				data.Type = NotificationSkipped
+				found = append(found, data)
+			}
+			return found
+		}
+
+		if triggers.Delay > 0 {
+			// Delays carry on to the following stops, so an update for an earlier stop is the delay at this one too
+			delay := update.Delay
+			if stopTimeUpdate.StopSequence == 0 || int(stopTimeUpdate.StopSequence) <= service.StopSequence {
+				if stopTimeUpdate.Departure.Delay != 0 {
+					delay = stopTimeUpdate.Departure.Delay
+				} else if stopTimeUpdate.Arrival.Delay != 0 {
+					delay = stopTimeUpdate.Arrival.Delay
+				}
+			}
+			if time.Duration(delay)*time.Second >= triggers.Delay {
+				data := base
+				data.Type = NotificationDelayed
+				data.Delay = int(delay / 60)
+				found = append(found, data)
+			}
+		}
+
+		// A different stop for the same stop_sequence, which is another platform of the same station
+		if triggers.PlatformChanges && updateStopID != "" && updateStopID != service.StopId &&
+			int(stopTimeUpdate.StopSequence) == service.StopSequence && service.StopData.ParentStation != "" {
+			if stop, err := n.db.stopByID(updateStopID); err == nil && stop.ParentStation == service.StopData.ParentStation {
+				data := base
+				data.Type = NotificationPlatformChanged
+				data.Platform = stop.PlatformNumber
+				data.PreviousPlatform = service.StopData.PlatformNumber
+				found = append(found, data)
+			}
+		}
+	}
+
+	if triggers.Alerts {
+		stopIDs := []string{matcher.feedID(service.StopId), matcher.feedID(service.StopData.ParentStation)}
+		for _, alert := range alerts.ForService(matcher.feedID(service.TripData.RouteID), matcher.feedID(service.TripID), stopIDs, now) {
+			data := base
+			data.Type = NotificationAlert
+			data.AlertID = alert.ID
+			data.AlertHeader = alertText(alert.HeaderText)
+			data.AlertDescription = alertText(alert.DescriptionText)
+			found = append(found, data)
+		}
+	}
+
+	return found
+}
+
+/*
+The key a notification is remembered by in a client's recent notifications, so it's only sent once
+*/
+func notificationKey(data NotificationData) string {
+	switch data.Type {
+	case "", NotificationCancelled:
+		// Cancellations were the only notifications before there were triggers, so they're still just the trip id
+		return data.TripID
+	case NotificationAlert:
+		return data.Type + ":" + data.AlertID
+	}
+	return data.Type + ":" + data.TripID
+}
+
+/*
+The first translation of an alert text, alert languages aren't matched to the client's yet
+*/
+func alertText(text realtime.Text) string {
+	if len(text.Translation) == 0 {
+		return ""
+	}
+	return text.Translation[0].Text
+}
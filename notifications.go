@@ -0,0 +1,960 @@
+package gtfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+Tables which aren't part of the gtfs feed, these are kept when the feed data is refreshed
+*/
+var nonFeedTableNames = []string{
+	"notifications",
+	"saved_items",
+	"vehicle_positions",
+}
+
+/*
+Columns of the notifications table, used to migrate tables created by older versions
+*/
+var notificationsColumns = []struct {
+	Name       string
+	Definition string
+}{
+	{"endpoint", "TEXT NOT NULL DEFAULT ''"},
+	{"p256dh", "TEXT NOT NULL DEFAULT ''"},
+	{"auth", "TEXT NOT NULL DEFAULT ''"},
+	{"stop", "TEXT NOT NULL DEFAULT ''"},
+	{"recent_notifications", "TEXT DEFAULT ''"},
+	{"created", "INTEGER NOT NULL DEFAULT 0"},
+	{"channel", "TEXT NOT NULL DEFAULT 'webpush'"},
+	{"secret", "TEXT NOT NULL DEFAULT ''"},
+	{"language", "TEXT NOT NULL DEFAULT ''"},
+	{"route", "TEXT NOT NULL DEFAULT ''"},
+	{"trip", "TEXT NOT NULL DEFAULT ''"},
+	{"windows", "TEXT NOT NULL DEFAULT ''"},
+	{"quiet_start", "TEXT NOT NULL DEFAULT ''"},
+	{"quiet_end", "TEXT NOT NULL DEFAULT ''"},
+	{"timezone", "TEXT NOT NULL DEFAULT ''"},
+}
+
+/*
+The notifications table's columns and constraints, a client can subscribe to the same endpoint for many stops, routes and trips
+*/
+const notificationsTableDefinition = `
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	endpoint TEXT NOT NULL,
+	p256dh TEXT NOT NULL DEFAULT '',
+	auth TEXT NOT NULL DEFAULT '',
+	stop TEXT NOT NULL DEFAULT '',
+	recent_notifications TEXT DEFAULT '',
+	created INTEGER NOT NULL DEFAULT 0,
+	channel TEXT NOT NULL DEFAULT 'webpush',
+	secret TEXT NOT NULL DEFAULT '',
+	language TEXT NOT NULL DEFAULT '',
+	route TEXT NOT NULL DEFAULT '',
+	trip TEXT NOT NULL DEFAULT '',
+	windows TEXT NOT NULL DEFAULT '',
+	quiet_start TEXT NOT NULL DEFAULT '',
+	quiet_end TEXT NOT NULL DEFAULT '',
+	timezone TEXT NOT NULL DEFAULT '',
+	CONSTRAINT unique_notification UNIQUE (endpoint, p256dh, auth, stop, route, trip)
+`
+
+/*
+Create (or migrate) the notifications table and its indexes
+*/
+func (v Database) createNotificationsTable() error {
+	if _, err := v.db.Exec(`CREATE TABLE IF NOT EXISTS notifications (` + notificationsTableDefinition + `);`); err != nil {
+		return fmt.Errorf("failed to create notifications table: %w", err)
+	}
+
+	// Add any columns missing from a table created by an older version
+	columns, err := v.getTableColumns("notifications")
+	if err != nil {
+		return err
+	}
+	for _, column := range notificationsColumns {
+		if contains(columns, column.Name) {
+			continue
+		}
+		_, err := v.db.Exec(fmt.Sprintf(`ALTER TABLE notifications ADD COLUMN %s %s;`, column.Name, column.Definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s to notifications: %w", column.Name, err)
+		}
+	}
+
+	// Older versions only had stops in the unique constraint, so a client couldn't subscribe to more than one route or trip
+	var tableSQL string
+	if err := v.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'notifications'`).Scan(&tableSQL); err != nil {
+		return fmt.Errorf("failed to read notifications table: %w", err)
+	}
+	if !strings.Contains(tableSQL, "stop, route, trip)") {
+		if err := v.rebuildNotificationsTable(); err != nil {
+			return err
+		}
+	}
+
+	// Older versions created a unique index on stop, which only allowed one client per stop
+	var indexSQL string
+	err = v.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'index' AND name = 'idx_notifications_stop'`).Scan(&indexSQL)
+	if err == nil && strings.Contains(strings.ToUpper(indexSQL), "UNIQUE") {
+		if _, err := v.db.Exec(`DROP INDEX idx_notifications_stop;`); err != nil {
+			return fmt.Errorf("failed to drop old notifications index: %w", err)
+		}
+	}
+
+	indexes := `
+		CREATE INDEX IF NOT EXISTS idx_notifications_stop ON notifications (stop);
+		CREATE INDEX IF NOT EXISTS idx_notifications_endpoint ON notifications (endpoint);
+		CREATE INDEX IF NOT EXISTS idx_notifications_route ON notifications (route);
+		CREATE INDEX IF NOT EXISTS idx_notifications_trip ON notifications (trip);
+	`
+	if _, err := v.db.Exec(indexes); err != nil {
+		return fmt.Errorf("failed to create notifications indexes: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Recreate the notifications table with the current constraints, keeping its clients
+
+sqlite can't change a table's constraints, so the table is copied into a new one
+*/
+func (v Database) rebuildNotificationsTable() error {
+	var columns []string
+	for _, column := range notificationsColumns {
+		columns = append(columns, column.Name)
+	}
+	columnList := "id, " + strings.Join(columns, ", ")
+
+	tx, err := v.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE notifications RENAME TO notifications_old;`,
+		`CREATE TABLE notifications (` + notificationsTableDefinition + `);`,
+		`INSERT OR IGNORE INTO notifications (` + columnList + `) SELECT ` + columnList + ` FROM notifications_old;`,
+		`DROP TABLE notifications_old;`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to migrate notifications table: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+var ErrSubscriptionExpired = errors.New("push subscription expired")
+
+/*
+How a notification client is delivered to
+*/
+const (
+	NotificationChannelWebPush = "webpush" // Browser push via the PushSender
+	NotificationChannelWebhook = "webhook" // HTTP POST of the notification json, signed with the client secret
+	NotificationChannelEmail   = "email"   // Email sent via the notifiers smtp config
+)
+
+type VAPIDKeys struct {
+	PublicKey  string
+	PrivateKey string
+}
+
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type PushOptions struct {
+	VAPIDKeys  VAPIDKeys
+	Subscriber string // The contact email for the push service (without mailto:)
+	TTL        int    // Seconds the push service should keep the message for
+}
+
+/*
+Sends a push message to a subscription
+
+Implement this to use webpush, FCM, APNs etc. (or a mock in tests).
+Return ErrSubscriptionExpired (or wrap it) when the subscription no longer exists so the client is removed.
+*/
+type PushSender interface {
+	Send(subscription PushSubscription, payload []byte, options PushOptions) error
+}
+
+type Notification struct {
+	Title    string             `json:"title"`
+	Body     string             `json:"body"`
+	Data     NotificationData   `json:"data"`
+	Services []NotificationData `json:"services,omitempty"` // Set when multiple notifications are combined into one
+}
+
+type DeadLetter struct {
+	Client       NotificationClient `json:"client"`
+	Notification Notification       `json:"notification"`
+	Error        string             `json:"error"`
+	Failed       int64              `json:"failed"`
+}
+
+type NotificationData struct {
+	Type          string `json:"type"` // What the notification is about, e.g NotificationCancelled
+	AlertID       string `json:"alert_id,omitempty"`
+	TripID        string `json:"trip_id"`
+	StopID        string `json:"stop_id"`
+	RouteID       string `json:"route_id"`
+	DepartureTime string `json:"departure_time"`
+}
+
+type NotificationClient struct {
+	ID                  int64                `json:"id"`
+	Channel             string               `json:"channel"`
+	Subscription        PushSubscription     `json:"subscription"` // For webhooks and emails only the endpoint (url/email address) is set
+	Secret              string               `json:"-"`
+	Language            string               `json:"language"`
+	StopID              string               `json:"stop_id"`
+	RouteID             string               `json:"route_id"`
+	TripID              string               `json:"trip_id"`
+	Schedule            NotificationSchedule `json:"schedule"`
+	RecentNotifications []string             `json:"recent_notifications"`
+	Created             int64                `json:"created"`
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+type Notifier struct {
+	db         Database
+	sender     PushSender
+	keys       VAPIDKeys
+	smtp       *SMTPConfig
+	httpClient *http.Client
+
+	mu        sync.Mutex // Guards the settings changed after the notifier is created
+	templates map[string]notificationTemplates
+	triggers  NotificationTriggers
+
+	workers int
+	retry   notificationRetry
+
+	deadLettersMutex sync.Mutex
+	deadLetters      []DeadLetter
+}
+
+/*
+How failed notifications are retried, see SetRetry
+*/
+type notificationRetry struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+/*
+Create a notifier which sends pushes to the stored notification clients
+
+  - sender: what to send the pushes with, can be nil if only webhook/email clients are used
+  - keys: the VAPID keys passed to the sender
+*/
+func (v Database) NewNotifier(sender PushSender, keys VAPIDKeys) (*Notifier, error) {
+	if sender != nil && (keys.PublicKey == "" || keys.PrivateKey == "") {
+		return nil, errors.New("missing vapid keys")
+	}
+	return &Notifier{
+		db:         v,
+		sender:     sender,
+		keys:       keys,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		templates:  map[string]notificationTemplates{"": defaultNotificationTemplates},
+		triggers:   defaultNotificationTriggers,
+		workers:    4,
+		retry:      notificationRetry{maxRetries: 3, backoff: time.Second},
+	}, nil
+}
+
+/*
+Enable email notifications, emails are sent from the databases mailToEmail
+*/
+func (n *Notifier) EnableEmail(config SMTPConfig) error {
+	if config.Host == "" || config.Port == 0 {
+		return errors.New("missing smtp host/port")
+	}
+	if n.db.mailToEmail == "" {
+		return errors.New("missing mailToEmail to send emails from")
+	}
+	n.smtp = &config
+	return nil
+}
+
+/*
+What a client is notified about, any combination of a stop, route and trip can be set (e.g a route at a stop)
+
+  - StopID: services departing from the stop (or its child stops)
+  - RouteID: services on the route
+  - TripID: the trip
+*/
+type NotificationTarget struct {
+	StopID  string `json:"stop_id,omitempty"`
+	RouteID string `json:"route_id,omitempty"`
+	TripID  string `json:"trip_id,omitempty"`
+}
+
+func (t NotificationTarget) validate() error {
+	if t.StopID == "" && t.RouteID == "" && t.TripID == "" {
+		return errors.New("missing stop, route or trip id")
+	}
+	return nil
+}
+
+/*
+Add the id prefix (see WithIDPrefix) to a target's ids, clients are stored with the database's ids
+*/
+func (v Database) prefixTarget(target NotificationTarget) NotificationTarget {
+	return NotificationTarget{StopID: v.PrefixID(target.StopID), RouteID: v.PrefixID(target.RouteID), TripID: v.PrefixID(target.TripID)}
+}
+
+/*
+Add a client to be notified about services at a stop
+*/
+func (v Database) AddNotificationClient(subscription PushSubscription, stopID string) error {
+	if stopID == "" {
+		return errors.New("missing stop id")
+	}
+	return v.AddNotificationClientFor(subscription, NotificationTarget{StopID: stopID})
+}
+
+/*
+Add a client to be notified about the services of a stop, route or trip
+*/
+func (v Database) AddNotificationClientFor(subscription PushSubscription, target NotificationTarget) error {
+	if subscription.Endpoint == "" || subscription.Keys.P256dh == "" || subscription.Keys.Auth == "" {
+		return errors.New("invalid push subscription")
+	}
+	if err := target.validate(); err != nil {
+		return err
+	}
+
+	return v.insertNotificationClient(NotificationChannelWebPush, subscription, "", target)
+}
+
+/*
+Add a webhook to be notified about services at a stop
+
+The notification json is POSTed to the url with a "X-Signature-256: sha256=<hex hmac of the body>" header made with the secret.
+The client is removed when the webhook responds 410 Gone
+*/
+func (v Database) AddWebhookNotificationClient(url string, secret string, stopID string) error {
+	if stopID == "" {
+		return errors.New("missing stop id")
+	}
+	return v.AddWebhookNotificationClientFor(url, secret, NotificationTarget{StopID: stopID})
+}
+
+/*
+Add a webhook to be notified about the services of a stop, route or trip, see AddWebhookNotificationClient
+*/
+func (v Database) AddWebhookNotificationClientFor(url string, secret string, target NotificationTarget) error {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return errors.New("invalid webhook url")
+	}
+	if err := target.validate(); err != nil {
+		return err
+	}
+
+	var subscription PushSubscription
+	subscription.Endpoint = url
+	return v.insertNotificationClient(NotificationChannelWebhook, subscription, secret, target)
+}
+
+/*
+Add an email address to be notified about services at a stop
+*/
+func (v Database) AddEmailNotificationClient(email string, stopID string) error {
+	if stopID == "" {
+		return errors.New("missing stop id")
+	}
+	return v.AddEmailNotificationClientFor(email, NotificationTarget{StopID: stopID})
+}
+
+/*
+Add an email address to be notified about the services of a stop, route or trip
+*/
+func (v Database) AddEmailNotificationClientFor(email string, target NotificationTarget) error {
+	// Headers are built with the address, so it can't have line breaks to add its own
+	if strings.ContainsAny(email, "\r\n") {
+		return errors.New("invalid email")
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return errors.New("invalid email")
+	}
+	if err := target.validate(); err != nil {
+		return err
+	}
+
+	var subscription PushSubscription
+	subscription.Endpoint = email
+	return v.insertNotificationClient(NotificationChannelEmail, subscription, "", target)
+}
+
+func (v Database) insertNotificationClient(channel string, subscription PushSubscription, secret string, target NotificationTarget) error {
+	target = v.prefixTarget(target)
+	query := `
+		INSERT OR IGNORE INTO notifications (channel, endpoint, p256dh, auth, secret, stop, route, trip, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := v.db.Exec(query, channel, subscription.Endpoint, subscription.Keys.P256dh, subscription.Keys.Auth, secret,
+		target.StopID, target.RouteID, target.TripID, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to add notification client: %w", err)
+	}
+	return nil
+}
+
+/*
+Set the language (e.g "en", "mi-NZ") notifications are sent to a client in
+*/
+func (v Database) SetNotificationClientLanguage(endpoint string, language string) error {
+	_, err := v.db.Exec(`UPDATE notifications SET language = ? WHERE endpoint = ?`, language, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to set notification client language: %w", err)
+	}
+	return nil
+}
+
+/*
+Remove a client from notifications for a stop, or from all stops if stopID is ""
+*/
+func (v Database) RemoveNotificationClient(endpoint string, stopID string) error {
+	var err error
+	if stopID == "" {
+		_, err = v.db.Exec(`DELETE FROM notifications WHERE endpoint = ?`, endpoint)
+	} else {
+		_, err = v.db.Exec(`DELETE FROM notifications WHERE endpoint = ? AND stop = ?`, endpoint, v.PrefixID(stopID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove notification client: %w", err)
+	}
+	return nil
+}
+
+/*
+Remove a client from notifications for a stop, route or trip (only the exact combination it was added with)
+*/
+func (v Database) RemoveNotificationClientFor(endpoint string, target NotificationTarget) error {
+	if err := target.validate(); err != nil {
+		return err
+	}
+	target = v.prefixTarget(target)
+	_, err := v.db.Exec(`DELETE FROM notifications WHERE endpoint = ? AND stop = ? AND route = ? AND trip = ?`,
+		endpoint, target.StopID, target.RouteID, target.TripID)
+	if err != nil {
+		return fmt.Errorf("failed to remove notification client: %w", err)
+	}
+	return nil
+}
+
+/*
+Get all the clients to be notified about a stop, or every client if stopID is ""
+*/
+func (v Database) GetNotificationClients(stopID string) ([]NotificationClient, error) {
+	clients, err := v.notificationClients(v.PrefixID(stopID))
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&clients)
+	return clients, nil
+}
+
+func (v Database) notificationClients(stopID string) ([]NotificationClient, error) {
+	query := `
+		SELECT
+			id,
+			channel,
+			endpoint,
+			p256dh,
+			auth,
+			secret,
+			language,
+			stop,
+			route,
+			trip,
+			windows,
+			quiet_start,
+			quiet_end,
+			timezone,
+			COALESCE(recent_notifications, ''),
+			created
+		FROM
+			notifications
+	`
+	var args []interface{}
+	if stopID != "" {
+		query += " WHERE stop = ?"
+		args = append(args, stopID)
+	}
+
+	rows, err := v.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []NotificationClient
+	for rows.Next() {
+		var client NotificationClient
+		var recent, windows, quietStart, quietEnd, timezone string
+		err := rows.Scan(
+			&client.ID,
+			&client.Channel,
+			&client.Subscription.Endpoint,
+			&client.Subscription.Keys.P256dh,
+			&client.Subscription.Keys.Auth,
+			&client.Secret,
+			&client.Language,
+			&client.StopID,
+			&client.RouteID,
+			&client.TripID,
+			&windows,
+			&quietStart,
+			&quietEnd,
+			&timezone,
+			&recent,
+			&client.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		client.Schedule = parseNotificationSchedule(windows, quietStart, quietEnd, timezone)
+		if recent != "" {
+			client.RecentNotifications = strings.Split(recent, ",")
+		}
+		clients = append(clients, client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+/*
+Notify clients about changes to the services departing soon from their stops, or to the services on their routes and
+trips, see SetTriggers for which changes
+
+Clients of a route or trip without a stop are only notified about trips in the trip updates.
+Clients aren't notified in their quiet hours, or about services departing outside their time windows (see SetNotificationClientSchedule).
+
+Each client gets at most one notification per call, multiple changes are combined into it.
+Notifications are sent by a pool of workers and retried with backoff, ones that still fail are kept as dead letters.
+
+  - alerts: optionally the active service alerts, for the alerts trigger
+*/
+func (n *Notifier) Notify(updates realtime.TripUpdatesMap, alerts ...realtime.AlertMap) error {
+	clients, err := n.db.notificationClients("")
+	if err != nil {
+		return err
+	}
+
+	// The updates use the realtime feed's ids, they're looked up by the static trip they're for
+	matcher := n.db.TripMatcher()
+	updates = matcher.TripUpdatesByTripID(updates)
+
+	triggers := n.getTriggers()
+	var activeAlerts realtime.AlertMap
+	for _, alertMap := range alerts {
+		activeAlerts = append(activeAlerts, alertMap...)
+	}
+
+	// Group the clients by stop so each stop is only looked up once, clients of only routes or trips go by the trip updates
+	clientsByStop := make(map[string][]*NotificationClient)
+	var otherClients []*NotificationClient
+	for i := range clients {
+		if clients[i].StopID == "" {
+			otherClients = append(otherClients, &clients[i])
+			continue
+		}
+		clientsByStop[clients[i].StopID] = append(clientsByStop[clients[i].StopID], &clients[i])
+	}
+
+	// Collect every change for each client before sending anything
+	pending := make(map[*NotificationClient][]NotificationTemplateData)
+	routeNames := make(map[string]string)
+	addNotifications := func(clients []*NotificationClient, service StopTimes, now time.Time) {
+		// When the service departs, for the clients' time windows
+		day := ServiceDayOf(now, nil)
+		if service.Instance.ServiceDate != "" {
+			if serviceDay, err := ParseServiceDay(service.Instance.ServiceDate, now.Location()); err == nil {
+				day = serviceDay
+			}
+		}
+		departure, err := day.ParseTime(service.DepartureTime)
+		if err != nil {
+			departure = now
+		}
+
+		var subscribed []*NotificationClient
+		for _, client := range clients {
+			if client.subscribedTo(service) && client.Schedule.allows(departure, now) {
+				subscribed = append(subscribed, client)
+			}
+		}
+		if len(subscribed) == 0 {
+			return
+		}
+
+		var update *realtime.TripUpdate
+		if found, err := updates.ByTripID(service.TripID); err == nil {
+			update = &found
+		}
+		notifications := n.serviceNotifications(triggers, service, update, activeAlerts, now, matcher)
+		if len(notifications) == 0 {
+			return
+		}
+
+		routeName, found := routeNames[service.TripData.RouteID]
+		if !found {
+			routeName = service.TripData.RouteID
+			if route, err := n.db.routeByID(service.TripData.RouteID); err == nil && route.RouteShortName != "" {
+				routeName = route.RouteShortName
+			}
+			routeNames[service.TripData.RouteID] = routeName
+		}
+
+		for _, data := range notifications {
+			data.RouteName = routeName
+			key := notificationKey(data.notificationData())
+			for _, client := range subscribed {
+				if contains(client.RecentNotifications, key) || containsNotification(pending[client], key) {
+					continue
+				}
+				pending[client] = append(pending[client], data)
+			}
+		}
+	}
+
+	for stopID, stopClients := range clientsByStop {
+		now := time.Now().In(n.db.locationFor(stopID, ""))
+		services, err := n.db.upcomingServicesAtStop(stopID, now)
+		if err != nil {
+			continue
+		}
+		for _, service := range services {
+			addNotifications(stopClients, service, now)
+		}
+	}
+
+	if len(otherClients) > 0 {
+		// Only look up the services of updates a client could be subscribed to
+		tripIDs := make(map[string]bool)
+		routeIDs := make(map[string]bool)
+		for _, client := range otherClients {
+			if client.TripID != "" {
+				tripIDs[client.TripID] = true
+			} else {
+				routeIDs[client.RouteID] = true
+			}
+		}
+		for tripID, update := range updates {
+			routeID := matcher.prefixID(string(update.Trip.RouteID))
+			if !tripIDs[tripID] && (len(routeIDs) == 0 || (routeID != "" && !routeIDs[routeID])) {
+				continue
+			}
+			service, err := n.db.tripUpdateService(tripID, update, matcher)
+			if err != nil {
+				continue
+			}
+			now := time.Now().In(n.db.locationFor(service.StopId, service.TripData.RouteID))
+			addNotifications(otherClients, service, now)
+		}
+	}
+
+	// The settings can be changed while the notifications are being sent
+	workers, retry := n.sendSettings()
+
+	jobs := make(chan *NotificationClient)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for client := range jobs {
+				notification, err := n.buildNotification(client.Language, pending[client])
+				if err != nil {
+					n.db.logger().Warn("notify: failed to build notification", "stop_id", client.StopID, "error", err)
+					continue
+				}
+				n.sendWithRetry(client, notification, retry)
+			}
+		}()
+	}
+	for client := range pending {
+		jobs <- client
+	}
+	close(jobs)
+	wg.Wait()
+
+	return nil
+}
+
+/*
+Set how many notifications can be sent at once (default 4)
+*/
+func (n *Notifier) SetConcurrency(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.workers = workers
+}
+
+/*
+Set how many times a failed notification is retried and the delay before the first retry, which doubles each retry (default 3, 1s)
+*/
+func (n *Notifier) SetRetry(maxRetries int, backoff time.Duration) {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.retry = notificationRetry{maxRetries: maxRetries, backoff: backoff}
+}
+
+func (n *Notifier) sendSettings() (int, notificationRetry) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.workers, n.retry
+}
+
+/*
+Get the notifications which failed to send after all their retries (most recent 100)
+*/
+func (n *Notifier) DeadLetters() []DeadLetter {
+	n.deadLettersMutex.Lock()
+	defer n.deadLettersMutex.Unlock()
+	return append([]DeadLetter(nil), n.deadLetters...)
+}
+
+func (n *Notifier) sendWithRetry(client *NotificationClient, notification Notification, retry notificationRetry) {
+	backoff := retry.backoff
+	var err error
+	for attempt := 0; attempt <= retry.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = n.send(client, notification)
+		if err == nil || errors.Is(err, ErrSubscriptionExpired) {
+			if m := n.db.metrics(); m != nil {
+				m.NotificationSent(client.Channel, err)
+			}
+			return
+		}
+	}
+
+	if m := n.db.metrics(); m != nil {
+		m.NotificationSent(client.Channel, err)
+	}
+
+	n.db.logger().Warn("notify: giving up sending notification", "channel", client.Channel, "stop_id", client.StopID, "error", err)
+
+	n.deadLettersMutex.Lock()
+	defer n.deadLettersMutex.Unlock()
+	n.deadLetters = append(n.deadLetters, DeadLetter{
+		Client:       *client,
+		Notification: notification,
+		Error:        err.Error(),
+		Failed:       time.Now().Unix(),
+	})
+	if len(n.deadLetters) > 100 {
+		n.deadLetters = n.deadLetters[len(n.deadLetters)-100:]
+	}
+}
+
+func (n *Notifier) send(client *NotificationClient, notification Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	switch client.Channel {
+	case NotificationChannelWebhook:
+		err = n.sendWebhook(client, payload)
+	case NotificationChannelEmail:
+		err = n.sendEmail(client, notification)
+	default:
+		if n.sender == nil {
+			return errors.New("no push sender to send web push notifications with")
+		}
+		err = n.sender.Send(client.Subscription, payload, PushOptions{
+			VAPIDKeys:  n.keys,
+			Subscriber: n.db.mailToEmail,
+			TTL:        60,
+		})
+	}
+	if errors.Is(err, ErrSubscriptionExpired) {
+		if err := n.db.RemoveNotificationClient(client.Subscription.Endpoint, ""); err != nil {
+			return err
+		}
+		return ErrSubscriptionExpired
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send notification to %s: %w", client.Subscription.Endpoint, err)
+	}
+
+	// Remember the notifications so the client isn't sent them again
+	recent := append(client.RecentNotifications, notificationKey(notification.Data))
+	for _, service := range notification.Services {
+		if key := notificationKey(service); !contains(recent, key) {
+			recent = append(recent, key)
+		}
+	}
+	if len(recent) > 50 {
+		recent = recent[len(recent)-50:]
+	}
+	client.RecentNotifications = recent
+	_, err = n.db.db.Exec(`UPDATE notifications SET recent_notifications = ? WHERE id = ?`, strings.Join(recent, ","), client.ID)
+	return err
+}
+func (n *Notifier) sendWebhook(client *NotificationClient, payload []byte) error {
+	req, err := http.NewRequest("POST", client.Subscription.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(client.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Only gone means the webhook was removed, a not found can be a deploy or misconfigured proxy
+	if resp.StatusCode == http.StatusGone {
+		return ErrSubscriptionExpired
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *Notifier) sendEmail(client *NotificationClient, notification Notification) error {
+	if n.smtp == nil {
+		return errors.New("email notifications are not enabled")
+	}
+
+	var auth smtp.Auth
+	if n.smtp.Username != "" {
+		auth = smtp.PlainAuth("", n.smtp.Username, n.smtp.Password, n.smtp.Host)
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		n.db.mailToEmail,
+		client.Subscription.Endpoint,
+		mime.QEncoding.Encode("UTF-8", stripLineBreaks(notification.Title)),
+		notification.Body,
+	)
+
+	addr := fmt.Sprintf("%s:%d", n.smtp.Host, n.smtp.Port)
+	return smtp.SendMail(addr, auth, n.db.mailToEmail, []string{client.Subscription.Endpoint}, []byte(message))
+}
+
+/*
+If a client is subscribed to a service, its stop is already matched by Notify
+*/
+func (client NotificationClient) subscribedTo(service StopTimes) bool {
+	if client.RouteID != "" && client.RouteID != service.TripData.RouteID {
+		return false
+	}
+	if client.TripID != "" && client.TripID != service.TripID {
+		return false
+	}
+	return true
+}
+
+/*
+Get the service a trip update is for (by the static trip's id, see TripMatcher.TripUpdatesByTripID), at the stop the
+update is for (or the trip's first stop)
+*/
+func (v Database) tripUpdateService(tripID string, update realtime.TripUpdate, matcher TripMatcher) (StopTimes, error) {
+	if update.StopTimeUpdate.StopID != "" {
+		if service, err := v.serviceByTripAndStop(tripID, matcher.prefixID(update.StopTimeUpdate.StopID), ""); err == nil {
+			return service, nil
+		}
+	}
+	stops, err := v.stopsForTrip(tripID)
+	if err != nil {
+		return StopTimes{}, err
+	}
+	if len(stops) == 0 {
+		return StopTimes{}, errors.New("trip has no stops")
+	}
+	return v.serviceByTripAndStop(tripID, stops[0].StopId, "")
+}
+
+/*
+Replace line breaks with spaces, so text can be put in a header
+*/
+func stripLineBreaks(text string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+}
+
+/*
+Get the next services departing from a stop (or any of its child stops)
+*/
+func (v Database) upcomingServicesAtStop(stopID string, now time.Time) ([]StopTimes, error) {
+	childStops, err := v.childStops(stopID)
+	if err != nil {
+		return nil, err
+	}
+
+	day := ServiceDayOf(now, nil)
+
+	var services []StopTimes
+	for _, stop := range childStops {
+		stopServices, err := v.activeTrips(ActiveTripsOptions{
+			StopID: stop.StopId,
+			Date:   day.String(),
+			From:   day.FormatTime(now),
+			Limit:  15,
+		})
+		if err != nil {
+			continue
+		}
+		services = append(services, stopServices...)
+	}
+
+	return services, nil
+}
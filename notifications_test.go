@@ -0,0 +1,524 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+Create a database of a small feed with two trips departing from station P1 soon, T1 on route R1 and T2 on route R2,
+and T3 on R1 which stops at both of P1's platforms before them
+*/
+func newTestDatabase(t *testing.T, name string, options ...Option) Database {
+	t.Helper()
+
+	location, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := Today(location)
+	at := func(d time.Duration) string {
+		return formatGTFSTime(today.Seconds(time.Now().Add(d)))
+	}
+
+	files := map[string]string{
+		"agency.txt": "agency_id,agency_name,agency_url,agency_timezone\nA1,Agency,http://a,Pacific/Auckland\n",
+		"stops.txt": "stop_id,stop_code,stop_name,stop_lat,stop_lon,location_type,parent_station,platform_code\n" +
+			"P1,100,Central Station,-36.84,174.76,1,,\n" +
+			"C1,101,Central Station 1,-36.8401,174.7601,0,P1,1\n" +
+			"C2,102,Central Station 2,-36.8402,174.7602,0,P1,2\n" +
+			"S2,200,Second Stop,-36.85,174.77,0,,\n",
+		"routes.txt": "route_id,agency_id,route_short_name,route_long_name,route_type\nR1,A1,STH,Southern,2\nR2,A1,70,Bus 70,3\n",
+		"trips.txt":  "route_id,service_id,trip_id,trip_headsign\nR1,SV1,T1,Second Stop\nR2,SV1,T2,Second Stop\nR1,SV1,T3,Second Stop\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+			fmt.Sprintf("T1,%s,%s,C1,1\nT1,%s,%s,S2,2\n", at(20*time.Minute), at(20*time.Minute), at(30*time.Minute), at(30*time.Minute)) +
+			fmt.Sprintf("T2,%s,%s,C2,1\nT2,%s,%s,S2,2\n", at(40*time.Minute), at(40*time.Minute), at(50*time.Minute), at(50*time.Minute)) +
+			fmt.Sprintf("T3,%s,%s,C1,1\nT3,%s,%s,C2,2\nT3,%s,%s,S2,3\n", at(10*time.Minute), at(10*time.Minute), at(12*time.Minute), at(12*time.Minute), at(15*time.Minute), at(15*time.Minute)),
+		"calendar.txt":  "service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\nSV1,1,1,1,1,1,1,1,20200101,20991231\n",
+		"feed_info.txt": "feed_publisher_name,feed_publisher_url,feed_lang,feed_start_date,feed_end_date\nPub,http://p,en,20200101,20991231\n",
+	}
+
+	var feed bytes.Buffer
+	writer := zip.NewWriter(&feed)
+	for fileName, content := range files {
+		file, err := writer.Create(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(feed.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	path := filepath.Join(GetWorkDir(), "gtfs", fmt.Sprintf("gtfs-%s.db", name))
+	removeDatabase := func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(path + suffix)
+		}
+		os.Remove(filepath.Dir(path))
+	}
+	removeDatabase()
+
+	db, err := New(server.URL, name, location, "notify@example.com", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.db.Close()
+		removeDatabase()
+	})
+	return db
+}
+
+func cancelled(tripIDs ...string) realtime.TripUpdatesMap {
+	updates := make(realtime.TripUpdatesMap)
+	for _, tripID := range tripIDs {
+		updates[tripID] = realtime.TripUpdate{Trip: realtime.Trip{TripID: tripID, ScheduleRelationship: 3}}
+	}
+	return updates
+}
+
+/*
+A PushSender which returns the errors in order, then succeeds
+*/
+type fakePushSender struct {
+	mu       sync.Mutex
+	errs     []error
+	payloads [][]byte
+	calls    int
+}
+
+func (s *fakePushSender) Send(subscription PushSubscription, payload []byte, options PushOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls <= len(s.errs) {
+		return s.errs[s.calls-1]
+	}
+	s.payloads = append(s.payloads, payload)
+	return nil
+}
+
+/*
+A webhook which responds with the status and records the requests it gets
+*/
+type testWebhook struct {
+	*httptest.Server
+	mu         sync.Mutex
+	status     int
+	bodies     [][]byte
+	signatures []string
+}
+
+func newTestWebhook(t *testing.T, status int) *testWebhook {
+	webhook := &testWebhook{status: status}
+	webhook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		webhook.mu.Lock()
+		webhook.bodies = append(webhook.bodies, body)
+		webhook.signatures = append(webhook.signatures, r.Header.Get("X-Signature-256"))
+		webhook.mu.Unlock()
+		w.WriteHeader(webhook.status)
+	}))
+	t.Cleanup(webhook.Close)
+	return webhook
+}
+
+func testSubscription(endpoint string) PushSubscription {
+	var subscription PushSubscription
+	subscription.Endpoint = endpoint
+	subscription.Keys.P256dh = "p256dh"
+	subscription.Keys.Auth = "auth"
+	return subscription
+}
+
+func TestNotifyDeliversToWebhook(t *testing.T) {
+	db := newTestDatabase(t, "notify-webhook")
+	webhook := newTestWebhook(t, http.StatusOK)
+	if err := db.AddWebhookNotificationClient(webhook.URL, "secret", "P1"); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier, err := db.NewNotifier(nil, VAPIDKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(cancelled("T1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(webhook.bodies) != 1 {
+		t.Fatalf("expected 1 webhook request, got %d", len(webhook.bodies))
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(webhook.bodies[0])
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); webhook.signatures[0] != expected {
+		t.Errorf("expected signature %s, got %s", expected, webhook.signatures[0])
+	}
+
+	var notification Notification
+	if err := json.Unmarshal(webhook.bodies[0], &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Data.TripID != "T1" || notification.Data.Type != NotificationCancelled {
+		t.Errorf("expected a cancellation of T1, got %+v", notification.Data)
+	}
+	if notification.Title != "Second Stop cancelled" {
+		t.Errorf("unexpected title %q", notification.Title)
+	}
+
+	// The client was already notified about the trip
+	if err := notifier.Notify(cancelled("T1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.bodies) != 1 {
+		t.Errorf("expected the cancellation to only be sent once, got %d requests", len(webhook.bodies))
+	}
+}
+
+func TestNotifyCombinesServices(t *testing.T) {
+	db := newTestDatabase(t, "notify-combined")
+	sender := &fakePushSender{}
+	if err := db.AddNotificationClient(testSubscription("https://push.example.com/1"), "P1"); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier, err := db.NewNotifier(sender, VAPIDKeys{PublicKey: "public", PrivateKey: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(cancelled("T1", "T2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.payloads) != 1 {
+		t.Fatalf("expected 1 push, got %d", len(sender.payloads))
+	}
+	var notification Notification
+	if err := json.Unmarshal(sender.payloads[0], &notification); err != nil {
+		t.Fatal(err)
+	}
+	if len(notification.Services) != 2 {
+		t.Errorf("expected 2 services in the push, got %d", len(notification.Services))
+	}
+}
+
+func TestNotifyRetriesFailedPushes(t *testing.T) {
+	db := newTestDatabase(t, "notify-retry")
+	failure := errors.New("push service unavailable")
+	sender := &fakePushSender{errs: []error{failure, failure}}
+	if err := db.AddNotificationClient(testSubscription("https://push.example.com/1"), "P1"); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier, err := db.NewNotifier(sender, VAPIDKeys{PublicKey: "public", PrivateKey: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.SetRetry(3, time.Millisecond)
+	if err := notifier.Notify(cancelled("T1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if sender.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", sender.calls)
+	}
+	if len(sender.payloads) != 1 {
+		t.Errorf("expected the push to be delivered, got %d", len(sender.payloads))
+	}
+	if deadLetters := notifier.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("expected no dead letters, got %d", len(deadLetters))
+	}
+}
+
+func TestNotifyKeepsDeadLetters(t *testing.T) {
+	db := newTestDatabase(t, "notify-dead")
+	failure := errors.New("push service unavailable")
+	sender := &fakePushSender{errs: []error{failure, failure, failure, failure}}
+	if err := db.AddNotificationClient(testSubscription("https://push.example.com/1"), "P1"); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier, err := db.NewNotifier(sender, VAPIDKeys{PublicKey: "public", PrivateKey: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.SetRetry(2, time.Millisecond)
+	if err := notifier.Notify(cancelled("T1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if sender.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", sender.calls)
+	}
+	deadLetters := notifier.DeadLetters()
+	if len(deadLetters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(deadLetters))
+	}
+	if deadLetters[0].Notification.Data.TripID != "T1" || !strings.Contains(deadLetters[0].Error, failure.Error()) {
+		t.Errorf("unexpected dead letter %+v", deadLetters[0])
+	}
+
+	// Undelivered notifications aren't remembered, so they're tried again next time
+	clients, err := db.GetNotificationClients("P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || len(clients[0].RecentNotifications) != 0 {
+		t.Errorf("expected the client to have no recent notifications, got %+v", clients)
+	}
+}
+
+func TestNotifyRemovesExpiredSubscriptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		add     func(db Database) error
+		sender  *fakePushSender
+		removed bool
+	}{
+		{
+			name: "gone webhook",
+			add: func(db Database) error {
+				return db.AddWebhookNotificationClient(newTestWebhook(t, http.StatusGone).URL, "", "P1")
+			},
+			removed: true,
+		},
+		{
+			name: "missing webhook",
+			add: func(db Database) error {
+				return db.AddWebhookNotificationClient(newTestWebhook(t, http.StatusNotFound).URL, "", "P1")
+			},
+			removed: false,
+		},
+		{
+			name: "expired push",
+			add: func(db Database) error {
+				return db.AddNotificationClient(testSubscription("https://push.example.com/1"), "P1")
+			},
+			sender:  &fakePushSender{errs: []error{fmt.Errorf("410 from push service: %w", ErrSubscriptionExpired)}},
+			removed: true,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDatabase(t, fmt.Sprintf("notify-expired-%d", i))
+			if err := test.add(db); err != nil {
+				t.Fatal(err)
+			}
+
+			var sender PushSender
+			keys := VAPIDKeys{}
+			if test.sender != nil {
+				sender, keys = test.sender, VAPIDKeys{PublicKey: "public", PrivateKey: "private"}
+			}
+			notifier, err := db.NewNotifier(sender, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifier.SetRetry(1, time.Millisecond)
+			if err := notifier.Notify(cancelled("T1")); err != nil {
+				t.Fatal(err)
+			}
+
+			clients, err := db.GetNotificationClients("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed := len(clients) == 0; removed != test.removed {
+				t.Errorf("expected removed to be %v, got %d clients", test.removed, len(clients))
+			}
+			if deadLetters := notifier.DeadLetters(); test.removed && len(deadLetters) != 0 {
+				t.Errorf("expected no dead letters for an expired subscription, got %d", len(deadLetters))
+			}
+		})
+	}
+}
+
+func TestNotifyRouteAndTripClients(t *testing.T) {
+	db := newTestDatabase(t, "notify-targets")
+	routeWebhook := newTestWebhook(t, http.StatusOK)
+	tripWebhook := newTestWebhook(t, http.StatusOK)
+	stopRouteWebhook := newTestWebhook(t, http.StatusOK)
+	if err := db.AddWebhookNotificationClientFor(routeWebhook.URL, "", NotificationTarget{RouteID: "R2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddWebhookNotificationClientFor(tripWebhook.URL, "", NotificationTarget{TripID: "T1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddWebhookNotificationClientFor(stopRouteWebhook.URL, "", NotificationTarget{StopID: "P1", RouteID: "R1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier, err := db.NewNotifier(nil, VAPIDKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(cancelled("T1", "T2")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]struct {
+		webhook *testWebhook
+		tripID  string
+	}{
+		"route":         {routeWebhook, "T2"},
+		"trip":          {tripWebhook, "T1"},
+		"route at stop": {stopRouteWebhook, "T1"},
+	} {
+		if len(expected.webhook.bodies) != 1 {
+			t.Errorf("%s: expected 1 notification, got %d", name, len(expected.webhook.bodies))
+			continue
+		}
+		var notification Notification
+		if err := json.Unmarshal(expected.webhook.bodies[0], &notification); err != nil {
+			t.Fatal(err)
+		}
+		if notification.Data.TripID != expected.tripID || len(notification.Services) != 0 {
+			t.Errorf("%s: expected only %s, got %+v", name, expected.tripID, notification)
+		}
+	}
+}
+
+func TestNotifierSetTemplatesWhileNotifying(t *testing.T) {
+	db := newTestDatabase(t, "notify-templates")
+	sender := &fakePushSender{}
+	for i := 0; i < 5; i++ {
+		if err := db.AddNotificationClient(testSubscription(fmt.Sprintf("https://push.example.com/%d", i)), "P1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifier, err := db.NewNotifier(sender, VAPIDKeys{PublicKey: "public", PrivateKey: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			notifier.SetTemplates("mi", NotificationTemplates{
+				CancelledTitle: "Kua whakakorea",
+				CancelledBody:  "{{.Headsign}}",
+				CombinedTitle:  "{{.Count}}",
+			})
+		}
+	}()
+	if err := notifier.Notify(cancelled("T1")); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if len(sender.payloads) != 5 {
+		t.Errorf("expected 5 pushes, got %d", len(sender.payloads))
+	}
+}
+
+func TestNotifierSetRetryWhileNotifying(t *testing.T) {
+	db := newTestDatabase(t, "notify-settings")
+	sender := &fakePushSender{}
+	for i := 0; i < 5; i++ {
+		if err := db.AddNotificationClient(testSubscription(fmt.Sprintf("https://push.example.com/%d", i)), "P1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifier, err := db.NewNotifier(sender, VAPIDKeys{PublicKey: "public", PrivateKey: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			notifier.SetConcurrency(i%4 + 1)
+			notifier.SetRetry(i%3, time.Millisecond)
+		}
+	}()
+	err = notifier.Notify(cancelled("T1"))
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.payloads) != 5 {
+		t.Errorf("expected 5 pushes, got %d", len(sender.payloads))
+	}
+}
+
+func TestGetActiveTripsWithOptions(t *testing.T) {
+	db := newTestDatabase(t, "active-trips")
+
+	tripIDs := func(services []StopTimes) []string {
+		var ids []string
+		for _, service := range services {
+			ids = append(ids, service.TripID)
+		}
+		return ids
+	}
+
+	services, err := db.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "P1", ByStation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := strings.Join(tripIDs(services), ","); ids != "T3,T1,T2" {
+		t.Errorf("expected T3,T1,T2 at the station, got %s", ids)
+	}
+
+	// T3's second platform isn't a departure, so doesn't use up the limit
+	services, err = db.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "P1", ByStation: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := strings.Join(tripIDs(services), ","); ids != "T3,T1" {
+		t.Errorf("expected T3,T1 with a limit of 2, got %s", ids)
+	}
+
+	services, err = db.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "P1", ByStation: true, RouteID: "R2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := strings.Join(tripIDs(services), ","); ids != "T2" {
+		t.Errorf("expected only T2 on R2, got %s", ids)
+	}
+
+	services, err = db.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "C1", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].TripID != "T3" || services[0].StopData.PlatformNumber != "1" {
+		t.Errorf("expected T3 from platform 1, got %+v", services)
+	}
+}
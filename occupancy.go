@@ -0,0 +1,68 @@
+package gtfs
+
+/*
+How full a vehicle is, as the gtfs-realtime OccupancyStatus values
+*/
+const (
+	OccupancyEmpty                   = 0
+	OccupancyManySeatsAvailable      = 1
+	OccupancyFewSeatsAvailable       = 2
+	OccupancyStandingRoomOnly        = 3
+	OccupancyCrushedStandingRoomOnly = 4
+	OccupancyFull                    = 5
+	OccupancyNotAcceptingPassengers  = 6
+	OccupancyNoDataAvailable         = 7
+	OccupancyNotBoardable            = 8
+)
+
+type Occupancy struct {
+	Status     int    `json:"status"`               // One of the Occupancy* values
+	Percentage *int   `json:"percentage,omitempty"` // How full it is (0-100+), if the provider knows
+	Source     string `json:"source,omitempty"`     // Where the data is from, e.g the provider's name
+}
+
+/*
+Provides the occupancy (crowding) of trips from somewhere other than the gtfs-realtime feeds, e.g an agency's own api
+
+Occupancy is called for each departure and vehicle, so implementations should answer from their own cache rather than
+making a request each time. vehicleID is "" when it isn't known
+*/
+type OccupancyProvider interface {
+	Occupancy(tripID string, vehicleID string) (Occupancy, bool)
+}
+
+/*
+Add the occupancy of trips from a provider to departures (see GetActiveTripsWithOptions) and vehicles (see GetVehiclesForRoute)
+*/
+func WithOccupancyProvider(provider OccupancyProvider) Option {
+	return func(o *databaseOptions) {
+		o.occupancyProvider = provider
+	}
+}
+
+func (v Database) occupancyFor(tripID string, vehicleID string) *Occupancy {
+	if v.state == nil || v.state.occupancyProvider == nil || tripID == "" {
+		return nil
+	}
+	occupancy, found := v.state.occupancyProvider.Occupancy(tripID, vehicleID)
+	if !found {
+		return nil
+	}
+	return &occupancy
+}
+
+/*
+Set the occupancy of the services from the provider, if there is one
+*/
+func (v Database) setStopTimesOccupancy(stopTimes []StopTimes) {
+	if v.state == nil || v.state.occupancyProvider == nil {
+		return
+	}
+	for i, stopTime := range stopTimes {
+		var vehicleID string
+		if stopTime.Realtime != nil {
+			vehicleID = stopTime.Realtime.Vehicle.ID
+		}
+		stopTimes[i].Occupancy = v.occupancyFor(stopTime.TripID, vehicleID)
+	}
+}
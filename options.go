@@ -0,0 +1,280 @@
+package gtfs
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+An optional setting for New
+*/
+type Option func(*databaseOptions)
+
+type databaseOptions struct {
+	logger   *slog.Logger
+	readOnly bool
+
+	busyTimeout  time.Duration
+	cacheSize    int // KiB
+	mmapSize     int64
+	foreignKeys  bool
+	maxOpenConns int
+	maxIdleConns int
+
+	maintenance            MaintenanceOptions
+	materializedDepartures bool
+	lazyQuotes             bool
+	duplicatePolicy        DuplicatePolicy
+	userData               bool
+	occupancyProvider      OccupancyProvider
+	integrityCheck         *integrityCheckOptions
+	idPrefix               string
+}
+
+type integrityCheckOptions struct {
+	fail bool
+}
+
+func defaultDatabaseOptions() databaseOptions {
+	return databaseOptions{
+		busyTimeout: 5 * time.Second,
+		maintenance: defaultMaintenanceOptions(),
+	}
+}
+
+/*
+Build the sqlite data source, the pragmas are set on every connection in the pool
+*/
+func (o databaseOptions) dataSource(path string) string {
+	query := url.Values{}
+	if o.readOnly {
+		query.Set("mode", "ro")
+	} else {
+		// WAL mode stops readers being blocked by the writer (read only databases use the writers mode)
+		query.Add("_pragma", "journal_mode(WAL)")
+	}
+	query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", o.busyTimeout.Milliseconds()))
+	if o.cacheSize > 0 {
+		// Negative sizes are in KiB rather than pages
+		query.Add("_pragma", fmt.Sprintf("cache_size(-%d)", o.cacheSize))
+	}
+	if o.mmapSize > 0 {
+		query.Add("_pragma", fmt.Sprintf("mmap_size(%d)", o.mmapSize))
+	}
+	if o.foreignKeys {
+		query.Add("_pragma", "foreign_keys(1)")
+	}
+	return "file:" + path + "?" + query.Encode()
+}
+
+/*
+Log with the given logger instead of slog.Default(), the feed's database name is added to each message
+*/
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *databaseOptions) {
+		o.logger = logger
+	}
+}
+
+/*
+Open an existing database read only, for sharing one database file between a single writer and many readers
+
+The schema isn't created and the feed data is never refreshed (that's left to the writer), so the database must already have been created.
+The url can be "" as it's never fetched
+*/
+func WithReadOnly() Option {
+	return func(o *databaseOptions) {
+		o.readOnly = true
+	}
+}
+
+/*
+How long a query waits for a lock held by another connection (e.g a refresh) before failing with SQLITE_BUSY, defaults to 5s
+*/
+func WithBusyTimeout(timeout time.Duration) Option {
+	return func(o *databaseOptions) {
+		o.busyTimeout = timeout
+	}
+}
+
+/*
+The size of sqlite's page cache for each connection in KiB, defaults to sqlite's default (~2MB)
+*/
+func WithCacheSize(kib int) Option {
+	return func(o *databaseOptions) {
+		o.cacheSize = kib
+	}
+}
+
+/*
+The max bytes of the database file sqlite memory maps, defaults to 0 (not memory mapped)
+*/
+func WithMmapSize(bytes int64) Option {
+	return func(o *databaseOptions) {
+		o.mmapSize = bytes
+	}
+}
+
+/*
+Enforce the foreign keys of the gtfs tables, off by default as feeds often break them
+
+The feed's files are imported in any order, so this fails imports even for valid feeds. Use WithIntegrityCheck to check
+the references once the feed is imported
+*/
+func WithForeignKeys(enabled bool) Option {
+	return func(o *databaseOptions) {
+		o.foreignKeys = enabled
+	}
+}
+
+/*
+Limit the connections in the pool, 0 is no limit (the default)
+*/
+func WithMaxOpenConns(n int) Option {
+	return func(o *databaseOptions) {
+		o.maxOpenConns = n
+	}
+}
+
+/*
+The max idle connections kept in the pool, 0 uses database/sql's default (2)
+*/
+func WithMaxIdleConns(n int) Option {
+	return func(o *databaseOptions) {
+		o.maxIdleConns = n
+	}
+}
+
+/*
+What to run on the database after each refresh, defaults to vacuuming and analyzing it
+
+Turn off vacuuming for large feeds which are refreshed often, as it rewrites the whole database file
+*/
+func WithMaintenance(options MaintenanceOptions) Option {
+	return func(o *databaseOptions) {
+		o.maintenance = options
+	}
+}
+
+/*
+Write the departures from every stop for today and tomorrow to the departures table after each refresh and each night, for GetDepartures
+*/
+func WithMaterializedDepartures() Option {
+	return func(o *databaseOptions) {
+		o.materializedDepartures = true
+	}
+}
+
+/*
+Import rows with quotes in unquoted fields (e.g 5" Stop) and unescaped quotes in quoted fields, instead of skipping them
+*/
+func WithLazyQuotes() Option {
+	return func(o *databaseOptions) {
+		o.lazyQuotes = true
+	}
+}
+
+/*
+Keep the stops, routes and journeys clients save in the database (see SaveItem), in a table which isn't touched by refreshes
+*/
+func WithUserData() Option {
+	return func(o *databaseOptions) {
+		o.userData = true
+	}
+}
+
+/*
+Check the references between the feed's files after each import (see CheckIntegrity), the problems are logged and
+added to the import report
+
+  - fail: fail the refresh when there are problems, the new data is still kept
+*/
+func WithIntegrityCheck(fail bool) Option {
+	return func(o *databaseOptions) {
+		o.integrityCheck = &integrityCheckOptions{fail: fail}
+	}
+}
+
+/*
+Prefix every id in the feed (stop_id, trip_id, route_id, service_id etc) when it's imported, e.g "bus:" so feeds from
+agencies which both use numeric ids can be used together without their ids clashing
+
+Every method taking ids (e.g GetStopByStopID, ActiveTripsOptions.StopID) and matching realtime trips (see TripMatcher)
+take the feed's own ids, the prefix is added to them once when they're called. The ids they return have the prefix
+removed again, so they can be passed straight back (e.g GetStopByStopID(stops[0].StopId))
+*/
+func WithIDPrefix(prefix string) Option {
+	return func(o *databaseOptions) {
+		o.idPrefix = prefix
+	}
+}
+
+/*
+Get the logger of the database
+*/
+func (v Database) logger() *slog.Logger {
+	if v.state == nil || v.state.logger == nil {
+		return slog.Default()
+	}
+	return v.state.logger
+}
+
+/*
+Get the prefix added to the feed's ids, see WithIDPrefix
+*/
+func (v Database) IDPrefix() string {
+	if v.state == nil {
+		return ""
+	}
+	return v.state.idPrefix
+}
+
+/*
+Add the id prefix (see WithIDPrefix) to one of the feed's own ids, it's always added (the feed's ids can start with it
+too) so each id must only be prefixed once
+*/
+func (v Database) PrefixID(id string) string {
+	prefix := v.IDPrefix()
+	if prefix == "" || id == "" {
+		return id
+	}
+	return prefix + id
+}
+
+/*
+Add the id prefix (see WithIDPrefix) to some of the feed's own ids
+*/
+func (v Database) prefixIDs(ids []string) []string {
+	if v.IDPrefix() == "" {
+		return ids
+	}
+	prefixed := make([]string, len(ids))
+	for i, id := range ids {
+		prefixed[i] = v.PrefixID(id)
+	}
+	return prefixed
+}
+
+/*
+Remove the id prefix (see WithIDPrefix) from an id, e.g to look it up in the agency's own systems
+*/
+func (v Database) StripIDPrefix(id string) string {
+	return strings.TrimPrefix(id, v.IDPrefix())
+}
+
+/*
+Remove the id prefix (see WithIDPrefix) from some of the database's ids, in place
+*/
+func (v Database) stripIDPrefixes(ids []string) []string {
+	for i, id := range ids {
+		ids[i] = v.StripIDPrefix(id)
+	}
+	return ids
+}
+
+func (v Database) lazyQuotes() bool {
+	return v.state != nil && v.state.lazyQuotes
+}
@@ -0,0 +1,37 @@
+package gtfs
+
+import "fmt"
+
+/*
+A page of results, pass to list/search functions to only get some of the results
+
+  - Limit: the max amount of results, 0 for no limit
+  - Offset: how many results to skip
+*/
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+/*
+Build the LIMIT/OFFSET clause for the first page given, "" if none were given
+*/
+func pageClause(page []Page) string {
+	if len(page) == 0 {
+		return ""
+	}
+	p := page[0]
+	if p.Limit <= 0 && p.Offset <= 0 {
+		return ""
+	}
+
+	limit := p.Limit
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	clause := fmt.Sprintf(" LIMIT %d", limit)
+	if p.Offset > 0 {
+		clause += fmt.Sprintf(" OFFSET %d", p.Offset)
+	}
+	return clause
+}
@@ -0,0 +1,109 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+/*
+Re-import only some of the feed's files from a feed zip, e.g a mid-day fix to calendar_dates.txt, without re-importing the
+rest (like stop_times.txt)
+
+The tables are cleared and imported from the zip's files (which must all be in it) in one transaction, so they're kept
+if the import fails. The derived data built from them (e.g stop stats) is rebuilt, and refresh subscribers are notified
+the same as for a full refresh
+
+  - names: the files to re-import, e.g "calendar_dates" or "calendar_dates.txt"
+  - zipData: a feed zip with the files, it can have other files which are ignored
+*/
+func (v Database) RefreshTables(names []string, zipData []byte) (ImportReport, error) {
+	if v.IsReadOnly() {
+		return ImportReport{}, errors.New("can't refresh a read only database")
+	}
+	// The zip would have one feed's unprefixed ids
+	if v.isMerged() {
+		return ImportReport{}, errors.New("can't refresh tables of merged feeds, merge them again")
+	}
+	if len(names) == 0 {
+		return ImportReport{}, errors.New("missing tables")
+	}
+
+	validName := regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	var tables []string
+	for _, name := range names {
+		table := feedFileTable(name)
+		if !validName.MatchString(table) {
+			return ImportReport{}, fmt.Errorf("invalid table name: %s", name)
+		}
+		if contains(nonFeedTableNames, table) || contains(derivedTableNames, table) || contains(rtreeShadowTableNames, table) {
+			return ImportReport{}, fmt.Errorf("%s isn't a feed table", table)
+		}
+		if !contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+
+	// Check the files are all there before anything is cleared
+	reader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return ImportReport{}, errors.New("error reading GTFS zip file")
+	}
+	var found []string
+	for _, file := range reader.File {
+		if !file.FileInfo().IsDir() && isCSVFile(file.Name) {
+			found = append(found, feedFileTable(file.Name))
+		}
+	}
+	for _, table := range tables {
+		if !contains(found, table) {
+			return ImportReport{}, fmt.Errorf("%s.txt isn't in the zip", table)
+		}
+	}
+
+	logger := v.logger().With("tables", tables)
+	logger.Info("refreshing tables")
+	start := time.Now()
+
+	// The prepared statements and agency timezones use the tables being replaced
+	v.resetStatements()
+	v.resetLocations()
+
+	report, err := writeFilesToDB(zipData, v, func(tx *sql.Tx) error {
+		for _, table := range tables {
+			var exists bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)`, table).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", table)); err != nil {
+				return fmt.Errorf("failed to delete data from table %s: %w", table, err)
+			}
+		}
+		return nil
+	}, tables...)
+	v.setImportReport(report)
+	if err != nil {
+		v.observeImport(start, err)
+		v.setRefreshResult(err)
+		logger.Error("failed to write new data to the database", "error", err)
+		return report, fmt.Errorf("failed to write new data to the database: %w", err)
+	}
+	// Queries during the import could have cached the old agencies' timezones
+	v.resetLocations()
+
+	v.buildDerivedData(tables...)
+
+	v.observeImport(start, nil)
+	v.setRefreshResult(nil)
+	v.notifyRefreshed()
+
+	logger.Info("tables refreshed successfully", "duration", time.Since(start))
+	return report, nil
+}
@@ -0,0 +1,168 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+How far apart (in time) the positions of a playback are
+*/
+const playbackInterval = 10 * time.Second
+
+/*
+Create the table vehicle positions are recorded in, it's kept when the feed data is refreshed
+*/
+func (v Database) createVehiclePositionsTable() error {
+	query := `
+		CREATE TABLE IF NOT EXISTS vehicle_positions (
+			trip_id TEXT NOT NULL,
+			service_date TEXT NOT NULL,
+			vehicle_id TEXT NOT NULL DEFAULT '',
+			timestamp INTEGER NOT NULL,
+			lat REAL NOT NULL,
+			lon REAL NOT NULL,
+			speed REAL NOT NULL DEFAULT 0,
+			PRIMARY KEY (trip_id, service_date, vehicle_id, timestamp)
+		) WITHOUT ROWID;
+		CREATE INDEX IF NOT EXISTS idx_vehicle_positions_timestamp ON vehicle_positions (timestamp);
+	`
+	if _, err := v.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create vehicle positions table: %w", err)
+	}
+	return nil
+}
+
+/*
+Record the positions of vehicles, for GetVehiclePlayback. Call it with each fetch of the vehicles (positions which
+have already been recorded are ignored), and remove old positions with PruneVehiclePositions
+*/
+func (v Database) RecordVehiclePositions(vehicles realtime.VehiclesMap) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	location := v.locationFor("", "")
+	for _, vehicle := range vehicles {
+		if vehicle.Trip.TripID == "" || vehicle.Timestamp <= 0 {
+			continue
+		}
+		serviceDate := vehicle.Trip.StartDate
+		if serviceDate == "" {
+			serviceDate = ServiceDayOf(time.Unix(vehicle.Timestamp, 0), location).String()
+		}
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO vehicle_positions (trip_id, service_date, vehicle_id, timestamp, lat, lon, speed)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, vehicle.Trip.TripID, serviceDate, vehicle.Vehicle.ID, vehicle.Timestamp, vehicle.Position.Latitude, vehicle.Position.Longitude, vehicle.Position.Speed)
+		if err != nil {
+			return fmt.Errorf("failed to record vehicle position: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+Remove the vehicle positions recorded before a time
+*/
+func (v Database) PruneVehiclePositions(before time.Time) error {
+	if _, err := v.db.Exec(`DELETE FROM vehicle_positions WHERE timestamp < ?`, before.Unix()); err != nil {
+		return fmt.Errorf("failed to prune vehicle positions: %w", err)
+	}
+	return nil
+}
+
+type PlaybackPosition struct {
+	Time      time.Time `json:"time"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Distance  float64   `json:"distance"` // How far along the trip's shape (km)
+	VehicleID string    `json:"vehicle_id"`
+	Recorded  bool      `json:"recorded"` // If the position was recorded, else it's between two recorded positions
+}
+
+/*
+Get where a trip's vehicle was over the trip, from the positions recorded by RecordVehiclePositions
+
+The positions are snapped to the trip's shape and resampled every 10 seconds between the recorded ones, so a replay
+moves along the route smoothly instead of jumping (or cutting corners) between the recorded positions
+*/
+func (v Database) GetVehiclePlayback(tripID string, date string) ([]PlaybackPosition, error) {
+	defer v.observeQuery("GetVehiclePlayback", time.Now())
+
+	trip, err := v.tripByID(v.PrefixID(tripID))
+	if err != nil {
+		return nil, errors.New("trip not found")
+	}
+	if date == "" {
+		date = Today(v.locationFor("", trip.RouteID)).String()
+	}
+
+	var recorded []struct {
+		VehicleID string  `db:"vehicle_id"`
+		Timestamp int64   `db:"timestamp"`
+		Lat       float64 `db:"lat"`
+		Lon       float64 `db:"lon"`
+	}
+	err = v.db.Select(&recorded, `
+		SELECT vehicle_id, timestamp, lat, lon
+		FROM vehicle_positions
+		WHERE trip_id = ? AND service_date = ?
+		ORDER BY timestamp
+	`, tripID, date)
+	if err != nil {
+		return nil, err
+	}
+	if len(recorded) == 0 {
+		return nil, errors.New("no positions recorded for the trip")
+	}
+
+	line, err := v.tripPolyline(trip)
+	if err != nil {
+		return nil, err
+	}
+
+	// Vehicles don't go backwards along the trip, so each position is only matched from the last one on
+	playback := []PlaybackPosition{}
+	along := 0.0
+	for i, position := range recorded {
+		projected, _ := line.project(position.Lat, position.Lon, along)
+		at := time.Unix(position.Timestamp, 0)
+
+		if i > 0 {
+			previous := playback[len(playback)-1]
+			gap := at.Sub(previous.Time)
+			for t := playbackInterval; t < gap; t += playbackInterval {
+				distance := previous.Distance + (projected-previous.Distance)*float64(t)/float64(gap)
+				lat, lon := line.pointAt(distance)
+				playback = append(playback, PlaybackPosition{
+					Time:      previous.Time.Add(t),
+					Lat:       lat,
+					Lon:       lon,
+					Distance:  math.Round(distance*1000) / 1000,
+					VehicleID: position.VehicleID,
+				})
+			}
+		}
+
+		lat, lon := line.pointAt(projected)
+		playback = append(playback, PlaybackPosition{
+			Time:      at,
+			Lat:       lat,
+			Lon:       lon,
+			Distance:  math.Round(projected*1000) / 1000,
+			VehicleID: position.VehicleID,
+			Recorded:  true,
+		})
+		along = projected
+	}
+
+	return playback, nil
+}
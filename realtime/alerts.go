@@ -12,23 +12,70 @@ import (
 
 var (
 	alertClient          = &http.Client{}
-	alertApiRequestMutex sync.Mutex
+	alertApiRequestMutex sync.Mutex // Guards the caches, a realtime's fetches are behind requestMutex
 )
 
 var (
-	cachedAlertsData       map[string]AlertMap = make(map[string]AlertMap)
-	lastUpdatedAlertsCache time.Time
+	cachedAlertsData       map[string]AlertMap      = make(map[string]AlertMap)
+	lastUpdatedAlertsCache map[string]time.Time     = make(map[string]time.Time)
+	alertsCachePeriod      map[string]time.Duration = make(map[string]time.Duration)
 )
 
 type AlertMap []Alert
 
 func (v alerts) GetAlerts() (AlertMap, error) {
+	fetchMutex := requestMutex("alerts", v.name)
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+
 	alertApiRequestMutex.Lock()
-	defer alertApiRequestMutex.Unlock()
-	if cachedAlertsData[v.name] != nil && len(cachedAlertsData[v.name]) >= 1 && lastUpdatedAlertsCache.Add(15*time.Second).After(time.Now()) {
-		return cachedAlertsData[v.name], nil
+	cached, lastUpdated, cachePeriod := cachedAlertsData[v.name], lastUpdatedAlertsCache[v.name], alertsCachePeriod[v.name]
+	alertApiRequestMutex.Unlock()
+	if cached != nil && len(cached) >= 1 && lastUpdated.Add(cachePeriod).After(time.Now()) {
+		return cached, nil
+	}
+
+	// After a restart, answer from the persisted feed for a cache period rather than everyone waiting on the api
+	if cached == nil {
+		if alerts, ok := loadPersistedFeed[AlertMap](v.persistence, v.name, "alerts"); ok {
+			v.cacheAlerts(alerts)
+			return alerts, nil
+		}
+	}
+
+	// Don't request the api again until its backoff has passed, the cached data is better than nothing
+	if backingOff(v.name, "alerts") {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, ErrRateLimited
+	}
+
+	start := time.Now()
+	alerts, err := v.fetchAlerts()
+	observeFetch(v.name, "alerts", v.url, time.Since(start), err)
+	if err != nil {
+		return nil, err
 	}
 
+	v.cacheAlerts(alerts)
+	persistFeed(v.persistence, v.name, "alerts", alerts)
+
+	return alerts, nil
+}
+
+func (v alerts) cacheAlerts(alerts AlertMap) {
+	alertApiRequestMutex.Lock()
+	defer alertApiRequestMutex.Unlock()
+	cachedAlertsData[v.name] = alerts
+	lastUpdatedAlertsCache[v.name] = time.Now()
+	alertsCachePeriod[v.name] = jitteredCachePeriod()
+}
+
+/*
+Request the alerts from the api
+*/
+func (v alerts) fetchAlerts() (AlertMap, error) {
 	url := v.url
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -45,6 +92,10 @@ func (v alerts) GetAlerts() (AlertMap, error) {
 	}
 	defer resp.Body.Close()
 
+	if err := checkRateLimit(v.name, "alerts", resp); err != nil {
+		return nil, err
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response body: %w", err)
@@ -75,9 +126,6 @@ func (v alerts) GetAlerts() (AlertMap, error) {
 		}
 	}
 
-	cachedAlertsData[v.name] = alerts
-	lastUpdatedAlertsCache = time.Now()
-
 	return alerts, nil
 }
 
@@ -148,6 +196,93 @@ type Translation struct {
 }
 
 type InformedEntity struct {
-	StopID  string  `json:"stop_id"`
+	AgencyID string        `json:"agency_id"`
+	StopID   string        `json:"stop_id"`
+	RouteID  RouteID       `json:"route_id"`
+	Trip     *InformedTrip `json:"trip,omitempty"`
+}
+
+type InformedTrip struct {
+	TripID  string  `json:"trip_id"`
 	RouteID RouteID `json:"route_id"`
 }
+
+/*
+If the alert is active at a time, alerts without an active period are always active
+*/
+func (alert Alert) ActiveAt(t time.Time) bool {
+	if len(alert.ActivePeriod) == 0 {
+		return true
+	}
+	unix := t.Unix()
+	for _, period := range alert.ActivePeriod {
+		if (period.Start == 0 || unix >= period.Start) && (period.End == 0 || unix < period.End) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Get the alerts which affect a service at a time, so clients don't have to match the informed entities themselves
+
+An informed entity matches when every field it sets matches the service, e.g an entity with a route and a stop only
+matches the route's services at that stop. Entities which set nothing are ignored
+
+  - routeID, tripID: the service's route and trip
+  - stopIDs: the stop the service is at (and its parent station), can be empty for trip/route wide alerts
+  - at: when the service is there, alerts which aren't active then are left out
+*/
+func (alerts AlertMap) ForService(routeID, tripID string, stopIDs []string, at time.Time) AlertMap {
+	var found AlertMap
+	for _, alert := range alerts {
+		if !alert.ActiveAt(at) {
+			continue
+		}
+		for _, entity := range alert.InformedEntity {
+			if entity.matches(routeID, tripID, stopIDs) {
+				found = append(found, alert)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func (entity InformedEntity) matches(routeID, tripID string, stopIDs []string) bool {
+	matchedAny := false
+	if entity.RouteID != "" {
+		if string(entity.RouteID) != routeID {
+			return false
+		}
+		matchedAny = true
+	}
+	if entity.Trip != nil {
+		if entity.Trip.TripID != "" {
+			if entity.Trip.TripID != tripID {
+				return false
+			}
+			matchedAny = true
+		}
+		if entity.Trip.RouteID != "" {
+			if string(entity.Trip.RouteID) != routeID {
+				return false
+			}
+			matchedAny = true
+		}
+	}
+	if entity.StopID != "" {
+		atStop := false
+		for _, stopID := range stopIDs {
+			if stopID != "" && stopID == entity.StopID {
+				atStop = true
+				break
+			}
+		}
+		if !atStop {
+			return false
+		}
+		matchedAny = true
+	}
+	return matchedAny
+}
@@ -0,0 +1,327 @@
+package realtime
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+A realtime's feeds in a manager, nil for the feeds it doesn't have
+*/
+type managedRealtime struct {
+	realtime    RealtimeS
+	vehicles    *vehicles
+	tripUpdates *tripUpdates
+	alerts      *alerts
+}
+
+/*
+Owns the realtime of many agencies/regions, fetching them all on one schedule and giving merged views across them
+*/
+type RealtimeManager struct {
+	concurrency int
+	interval    time.Duration
+
+	mu        sync.Mutex
+	realtimes map[string]managedRealtime // By realtime name
+	running   bool
+	stop      chan struct{}
+}
+
+/*
+A vehicle and the name of the realtime it's from, as trip ids are only unique within a feed
+*/
+type ManagedVehicle struct {
+	Realtime string `json:"realtime"`
+	Vehicle
+}
+
+/*
+Create a manager for many realtimes, add them with Add
+
+  - concurrency: how many feeds are fetched at the same time (min 1)
+  - interval: how often Start fetches the feeds (min 15s as that's how long the feeds are cached for)
+*/
+func NewManager(concurrency int, interval time.Duration) *RealtimeManager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if interval < 15*time.Second {
+		interval = 15 * time.Second
+	}
+	return &RealtimeManager{
+		concurrency: concurrency,
+		interval:    interval,
+		realtimes:   make(map[string]managedRealtime),
+	}
+}
+
+/*
+Add a realtime and its feed urls to the manager, replacing any with the same name
+
+Any of the urls can be "" for regions without that feed, but not all of them
+*/
+func (m *RealtimeManager) Add(realtime RealtimeS, vehiclesUrl, tripUpdatesUrl, alertsUrl string) error {
+	if vehiclesUrl == "" && tripUpdatesUrl == "" && alertsUrl == "" {
+		return errors.New("missing vehicles, trip updates and alerts url")
+	}
+
+	managed := managedRealtime{realtime: realtime}
+	if vehiclesUrl != "" {
+		vehicles, err := realtime.Vehicles(vehiclesUrl)
+		if err != nil {
+			return err
+		}
+		managed.vehicles = &vehicles
+	}
+	if tripUpdatesUrl != "" {
+		tripUpdates, err := realtime.TripUpdates(tripUpdatesUrl)
+		if err != nil {
+			return err
+		}
+		managed.tripUpdates = &tripUpdates
+	}
+	if alertsUrl != "" {
+		alerts, err := realtime.Alerts(alertsUrl)
+		if err != nil {
+			return err
+		}
+		managed.alerts = &alerts
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.realtimes[realtime.name] = managed
+	return nil
+}
+
+/*
+Remove a realtime from the manager, its cached data is kept until the process restarts
+*/
+func (m *RealtimeManager) Remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.realtimes, name)
+}
+
+/*
+Get a realtime in the manager by its name
+*/
+func (m *RealtimeManager) Get(name string) (RealtimeS, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	managed, found := m.realtimes[name]
+	return managed.realtime, found
+}
+
+/*
+Get the names of the realtimes in the manager, in order
+*/
+func (m *RealtimeManager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.realtimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Start fetching every realtime's feeds in the background, so the merged views are answered from the caches
+*/
+func (m *RealtimeManager) Start() {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = true
+	m.stop = make(chan struct{})
+	stop := m.stop
+	m.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		m.Refresh()
+		for {
+			select {
+			case <-ticker.C:
+				m.Refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+Stop fetching the feeds in the background
+*/
+func (m *RealtimeManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return
+	}
+	m.running = false
+	close(m.stop)
+}
+
+/*
+Fetch every realtime's feeds now (they're still only requested when their cache has expired)
+
+Failures are logged and can be seen in Status
+*/
+func (m *RealtimeManager) Refresh() {
+	m.forEach(func(name string, managed managedRealtime) {
+		logger := managed.realtime.getLogger()
+		if managed.vehicles != nil {
+			if _, err := managed.vehicles.GetVehicles(); err != nil {
+				logger.Warn("manager: failed to get vehicles", "error", err)
+			}
+		}
+		if managed.tripUpdates != nil {
+			if _, err := managed.tripUpdates.GetTripUpdates(); err != nil {
+				logger.Warn("manager: failed to get trip updates", "error", err)
+			}
+		}
+		if managed.alerts != nil {
+			if _, err := managed.alerts.GetAlerts(); err != nil {
+				logger.Warn("manager: failed to get alerts", "error", err)
+			}
+		}
+	})
+}
+
+/*
+Get the vehicles of every realtime, by realtime name. Realtimes whose vehicles couldn't be fetched are left out
+*/
+func (m *RealtimeManager) Vehicles() map[string]VehiclesMap {
+	result := make(map[string]VehiclesMap)
+	var resultMutex sync.Mutex
+	m.forEach(func(name string, managed managedRealtime) {
+		if managed.vehicles == nil {
+			return
+		}
+		vehicles, err := managed.vehicles.GetVehicles()
+		if err != nil {
+			managed.realtime.getLogger().Warn("manager: failed to get vehicles", "error", err)
+			return
+		}
+		resultMutex.Lock()
+		result[name] = vehicles
+		resultMutex.Unlock()
+	})
+	return result
+}
+
+/*
+Get the vehicles of every realtime inside a bounding box, e.g for a map spanning regions
+*/
+func (m *RealtimeManager) VehiclesInBounds(minLat, minLon, maxLat, maxLon float64) []ManagedVehicle {
+	var result []ManagedVehicle
+	for name, vehicles := range m.Vehicles() {
+		for _, vehicle := range vehicles {
+			position := vehicle.Position
+			if position.Latitude < minLat || position.Latitude > maxLat || position.Longitude < minLon || position.Longitude > maxLon {
+				continue
+			}
+			result = append(result, ManagedVehicle{Realtime: name, Vehicle: vehicle})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Realtime != result[j].Realtime {
+			return result[i].Realtime < result[j].Realtime
+		}
+		return result[i].Trip.TripID < result[j].Trip.TripID
+	})
+	return result
+}
+
+/*
+Get the trip updates of every realtime, by realtime name. Realtimes whose trip updates couldn't be fetched are left out
+*/
+func (m *RealtimeManager) TripUpdates() map[string]TripUpdatesMap {
+	result := make(map[string]TripUpdatesMap)
+	var resultMutex sync.Mutex
+	m.forEach(func(name string, managed managedRealtime) {
+		if managed.tripUpdates == nil {
+			return
+		}
+		updates, err := managed.tripUpdates.GetTripUpdates()
+		if err != nil {
+			managed.realtime.getLogger().Warn("manager: failed to get trip updates", "error", err)
+			return
+		}
+		resultMutex.Lock()
+		result[name] = updates
+		resultMutex.Unlock()
+	})
+	return result
+}
+
+/*
+Get the alerts of every realtime, by realtime name. Realtimes whose alerts couldn't be fetched are left out
+*/
+func (m *RealtimeManager) Alerts() map[string]AlertMap {
+	result := make(map[string]AlertMap)
+	var resultMutex sync.Mutex
+	m.forEach(func(name string, managed managedRealtime) {
+		if managed.alerts == nil {
+			return
+		}
+		alerts, err := managed.alerts.GetAlerts()
+		if err != nil {
+			managed.realtime.getLogger().Warn("manager: failed to get alerts", "error", err)
+			return
+		}
+		resultMutex.Lock()
+		result[name] = alerts
+		resultMutex.Unlock()
+	})
+	return result
+}
+
+/*
+Get the feed statuses of every realtime, by realtime name
+*/
+func (m *RealtimeManager) Status() map[string][]FeedStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string][]FeedStatus)
+	for name, managed := range m.realtimes {
+		result[name] = managed.realtime.Status()
+	}
+	return result
+}
+
+/*
+Run fn for each realtime, at most concurrency at a time, and wait for them all
+*/
+func (m *RealtimeManager) forEach(fn func(name string, managed managedRealtime)) {
+	m.mu.Lock()
+	realtimes := make(map[string]managedRealtime, len(m.realtimes))
+	for name, managed := range m.realtimes {
+		realtimes[name] = managed
+	}
+	m.mu.Unlock()
+
+	semaphore := make(chan struct{}, m.concurrency)
+	var wg sync.WaitGroup
+	for name, managed := range realtimes {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(name string, managed managedRealtime) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			fn(name, managed)
+		}(name, managed)
+	}
+	wg.Wait()
+}
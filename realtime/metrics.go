@@ -0,0 +1,38 @@
+package realtime
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Receives measurements of the realtime api requests, e.g to export them to prometheus
+*/
+type Metrics interface {
+	// Called after each request to a realtime api (not when the cached data is used)
+	FetchFinished(feed string, url string, duration time.Duration, err error)
+}
+
+var (
+	metrics      Metrics
+	metricsMutex sync.RWMutex
+)
+
+/*
+Set where the measurements of the realtime api requests are sent, nil to stop sending them
+*/
+func SetMetrics(m Metrics) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metrics = m
+}
+
+func observeFetch(name string, feed string, url string, duration time.Duration, err error) {
+	recordFetch(name, feed, url, err)
+
+	metricsMutex.RLock()
+	defer metricsMutex.RUnlock()
+	if metrics != nil {
+		metrics.FetchFinished(feed, url, duration, err)
+	}
+}
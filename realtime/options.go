@@ -0,0 +1,26 @@
+package realtime
+
+import (
+	"log/slog"
+)
+
+/*
+An optional setting for New
+*/
+type Option func(*RealtimeS)
+
+/*
+Log with the given logger instead of slog.Default(), the feed name is added to each message
+*/
+func WithLogger(logger *slog.Logger) Option {
+	return func(v *RealtimeS) {
+		v.logger = logger
+	}
+}
+
+func (v RealtimeS) getLogger() *slog.Logger {
+	if v.logger == nil {
+		return slog.Default().With("feed", v.name)
+	}
+	return v.logger.With("feed", v.name)
+}
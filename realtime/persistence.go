@@ -0,0 +1,111 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+/*
+Where to keep the last fetched vehicles, trip updates and alerts, so a restarted process can answer from them instead of
+every request waiting on (and all hitting) the api at once
+
+Realtimes with names which can't be used in a file name (anything but letters, numbers, spaces, ".", "_" and "-")
+aren't persisted
+*/
+type Persistence struct {
+	Dir    string        // The directory the feeds are written to, one json file per realtime name and feed
+	MaxAge time.Duration // The oldest persisted data to load, defaults to 15s (how long fetched data is cached for)
+
+	logger *slog.Logger // The realtime's logger, set when its feeds are created
+}
+
+/*
+Write each fetched feed to disk, and load it when the process starts if it's recent enough
+*/
+func WithPersistence(persistence Persistence) Option {
+	return func(v *RealtimeS) {
+		v.persistence = persistence
+	}
+}
+
+type persistedFeed[T any] struct {
+	Fetched time.Time `json:"fetched"`
+	Data    T         `json:"data"`
+}
+
+/*
+Only names made of these can be used in file names, so a name can't point outside the directory (e.g "../x")
+*/
+var safeFileName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_. -]*$`)
+
+func (p Persistence) path(name string, feed string) (string, error) {
+	file := fmt.Sprintf("%s-%s.json", name, feed)
+	if filepath.Base(file) != file || !safeFileName.MatchString(file) {
+		return "", errors.New("realtime name can't be used in a file name")
+	}
+	return filepath.Join(p.Dir, file), nil
+}
+
+func (p Persistence) getLogger(name string) *slog.Logger {
+	if p.logger == nil {
+		return slog.Default().With("feed", name)
+	}
+	return p.logger
+}
+
+/*
+Write a fetched feed, the file is replaced in one go so a crash can't leave half of it
+*/
+func persistFeed[T any](p Persistence, name string, feed string, data T) {
+	if p.Dir == "" {
+		return
+	}
+
+	path, err := p.path(name, feed)
+	if err == nil {
+		var encoded []byte
+		if encoded, err = json.Marshal(persistedFeed[T]{Fetched: time.Now(), Data: data}); err == nil {
+			temp := path + ".tmp"
+			if err = os.WriteFile(temp, encoded, 0o644); err == nil {
+				err = os.Rename(temp, path)
+			}
+		}
+	}
+	if err != nil {
+		p.getLogger(name).Warn("failed to persist realtime data", "type", feed, "error", err)
+	}
+}
+
+/*
+Load a persisted feed if there is one younger than the max age
+*/
+func loadPersistedFeed[T any](p Persistence, name string, feed string) (T, bool) {
+	var persisted persistedFeed[T]
+	if p.Dir == "" {
+		return persisted.Data, false
+	}
+
+	maxAge := p.MaxAge
+	if maxAge <= 0 {
+		maxAge = 15 * time.Second
+	}
+
+	path, err := p.path(name, feed)
+	if err != nil {
+		return persisted.Data, false
+	}
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return persisted.Data, false
+	}
+	if err := json.Unmarshal(encoded, &persisted); err != nil || time.Since(persisted.Fetched) > maxAge {
+		return persisted.Data, false
+	}
+	return persisted.Data, true
+}
@@ -0,0 +1,130 @@
+package realtime
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited by the realtime api")
+
+/*
+A 429 (or 503 with Retry-After) response from a realtime api
+*/
+type RateLimitError struct {
+	StatusCode int
+	RetryAfter time.Duration // 0 if the api didn't say
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by the realtime api (%d), retry after %s", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited by the realtime api (%d)", e.StatusCode)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+/*
+How long to back off for after being rate limited without a Retry-After, doubling each time up to maxBackoff
+*/
+const (
+	minBackoff = 30 * time.Second
+	maxBackoff = 10 * time.Minute
+)
+
+/*
+A feed's rate limiting, from the api's responses
+*/
+type backoffState struct {
+	until          time.Time
+	rateLimited    int // In a row
+	quotaLimit     *int
+	quotaRemaining *int
+}
+
+var (
+	backoffStates      = make(map[string]map[string]backoffState) // By realtime name, then feed
+	backoffStatesMutex sync.Mutex
+)
+
+/*
+Check a response for rate limiting, and keep the quota headers (X-RateLimit-Limit/Remaining) for Status
+*/
+func checkRateLimit(name string, feed string, resp *http.Response) error {
+	backoffStatesMutex.Lock()
+	defer backoffStatesMutex.Unlock()
+
+	if backoffStates[name] == nil {
+		backoffStates[name] = make(map[string]backoffState)
+	}
+	state := backoffStates[name][feed]
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		state.quotaLimit = &limit
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		state.quotaRemaining = &remaining
+	}
+
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if resp.StatusCode != http.StatusTooManyRequests && (resp.StatusCode != http.StatusServiceUnavailable || retryAfter == 0) {
+		state.rateLimited = 0
+		backoffStates[name][feed] = state
+		return nil
+	}
+
+	state.rateLimited++
+	backoff := retryAfter
+	if backoff <= 0 {
+		backoff = minBackoff << (state.rateLimited - 1)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+	}
+	state.until = time.Now().Add(backoff)
+	backoffStates[name][feed] = state
+
+	return &RateLimitError{StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+}
+
+/*
+Parse a Retry-After header, in seconds or as a http date
+*/
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+/*
+If the api shouldn't be requested until a time, because it rate limited the last request
+*/
+func backingOff(name string, feed string) bool {
+	backoffStatesMutex.Lock()
+	defer backoffStatesMutex.Unlock()
+	return time.Now().Before(backoffStates[name][feed].until)
+}
+
+/*
+How long fetched data is cached for, with up to 20% added at random so processes started together don't all request
+the api at the same moment
+*/
+func jitteredCachePeriod() time.Duration {
+	const period = 15 * time.Second
+	return period + time.Duration(rand.Int63n(int64(period/5)))
+}
@@ -2,35 +2,49 @@ package realtime
 
 import (
 	"errors"
+	"log/slog"
 	"regexp"
+	"sync"
 )
 
+/*
+A realtime api's settings, safe to copy and to use from multiple goroutines. The fetched data is cached by name, shared by
+every copy (see requestMutex)
+*/
 type RealtimeS struct {
-	apiKey    string
-	apiHeader string
-	name      string
+	apiKey      string
+	apiHeader   string
+	name        string
+	logger      *slog.Logger
+	staleness   Staleness
+	persistence Persistence
 }
 
 type tripUpdates struct {
-	url       string
-	apiKey    string
-	apiHeader string
-	name      string
+	url         string
+	apiKey      string
+	apiHeader   string
+	name        string
+	staleness   Staleness
+	persistence Persistence
 }
 type vehicles struct {
-	url       string
-	apiKey    string
-	apiHeader string
-	name      string
+	url         string
+	apiKey      string
+	apiHeader   string
+	name        string
+	staleness   Staleness
+	persistence Persistence
 }
 type alerts struct {
-	url       string
-	apiKey    string
-	apiHeader string
-	name      string
+	url         string
+	apiKey      string
+	apiHeader   string
+	name        string
+	persistence Persistence
 }
 
-func New(apiKey string, apiHeader string, name string) (RealtimeS, error) {
+func New(apiKey string, apiHeader string, name string, options ...Option) (RealtimeS, error) {
 	if apiKey == "" {
 		return RealtimeS{}, errors.New("missing api key")
 	}
@@ -40,10 +54,15 @@ func New(apiKey string, apiHeader string, name string) (RealtimeS, error) {
 	if len(name) < 3 {
 		return RealtimeS{}, errors.New("missing name")
 	}
-	return RealtimeS{
+	realtime := RealtimeS{
 		apiKey:    apiKey,
 		apiHeader: apiHeader,
-	}, nil
+		name:      name,
+	}
+	for _, option := range options {
+		option(&realtime)
+	}
+	return realtime, nil
 }
 
 func (v RealtimeS) Vehicles(url string) (vehicles, error) {
@@ -53,10 +72,12 @@ func (v RealtimeS) Vehicles(url string) (vehicles, error) {
 		return vehicles{}, errors.New("missing vehicles url/invalid url")
 	}
 	return vehicles{
-		url:       url,
-		apiKey:    v.apiKey,
-		apiHeader: v.apiHeader,
-		name:      v.name,
+		url:         url,
+		apiKey:      v.apiKey,
+		apiHeader:   v.apiHeader,
+		name:        v.name,
+		staleness:   v.staleness,
+		persistence: v.feedPersistence(),
 	}, nil
 }
 
@@ -67,10 +88,12 @@ func (v RealtimeS) TripUpdates(url string) (tripUpdates, error) {
 		return tripUpdates{}, errors.New("missing trip updates url/invalid url")
 	}
 	return tripUpdates{
-		url:       url,
-		apiKey:    v.apiKey,
-		apiHeader: v.apiHeader,
-		name:      v.name,
+		url:         url,
+		apiKey:      v.apiKey,
+		apiHeader:   v.apiHeader,
+		name:        v.name,
+		staleness:   v.staleness,
+		persistence: v.feedPersistence(),
 	}, nil
 }
 
@@ -81,9 +104,39 @@ func (v RealtimeS) Alerts(url string) (alerts, error) {
 		return alerts{}, errors.New("missing alerts url/invalid url")
 	}
 	return alerts{
-		url:       url,
-		apiKey:    v.apiKey,
-		apiHeader: v.apiHeader,
-		name:      v.name,
+		url:         url,
+		apiKey:      v.apiKey,
+		apiHeader:   v.apiHeader,
+		name:        v.name,
+		persistence: v.feedPersistence(),
 	}, nil
 }
+
+/*
+The persistence settings for the realtime's feeds, logging with its logger
+*/
+func (v RealtimeS) feedPersistence() Persistence {
+	persistence := v.persistence
+	persistence.logger = v.getLogger()
+	return persistence
+}
+
+var (
+	requestMutexes      = make(map[string]*sync.Mutex) // By feed, then realtime name
+	requestMutexesMutex sync.Mutex
+)
+
+/*
+Get the mutex a realtime's feed is fetched under, so a feed is only requested once at a time while different realtimes
+(e.g in a RealtimeManager) can be requested at the same time
+*/
+func requestMutex(feed string, name string) *sync.Mutex {
+	requestMutexesMutex.Lock()
+	defer requestMutexesMutex.Unlock()
+
+	key := feed + "/" + name
+	if requestMutexes[key] == nil {
+		requestMutexes[key] = &sync.Mutex{}
+	}
+	return requestMutexes[key]
+}
@@ -0,0 +1,150 @@
+package realtime
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+How old realtime data can be before it's filtered out, so maps don't show vehicles which stopped reporting and
+departure boards don't show updates for trips which finished hours ago. Zero values don't filter
+*/
+type Staleness struct {
+	VehicleMaxAge    time.Duration  // Drop vehicles whose position timestamp is older than this
+	TripUpdateMaxAge time.Duration  // Drop trip updates whose timestamp is older than this
+	ServiceDayGrace  time.Duration  // Drop trip updates for trips whose service day (start_date) ended more than this long ago
+	Location         *time.Location // The timezone the start dates are in, defaults to time.Local
+}
+
+/*
+Filter out stale vehicles and trip updates each time they're fetched (and when Cleanup is called)
+*/
+func WithStaleness(staleness Staleness) Option {
+	return func(v *RealtimeS) {
+		v.staleness = staleness
+	}
+}
+
+/*
+How many entities were filtered out as stale, e.g for monitoring
+*/
+type CleanupStats struct {
+	LastCleanup      time.Time `json:"last_cleanup"`
+	StaleVehicles    int       `json:"stale_vehicles"`     // In the last fetch/cleanup of the vehicles
+	StaleTripUpdates int       `json:"stale_trip_updates"` // In the last fetch/cleanup of the trip updates, by timestamp
+	GhostTrips       int       `json:"ghost_trips"`        // In the last fetch/cleanup of the trip updates, by service day
+
+	TotalStaleVehicles    int64 `json:"total_stale_vehicles"` // Since the process started
+	TotalStaleTripUpdates int64 `json:"total_stale_trip_updates"`
+	TotalGhostTrips       int64 `json:"total_ghost_trips"`
+}
+
+var (
+	cleanupStats      = make(map[string]CleanupStats) // By realtime name
+	cleanupStatsMutex sync.Mutex
+)
+
+/*
+Get the vehicles which aren't stale
+*/
+func (s Staleness) filterVehicles(name string, vehicles VehiclesMap, now time.Time) VehiclesMap {
+	if s.VehicleMaxAge <= 0 {
+		return vehicles
+	}
+
+	filtered := make(VehiclesMap, len(vehicles))
+	stale := 0
+	for key, vehicle := range vehicles {
+		if vehicle.Timestamp > 0 && now.Sub(time.Unix(vehicle.Timestamp, 0)) > s.VehicleMaxAge {
+			stale++
+			continue
+		}
+		filtered[key] = vehicle
+	}
+
+	cleanupStatsMutex.Lock()
+	stats := cleanupStats[name]
+	stats.LastCleanup = now
+	stats.StaleVehicles = stale
+	stats.TotalStaleVehicles += int64(stale)
+	cleanupStats[name] = stats
+	cleanupStatsMutex.Unlock()
+
+	return filtered
+}
+
+/*
+Get the trip updates which aren't stale or for trips whose service day has ended
+*/
+func (s Staleness) filterTripUpdates(name string, updates TripUpdatesMap, now time.Time) TripUpdatesMap {
+	if s.TripUpdateMaxAge <= 0 && s.ServiceDayGrace <= 0 {
+		return updates
+	}
+
+	location := s.Location
+	if location == nil {
+		location = time.Local
+	}
+
+	filtered := make(TripUpdatesMap, len(updates))
+	stale, ghosts := 0, 0
+	for key, update := range updates {
+		if s.TripUpdateMaxAge > 0 && update.Timestamp > 0 && now.Sub(time.Unix(update.Timestamp, 0)) > s.TripUpdateMaxAge {
+			stale++
+			continue
+		}
+		if s.ServiceDayGrace > 0 && update.Trip.StartDate != "" {
+			if startDate, err := time.ParseInLocation("20060102", update.Trip.StartDate, location); err == nil {
+				if now.After(startDate.AddDate(0, 0, 1).Add(s.ServiceDayGrace)) {
+					ghosts++
+					continue
+				}
+			}
+		}
+		filtered[key] = update
+	}
+
+	cleanupStatsMutex.Lock()
+	stats := cleanupStats[name]
+	stats.LastCleanup = now
+	stats.StaleTripUpdates = stale
+	stats.GhostTrips = ghosts
+	stats.TotalStaleTripUpdates += int64(stale)
+	stats.TotalGhostTrips += int64(ghosts)
+	cleanupStats[name] = stats
+	cleanupStatsMutex.Unlock()
+
+	return filtered
+}
+
+/*
+Filter the stale entities out of the cached vehicles and trip updates now, instead of waiting for the next fetch
+
+Returns the counts of what was filtered
+*/
+func (v RealtimeS) Cleanup() CleanupStats {
+	now := time.Now()
+
+	vehiclesApiRequestMutex.Lock()
+	if cached := cachedVehiclesData[v.name]; cached != nil {
+		cachedVehiclesData[v.name] = v.staleness.filterVehicles(v.name, cached, now)
+	}
+	vehiclesApiRequestMutex.Unlock()
+
+	tripUpdateApiRequestMutex.Lock()
+	if cached := cachedTripUpdatesData[v.name]; cached != nil {
+		cachedTripUpdatesData[v.name] = v.staleness.filterTripUpdates(v.name, cached, now)
+	}
+	tripUpdateApiRequestMutex.Unlock()
+
+	return v.CleanupStats()
+}
+
+/*
+Get how many entities have been filtered out as stale, see WithStaleness
+*/
+func (v RealtimeS) CleanupStats() CleanupStats {
+	cleanupStatsMutex.Lock()
+	defer cleanupStatsMutex.Unlock()
+	return cleanupStats[v.name]
+}
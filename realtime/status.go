@@ -0,0 +1,71 @@
+package realtime
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type FeedStatus struct {
+	Feed        string    `json:"feed"` // vehicles, trip_updates or alerts
+	Url         string    `json:"url"`
+	LastFetch   time.Time `json:"last_fetch"`   // The last time the api was requested
+	LastSuccess time.Time `json:"last_success"` // The last time the api was requested without an error
+	LastError   string    `json:"last_error"`   // The error of the last request, "" if it succeeded
+
+	BackoffUntil   *time.Time `json:"backoff_until,omitempty"`   // When the api will be requested again, while it's rate limiting us
+	QuotaLimit     *int       `json:"quota_limit,omitempty"`     // From the api's X-RateLimit-Limit header
+	QuotaRemaining *int       `json:"quota_remaining,omitempty"` // From the api's X-RateLimit-Remaining header
+}
+
+var (
+	feedStatuses      = make(map[string]map[string]FeedStatus) // By realtime name, then feed
+	feedStatusesMutex sync.Mutex
+)
+
+func recordFetch(name string, feed string, url string, err error) {
+	feedStatusesMutex.Lock()
+	defer feedStatusesMutex.Unlock()
+
+	if feedStatuses[name] == nil {
+		feedStatuses[name] = make(map[string]FeedStatus)
+	}
+	status := feedStatuses[name][feed]
+	status.Feed = feed
+	status.Url = url
+	status.LastFetch = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastSuccess = status.LastFetch
+		status.LastError = ""
+	}
+	feedStatuses[name][feed] = status
+}
+
+/*
+Get when each of the realtime feeds was last fetched, e.g for a health check endpoint
+*/
+func (v RealtimeS) Status() []FeedStatus {
+	feedStatusesMutex.Lock()
+	defer feedStatusesMutex.Unlock()
+
+	backoffStatesMutex.Lock()
+	defer backoffStatesMutex.Unlock()
+
+	var statuses []FeedStatus
+	for feed, status := range feedStatuses[v.name] {
+		backoff := backoffStates[v.name][feed]
+		if time.Now().Before(backoff.until) {
+			until := backoff.until
+			status.BackoffUntil = &until
+		}
+		status.QuotaLimit = backoff.quotaLimit
+		status.QuotaRemaining = backoff.quotaRemaining
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Feed < statuses[j].Feed
+	})
+	return statuses
+}
@@ -0,0 +1,298 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type StreamEvent struct {
+	Type       string      `json:"type"`   // "vehicle" or "trip_update"
+	Action     string      `json:"action"` // "snapshot" (sent when subscribing), "added", "updated" or "removed"
+	TripID     string      `json:"trip_id"`
+	Vehicle    *Vehicle    `json:"vehicle,omitempty"`
+	TripUpdate *TripUpdate `json:"trip_update,omitempty"`
+}
+
+/*
+Pushes the changes to the vehicles and trip updates to subscribers, in process (Subscribe) or as Server-Sent Events
+(ServeHTTP). There's no WebSocket endpoint, SSE is one way which is all the stream needs and works through proxies
+without an upgrade
+*/
+type Stream struct {
+	vehicles    *vehicles
+	tripUpdates *tripUpdates
+	interval    time.Duration
+
+	mu              sync.Mutex
+	subscribers     map[chan []StreamEvent]struct{}
+	lastVehicles    VehiclesMap
+	lastTripUpdates TripUpdatesMap
+	running         bool
+	stop            chan struct{}
+	logger          *slog.Logger
+}
+
+/*
+Create a stream which polls the given feeds and pushes the changes to its subscribers
+
+  - vehiclesUrl: the vehicle positions url, can be "" to not stream vehicles
+  - tripUpdatesUrl: the trip updates url, can be "" to not stream trip updates
+  - interval: how often to check the feeds for changes (min 15s as that's how long the feeds are cached for)
+*/
+func (v RealtimeS) Stream(vehiclesUrl, tripUpdatesUrl string, interval time.Duration) (*Stream, error) {
+	if vehiclesUrl == "" && tripUpdatesUrl == "" {
+		return nil, errors.New("missing vehicles and trip updates url")
+	}
+	if interval < 15*time.Second {
+		interval = 15 * time.Second
+	}
+
+	stream := &Stream{
+		interval:    interval,
+		subscribers: make(map[chan []StreamEvent]struct{}),
+		logger:      v.getLogger(),
+	}
+
+	if vehiclesUrl != "" {
+		vehicles, err := v.Vehicles(vehiclesUrl)
+		if err != nil {
+			return nil, err
+		}
+		stream.vehicles = &vehicles
+	}
+	if tripUpdatesUrl != "" {
+		tripUpdates, err := v.TripUpdates(tripUpdatesUrl)
+		if err != nil {
+			return nil, err
+		}
+		stream.tripUpdates = &tripUpdates
+	}
+
+	return stream, nil
+}
+
+/*
+Start polling the feeds in the background
+*/
+func (s *Stream) Start() {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	stop := s.stop
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		s.poll()
+		for {
+			select {
+			case <-ticker.C:
+				s.poll()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+Stop polling the feeds, subscribers stay subscribed and will get events again if the stream is restarted
+*/
+func (s *Stream) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return
+	}
+	s.running = false
+	close(s.stop)
+}
+
+/*
+Subscribe to the changes of the stream
+
+Returns a channel which receives a batch of events every time the feeds change, and a func to unsubscribe.
+The first batch is a "snapshot" event for every vehicle and trip update the stream currently has (if it has polled
+the feeds yet), so subscribers don't have to wait for the next change to see anything.
+Batches are dropped for subscribers that aren't keeping up.
+*/
+func (s *Stream) Subscribe() (<-chan []StreamEvent, func()) {
+	ch := make(chan []StreamEvent, 8)
+
+	// The snapshot is sent while holding the lock, so no changes are missed (or sent twice) between it and subscribing
+	s.mu.Lock()
+	if snapshot := s.snapshot(); len(snapshot) > 0 {
+		ch <- snapshot
+	}
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subscribers, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+/*
+Serve the stream as Server-Sent Events
+
+Each change is sent as an event named after its type ("vehicle" or "trip_update") with the StreamEvent as json data
+*/
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case batch, ok := <-events:
+			if !ok {
+				return
+			}
+			for _, event := range batch {
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Stream) poll() {
+	var vehicles VehiclesMap
+	var updates TripUpdatesMap
+	var vehiclesErr, updatesErr error
+
+	if s.vehicles != nil {
+		vehicles, vehiclesErr = s.vehicles.GetVehicles()
+		if vehiclesErr != nil {
+			s.logger.Warn("stream: failed to get vehicles", "error", vehiclesErr)
+		}
+	}
+	if s.tripUpdates != nil {
+		updates, updatesErr = s.tripUpdates.GetTripUpdates()
+		if updatesErr != nil {
+			s.logger.Warn("stream: failed to get trip updates", "error", updatesErr)
+		}
+	}
+
+	// The last feeds are read by Subscribe for the snapshot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []StreamEvent
+	if s.vehicles != nil && vehiclesErr == nil {
+		events = append(events, s.diffVehicles(vehicles)...)
+	}
+	if s.tripUpdates != nil && updatesErr == nil {
+		events = append(events, s.diffTripUpdates(updates)...)
+	}
+
+	if len(events) == 0 {
+		return
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- events:
+		default:
+			// Subscriber is too slow, drop this batch for it
+		}
+	}
+}
+
+/*
+Get an event for every vehicle and trip update from the last poll, the lock must be held
+*/
+func (s *Stream) snapshot() []StreamEvent {
+	var events []StreamEvent
+	for tripID, vehicle := range s.lastVehicles {
+		vehicle := vehicle
+		events = append(events, StreamEvent{Type: "vehicle", Action: "snapshot", TripID: tripID, Vehicle: &vehicle})
+	}
+	for tripID, update := range s.lastTripUpdates {
+		update := update
+		events = append(events, StreamEvent{Type: "trip_update", Action: "snapshot", TripID: tripID, TripUpdate: &update})
+	}
+	return events
+}
+
+func (s *Stream) diffVehicles(current VehiclesMap) []StreamEvent {
+	var events []StreamEvent
+
+	for tripID, vehicle := range current {
+		previous, found := s.lastVehicles[tripID]
+		if !found {
+			vehicle := vehicle
+			events = append(events, StreamEvent{Type: "vehicle", Action: "added", TripID: tripID, Vehicle: &vehicle})
+		} else if previous != vehicle {
+			vehicle := vehicle
+			events = append(events, StreamEvent{Type: "vehicle", Action: "updated", TripID: tripID, Vehicle: &vehicle})
+		}
+	}
+	for tripID := range s.lastVehicles {
+		if _, found := current[tripID]; !found {
+			events = append(events, StreamEvent{Type: "vehicle", Action: "removed", TripID: tripID})
+		}
+	}
+
+	s.lastVehicles = current
+	return events
+}
+
+func (s *Stream) diffTripUpdates(current TripUpdatesMap) []StreamEvent {
+	var events []StreamEvent
+
+	for tripID, update := range current {
+		previous, found := s.lastTripUpdates[tripID]
+		if !found {
+			update := update
+			events = append(events, StreamEvent{Type: "trip_update", Action: "added", TripID: tripID, TripUpdate: &update})
+		} else if previous != update {
+			update := update
+			events = append(events, StreamEvent{Type: "trip_update", Action: "updated", TripID: tripID, TripUpdate: &update})
+		}
+	}
+	for tripID := range s.lastTripUpdates {
+		if _, found := current[tripID]; !found {
+			events = append(events, StreamEvent{Type: "trip_update", Action: "removed", TripID: tripID})
+		}
+	}
+
+	s.lastTripUpdates = current
+	return events
+}
@@ -12,23 +12,72 @@ import (
 
 var (
 	tripUpdateClient          = &http.Client{}
-	tripUpdateApiRequestMutex sync.Mutex
+	tripUpdateApiRequestMutex sync.Mutex // Guards the caches, a realtime's fetches are behind requestMutex
 )
 
 var (
 	cachedTripUpdatesData       map[string]TripUpdatesMap = make(map[string]TripUpdatesMap)
-	lastUpdatedTripUpdatesCache time.Time
+	lastUpdatedTripUpdatesCache map[string]time.Time      = make(map[string]time.Time)
+	tripUpdatesCachePeriod      map[string]time.Duration  = make(map[string]time.Duration)
 )
 
 type TripUpdatesMap map[string]TripUpdate
 
 func (v tripUpdates) GetTripUpdates() (TripUpdatesMap, error) {
+	fetchMutex := requestMutex("trip_updates", v.name)
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+
 	tripUpdateApiRequestMutex.Lock()
-	defer tripUpdateApiRequestMutex.Unlock()
-	if cachedTripUpdatesData[v.name] != nil && len(cachedTripUpdatesData[v.name]) >= 1 && lastUpdatedTripUpdatesCache.Add(15*time.Second).After(time.Now()) {
-		return cachedTripUpdatesData[v.name], nil
+	cached, lastUpdated, cachePeriod := cachedTripUpdatesData[v.name], lastUpdatedTripUpdatesCache[v.name], tripUpdatesCachePeriod[v.name]
+	tripUpdateApiRequestMutex.Unlock()
+	if cached != nil && len(cached) >= 1 && lastUpdated.Add(cachePeriod).After(time.Now()) {
+		return cached, nil
+	}
+
+	// After a restart, answer from the persisted feed for a cache period rather than everyone waiting on the api
+	if cached == nil {
+		if updates, ok := loadPersistedFeed[TripUpdatesMap](v.persistence, v.name, "trip_updates"); ok {
+			updates = v.staleness.filterTripUpdates(v.name, updates, time.Now())
+			v.cacheTripUpdates(updates)
+			return updates, nil
+		}
+	}
+
+	// Don't request the api again until its backoff has passed, the cached data is better than nothing
+	if backingOff(v.name, "trip_updates") {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, ErrRateLimited
+	}
+
+	start := time.Now()
+	updates, err := v.fetchTripUpdates()
+	observeFetch(v.name, "trip_updates", v.url, time.Since(start), err)
+	if err != nil {
+		return nil, err
 	}
 
+	updates = v.staleness.filterTripUpdates(v.name, updates, time.Now())
+	v.cacheTripUpdates(updates)
+	persistFeed(v.persistence, v.name, "trip_updates", updates)
+
+	return updates, nil
+}
+
+func (v tripUpdates) cacheTripUpdates(updates TripUpdatesMap) {
+	tripUpdateApiRequestMutex.Lock()
+	defer tripUpdateApiRequestMutex.Unlock()
+	cachedTripUpdatesData[v.name] = updates
+	lastUpdatedTripUpdatesCache[v.name] = time.Now()
+	tripUpdatesCachePeriod[v.name] = jitteredCachePeriod()
+}
+
+/*
+Request the trip updates from the api
+*/
+func (v tripUpdates) fetchTripUpdates() (TripUpdatesMap, error) {
 	url := v.url
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -45,6 +94,10 @@ func (v tripUpdates) GetTripUpdates() (TripUpdatesMap, error) {
 	}
 	defer resp.Body.Close()
 
+	if err := checkRateLimit(v.name, "trip_updates", resp); err != nil {
+		return nil, err
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response body: %w", err)
@@ -64,23 +117,30 @@ func (v tripUpdates) GetTripUpdates() (TripUpdatesMap, error) {
 		if result.Response != nil {
 			for _, i := range result.Response.Entity {
 				i.TripUpdate.ID = i.ID
-				updates[i.TripUpdate.Trip.TripID] = i.TripUpdate
+				updates[tripKey(i.TripUpdate.Trip.TripID, i.ID)] = i.TripUpdate
 			}
 		}
 	} else {
 		// Handle case where Status and Response are not present (use header and entity)
 		for _, i := range result.Entity {
 			i.TripUpdate.ID = i.ID
-			updates[i.TripUpdate.Trip.TripID] = i.TripUpdate
+			updates[tripKey(i.TripUpdate.Trip.TripID, i.ID)] = i.TripUpdate
 		}
 	}
 
-	cachedTripUpdatesData[v.name] = updates
-	lastUpdatedTripUpdatesCache = time.Now()
-
 	return updates, nil
 }
 
+/*
+The key of an entity in the feed maps, its trip id, or its entity id for trips identified by route and start time
+*/
+func tripKey(tripID string, entityID string) string {
+	if tripID == "" {
+		return entityID
+	}
+	return tripID
+}
+
 func (trips TripUpdatesMap) ByTripID(tripID string) (TripUpdate, error) {
 	trip, found := trips[tripID]
 	if !found {
@@ -12,23 +12,72 @@ import (
 
 var (
 	vehiclesClient          = &http.Client{}
-	vehiclesApiRequestMutex sync.Mutex
+	vehiclesApiRequestMutex sync.Mutex // Guards the caches, a realtime's fetches are behind requestMutex
 )
 
 var (
-	cachedVehiclesData       map[string]VehiclesMap = make(map[string]VehiclesMap)
-	lastUpdatedVehiclesCache time.Time
+	cachedVehiclesData       map[string]VehiclesMap   = make(map[string]VehiclesMap)
+	lastUpdatedVehiclesCache map[string]time.Time     = make(map[string]time.Time)
+	vehiclesCachePeriod      map[string]time.Duration = make(map[string]time.Duration)
 )
 
 type VehiclesMap map[string]Vehicle
 
 func (v vehicles) GetVehicles() (VehiclesMap, error) {
+	fetchMutex := requestMutex("vehicles", v.name)
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+
 	vehiclesApiRequestMutex.Lock()
-	defer vehiclesApiRequestMutex.Unlock()
-	if cachedVehiclesData[v.name] != nil && len(cachedVehiclesData[v.name]) >= 1 && lastUpdatedVehiclesCache.Add(15*time.Second).After(time.Now()) {
-		return cachedVehiclesData[v.name], nil
+	cached, lastUpdated, cachePeriod := cachedVehiclesData[v.name], lastUpdatedVehiclesCache[v.name], vehiclesCachePeriod[v.name]
+	vehiclesApiRequestMutex.Unlock()
+	if cached != nil && len(cached) >= 1 && lastUpdated.Add(cachePeriod).After(time.Now()) {
+		return cached, nil
+	}
+
+	// After a restart, answer from the persisted feed for a cache period rather than everyone waiting on the api
+	if cached == nil {
+		if vehicles, ok := loadPersistedFeed[VehiclesMap](v.persistence, v.name, "vehicles"); ok {
+			vehicles = v.staleness.filterVehicles(v.name, vehicles, time.Now())
+			v.cacheVehicles(vehicles)
+			return vehicles, nil
+		}
+	}
+
+	// Don't request the api again until its backoff has passed, the cached data is better than nothing
+	if backingOff(v.name, "vehicles") {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, ErrRateLimited
+	}
+
+	start := time.Now()
+	vehicles, err := v.fetchVehicles()
+	observeFetch(v.name, "vehicles", v.url, time.Since(start), err)
+	if err != nil {
+		return nil, err
 	}
 
+	vehicles = v.staleness.filterVehicles(v.name, vehicles, time.Now())
+	v.cacheVehicles(vehicles)
+	persistFeed(v.persistence, v.name, "vehicles", vehicles)
+
+	return vehicles, nil
+}
+
+func (v vehicles) cacheVehicles(vehicles VehiclesMap) {
+	vehiclesApiRequestMutex.Lock()
+	defer vehiclesApiRequestMutex.Unlock()
+	cachedVehiclesData[v.name] = vehicles
+	lastUpdatedVehiclesCache[v.name] = time.Now()
+	vehiclesCachePeriod[v.name] = jitteredCachePeriod()
+}
+
+/*
+Request the vehicles from the api
+*/
+func (v vehicles) fetchVehicles() (VehiclesMap, error) {
 	url := v.url
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -45,6 +94,10 @@ func (v vehicles) GetVehicles() (VehiclesMap, error) {
 	}
 	defer resp.Body.Close()
 
+	if err := checkRateLimit(v.name, "vehicles", resp); err != nil {
+		return nil, err
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response body: %w", err)
@@ -63,19 +116,16 @@ func (v vehicles) GetVehicles() (VehiclesMap, error) {
 		// Handle case where Status and Response are present
 		if result.Response != nil {
 			for _, i := range result.Response.Entity {
-				vehicles[i.Vehicle.Trip.TripID] = i.Vehicle
+				vehicles[tripKey(i.Vehicle.Trip.TripID, i.ID)] = i.Vehicle
 			}
 		}
 	} else {
 		// Handle case where Status and Response are not present (use header and entity)
 		for _, i := range result.Entity {
-			vehicles[i.Vehicle.Trip.TripID] = i.Vehicle
+			vehicles[tripKey(i.Vehicle.Trip.TripID, i.ID)] = i.Vehicle
 		}
 	}
 
-	cachedVehiclesData[v.name] = vehicles
-	lastUpdatedVehiclesCache = time.Now()
-
 	return vehicles, nil
 }
 
@@ -135,6 +185,21 @@ type VehicleTrip struct {
 	StartDate            string  `json:"start_date"`
 	ScheduleRelationship int64   `json:"schedule_relationship"`
 	RouteID              RouteID `json:"route_id"`
+	DirectionID          int64   `json:"direction_id"`
+}
+
+/*
+Get the vehicle's trip as a trip descriptor, the same as trip updates use
+*/
+func (t VehicleTrip) Descriptor() Trip {
+	return Trip{
+		TripID:               t.TripID,
+		StartTime:            t.StartTime,
+		StartDate:            t.StartDate,
+		ScheduleRelationship: t.ScheduleRelationship,
+		RouteID:              t.RouteID,
+		DirectionID:          t.DirectionID,
+	}
 }
 
 type RouteID string
@@ -0,0 +1,169 @@
+package gtfs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+// Gtfs-realtime trip schedule relationships for trips which aren't (or aren't only) in the static feed
+const (
+	tripAdded      = 1
+	tripDuplicated = 6
+)
+
+/*
+Build the stop times at the stops for the trips which only exist in the realtime data, so they show on departure boards
+
+  - ADDED trips aren't in the static feed, their stop time comes from the update's stop time update (the only stop
+    the update has), so they're only included at that stop
+  - DUPLICATED trips copy a static trip at a different start time, their stop times are the static trip's shifted
+    to the update's start time
+
+The updates use the realtime feed's ids, the matcher adds the prefix (see TripMatcher)
+*/
+func (v Database) realtimeOnlyStopTimes(updates realtime.TripUpdatesMap, stopIDs []string, day ServiceDay, matcher TripMatcher) []StopTimes {
+	var stopTimes []StopTimes
+	for _, update := range updates {
+		if update.Trip.StartDate != "" && update.Trip.StartDate != day.String() {
+			continue
+		}
+
+		// Only the first of the stops the trip stops at, as with the static services
+		for _, stopID := range stopIDs {
+			var stopTime StopTimes
+			var ok bool
+			switch update.Trip.ScheduleRelationship {
+			case tripAdded:
+				stopTime, ok = v.addedTripStopTime(update, stopID, day, matcher)
+			case tripDuplicated:
+				stopTime, ok = v.duplicatedTripStopTime(update, stopID, day, matcher)
+			}
+			if !ok {
+				continue
+			}
+
+			update := update
+			stopTime.Realtime = &update
+			stopTime.RealtimeOnly = true
+			stopTime.Instance = TripInstance{TripID: stopTime.TripID, ServiceDate: day.String(), StartTime: update.Trip.StartTime}
+			stopTimes = append(stopTimes, stopTime)
+			break
+		}
+	}
+	return stopTimes
+}
+
+func (v Database) addedTripStopTime(update realtime.TripUpdate, stopID string, day ServiceDay, matcher TripMatcher) (StopTimes, bool) {
+	stopUpdate := update.StopTimeUpdate
+	if matcher.prefixID(stopUpdate.StopID) != stopID {
+		return StopTimes{}, false
+	}
+
+	arrival, departure := stopUpdate.Arrival.Time, stopUpdate.Departure.Time
+	if arrival <= 0 {
+		arrival = departure
+	}
+	if departure <= 0 {
+		departure = arrival
+	}
+	if departure <= 0 {
+		return StopTimes{}, false
+	}
+
+	stop, err := v.stopByID(stopID)
+	if err != nil {
+		return StopTimes{}, false
+	}
+
+	tripID, routeID := matcher.prefixID(update.Trip.TripID), matcher.prefixID(string(update.Trip.RouteID))
+	stopTime := StopTimes{
+		TripID:        tripID,
+		ArrivalTime:   day.FormatTime(time.Unix(arrival, 0)),
+		DepartureTime: day.FormatTime(time.Unix(departure, 0)),
+		StopId:        stopID,
+		StopSequence:  int(stopUpdate.StopSequence),
+		Platform:      stop.PlatformNumber,
+		StopData:      *stop,
+		TripData: Trip{
+			TripID:      tripID,
+			RouteID:     routeID,
+			DirectionID: int(update.Trip.DirectionID),
+		},
+	}
+	if route, err := v.routeByID(routeID); err == nil {
+		stopTime.RouteColor = route.RouteColor
+		stopTime.TripData.TripHeadsign = route.RouteLongName
+	}
+	return stopTime, true
+}
+
+func (v Database) duplicatedTripStopTime(update realtime.TripUpdate, stopID string, day ServiceDay, matcher TripMatcher) (StopTimes, bool) {
+	startSec, err := parseGTFSTime(update.Trip.StartTime)
+	if err != nil {
+		return StopTimes{}, false
+	}
+
+	tripID := matcher.prefixID(update.Trip.TripID)
+	stopTime, err := v.serviceByTripAndStop(tripID, stopID, "")
+	if err != nil {
+		return StopTimes{}, false
+	}
+
+	var originalStartSec int
+	if err := v.db.Get(&originalStartSec, `SELECT departure_sec FROM stop_times WHERE trip_id = ? AND departure_sec IS NOT NULL ORDER BY stop_sequence LIMIT 1`, tripID); err != nil {
+		return StopTimes{}, false
+	}
+	shift := startSec - originalStartSec
+
+	arrival, errArrival := parseGTFSTime(stopTime.ArrivalTime)
+	departure, errDeparture := parseGTFSTime(stopTime.DepartureTime)
+	if errArrival != nil || errDeparture != nil || departure+shift < 0 {
+		return StopTimes{}, false
+	}
+	stopTime.ArrivalTime = formatGTFSTime(arrival + shift)
+	stopTime.DepartureTime = formatGTFSTime(departure + shift)
+	return stopTime, true
+}
+
+/*
+Add the realtime only stop times to the static ones, keeping them in time order and within the options' filters
+*/
+func (v Database) mergeRealtimeOnlyStopTimes(stopTimes []StopTimes, options ActiveTripsOptions, stopIDs []string, day ServiceDay, matcher TripMatcher) []StopTimes {
+	added := v.realtimeOnlyStopTimes(options.TripUpdates, stopIDs, day, matcher)
+	if len(added) == 0 {
+		return stopTimes
+	}
+
+	timeOf := func(stopTime StopTimes) int {
+		value := stopTime.DepartureTime
+		if options.Arrivals {
+			value = stopTime.ArrivalTime
+		}
+		seconds, _ := parseGTFSTime(value)
+		return seconds
+	}
+
+	from, errFrom := parseGTFSTime(options.From)
+	to, errTo := parseGTFSTime(options.To)
+	for _, stopTime := range added {
+		seconds := timeOf(stopTime)
+		switch {
+		case options.From != "" && errFrom == nil && seconds <= from,
+			options.To != "" && errTo == nil && seconds >= to,
+			options.RouteID != "" && stopTime.TripData.RouteID != options.RouteID,
+			options.DirectionID != nil && stopTime.TripData.DirectionID != *options.DirectionID:
+			continue
+		}
+		stopTimes = append(stopTimes, stopTime)
+	}
+
+	sort.SliceStable(stopTimes, func(i, j int) bool {
+		return timeOf(stopTimes[i]) < timeOf(stopTimes[j])
+	})
+	if options.Limit > 0 && len(stopTimes) > options.Limit {
+		stopTimes = stopTimes[:options.Limit]
+	}
+	return stopTimes
+}
@@ -0,0 +1,124 @@
+package gtfs
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+State shared by every copy of a Database (it's passed by value)
+
+Database keeps value receivers rather than pointer ones, as callers hold and copy it by value (e.g in structs and
+closures) and changing every method would break them. So anything a method changes after New must live here behind
+the pointer, guarded by mutex (or its own lock), never directly on Database where the change would only be made to
+that copy and race with the others
+*/
+type databaseState struct {
+	mutex              sync.Mutex
+	refreshSubscribers map[chan struct{}]bool
+	failureSubscribers map[chan error]bool
+	caches             *DatabaseCaches
+	statements         statementCache
+	locations          locationCache
+	metrics            Metrics
+	logger             *slog.Logger
+
+	name                   string
+	readOnly               bool
+	maintenance            MaintenanceOptions
+	materializedDepartures bool
+	lazyQuotes             bool
+	duplicatePolicy        DuplicatePolicy
+	userData               bool
+	occupancyProvider      OccupancyProvider
+	integrityCheck         *integrityCheckOptions
+	idPrefix               string
+	merged                 bool // Feeds were merged into it, see MergeFeeds
+
+	lastImport       time.Time
+	lastRefreshError string
+	lastImportReport *ImportReport
+}
+
+func newDatabaseState() *databaseState {
+	return &databaseState{
+		refreshSubscribers: make(map[chan struct{}]bool),
+		failureSubscribers: make(map[chan error]bool),
+	}
+}
+
+/*
+Get a channel which receives each time the feed data has been refreshed, and a func to stop receiving
+
+Refreshes are dropped (not queued) if the last one hasn't been received yet
+*/
+func (v Database) RefreshNotifier() (<-chan struct{}, func()) {
+	notify := make(chan struct{}, 1)
+	if v.state == nil {
+		close(notify)
+		return notify, func() {}
+	}
+
+	v.state.mutex.Lock()
+	v.state.refreshSubscribers[notify] = true
+	v.state.mutex.Unlock()
+
+	var once sync.Once
+	return notify, func() {
+		once.Do(func() {
+			v.state.mutex.Lock()
+			delete(v.state.refreshSubscribers, notify)
+			v.state.mutex.Unlock()
+			close(notify)
+		})
+	}
+}
+
+/*
+Tell the refresh subscribers the feed data has been refreshed
+*/
+func (v Database) notifyRefreshed() {
+	if v.state == nil {
+		return
+	}
+
+	// The timezones may have been read while the agencies were being replaced
+	v.resetLocations()
+
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	for notify := range v.state.refreshSubscribers {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+Get a channel which receives the error each time refreshing the feed data fails, and a func to stop receiving
+
+Failures are dropped (not queued) if the last one hasn't been received yet
+*/
+func (v Database) RefreshFailureNotifier() (<-chan error, func()) {
+	notify := make(chan error, 1)
+	if v.state == nil {
+		close(notify)
+		return notify, func() {}
+	}
+
+	v.state.mutex.Lock()
+	v.state.failureSubscribers[notify] = true
+	v.state.mutex.Unlock()
+
+	var once sync.Once
+	return notify, func() {
+		once.Do(func() {
+			v.state.mutex.Lock()
+			delete(v.state.failureSubscribers, notify)
+			v.state.mutex.Unlock()
+			close(notify)
+		})
+	}
+}
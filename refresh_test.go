@@ -0,0 +1,64 @@
+package gtfs
+
+import (
+	"sync"
+	"testing"
+)
+
+/*
+Run with -race, Database is passed by value so every copy must share its state safely while the feed data is replaced
+*/
+func TestConcurrentQueriesDuringRefresh(t *testing.T) {
+	db := newTestDatabase(t, "concurrent-refresh")
+	if _, err := db.EnableCaches(); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, stop := db.RefreshNotifier()
+	defer stop()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(copied Database) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Queries can fail while the tables are being replaced, only races matter here
+				copied.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "P1", ByStation: true, Limit: 5})
+				copied.GetStops(false)
+				copied.GetRoutesByStopId("C1")
+				copied.locationFor("C1", "")
+				copied.Status()
+
+				notify, stopNotify := copied.RefreshNotifier()
+				stopNotify()
+				for range notify {
+				}
+			}
+		}(db)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.refreshDatabaseData(); err != nil {
+			t.Error(err)
+		}
+		<-refreshed
+	}
+	close(done)
+	wg.Wait()
+
+	services, err := db.GetActiveTripsWithOptions(ActiveTripsOptions{StopID: "P1", ByStation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 3 {
+		t.Errorf("expected 3 services after refreshing, got %d", len(services))
+	}
+}
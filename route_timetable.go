@@ -0,0 +1,182 @@
+package gtfs
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"time"
+)
+
+type RouteTimetableTrip struct {
+	TripID    string `json:"trip_id"`
+	Headsign  string `json:"headsign"`
+	StartTime string `json:"start_time"` // "15:04:05" when it leaves its first stop
+}
+
+/*
+A route's timetable for a day as a matrix, Times[stop][trip] is when the trip leaves the stop ("" if it doesn't stop there)
+*/
+type RouteTimetable struct {
+	Route       Route                `json:"route"`
+	DirectionID int                  `json:"direction_id"`
+	Date        string               `json:"date"`  // "20060102"
+	Stops       []Stop               `json:"stops"` // The rows, in the order they're travelled
+	Trips       []RouteTimetableTrip `json:"trips"` // The columns, in the order they start
+	Times       [][]string           `json:"times"` // "15:04:05", can be over 24:00:00
+}
+
+/*
+Get the timetable of a route going in a direction on a date, as a matrix of stops by trips
+
+The stops are ordered by the route's longest trip, with stops only some trips use fitted in where those trips stop at them
+*/
+func (v Database) GetRouteTimetable(routeID string, directionID int, date string) (RouteTimetable, error) {
+	defer v.observeQuery("GetRouteTimetable", time.Now())
+	routeID = v.PrefixID(routeID)
+
+	route, err := v.routeByID(routeID)
+	if err != nil {
+		return RouteTimetable{}, errors.New("route not found")
+	}
+
+	location := v.locationFor("", routeID)
+	day := Today(location)
+	if date != "" {
+		day, err = ParseServiceDay(date, location)
+		if err != nil {
+			return RouteTimetable{}, err
+		}
+	}
+
+	servicesQuery, args := activeServicesQuery(day)
+	var rows []struct {
+		TripID        string `db:"trip_id"`
+		Headsign      string `db:"trip_headsign"`
+		StopID        string `db:"stop_id"`
+		DepartureTime string `db:"departure_time"`
+	}
+	err = v.db.Select(&rows, servicesQuery+`
+		SELECT t.trip_id, COALESCE(t.trip_headsign, '') AS trip_headsign, st.stop_id,
+			COALESCE(NULLIF(st.departure_time, ''), st.arrival_time, '') AS departure_time
+		FROM trips t
+		JOIN adjusted_services a ON t.service_id = a.service_id
+		JOIN stop_times st ON t.trip_id = st.trip_id
+		WHERE t.route_id = ? AND COALESCE(t.direction_id, 0) = ?
+		ORDER BY (SELECT MIN(o.departure_sec) FROM stop_times o WHERE o.trip_id = t.trip_id), t.trip_id, st.stop_sequence
+	`, append(args, routeID, directionID)...)
+	if err != nil {
+		return RouteTimetable{}, err
+	}
+
+	timetable := RouteTimetable{Route: route, DirectionID: directionID, Date: day.String(), Stops: []Stop{}, Trips: []RouteTimetableTrip{}, Times: [][]string{}}
+	if len(rows) == 0 {
+		v.stripIDs(&timetable)
+		return timetable, nil
+	}
+
+	// Each trip's stops in order
+	var tripStops [][]string
+	var tripTimes [][]string
+	for _, row := range rows {
+		if last := len(timetable.Trips) - 1; last < 0 || timetable.Trips[last].TripID != row.TripID {
+			timetable.Trips = append(timetable.Trips, RouteTimetableTrip{TripID: row.TripID, Headsign: row.Headsign, StartTime: row.DepartureTime})
+			tripStops = append(tripStops, nil)
+			tripTimes = append(tripTimes, nil)
+		}
+		last := len(timetable.Trips) - 1
+		tripStops[last] = append(tripStops[last], row.StopID)
+		tripTimes[last] = append(tripTimes[last], row.DepartureTime)
+	}
+
+	// Start with the longest trip's stops, then fit the others in after the stop before them
+	longest := 0
+	for i, stops := range tripStops {
+		if len(stops) > len(tripStops[longest]) {
+			longest = i
+		}
+	}
+	order := append([]string{}, tripStops[longest]...)
+	for _, stops := range tripStops {
+		previous := -1
+		for _, stopID := range stops {
+			if index := indexFrom(order, stopID, previous+1); index >= 0 {
+				previous = index
+				continue
+			}
+			order = append(order[:previous+1], append([]string{stopID}, order[previous+1:]...)...)
+			previous++
+		}
+	}
+
+	timetable.Times = make([][]string, len(order))
+	for i := range timetable.Times {
+		timetable.Times[i] = make([]string, len(timetable.Trips))
+	}
+	for trip, stops := range tripStops {
+		previous := -1
+		for i, stopID := range stops {
+			index := indexFrom(order, stopID, previous+1)
+			if index < 0 {
+				continue
+			}
+			timetable.Times[index][trip] = tripTimes[trip][i]
+			previous = index
+		}
+	}
+
+	stops, err := v.stopsByIDs(order)
+	if err != nil {
+		return RouteTimetable{}, err
+	}
+	for _, stopID := range order {
+		stop, found := stops[stopID]
+		if !found {
+			stop = Stop{StopId: stopID}
+		}
+		timetable.Stops = append(timetable.Stops, stop)
+	}
+
+	v.stripIDs(&timetable)
+	return timetable, nil
+}
+
+/*
+Write the timetable as csv, a row for each stop and a column for each trip, with a header row of the trip ids and one of
+their headsigns
+*/
+func (t RouteTimetable) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+
+	tripIDs := []string{"stop_id", "stop_name"}
+	headsigns := []string{"", ""}
+	for _, trip := range t.Trips {
+		tripIDs = append(tripIDs, trip.TripID)
+		headsigns = append(headsigns, trip.Headsign)
+	}
+	if err := writer.Write(tripIDs); err != nil {
+		return err
+	}
+	if err := writer.Write(headsigns); err != nil {
+		return err
+	}
+	for i, stop := range t.Stops {
+		if err := writer.Write(append([]string{stop.StopId, stop.StopName}, t.Times[i]...)); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+/*
+Get the index of the first item at or after start, -1 if there isn't one
+*/
+func indexFrom(items []string, item string, start int) int {
+	for i := start; i < len(items); i++ {
+		if items[i] == item {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,265 @@
+package gtfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+/*
+The categories route types are rolled up into, see RouteTypeCategory
+*/
+const (
+	RouteCategoryRail  = "rail"  // Trains, metros, trams, monorails and funiculars
+	RouteCategoryBus   = "bus"   // Buses, coaches and trolleybuses
+	RouteCategoryWater = "water" // Ferries and other water transport
+	RouteCategoryOther = "other" // Everything else, e.g gondolas, planes and taxis
+)
+
+/*
+The category of each basic route_type (0-12), route types not in it are RouteCategoryOther
+*/
+var basicRouteTypeCategories = map[int]string{
+	0:  RouteCategoryRail,
+	1:  RouteCategoryRail,
+	2:  RouteCategoryRail,
+	3:  RouteCategoryBus,
+	4:  RouteCategoryWater,
+	5:  RouteCategoryRail,
+	7:  RouteCategoryRail,
+	11: RouteCategoryBus,
+	12: RouteCategoryRail,
+}
+
+/*
+The basic route_type of each group of extended route types (inclusive ranges), groups which aren't here (e.g 1100 air
+service, 1500 taxi service) have no basic route type
+*/
+var extendedRouteTypes = []struct {
+	Min, Max int
+	Basic    int
+}{
+	{100, 199, 2},
+	{200, 299, 3}, // Coaches
+	{400, 499, 1},
+	{700, 799, 3},
+	{800, 899, 11},
+	{900, 999, 0},
+	{1000, 1099, 4},
+	{1200, 1299, 4},
+	{1300, 1399, 6},
+	{1400, 1499, 7},
+}
+
+/*
+Get the basic route_type (0-12) of an extended route type (100-1700), e.g 700 (bus service) is 3 (bus). Route types
+without one are returned as they are
+*/
+func BasicRouteType(routeType int) int {
+	for _, group := range extendedRouteTypes {
+		if routeType >= group.Min && routeType <= group.Max {
+			return group.Basic
+		}
+	}
+	return routeType
+}
+
+/*
+The names of the route types, the basic ones (0-12) and the extended ones (100-1700) from
+https://developers.google.com/transit/gtfs/reference/extended-route-types
+*/
+var routeTypeNames = map[int]string{
+	0:  "Tram/Light Rail",
+	1:  "Subway/Metro",
+	2:  "Train",
+	3:  "Bus",
+	4:  "Ferry",
+	5:  "Cable Tram",
+	6:  "Gondola",
+	7:  "Train (up hill)",
+	11: "Trolleybus",
+	12: "Monorail",
+
+	100: "Railway Service",
+	101: "High Speed Rail Service",
+	102: "Long Distance Trains",
+	103: "Inter Regional Rail Service",
+	104: "Car Transport Rail Service",
+	105: "Sleeper Rail Service",
+	106: "Regional Rail Service",
+	107: "Tourist Railway Service",
+	108: "Rail Shuttle (Within Complex)",
+	109: "Suburban Railway",
+	110: "Replacement Rail Service",
+	111: "Special Rail Service",
+	112: "Lorry Transport Rail Service",
+	113: "All Rail Services",
+	114: "Cross-Country Rail Service",
+	115: "Vehicle Transport Rail Service",
+	116: "Rack and Pinion Railway",
+	117: "Additional Rail Service",
+
+	200: "Coach Service",
+	201: "International Coach Service",
+	202: "National Coach Service",
+	203: "Shuttle Coach Service",
+	204: "Regional Coach Service",
+	205: "Special Coach Service",
+	206: "Sightseeing Coach Service",
+	207: "Tourist Coach Service",
+	208: "Commuter Coach Service",
+	209: "All Coach Services",
+
+	400: "Urban Railway Service",
+	401: "Metro Service",
+	402: "Underground Service",
+	403: "Urban Railway Service",
+	404: "All Urban Railway Services",
+	405: "Monorail",
+
+	700: "Bus Service",
+	701: "Regional Bus Service",
+	702: "Express Bus Service",
+	703: "Stopping Bus Service",
+	704: "Local Bus Service",
+	705: "Night Bus Service",
+	706: "Post Bus Service",
+	707: "Special Needs Bus",
+	708: "Mobility Bus Service",
+	709: "Mobility Bus for Registered Disabled",
+	710: "Sightseeing Bus",
+	711: "Shuttle Bus",
+	712: "School Bus",
+	713: "School and Public Service Bus",
+	714: "Rail Replacement Bus Service",
+	715: "Demand and Response Bus Service",
+	716: "All Bus Services",
+
+	800: "Trolleybus Service",
+
+	900: "Tram Service",
+	901: "City Tram Service",
+	902: "Local Tram Service",
+	903: "Regional Tram Service",
+	904: "Sightseeing Tram Service",
+	905: "Shuttle Tram Service",
+	906: "All Tram Services",
+
+	1000: "Water Transport Service",
+	1100: "Air Service",
+	1200: "Ferry Service",
+	1300: "Aerial Lift Service",
+	1400: "Funicular Service",
+
+	1500: "Taxi Service",
+	1501: "Communal Taxi Service",
+	1502: "Water Taxi Service",
+	1503: "Rail Taxi Service",
+	1504: "Bike Taxi Service",
+	1505: "Licensed Taxi Service",
+	1506: "Private Hire Service Vehicle",
+	1507: "All Taxi Services",
+
+	1700: "Miscellaneous Service",
+	1702: "Horse-drawn Carriage",
+}
+
+/*
+Get the name of a route type, e.g "Bus" (3) or "Suburban Railway" (109)
+
+Extended route types which aren't listed use the name of their group, e.g 799 is "Bus Service", "unknown" if there isn't one
+*/
+func RouteTypeName(routeType int) string {
+	if name, found := routeTypeNames[routeType]; found {
+		return name
+	}
+	if routeType >= 100 {
+		if name, found := routeTypeNames[routeType-routeType%100]; found {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+/*
+Get the category of a route type (rail, bus, water or other), e.g 109 (suburban railway) is "rail"
+*/
+func RouteTypeCategory(routeType int) string {
+	if category, found := basicRouteTypeCategories[BasicRouteType(routeType)]; found {
+		return category
+	}
+	return RouteCategoryOther
+}
+
+/*
+The sql condition on route_type for the routes in a category
+*/
+func routeCategoryCondition(category string) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	// In order, so the query is the same each time
+	for routeType := 0; routeType <= 12; routeType++ {
+		if c, found := basicRouteTypeCategories[routeType]; found && (category == RouteCategoryOther || c == category) {
+			conditions = append(conditions, "route_type = ?")
+			args = append(args, routeType)
+		}
+	}
+	for _, group := range extendedRouteTypes {
+		if c, found := basicRouteTypeCategories[group.Basic]; found && (category == RouteCategoryOther || c == category) {
+			conditions = append(conditions, "route_type BETWEEN ? AND ?")
+			args = append(args, group.Min, group.Max)
+		}
+	}
+
+	switch category {
+	case RouteCategoryOther:
+		return "NOT (" + strings.Join(conditions, " OR ") + ")", args, nil
+	case RouteCategoryRail, RouteCategoryBus, RouteCategoryWater:
+		return "(" + strings.Join(conditions, " OR ") + ")", args, nil
+	}
+	return "", nil, errors.New("invalid route category")
+}
+
+/*
+Get the routes in a category (rail, bus, water or other), see RouteTypeCategory
+
+  - page: optionally only get a page of the routes
+*/
+func (v Database) GetRoutesByCategory(category string, page ...Page) ([]Route, error) {
+	defer v.observeQuery("GetRoutesByCategory", time.Now())
+
+	condition, args, err := routeCategoryCondition(strings.ToLower(strings.TrimSpace(category)))
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT
+			route_id,
+			agency_id,
+			route_short_name,
+			route_long_name,
+			route_type,
+			route_color,
+			COALESCE(route_text_color, '') AS route_text_color
+		FROM
+			routes
+		WHERE ` + condition
+	if len(page) > 0 {
+		query += ` ORDER BY route_id` + pageClause(page)
+	}
+
+	var routes []Route
+	if err := v.db.Select(&routes, query, args...); err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		routes[i].setDerivedFields()
+	}
+
+	if len(routes) == 0 {
+		return nil, errors.New("no routes found")
+	}
+	v.stripIDs(&routes)
+	return routes, nil
+}
@@ -0,0 +1,154 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+A vehicle serving a route, with what it's doing from the static data
+*/
+type RouteVehicle struct {
+	Vehicle     realtime.Vehicle `json:"vehicle"`
+	TripID      string           `json:"trip_id"`
+	Headsign    string           `json:"headsign"`
+	DirectionID int              `json:"direction_id"`
+	NextStop    *Stop            `json:"next_stop,omitempty"` // Unset once the vehicle has passed the last stop
+	Progress    float64          `json:"progress"`            // How far along the trip's shape the vehicle is, 0-100 (%)
+	Distance    float64          `json:"distance"`            // How far along the trip's shape the vehicle is (km)
+	Remaining   float64          `json:"remaining"`           // How far the vehicle has to go to the end of the trip (km)
+
+	RealtimeOnly bool       `json:"realtime_only"`       // The vehicle is running an ADDED trip which isn't in the static feed, so there's no progress
+	Occupancy    *Occupancy `json:"occupancy,omitempty"` // From the OccupancyProvider, if there is one
+}
+
+/*
+Get the vehicles currently serving a route, with their trip's headsign, direction, next stop and progress along the trip
+
+Vehicles are matched to the route by their trip, so feeds which leave the route id out of vehicle positions still work.
+Vehicles on trips which aren't in the static feed (ADDED trips) are matched by their route id instead, and vehicles
+without a trip id by their route, direction and start time (see TripMatcher)
+
+  - vehicles: the realtime vehicle positions (see realtime.RealtimeS.Vehicles)
+*/
+func (v Database) GetVehiclesForRoute(routeID string, vehicles realtime.VehiclesMap) ([]RouteVehicle, error) {
+	defer v.observeQuery("GetVehiclesForRoute", time.Now())
+
+	if routeID == "" {
+		return nil, errors.New("missing route id")
+	}
+
+	var trips []Trip
+	err := v.db.Select(&trips, `
+		SELECT trip_id, route_id, service_id, COALESCE(trip_headsign, '') AS trip_headsign, COALESCE(direction_id, 0) AS direction_id,
+			COALESCE(shape_id, '') AS shape_id, COALESCE(wheelchair_accessible, 0) AS wheelchair_accessible, COALESCE(bikes_allowed, 0) AS bikes_allowed
+		FROM trips
+		WHERE route_id = ?
+	`, v.PrefixID(routeID))
+	if err != nil {
+		return nil, err
+	}
+	tripsByID := make(map[string]Trip, len(trips))
+	for _, trip := range trips {
+		tripsByID[trip.TripID] = trip
+	}
+
+	// Trips on the same shape share their line
+	lines := make(map[string]polyline)
+	matcher := v.TripMatcher()
+	routeVehicles := []RouteVehicle{}
+	for _, vehicle := range vehicles {
+		// The vehicles use the feed's own ids
+		trip, found := tripsByID[matcher.prefixID(vehicle.Trip.TripID)]
+		// Feeds can identify the trip by its route and start time instead
+		if !found && vehicle.Trip.TripID == "" && string(vehicle.Trip.RouteID) == routeID {
+			if matched, _, err := matcher.resolve(vehicle.Trip.Descriptor()); err == nil {
+				trip, found = tripsByID[matched.TripID]
+			}
+		}
+		if !found {
+			if vehicle.Trip.TripID != "" && string(vehicle.Trip.RouteID) == routeID {
+				routeVehicles = append(routeVehicles, RouteVehicle{
+					Vehicle:      vehicle,
+					TripID:       vehicle.Trip.TripID,
+					RealtimeOnly: true,
+					Occupancy:    v.occupancyFor(vehicle.Trip.TripID, vehicle.Vehicle.ID),
+				})
+			}
+			continue
+		}
+
+		routeVehicle := RouteVehicle{
+			Vehicle:     vehicle,
+			TripID:      trip.TripID,
+			Headsign:    trip.TripHeadsign,
+			DirectionID: trip.DirectionID,
+			Occupancy:   v.occupancyFor(trip.TripID, vehicle.Vehicle.ID),
+		}
+
+		lineKey := trip.ShapeID
+		if lineKey == "" {
+			lineKey = "trip:" + trip.TripID
+		}
+		line, found := lines[lineKey]
+		if !found {
+			line, err = v.tripPolyline(trip)
+			if err != nil {
+				routeVehicles = append(routeVehicles, routeVehicle)
+				continue
+			}
+			lines[lineKey] = line
+		}
+
+		along, _ := line.project(vehicle.Position.Latitude, vehicle.Position.Longitude, 0)
+		routeVehicle.Distance = math.Round(along*1000) / 1000
+		routeVehicle.Remaining = math.Round((line.length()-along)*1000) / 1000
+		if length := line.length(); length > 0 {
+			routeVehicle.Progress = math.Round(along/length*1000) / 10
+		}
+		routeVehicle.NextStop = v.nextStopAlong(trip.TripID, line, along)
+
+		routeVehicles = append(routeVehicles, routeVehicle)
+	}
+
+	sort.Slice(routeVehicles, func(i, j int) bool {
+		return routeVehicles[i].Vehicle.Vehicle.ID < routeVehicles[j].Vehicle.Vehicle.ID
+	})
+	v.stripIDs(&routeVehicles)
+	return routeVehicles, nil
+}
+
+/*
+Get the first stop of a trip which is further along its line than a distance (km), nil if it's past the last stop
+*/
+func (v Database) nextStopAlong(tripID string, line polyline, along float64) *Stop {
+	stops, err := v.stopsForTrip(tripID)
+	if err != nil {
+		return nil
+	}
+
+	for i, stopAlong := range stopDistancesAlong(line, stops) {
+		// Vehicles waiting at a stop haven't passed it yet
+		if stopAlong >= along-0.02 {
+			return &stops[i]
+		}
+	}
+	return nil
+}
+
+/*
+Get how far along a line (km) each of a trip's stops are, in order
+*/
+func stopDistancesAlong(line polyline, stops []Stop) []float64 {
+	distances := make([]float64, len(stops))
+	minAlong := 0.0
+	for i, stop := range stops {
+		distances[i], _ = line.project(stop.StopLat, stop.StopLon, minAlong)
+		minAlong = distances[i]
+	}
+	return distances
+}
@@ -3,22 +3,30 @@ package gtfs
 import (
 	"errors"
 	"strings"
+	"time"
 )
 
 type Route struct {
-	RouteId        string `json:"route_id"`
-	AgencyId       string `json:"agency_id"`
-	RouteShortName string `json:"route_short_name"`
-	RouteLongName  string `json:"route_long_name"`
-	RouteType      int    `json:"route_type"`
-	RouteColor     string `json:"route_color"`
-	VehicleType    string `json:"vehicle_type"`
+	RouteId        string      `json:"route_id" db:"route_id"`
+	AgencyId       string      `json:"agency_id" db:"agency_id"`
+	RouteShortName string      `json:"route_short_name" db:"route_short_name"`
+	RouteLongName  string      `json:"route_long_name" db:"route_long_name"`
+	RouteType      int         `json:"route_type" db:"route_type"`
+	RouteColor     string      `json:"route_color" db:"route_color"`
+	RouteTextColor string      `json:"route_text_color" db:"route_text_color"`
+	VehicleType    string      `json:"vehicle_type" db:"-"`   // The route_type's name, see RouteTypeName
+	Category       string      `json:"category" db:"-"`       // rail, bus, water or other, see RouteTypeCategory
+	DisplayColors  RouteColors `json:"display_colors" db:"-"` // The colors normalized, with defaults when the feed doesn't have them
 }
 
 /*
 Get all the stored routes
+
+  - page: optionally only get a page of the routes
 */
-func (v Database) GetRoutes() ([]Route, error) {
+func (v Database) GetRoutes(page ...Page) ([]Route, error) {
+	defer v.observeQuery("GetRoutes", time.Now())
+
 	db := v.db
 	query := `
 		SELECT 
@@ -27,53 +35,30 @@ func (v Database) GetRoutes() ([]Route, error) {
 			route_short_name,
 			route_long_name,
 			route_type,
-			route_color
+			route_color,
+			COALESCE(route_text_color, '') AS route_text_color
 		FROM
 			routes
 	`
-
-	rows, err := db.Query(query)
-
-	if err != nil {
-		return nil, err
+	if len(page) > 0 {
+		query += ` ORDER BY route_id` + pageClause(page)
 	}
 
-	defer rows.Close() // Ensure the rows are closed after usage
-
-	// Slice to hold all the trips
 	var routes []Route
-
-	// Iterate over the rows
-	for rows.Next() {
-		var route Route
-		// Scan the row data into the trip struct
-		err := rows.Scan(
-			&route.RouteId,
-			&route.AgencyId,
-			&route.RouteShortName,
-			&route.RouteLongName,
-			&route.RouteType,
-			&route.RouteColor,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		route.VehicleType = getRouteVehicleType(route)
-		// Append each trip to the slice
-		routes = append(routes, route)
-	}
-
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
+	err := db.Select(&routes, query)
+	if err != nil {
 		return nil, err
 	}
+	for i := range routes {
+		routes[i].setDerivedFields()
+	}
 
 	// If no trips were found, return a custom error
 	if len(routes) == 0 {
 		return nil, errors.New("no routes found")
 	}
 
+	v.stripIDs(&routes)
 	return routes, nil
 }
 
@@ -81,7 +66,19 @@ func (v Database) GetRoutes() ([]Route, error) {
 Get a route by its route ids
 */
 func (v Database) GetRouteByID(routeID string) (Route, error) {
-	db := v.db
+	defer v.observeQuery("GetRouteByID", time.Now())
+	route, err := v.routeByID(v.PrefixID(routeID))
+	if err != nil {
+		return Route{}, err
+	}
+	v.stripIDs(&route)
+	return route, nil
+}
+
+/*
+Get a route by its id in the database (with the id prefix, see WithIDPrefix)
+*/
+func (v Database) routeByID(routeID string) (Route, error) {
 	query := `
 		SELECT
 			route_id,
@@ -89,77 +86,73 @@ func (v Database) GetRouteByID(routeID string) (Route, error) {
 			route_short_name,
 			route_long_name,
 			route_type,
-			route_color
+			route_color,
+			COALESCE(route_text_color, '') AS route_text_color
 		FROM
 			routes
 		WHERE
 			route_id = ?
 	`
 
-	row := db.QueryRow(query, routeID)
+	statement, err := v.prepared(query)
+	if err != nil {
+		return Route{}, err
+	}
 
-	// Slice to hold all the trips
 	var route Route
-
-	// Iterate over the rows
-	err := row.Scan(
-		&route.RouteId,
-		&route.AgencyId,
-		&route.RouteShortName,
-		&route.RouteLongName,
-		&route.RouteType,
-		&route.RouteColor,
-	)
+	err = statement.Get(&route, routeID)
 	if err != nil {
 		return Route{}, err
 	}
 
-	route.VehicleType = getRouteVehicleType(route)
+	route.setDerivedFields()
 
 	return route, nil
 }
 
+/*
+A route serving a stop, with the directions it goes in from the stop
+*/
+type StopRoute struct {
+	Route
+	Directions []StopRouteDirection `json:"directions"`
+}
+
+type StopRouteDirection struct {
+	DirectionID int      `json:"direction_id"`
+	Headsigns   []string `json:"headsigns"` // The headsigns shown at the stop, the most common first
+	Trips       int      `json:"trips"`     // How many trips in the direction stop there
+}
+
 /*
 Get all the routes that pass through a given stops
 */
 func (v Database) GetRoutesByStopId(stopId string) ([]Route, error) {
+	defer v.observeQuery("GetRoutesByStopId", time.Now())
+	routes, err := v.routesAtStop(v.PrefixID(stopId))
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&routes)
+	return routes, nil
+}
+
+func (v Database) routesAtStop(stopID string) ([]Route, error) {
 	query := `
-		SELECT DISTINCT r.route_id, r.route_short_name, r.route_long_name, r.route_type, r.route_color
+		SELECT DISTINCT r.route_id, COALESCE(r.agency_id, '') AS agency_id, r.route_short_name, r.route_long_name, r.route_type, r.route_color, COALESCE(r.route_text_color, '') AS route_text_color
 		FROM stop_times st
 		JOIN trips t ON st.trip_id = t.trip_id
 		JOIN routes r ON t.route_id = r.route_id
 		WHERE st.stop_id = ?;
 	`
-	db := v.db
 
-	rows, err := db.Query(query, stopId)
+	var routes []Route
+	err := v.db.Select(&routes, query, stopID)
 	if err != nil {
 		return nil, errors.New("no routes found for stop")
 	}
-
-	var routes []Route
-	defer rows.Close()
-
-	for rows.Next() {
-		var route Route
-		// Scan the row data into the trip struct
-		err := rows.Scan(
-			&route.RouteId,
-			&route.RouteShortName,
-			&route.RouteLongName,
-			&route.RouteType,
-			&route.RouteColor,
-		)
-		if err != nil {
-			return nil, err
-		}
-		route.VehicleType = getRouteVehicleType(route)
-		// Append each trip to the slice
-		routes = append(routes, route)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, err
+	for i := range routes {
+		routes[i].setDerivedFields()
 	}
 
 	if len(routes) == 0 {
@@ -169,38 +162,71 @@ func (v Database) GetRoutesByStopId(stopId string) ([]Route, error) {
 }
 
 /*
-Determine the type of vehicle a given route uses
+Get all the routes that pass through a given stops, with the directions serving the stop and their headsigns (e.g for a
+stop's page)
 */
-func getRouteVehicleType(route Route) string {
-	switch route.RouteType {
-	case 0:
-		return "Tram/Light Rail"
-	case 1:
-		return "Subway/Metro"
-	case 2:
-		return "Train"
-	case 3:
-		return "Bus"
-	case 4:
-		return "Ferry"
-	case 5:
-		return "Cable Tram"
-	case 6:
-		return "Gondola"
-	case 7:
-		return "Train (up hill)"
-	case 11:
-		return "Trolleybus"
-	case 12:
-		return "Monorail"
+func (v Database) GetRouteDirectionsByStopId(stopId string) ([]StopRoute, error) {
+	defer v.observeQuery("GetRouteDirectionsByStopId", time.Now())
+	stopId = v.PrefixID(stopId)
+
+	routes, err := v.routesAtStop(stopId)
+	if err != nil {
+		return nil, err
 	}
-	return "unknown"
+
+	// The stop's headsign overrides the trip's, e.g a loop route showing where it goes next
+	var headsigns []struct {
+		RouteID     string `db:"route_id"`
+		DirectionID int    `db:"direction_id"`
+		Headsign    string `db:"headsign"`
+		Trips       int    `db:"trips"`
+	}
+	err = v.db.Select(&headsigns, `
+		SELECT
+			t.route_id,
+			COALESCE(t.direction_id, 0) AS direction_id,
+			COALESCE(NULLIF(st.stop_headsign, ''), t.trip_headsign, '') AS headsign,
+			COUNT(*) AS trips
+		FROM stop_times st
+		JOIN trips t ON st.trip_id = t.trip_id
+		WHERE st.stop_id = ?
+		GROUP BY t.route_id, direction_id, headsign
+		ORDER BY direction_id, trips DESC, headsign
+	`, stopId)
+	if err != nil {
+		return nil, err
+	}
+
+	stopRoutes := make([]StopRoute, len(routes))
+	for i, route := range routes {
+		stopRoutes[i] = StopRoute{Route: route, Directions: []StopRouteDirection{}}
+		for _, headsign := range headsigns {
+			if headsign.RouteID != route.RouteId {
+				continue
+			}
+			directions := stopRoutes[i].Directions
+			if len(directions) == 0 || directions[len(directions)-1].DirectionID != headsign.DirectionID {
+				directions = append(directions, StopRouteDirection{DirectionID: headsign.DirectionID, Headsigns: []string{}})
+			}
+			direction := &directions[len(directions)-1]
+			direction.Trips += headsign.Trips
+			if headsign.Headsign != "" {
+				direction.Headsigns = append(direction.Headsigns, headsign.Headsign)
+			}
+			stopRoutes[i].Directions = directions
+		}
+	}
+
+	v.stripIDs(&stopRoutes)
+	return stopRoutes, nil
 }
 
 /*
 Search for a route based on a partial match to its id
+
+  - page: optionally only get a page of the results
 */
-func (v Database) SearchForRouteByID(searchText string) ([]Route, error) {
+func (v Database) SearchForRouteByID(searchText string, page ...Page) ([]Route, error) {
 	// Normalize the input search text and make it lowercase
 	normalizedSearchText := strings.ToLower(searchText)
 
@@ -212,69 +238,31 @@ func (v Database) SearchForRouteByID(searchText string) ([]Route, error) {
 			route_short_name,
 			route_long_name,
 			route_type,
-			route_color
+			route_color,
+			COALESCE(route_text_color, '') AS route_text_color
 		FROM 
 			routes
 		WHERE
-			LOWER(route_id) LIKE ?
+			LOWER(SUBSTR(route_id, ?)) LIKE ? -- Without the id prefix, see WithIDPrefix
 	`
+	if len(page) > 0 {
+		query += ` ORDER BY route_id` + pageClause(page)
+	}
 
 	// Run the query
-	rows, err := v.db.Query(query, "%"+normalizedSearchText+"%")
+	var routeSearchResults []Route
+	err := v.db.Select(&routeSearchResults, query, len(v.IDPrefix())+1, "%"+normalizedSearchText+"%")
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var routeSearchResults []Route
-
-	// Iterate over the rows
-	for rows.Next() {
-		var route Route
-		err := rows.Scan(
-			&route.RouteId,
-			&route.AgencyId,
-			&route.RouteShortName,
-			&route.RouteLongName,
-			&route.RouteType,
-			&route.RouteColor,
-		)
-		if err != nil {
-			return nil, err
-		}
-		switch route.RouteType {
-		case 0:
-			route.VehicleType = "Tram/Light Rail"
-		case 1:
-			route.VehicleType = "Subway/Metro"
-		case 2:
-			route.VehicleType = "Train"
-		case 3:
-			route.VehicleType = "Bus"
-		case 4:
-			route.VehicleType = "Ferry"
-		case 5:
-			route.VehicleType = "Cable Tram"
-		case 6:
-			route.VehicleType = "Gondola"
-		case 7:
-			route.VehicleType = "Train (up hill)"
-		case 11:
-			route.VehicleType = "Trolleybus"
-		case 12:
-			route.VehicleType = "Monorail"
-		}
-		routeSearchResults = append(routeSearchResults, route)
-	}
-
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
-		return nil, err
+	for i := range routeSearchResults {
+		routeSearchResults[i].setDerivedFields()
 	}
 
 	if len(routeSearchResults) == 0 {
 		return nil, errors.New("no routes found for search")
 	}
 
+	v.stripIDs(&routeSearchResults)
 	return routeSearchResults, nil
 }
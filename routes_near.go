@@ -0,0 +1,153 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+Store the segments of every shape in the shape_segments R-tree, for GetRoutesNear
+*/
+func (v Database) buildShapeSegments() error {
+	_, err := v.db.Exec(`
+		DELETE FROM shape_segments;
+
+		INSERT INTO shape_segments (min_lat, max_lat, min_lon, max_lon, shape_id, from_lat, from_lon, to_lat, to_lon)
+		SELECT MIN(lat, next_lat), MAX(lat, next_lat), MIN(lon, next_lon), MAX(lon, next_lon), shape_id, lat, lon, next_lat, next_lon
+		FROM (
+			SELECT
+				shape_id,
+				shape_pt_lat AS lat,
+				shape_pt_lon AS lon,
+				LEAD(shape_pt_lat) OVER (PARTITION BY shape_id ORDER BY shape_pt_sequence) AS next_lat,
+				LEAD(shape_pt_lon) OVER (PARTITION BY shape_id ORDER BY shape_pt_sequence) AS next_lon
+			FROM shapes
+		)
+		WHERE next_lat IS NOT NULL AND next_lon IS NOT NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to build shape segments: %w", err)
+	}
+	return nil
+}
+
+type NearbyRoute struct {
+	Route    Route   `json:"route"`
+	Distance float64 `json:"distance"` // How close the closest of the route's shapes comes to the point (m)
+}
+
+/*
+Get the routes whose shapes pass within a radius (m) of a point, closest first, e.g for what runs along a street
+
+Routes without shapes aren't found
+*/
+func (v Database) GetRoutesNear(lat, lon, radius float64) ([]NearbyRoute, error) {
+	defer v.observeQuery("GetRoutesNear", time.Now())
+
+	if radius <= 0 {
+		return nil, errors.New("invalid radius")
+	}
+
+	// The R-tree finds the segments whose bounding box is near the point, then their actual distance is worked out
+	latDelta := radius / 111320
+	lonDelta := radius / (111320 * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+	var segments []struct {
+		ShapeID string  `db:"shape_id"`
+		FromLat float64 `db:"from_lat"`
+		FromLon float64 `db:"from_lon"`
+		ToLat   float64 `db:"to_lat"`
+		ToLon   float64 `db:"to_lon"`
+	}
+	err := v.db.Select(&segments, `
+		SELECT shape_id, from_lat, from_lon, to_lat, to_lon
+		FROM shape_segments
+		WHERE max_lat >= ? AND min_lat <= ? AND max_lon >= ? AND min_lon <= ?
+	`, lat-latDelta, lat+latDelta, lon-lonDelta, lon+lonDelta)
+	if err != nil {
+		return nil, err
+	}
+
+	shapeDistances := make(map[string]float64)
+	var shapeIDs []string
+	for _, segment := range segments {
+		distance := segmentDistance(lat, lon, segment.FromLat, segment.FromLon, segment.ToLat, segment.ToLon)
+		if distance > radius {
+			continue
+		}
+		current, found := shapeDistances[segment.ShapeID]
+		if !found {
+			shapeIDs = append(shapeIDs, segment.ShapeID)
+		}
+		if !found || distance < current {
+			shapeDistances[segment.ShapeID] = distance
+		}
+	}
+	if len(shapeIDs) == 0 {
+		return []NearbyRoute{}, nil
+	}
+
+	shapeRoutes, err := selectByIDs[struct {
+		ShapeID string `db:"shape_id"`
+		RouteID string `db:"route_id"`
+	}](v, `SELECT DISTINCT shape_id, route_id FROM trips WHERE shape_id IN (%s)`, shapeIDs)
+	if err != nil {
+		return nil, err
+	}
+	routeDistances := make(map[string]float64)
+	var routeIDs []string
+	for _, shapeRoute := range shapeRoutes {
+		distance := shapeDistances[shapeRoute.ShapeID]
+		current, found := routeDistances[shapeRoute.RouteID]
+		if !found {
+			routeIDs = append(routeIDs, shapeRoute.RouteID)
+		}
+		if !found || distance < current {
+			routeDistances[shapeRoute.RouteID] = distance
+		}
+	}
+
+	routes, err := v.routesByIDs(routeIDs)
+	if err != nil {
+		return nil, err
+	}
+	nearby := make([]NearbyRoute, 0, len(routes))
+	for _, routeID := range routeIDs {
+		route, found := routes[routeID]
+		if !found {
+			continue
+		}
+		nearby = append(nearby, NearbyRoute{Route: route, Distance: routeDistances[routeID]})
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		if nearby[i].Distance != nearby[j].Distance {
+			return nearby[i].Distance < nearby[j].Distance
+		}
+		return naturalLess(nearby[i].Route.RouteShortName, nearby[j].Route.RouteShortName)
+	})
+
+	v.stripIDs(&nearby)
+	return nearby, nil
+}
+
+/*
+How far a point is from the closest point of a segment (m)
+
+The segment is projected flat around the point, which is close enough over the short distances searched
+*/
+func segmentDistance(lat, lon, fromLat, fromLon, toLat, toLon float64) float64 {
+	const metersPerDegree = 111320
+	scale := math.Cos(lat * math.Pi / 180)
+	ax, ay := (fromLon-lon)*metersPerDegree*scale, (fromLat-lat)*metersPerDegree
+	bx, by := (toLon-lon)*metersPerDegree*scale, (toLat-lat)*metersPerDegree
+
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		// Where the point is closest along the segment, clamped to its ends
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
@@ -0,0 +1,189 @@
+package gtfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+What a saved item is
+*/
+const (
+	SavedStop    = "stop"
+	SavedRoute   = "route"
+	SavedJourney = "journey" // ItemID is the client's own id for the journey, e.g "<from stop>-<to stop>", with the details in Data
+)
+
+/*
+A stop, route or journey a client has saved, see WithUserData
+*/
+type SavedItem struct {
+	ID       int64     `json:"id" db:"id"`
+	ClientID string    `json:"client_id" db:"client_id"`
+	Kind     string    `json:"kind" db:"kind"`       // SavedStop, SavedRoute or SavedJourney
+	ItemID   string    `json:"item_id" db:"item_id"` // The stop/route id, or the journey's id
+	Name     string    `json:"name" db:"name"`       // The client's name for it e.g "Home", can be ""
+	Data     string    `json:"data" db:"data"`       // Anything else the client wants to keep with it (e.g json), can be ""
+	Position int       `json:"position" db:"position"`
+	Created  time.Time `json:"created" db:"-"`
+}
+
+/*
+Create the saved items table, only when WithUserData is used
+*/
+func (v Database) createSavedItemsTable() error {
+	if v.state == nil || !v.state.userData {
+		return nil
+	}
+
+	query := `
+		CREATE TABLE IF NOT EXISTS saved_items (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			client_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			item_id TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			data TEXT NOT NULL DEFAULT '',
+			position INTEGER NOT NULL DEFAULT 0,
+			created INTEGER NOT NULL DEFAULT 0,
+			CONSTRAINT unique_saved_item UNIQUE (client_id, kind, item_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_saved_items_client ON saved_items (client_id, kind, position);
+	`
+	if _, err := v.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create saved items table: %w", err)
+	}
+	return nil
+}
+
+func (v Database) checkUserData() error {
+	if v.state == nil || !v.state.userData {
+		return errors.New("user data isn't enabled, see WithUserData")
+	}
+	return nil
+}
+
+/*
+Save a stop, route or journey for a client, or update its name, data and position if it's already saved
+
+  - clientID: an opaque id for the client (e.g a random id kept by the app), not a login
+*/
+func (v Database) SaveItem(clientID string, item SavedItem) (SavedItem, error) {
+	if err := v.checkUserData(); err != nil {
+		return SavedItem{}, err
+	}
+	if clientID == "" {
+		return SavedItem{}, errors.New("missing client id")
+	}
+	if item.ItemID == "" {
+		return SavedItem{}, errors.New("missing item id")
+	}
+	switch item.Kind {
+	case SavedStop:
+		if _, err := v.GetStopByStopID(item.ItemID); err != nil {
+			return SavedItem{}, errors.New("stop not found")
+		}
+	case SavedRoute:
+		if _, err := v.GetRouteByID(item.ItemID); err != nil {
+			return SavedItem{}, errors.New("route not found")
+		}
+	case SavedJourney:
+	default:
+		return SavedItem{}, errors.New("invalid kind")
+	}
+
+	_, err := v.db.Exec(`
+		INSERT INTO saved_items (client_id, kind, item_id, name, data, position, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (client_id, kind, item_id) DO UPDATE SET name = excluded.name, data = excluded.data, position = excluded.position
+	`, clientID, item.Kind, item.ItemID, item.Name, item.Data, item.Position, time.Now().Unix())
+	if err != nil {
+		return SavedItem{}, fmt.Errorf("failed to save item: %w", err)
+	}
+
+	return v.getSavedItem(clientID, item.Kind, item.ItemID)
+}
+
+/*
+Get the items a client has saved in order of their position, of one kind or every kind if kind is ""
+*/
+func (v Database) GetSavedItems(clientID string, kind string) ([]SavedItem, error) {
+	if err := v.checkUserData(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, client_id, kind, item_id, name, data, position, created FROM saved_items WHERE client_id = ?`
+	args := []interface{}{clientID}
+	if kind != "" {
+		query += ` AND kind = ?`
+		args = append(args, kind)
+	}
+	query += ` ORDER BY position, created, id`
+
+	var rows []savedItemRow
+	if err := v.db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	items := make([]SavedItem, len(rows))
+	for i, row := range rows {
+		items[i] = row.toSavedItem()
+	}
+	return items, nil
+}
+
+/*
+Remove a saved item from a client
+*/
+func (v Database) RemoveSavedItem(clientID string, kind string, itemID string) error {
+	if err := v.checkUserData(); err != nil {
+		return err
+	}
+
+	result, err := v.db.Exec(`DELETE FROM saved_items WHERE client_id = ? AND kind = ? AND item_id = ?`, clientID, kind, itemID)
+	if err != nil {
+		return fmt.Errorf("failed to remove saved item: %w", err)
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return errors.New("saved item not found")
+	}
+	return nil
+}
+
+/*
+Remove everything a client has saved, e.g when they delete their data
+*/
+func (v Database) RemoveClientData(clientID string) error {
+	if err := v.checkUserData(); err != nil {
+		return err
+	}
+
+	if _, err := v.db.Exec(`DELETE FROM saved_items WHERE client_id = ?`, clientID); err != nil {
+		return fmt.Errorf("failed to remove client data: %w", err)
+	}
+	return nil
+}
+
+func (v Database) getSavedItem(clientID string, kind string, itemID string) (SavedItem, error) {
+	var row savedItemRow
+	err := v.db.Get(&row, `SELECT id, client_id, kind, item_id, name, data, position, created FROM saved_items WHERE client_id = ? AND kind = ? AND item_id = ?`, clientID, kind, itemID)
+	if err == sql.ErrNoRows {
+		return SavedItem{}, errors.New("saved item not found")
+	}
+	if err != nil {
+		return SavedItem{}, err
+	}
+	return row.toSavedItem(), nil
+}
+
+type savedItemRow struct {
+	SavedItem
+	CreatedUnix int64 `db:"created"`
+}
+
+func (row savedItemRow) toSavedItem() SavedItem {
+	item := row.SavedItem
+	item.Created = time.Unix(row.CreatedUnix, 0)
+	return item
+}
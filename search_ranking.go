@@ -0,0 +1,171 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StopSearchOptions struct {
+	IncludeChildStops bool
+	Lat, Lon          *float64 // Rank stops near here higher, e.g the rider's location
+	Limit             int      // How many results, defaults to 20
+
+	// How much each score counts towards the overall score, defaults to 0.5, 0.3 and 0.2.
+	// DistanceWeight is only used with a location
+	TextWeight, ImportanceWeight, DistanceWeight float64
+}
+
+/*
+A stop search result with the scores it was ranked by (each 0-1), so clients can explain the order
+*/
+type RankedStop struct {
+	Stop            Stop     `json:"stop"`
+	Score           float64  `json:"score"`                    // The weighted combination of the scores, results are ordered by it
+	TextScore       float64  `json:"text_score"`               // 1 for an exact name or code match, less for prefix, word and partial matches
+	ImportanceScore float64  `json:"importance_score"`         // The stop's trips per day, relative to the busiest result
+	TripsPerDay     int      `json:"trips_per_day"`            // From the stop stats for today's day of the week
+	DistanceScore   *float64 `json:"distance_score,omitempty"` // Unset without a location, 0.5 at 1km away
+	Distance        *float64 `json:"distance,omitempty"`       // km from the location
+}
+
+/*
+Search stops by name or code, ranked by how well they match, how busy they are (see GetStopStats) and, with a location,
+how close they are
+*/
+func (v Database) SearchStopsRanked(searchText string, options StopSearchOptions) ([]RankedStop, error) {
+	defer v.observeQuery("SearchStopsRanked", time.Now())
+
+	search := strings.ToLower(strings.TrimSpace(searchText))
+	if search == "" {
+		return nil, errors.New("missing search text")
+	}
+	if options.Limit <= 0 {
+		options.Limit = 20
+	}
+	if options.TextWeight == 0 && options.ImportanceWeight == 0 && options.DistanceWeight == 0 {
+		options.TextWeight, options.ImportanceWeight, options.DistanceWeight = 0.5, 0.3, 0.2
+	}
+	hasLocation := options.Lat != nil && options.Lon != nil
+
+	query := `
+		SELECT
+			stop_id,
+			stop_code,
+			stop_name,
+			stop_lat,
+			stop_lon,
+			location_type,
+			parent_station,
+			platform_code,
+			zone_id,
+			wheelchair_boarding
+		FROM
+			stops
+		WHERE
+			(LOWER(stop_name) LIKE ? OR LOWER(stop_code) = ?)
+	`
+	if !options.IncludeChildStops {
+		query += ` AND NOT (location_type = 0 AND parent_station != '')`
+	}
+	var stops []Stop
+	if err := v.db.Select(&stops, query, "%"+search+"%", search); err != nil {
+		return nil, err
+	}
+	if len(stops) == 0 {
+		return nil, errors.New("no stops found for search")
+	}
+	v.setStopModes(stops)
+
+	stopIDs := make([]string, len(stops))
+	for i, stop := range stops {
+		stopIDs[i] = stop.StopId
+	}
+	tripsPerDay := v.storedTripsPerDay(stopIDs, int(Today(v.locationFor("", "")).Weekday()))
+	busiest := 0
+	for _, trips := range tripsPerDay {
+		if trips > busiest {
+			busiest = trips
+		}
+	}
+
+	results := make([]RankedStop, 0, len(stops))
+	for _, stop := range stops {
+		result := RankedStop{
+			Stop:        stop,
+			TextScore:   textScore(search, stop),
+			TripsPerDay: tripsPerDay[stop.StopId],
+		}
+		if busiest > 0 {
+			// Logarithmic so a few very busy stops don't flatten the rest
+			result.ImportanceScore = math.Log1p(float64(result.TripsPerDay)) / math.Log1p(float64(busiest))
+		}
+
+		result.Score = options.TextWeight*result.TextScore + options.ImportanceWeight*result.ImportanceScore
+		totalWeight := options.TextWeight + options.ImportanceWeight
+		if hasLocation {
+			distance := calculateDistance(*options.Lat, *options.Lon, stop.StopLat, stop.StopLon)
+			distanceScore := 1 / (1 + distance)
+			result.Distance = &distance
+			result.DistanceScore = &distanceScore
+			result.Score += options.DistanceWeight * distanceScore
+			totalWeight += options.DistanceWeight
+		}
+		if totalWeight > 0 {
+			result.Score /= totalWeight
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Stop.StopName < results[j].Stop.StopName
+	})
+	if len(results) > options.Limit {
+		results = results[:options.Limit]
+	}
+	v.stripIDs(&results)
+	return results, nil
+}
+
+/*
+How well a stop matches the (lowercase) search text
+*/
+func textScore(search string, stop Stop) float64 {
+	name := strings.ToLower(stop.StopName)
+	switch {
+	case name == search || strings.ToLower(stop.StopCode) == search:
+		return 1
+	case strings.HasPrefix(name, search):
+		return 0.8
+	case strings.Contains(name, " "+search):
+		return 0.6
+	case strings.Contains(name, search):
+		return 0.4
+	}
+	return 0
+}
+
+/*
+Get the stops' trips on a day of the week from the stop stats stored at import, stops without any are left out
+*/
+func (v Database) storedTripsPerDay(stopIDs []string, weekday int) map[string]int {
+	tripsPerDay := make(map[string]int)
+	rows, err := selectByIDs[struct {
+		StopID string `db:"stop_id"`
+		Trips  int    `db:"trips"`
+	}](v, `SELECT stop_id, trips FROM stop_stats WHERE weekday = `+strconv.Itoa(weekday)+` AND stop_id IN (%s)`, stopIDs)
+	if err != nil {
+		v.logger().Warn("failed to get stop stats for search", "error", err)
+		return tripsPerDay
+	}
+	for _, row := range rows {
+		tripsPerDay[row.StopID] = row.Trips
+	}
+	return tripsPerDay
+}
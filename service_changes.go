@@ -0,0 +1,197 @@
+package gtfs
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+The routes running differently to their usual timetable on a date, because of calendar_dates exceptions (e.g a public
+holiday)
+*/
+type ServiceChange struct {
+	Date     string               `json:"date"`                // "20060102"
+	Weekday  string               `json:"weekday"`             // e.g "Friday"
+	RunsLike string               `json:"runs_like,omitempty"` // The weekday's timetable every changed route runs, e.g "Sunday"
+	Routes   []RouteServiceChange `json:"routes"`
+}
+
+type RouteServiceChange struct {
+	RouteID   string   `json:"route_id"`
+	RouteName string   `json:"route_name"`          // The route's short name (or long name)
+	Added     []string `json:"added"`               // The service_ids added on the date
+	Removed   []string `json:"removed"`             // The service_ids removed on the date
+	NoService bool     `json:"no_service"`          // Nothing runs on the route on the date
+	RunsLike  string   `json:"runs_like,omitempty"` // The other weekday's timetable it runs instead, e.g "Sunday"
+}
+
+/*
+Get the dates in the next days with services added or removed by calendar_dates, and the routes they change, so apps
+can show e.g "Sunday timetable on Friday (public holiday)"
+
+Only exceptions which change what calendar.txt has running are included. Feeds without calendar.txt (only
+calendar_dates) have no usual timetable to compare with, so have no changes
+
+  - days: how many days to look ahead (including today), defaults to 7
+*/
+func (v Database) GetUpcomingServiceChanges(days int) ([]ServiceChange, error) {
+	defer v.observeQuery("GetUpcomingServiceChanges", time.Now())
+
+	if days <= 0 {
+		days = 7
+	}
+
+	calendars, exceptions, err := v.readCalendars()
+	if err != nil {
+		return nil, err
+	}
+	changes := []ServiceChange{}
+	if len(calendars) == 0 {
+		return changes, nil
+	}
+
+	var routes []struct {
+		RouteID   string `db:"route_id"`
+		ShortName string `db:"route_short_name"`
+		LongName  string `db:"route_long_name"`
+		ServiceID string `db:"service_id"`
+	}
+	err = v.db.Select(&routes, `
+		SELECT DISTINCT
+			r.route_id,
+			COALESCE(r.route_short_name, '') AS route_short_name,
+			COALESCE(r.route_long_name, '') AS route_long_name,
+			t.service_id
+		FROM routes r
+		JOIN trips t ON t.route_id = r.route_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	serviceRoutes := make(map[string][]string)
+	routeServices := make(map[string][]string)
+	routeNames := make(map[string]string)
+	for _, route := range routes {
+		serviceRoutes[route.ServiceID] = append(serviceRoutes[route.ServiceID], route.RouteID)
+		routeServices[route.RouteID] = append(routeServices[route.RouteID], route.ServiceID)
+		routeNames[route.RouteID] = route.ShortName
+		if route.ShortName == "" {
+			routeNames[route.RouteID] = route.LongName
+		}
+	}
+
+	// The services calendar.txt has running on a date, if it was a weekday
+	regular := func(date string, weekday time.Weekday) map[string]bool {
+		services := make(map[string]bool)
+		for _, calendar := range calendars {
+			if calendar.runsOn(date, weekday) {
+				services[calendar.ServiceID] = true
+			}
+		}
+		return services
+	}
+
+	exceptionsByDate := make(map[string][]calendarException)
+	for _, exception := range exceptions {
+		exceptionsByDate[exception.Date] = append(exceptionsByDate[exception.Date], exception)
+	}
+
+	today := Today(v.locationFor("", ""))
+	for i := 0; i < days; i++ {
+		day := today.AddDays(i)
+		date := day.String()
+		if len(exceptionsByDate[date]) == 0 {
+			continue
+		}
+
+		var weekdays [7]map[string]bool
+		for weekday := range weekdays {
+			weekdays[weekday] = regular(date, time.Weekday(weekday))
+		}
+		usual := weekdays[day.Weekday()]
+
+		// Only the exceptions which change what runs, some feeds repeat the calendar in calendar_dates
+		routeChanges := make(map[string]*RouteServiceChange)
+		for _, exception := range exceptionsByDate[date] {
+			added := exception.ExceptionType == 1 && !usual[exception.ServiceID]
+			removed := exception.ExceptionType == 2 && usual[exception.ServiceID]
+			if !added && !removed {
+				continue
+			}
+			for _, routeID := range serviceRoutes[exception.ServiceID] {
+				change, found := routeChanges[routeID]
+				if !found {
+					change = &RouteServiceChange{RouteID: routeID, RouteName: routeNames[routeID], Added: []string{}, Removed: []string{}}
+					routeChanges[routeID] = change
+				}
+				if added {
+					change.Added = append(change.Added, exception.ServiceID)
+				} else {
+					change.Removed = append(change.Removed, exception.ServiceID)
+				}
+			}
+		}
+		if len(routeChanges) == 0 {
+			continue
+		}
+
+		serviceChange := ServiceChange{Date: date, Weekday: day.Weekday().String()}
+		for routeID, change := range routeChanges {
+			running := make(map[string]bool)
+			for _, serviceID := range routeServices[routeID] {
+				if usual[serviceID] && !contains(change.Removed, serviceID) {
+					running[serviceID] = true
+				}
+			}
+			for _, serviceID := range change.Added {
+				running[serviceID] = true
+			}
+			change.NoService = len(running) == 0
+
+			// The route runs another weekday's timetable if it has the same services running
+			for weekday, services := range weekdays {
+				if change.NoService || time.Weekday(weekday) == day.Weekday() {
+					continue
+				}
+				same := true
+				for _, serviceID := range routeServices[routeID] {
+					if services[serviceID] != running[serviceID] {
+						same = false
+						break
+					}
+				}
+				if same {
+					change.RunsLike = time.Weekday(weekday).String()
+					break
+				}
+			}
+
+			sort.Strings(change.Added)
+			sort.Strings(change.Removed)
+			serviceChange.Routes = append(serviceChange.Routes, *change)
+		}
+		sort.Slice(serviceChange.Routes, func(i, j int) bool {
+			return naturalLess(serviceChange.Routes[i].RouteName, serviceChange.Routes[j].RouteName)
+		})
+
+		serviceChange.RunsLike = serviceChange.Routes[0].RunsLike
+		for _, change := range serviceChange.Routes {
+			if change.RunsLike != serviceChange.RunsLike {
+				serviceChange.RunsLike = ""
+				break
+			}
+		}
+
+		changes = append(changes, serviceChange)
+	}
+
+	// The service ids are only in lists named after what happened to them, so they're removed separately
+	for i := range changes {
+		for j := range changes[i].Routes {
+			changes[i].Routes[j].Added = v.stripIDPrefixes(changes[i].Routes[j].Added)
+			changes[i].Routes[j].Removed = v.stripIDPrefixes(changes[i].Routes[j].Removed)
+		}
+	}
+	v.stripIDs(&changes)
+	return changes, nil
+}
@@ -0,0 +1,203 @@
+package gtfs
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+A gtfs service day (the date a trip runs on) in a timezone
+
+Gtfs times are measured from "noon minus 12h" of the service day, not midnight, so a service day is 23 or 25 hours
+long when the clocks change. Doing the math with time.Time (AddDate, Hour, Format) is off by an hour on those days,
+ServiceDay does it from noon, which is never skipped or repeated
+*/
+type ServiceDay struct {
+	date     time.Time // Noon on the day, in location
+	location *time.Location
+}
+
+/*
+Get the service day a time is on, in the timezone given (the time's own timezone if nil)
+*/
+func ServiceDayOf(t time.Time, location *time.Location) ServiceDay {
+	if location == nil {
+		location = t.Location()
+	}
+	t = t.In(location)
+	return ServiceDay{date: time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, location), location: location}
+}
+
+/*
+Get today's service day in a timezone
+*/
+func Today(location *time.Location) ServiceDay {
+	return ServiceDayOf(time.Now(), location)
+}
+
+/*
+Parse a gtfs date ("20060102") as a service day in a timezone
+*/
+func ParseServiceDay(date string, location *time.Location) (ServiceDay, error) {
+	if location == nil {
+		location = time.UTC
+	}
+	parsed, err := time.ParseInLocation("20060102", date, location)
+	if err != nil {
+		return ServiceDay{}, errors.New("invalid date")
+	}
+	return ServiceDayOf(parsed, location), nil
+}
+
+/*
+The gtfs date of the day ("20060102")
+*/
+func (d ServiceDay) String() string {
+	return d.date.Format("20060102")
+}
+
+func (d ServiceDay) Location() *time.Location {
+	return d.location
+}
+
+func (d ServiceDay) Weekday() time.Weekday {
+	return d.date.Weekday()
+}
+
+/*
+Get the service day n days later (or earlier if n is negative)
+*/
+func (d ServiceDay) AddDays(n int) ServiceDay {
+	return ServiceDay{date: d.date.AddDate(0, 0, n), location: d.location}
+}
+
+/*
+Get how many days later another service day is (negative if it's earlier)
+*/
+func (d ServiceDay) DaysUntil(other ServiceDay) int {
+	// Noon to noon is 23-25 hours, so rounding to the nearest day is exact
+	return int(other.date.Sub(d.date).Round(24*time.Hour) / (24 * time.Hour))
+}
+
+/*
+The time gtfs times are measured from, noon minus 12h (midnight, except on days the clocks change around midnight)
+*/
+func (d ServiceDay) Start() time.Time {
+	return d.date.Add(-12 * time.Hour)
+}
+
+/*
+How long the day is, 23 or 25 hours on the days the clocks change
+*/
+func (d ServiceDay) Length() time.Duration {
+	return d.AddDays(1).Start().Sub(d.Start())
+}
+
+/*
+Get the time of a gtfs time on the day, in seconds since the start of the service day (see parseGTFSTime)
+*/
+func (d ServiceDay) Time(seconds int) time.Time {
+	return d.Start().Add(time.Duration(seconds) * time.Second)
+}
+
+/*
+Get the time of a gtfs time string ("15:04:05", can be over 24:00:00) on the day
+*/
+func (d ServiceDay) ParseTime(value string) (time.Time, error) {
+	seconds, err := parseGTFSTime(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return d.Time(seconds), nil
+}
+
+/*
+Get a time as seconds since the start of the service day, the reverse of Time
+
+Can be negative or over 24h if the time isn't on the day
+*/
+func (d ServiceDay) Seconds(t time.Time) int {
+	return int(t.Sub(d.Start()) / time.Second)
+}
+
+/*
+Get a time as a gtfs time string on the service day ("15:04:05")
+*/
+func (d ServiceDay) FormatTime(t time.Time) string {
+	seconds := d.Seconds(t)
+	if seconds < 0 {
+		seconds = 0
+	}
+	return formatGTFSTime(seconds)
+}
+
+type TimezoneIssue struct {
+	File     string `json:"file"` // "agency.txt", "stops.txt" or "" for the database
+	ID       string `json:"id"`   // The agency/stop id
+	Timezone string `json:"timezone"`
+	Problem  string `json:"problem"`
+}
+
+/*
+Check the feed's timezones for problems which make service days and times wrong
+
+  - agencies with a missing or unknown agency_timezone
+  - agencies with different timezones (the gtfs spec requires them to be the same)
+  - stops with an unknown stop_timezone
+  - the database being created with a different timezone than the feed's (the feed's is used for service days)
+*/
+func (v Database) AuditTimezones() ([]TimezoneIssue, error) {
+	var agencies []struct {
+		AgencyID string `db:"agency_id"`
+		Timezone string `db:"agency_timezone"`
+	}
+	if err := v.db.Select(&agencies, `SELECT COALESCE(agency_id, '') AS agency_id, COALESCE(agency_timezone, '') AS agency_timezone FROM agency ORDER BY agency_id`); err != nil {
+		return nil, err
+	}
+
+	issues := []TimezoneIssue{}
+	var feedTimezone string
+	for _, agency := range agencies {
+		switch {
+		case agency.Timezone == "":
+			issues = append(issues, TimezoneIssue{File: "agency.txt", ID: v.StripIDPrefix(agency.AgencyID), Problem: "missing agency_timezone"})
+			continue
+		case !validTimezone(agency.Timezone):
+			issues = append(issues, TimezoneIssue{File: "agency.txt", ID: v.StripIDPrefix(agency.AgencyID), Timezone: agency.Timezone, Problem: "unknown timezone"})
+			continue
+		}
+
+		if feedTimezone == "" {
+			feedTimezone = agency.Timezone
+		} else if agency.Timezone != feedTimezone {
+			issues = append(issues, TimezoneIssue{File: "agency.txt", ID: v.StripIDPrefix(agency.AgencyID), Timezone: agency.Timezone, Problem: "different timezone to the other agencies (" + feedTimezone + ")"})
+		}
+	}
+
+	var stops []struct {
+		StopID   string `db:"stop_id"`
+		Timezone string `db:"stop_timezone"`
+	}
+	if err := v.db.Select(&stops, `SELECT stop_id, stop_timezone FROM stops WHERE COALESCE(stop_timezone, '') != '' ORDER BY stop_id`); err != nil {
+		return nil, err
+	}
+	for _, stop := range stops {
+		if !validTimezone(stop.Timezone) {
+			issues = append(issues, TimezoneIssue{File: "stops.txt", ID: v.StripIDPrefix(stop.StopID), Timezone: stop.Timezone, Problem: "unknown timezone"})
+		}
+	}
+
+	if feedTimezone != "" && v.timeZone != nil && v.timeZone.String() != feedTimezone {
+		issues = append(issues, TimezoneIssue{
+			Timezone: v.timeZone.String(),
+			Problem:  "the database's timezone isn't the feed's (" + feedTimezone + "), service days use the feed's",
+		})
+	}
+
+	return issues, nil
+}
+
+func validTimezone(name string) bool {
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
@@ -1,25 +1,132 @@
 package gtfs
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/jfmow/gtfs/realtime"
 )
 
 type StopTimes struct {
-	TripID        string `json:"trip_id"`
-	ArrivalTime   string `json:"arrival_time"`
-	DepartureTime string `json:"departure_time"`
-	StopId        string `json:"stop_id"`
-	StopSequence  int    `json:"stop_sequence"`
-	StopHeadsign  string `json:"stop_headsign"`
-	Platform      string `json:"platform"`
-	StopData      Stop   `json:"stop_data"`
-	TripData      Trip   `json:"trip_data"`
-	RouteColor    string `json:"route_color"`
+	TripID        string `json:"trip_id" db:"trip_id"`
+	ArrivalTime   string `json:"arrival_time" db:"arrival_time"`
+	DepartureTime string `json:"departure_time" db:"departure_time"`
+	StopId        string `json:"stop_id" db:"stop_id"`
+	StopSequence  int    `json:"stop_sequence" db:"stop_sequence"`
+	StopHeadsign  string `json:"stop_headsign" db:"stop_headsign"`
+	Platform      string `json:"platform" db:"platform_code"`
+	StopData      Stop   `json:"stop_data" db:"-"`
+	TripData      Trip   `json:"trip_data" db:"-"`
+	RouteColor    string `json:"route_color" db:"route_color"`
+	IsOrigin      bool   `json:"is_origin" db:"is_origin"`     // The trip starts at this stop
+	IsTerminus    bool   `json:"is_terminus" db:"is_terminus"` // The trip ends at this stop
+
+	Instance    TripInstance      `json:"instance" db:"-"`               // The run of the trip this is part of
+	ContinuesAs *TripContinuation `json:"continues_as,omitempty" db:"-"` // The trip the vehicle continues as after the terminus
+
+	Realtime     *realtime.TripUpdate `json:"realtime,omitempty" db:"-"`
+	RealtimeOnly bool                 `json:"realtime_only" db:"-"`       // An ADDED or DUPLICATED trip from the realtime data, not the static feed
+	Alerts       realtime.AlertMap    `json:"alerts,omitempty" db:"-"`    // The active alerts for the service's route, trip or stop
+	Occupancy    *Occupancy           `json:"occupancy,omitempty" db:"-"` // From the OccupancyProvider, if there is one
+}
+
+/*
+A row of the stop times queries, joining stop_times with its trip, stop and route
+*/
+type stopTimeRow struct {
+	TripId              string  `db:"trip_id"`
+	ServiceId           string  `db:"service_id"`
+	RouteId             string  `db:"route_id"`
+	DirectionId         int     `db:"direction_id"`
+	ShapeId             string  `db:"shape_id"`
+	TripHeadsign        string  `db:"trip_headsign"`
+	ArrivalTime         string  `db:"arrival_time"`
+	DepartureTime       string  `db:"departure_time"`
+	StopId              string  `db:"stop_id"`
+	StopSequence        int     `db:"stop_sequence"`
+	StopHeadsign        string  `db:"stop_headsign"`
+	RouteColor          string  `db:"route_color"`
+	StopName            string  `db:"stop_name"`
+	StopLat             float64 `db:"stop_lat"`
+	StopLon             float64 `db:"stop_lon"`
+	StopCode            string  `db:"stop_code"`
+	StopLocationType    int     `db:"location_type"`
+	StopParentStationId string  `db:"parent_station"`
+	Platform            string  `db:"platform_code"`
+	StopZoneID          string  `db:"zone_id"`
+	IsOrigin            bool    `db:"is_origin"`
+	IsTerminus          bool    `db:"is_terminus"`
+	TripStartTime       string  `db:"trip_start_time"`
+}
+
+func (result stopTimeRow) toStopTimes(reStationPlatform, reCapitalLetter *regexp.Regexp) StopTimes {
+	if result.Platform == "" {
+		result.Platform = determinePlatform(result.StopName, reStationPlatform, reCapitalLetter)
+	}
+
+	var stopData = Stop{
+		LocationType:       result.StopLocationType,
+		ParentStation:      result.StopParentStationId,
+		StopCode:           result.StopCode,
+		StopId:             result.StopId,
+		StopLat:            result.StopLat,
+		StopLon:            result.StopLon,
+		StopName:           result.StopName,
+		WheelChairBoarding: 0,
+		PlatformNumber:     result.Platform,
+		ZoneID:             result.StopZoneID,
+		StopType:           typeOfStop(result.StopName),
+		Sequence:           result.StopSequence,
+	}
+	var tripData = Trip{
+		BikesAllowed:         0,
+		DirectionID:          result.DirectionId,
+		RouteID:              result.RouteId,
+		ServiceID:            result.ServiceId,
+		ShapeID:              result.ShapeId,
+		TripHeadsign:         result.TripHeadsign,
+		TripID:               result.TripId,
+		WheelchairAccessible: 0,
+	}
+
+	return StopTimes{
+		TripID:        result.TripId,
+		ArrivalTime:   result.ArrivalTime,
+		DepartureTime: result.DepartureTime,
+		StopId:        result.StopId,
+		StopSequence:  result.StopSequence,
+		StopHeadsign:  result.StopHeadsign,
+		Platform:      result.Platform,
+		StopData:      stopData,
+		TripData:      tripData,
+		RouteColor:    result.RouteColor,
+		IsOrigin:      result.IsOrigin,
+		IsTerminus:    result.IsTerminus,
+		Instance: TripInstance{
+			TripID:    result.TripId,
+			StartTime: result.TripStartTime,
+		},
+	}
+}
+
+type ActiveTripsOptions struct {
+	StopID      string                  // Only services stopping at this stop (child stop/parent with no children)
+	ByStation   bool                    // Treat StopID as a station and include the services at all of its child stops (each with its own platform)
+	Date        string                  // The service date "20060102", defaults to today
+	From        string                  // Only services departing after this time "15:04:05"
+	To          string                  // Only services departing before this time "15:04:05"
+	Arrivals    bool                    // Filter and order by arrival time instead of departure time (e.g for terminus stops)
+	RouteID     string                  // Only services on this route
+	DirectionID *int                    // Only services going in this direction
+	Limit       int                     // The max amount of services to get, 0 for no limit
+	TripUpdates realtime.TripUpdatesMap // If set, each service has its realtime trip update attached (if there is one), and ADDED/DUPLICATED trips are included at StopID
+	Alerts      realtime.AlertMap       // If set, each service has the alerts active when it's at the stop attached
+	Feed        int                     // The merged feed TripUpdates are from (see MergeFeeds), 0 if the database isn't merged
+
+	IncludeContinuations bool // Attach the trip the vehicle continues as to services at their terminus
 }
 
 /*
@@ -31,45 +138,71 @@ Get all the services stopping at a given stop (child stop/parent with not childr
   - date: "20060102"
 */
 func (v Database) GetActiveTrips(stopID, departureTimeFilter string, date string, limit int) ([]StopTimes, error) {
+	return v.GetActiveTripsWithOptions(ActiveTripsOptions{
+		StopID: stopID,
+		Date:   date,
+		From:   departureTimeFilter,
+		Limit:  limit,
+	})
+}
+
+/*
+Get the stops to get the services at, the stop and its child stops when getting them by station
+*/
+func (v Database) stopIDsFor(options ActiveTripsOptions) ([]string, error) {
+	if options.StopID == "" {
+		return nil, nil
+	}
+	stopIDs := []string{options.StopID}
+	if options.ByStation {
+		var children []string
+		if err := v.db.Select(&children, `SELECT stop_id FROM stops WHERE parent_station = ? ORDER BY stop_id`, options.StopID); err != nil {
+			return nil, err
+		}
+		stopIDs = append(stopIDs, children...)
+	}
+	return stopIDs, nil
+}
+
+/*
+Get all the services running on a date, filtered by the given options
+*/
+func (v Database) GetActiveTripsWithOptions(options ActiveTripsOptions) ([]StopTimes, error) {
+	defer v.observeQuery("GetActiveTripsWithOptions", time.Now())
+
+	options.StopID = v.PrefixID(options.StopID)
+	options.RouteID = v.PrefixID(options.RouteID)
+	services, err := v.activeTrips(options)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&services)
+	return services, nil
+}
+
+/*
+Get the services running on a date, with the options' ids being the database's (with the id prefix, see WithIDPrefix)
+*/
+func (v Database) activeTrips(options ActiveTripsOptions) ([]StopTimes, error) {
 	// Open the SQLite database
 	db := v.db // Assuming db is already connected, if not, you can open it here
 
-	now := time.Now().In(v.timeZone)
-	dayColumn := strings.ToLower(now.Weekday().String())
-	var dateString string
-	if date != "" {
-		dateString = date
-	} else {
-		dateString = now.Format("20060102")
+	// Service days are relative to the stop/agency timezone, not where the server is
+	location := v.locationFor(options.StopID, options.RouteID)
+
+	serviceDay := Today(location)
+	if options.Date != "" {
+		parsed, err := ParseServiceDay(options.Date, location)
+		if err != nil {
+			return nil, err
+		}
+		serviceDay = parsed
 	}
+	dateString := serviceDay.String()
 
-	// Base query with placeholders for the date and dynamic weekday column
-	query := fmt.Sprintf(`
-	WITH active_services AS (
-		-- Select services from the calendar where today's date falls within start_date and end_date
-		SELECT service_id
-		FROM calendar
-		WHERE start_date <= ? 
-		  AND end_date >= ? 
-		  AND %s = 1 -- Ensure the service is active on the current day
-		UNION ALL
-		-- Add services from calendar_dates where exception_type = 1 (added services)
-		SELECT service_id
-		FROM calendar_dates
-		WHERE date = ? AND exception_type = 1
-	),
-	removed_services AS (
-		-- Select services from calendar_dates where exception_type = 2 (removed services)
-		SELECT service_id
-		FROM calendar_dates
-		WHERE date = ? AND exception_type = 2
-	),
-	adjusted_services AS (
-		-- Remove services from active_services that are marked as removed
-		SELECT DISTINCT service_id
-		FROM active_services
-		WHERE service_id NOT IN (SELECT service_id FROM removed_services)
-	)
+	// Base query with the services running on the date
+	servicesQuery, args := activeServicesQuery(serviceDay)
+	query := servicesQuery + `
 	-- Select trip details for active service_ids from trips and stop_times
 	SELECT 
 		t.trip_id, 
@@ -90,157 +223,273 @@ func (v Database) GetActiveTrips(stopID, departureTimeFilter string, date string
 		s.stop_code, 
 		s.location_type, 
 		s.parent_station,
-		s.platform_code
+		s.platform_code,
+		s.zone_id,
+		st.stop_sequence = (SELECT MIN(o.stop_sequence) FROM stop_times o WHERE o.trip_id = st.trip_id) AS is_origin,
+		st.stop_sequence = (SELECT MAX(o.stop_sequence) FROM stop_times o WHERE o.trip_id = st.trip_id) AS is_terminus,
+		(SELECT o.departure_time FROM stop_times o WHERE o.trip_id = st.trip_id ORDER BY o.stop_sequence LIMIT 1) AS trip_start_time
 	FROM trips t
 	JOIN adjusted_services a ON t.service_id = a.service_id
 	JOIN stop_times st ON t.trip_id = st.trip_id
 	JOIN stops s ON st.stop_id = s.stop_id
 	JOIN routes r ON t.route_id = r.route_id
-	`, dayColumn)
+	`
 
-	// Add the departure time filter if specified
-	if departureTimeFilter != "" {
-		query += " WHERE st.departure_time > ?"
+	// The times are compared as seconds, as not every feed pads the hours ("8:00:00")
+	timeColumn := "st.departure_sec"
+	if options.Arrivals {
+		timeColumn = "st.arrival_sec"
 	}
 
-	// If a stop_id is provided, add a filter for stop_id
-	if stopID != "" {
-		if departureTimeFilter != "" {
-			query += " AND st.stop_id = ?"
-		} else {
-			query += " WHERE st.stop_id = ?"
+	// Add the filters which were specified
+	var filters []string
+	if options.From != "" {
+		from, err := parseGTFSTime(options.From)
+		if err != nil {
+			return nil, errors.New("invalid from time")
 		}
+		filters = append(filters, timeColumn+" > ?")
+		args = append(args, from)
 	}
-
-	query += " ORDER BY st.departure_time ASC"
-
-	// Add limit to the query if specified
-	if limit > 0 {
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	if options.To != "" {
+		to, err := parseGTFSTime(options.To)
+		if err != nil {
+			return nil, errors.New("invalid to time")
+		}
+		filters = append(filters, timeColumn+" < ?")
+		args = append(args, to)
 	}
+	stopIDs, err := v.stopIDsFor(options)
+	if err != nil {
+		return nil, err
+	}
+	if len(stopIDs) > 0 {
+		filters = append(filters, "st.stop_id IN (?"+strings.Repeat(", ?", len(stopIDs)-1)+")")
+		for _, stopID := range stopIDs {
+			args = append(args, stopID)
+		}
+	}
+	if options.RouteID != "" {
+		filters = append(filters, "t.route_id = ?")
+		args = append(args, options.RouteID)
+	}
+	if options.DirectionID != nil {
+		filters = append(filters, "t.direction_id = ?")
+		args = append(args, *options.DirectionID)
+	}
+	if len(filters) > 0 {
+		query += " WHERE " + strings.Join(filters, " AND ")
+	}
+
+	query += " ORDER BY " + timeColumn + " ASC"
 
-	// Execute the query with the variable date, departure time filter, and optionally the stop_id
-	var rows *sql.Rows
-	var err error
-	if departureTimeFilter != "" && stopID != "" {
-		rows, err = db.Query(query, dateString, dateString, dateString, dateString, departureTimeFilter, stopID)
-	} else if departureTimeFilter != "" {
-		rows, err = db.Query(query, dateString, dateString, dateString, dateString, departureTimeFilter)
-	} else if stopID != "" {
-		rows, err = db.Query(query, dateString, dateString, dateString, dateString, stopID)
-	} else {
-		rows, err = db.Query(query, dateString, dateString, dateString, dateString)
+	// Add limit to the query if specified, a station's is applied once a trip's other stops there are left out
+	if options.Limit > 0 && !options.ByStation {
+		query += fmt.Sprintf(" LIMIT %d", options.Limit)
 	}
 
+	var rows []stopTimeRow
+	err = db.Select(&rows, query, args...)
 	if err != nil {
-		fmt.Println(err)
+		v.logger().Error("failed to query active trips", "stop_id", options.StopID, "route_id", options.RouteID, "error", err)
 		return nil, errors.New("an error occurred querying for the data")
 	}
-	defer rows.Close()
 
 	// Regular expressions for platform determination
 	reStationPlatform := regexp.MustCompile(`Train Station (\d)$`)
 	reCapitalLetter := regexp.MustCompile(`[A-Z]$`)
 
-	// Iterate through the result set
+	// Updates for trips identified by route and start time are looked up by the static trip they're for
+	matcher := v.tripMatcherFor(options.Feed)
+	tripUpdates := options.TripUpdates
+	if tripUpdates != nil {
+		tripUpdates = matcher.TripUpdatesByTripID(tripUpdates)
+	}
+
 	var results []StopTimes
-	for rows.Next() {
-		var result struct {
-			TripId              string
-			ServiceId           string
-			RouteId             string
-			DirectionId         int
-			ShapeId             string
-			TripHeadsign        string
-			ArrivalTime         string
-			DepartureTime       string
-			StopId              string
-			StopSequence        int
-			StopHeadsign        string
-			RouteColor          string
-			StopName            string
-			StopLat             float64
-			StopLon             float64
-			StopCode            string
-			StopLocationType    int
-			StopParentStationId string
-			Platform            string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		stopTimeData := row.toStopTimes(reStationPlatform, reCapitalLetter)
+		stopTimeData.Instance.ServiceDate = dateString
+
+		// A trip can stop at more than one of a station's platforms (e.g loops), only its first stop there is a departure
+		if options.ByStation {
+			if seen[stopTimeData.Instance.Key()] {
+				continue
+			}
+			if options.Limit > 0 && len(results) == options.Limit {
+				break
+			}
+			seen[stopTimeData.Instance.Key()] = true
 		}
 
-		// Scan the results into StopTimes, Stop, and Trip
-		if err := rows.Scan(
-			&result.TripId,
-			&result.ServiceId,
-			&result.RouteId,
-			&result.DirectionId,
-			&result.ShapeId,
-			&result.TripHeadsign,
-			&result.ArrivalTime,
-			&result.DepartureTime,
-			&result.StopId,
-			&result.StopSequence,
-			&result.StopHeadsign,
-			&result.RouteColor,
-			&result.StopName,
-			&result.StopLat,
-			&result.StopLon,
-			&result.StopCode,
-			&result.StopLocationType,
-			&result.StopParentStationId,
-			&result.Platform,
-		); err != nil {
-			return nil, err
+		// Attach the realtime update for the trip if there is one
+		if tripUpdates != nil {
+			// A DUPLICATED update is for the copy of the trip, not this run of it
+			if update, err := tripUpdates.ByTripID(row.TripId); err == nil && (update.Trip.ScheduleRelationship != tripDuplicated || stopTimeData.Instance.Matches(update.Trip)) {
+				stopTimeData.Realtime = &update
+			}
 		}
 
-		if result.Platform == "" {
-			result.Platform = determinePlatform(result.StopName, reStationPlatform, reCapitalLetter)
+		if options.IncludeContinuations && row.IsTerminus {
+			if continuation, err := v.tripContinuation(row.TripId); err == nil {
+				stopTimeData.ContinuesAs = &continuation
+			}
 		}
 
-		var stopData = Stop{
-			LocationType:       result.StopLocationType,
-			ParentStation:      result.StopParentStationId,
-			StopCode:           result.StopCode,
-			StopId:             result.StopId,
-			StopLat:            result.StopLat,
-			StopLon:            result.StopLon,
-			StopName:           result.StopName,
-			WheelChairBoarding: 0,
-			PlatformNumber:     result.Platform,
-			StopType:           typeOfStop(result.StopName),
-			Sequence:           result.StopSequence,
-		}
-		var tripData = Trip{
-			BikesAllowed:         0,
-			DirectionID:          result.DirectionId,
-			RouteID:              result.RouteId,
-			ServiceID:            result.ServiceId,
-			ShapeID:              result.ShapeId,
-			TripHeadsign:         result.TripHeadsign,
-			TripID:               result.TripId,
-			WheelchairAccessible: 0,
-		}
+		results = append(results, stopTimeData)
+	}
+	if options.TripUpdates != nil {
+		results = v.mergeRealtimeOnlyStopTimes(results, options, stopIDs, serviceDay, matcher)
+	}
+	if options.Alerts != nil {
+		attachAlerts(results, options.Alerts, serviceDay, matcher)
+	}
+	v.setStopTimesOccupancy(results)
+	v.setStopTimesModes(results)
+
+	return results, nil
+}
+
+/*
+Build the start of a query with the "adjusted_services" CTE, which has the service_id of every service running on a date
+*/
+func activeServicesQuery(day ServiceDay) (string, []interface{}) {
+	dayColumn := strings.ToLower(day.Weekday().String())
+	dateString := day.String()
+
+	query := fmt.Sprintf(`
+	WITH active_services AS (
+		-- Select services from the calendar where today's date falls within start_date and end_date
+		SELECT service_id
+		FROM calendar
+		WHERE start_date <= ? 
+		  AND end_date >= ? 
+		  AND %s = 1 -- Ensure the service is active on the current day
+		UNION ALL
+		-- Add services from calendar_dates where exception_type = 1 (added services)
+		SELECT service_id
+		FROM calendar_dates
+		WHERE date = ? AND exception_type = 1
+	),
+	removed_services AS (
+		-- Select services from calendar_dates where exception_type = 2 (removed services)
+		SELECT service_id
+		FROM calendar_dates
+		WHERE date = ? AND exception_type = 2
+	),
+	adjusted_services AS (
+		-- Remove services from active_services that are marked as removed
+		SELECT DISTINCT service_id
+		FROM active_services
+		WHERE service_id NOT IN (SELECT service_id FROM removed_services)
+	)`, dayColumn)
+
+	return query, []interface{}{dateString, dateString, dateString, dateString}
+}
+
+type StopTimesBetween struct {
+	Trip          Trip   `json:"trip"`
+	RouteColor    string `json:"route_color"`
+	FromStopID    string `json:"from_stop_id"`
+	DepartureTime string `json:"departure_time"` // When the trip leaves the from stop
+	ToStopID      string `json:"to_stop_id"`
+	ArrivalTime   string `json:"arrival_time"` // When the trip gets to the to stop
+	Stops         int    `json:"stops"`        // How many stops the trip makes after the from stop, including the to stop
+}
+
+/*
+Get every trip on a date which goes from one stop to another, ordered by departure time
+
+Parent stops can be used to include trips stopping at any of their child stops
+
+  - date: "20060102", defaults to today
+*/
+func (v Database) GetStopTimesBetweenStops(fromStopID, toStopID string, date string) ([]StopTimesBetween, error) {
+	defer v.observeQuery("GetStopTimesBetweenStops", time.Now())
 
-		var stopTimeData StopTimes = StopTimes{
-			TripID:        result.TripId,
-			ArrivalTime:   result.ArrivalTime,
-			DepartureTime: result.DepartureTime,
-			StopId:        result.StopId,
-			StopSequence:  result.StopSequence,
-			StopHeadsign:  result.StopHeadsign,
-			Platform:      result.Platform,
-			StopData:      stopData,
-			TripData:      tripData,
+	if fromStopID == "" || toStopID == "" {
+		return nil, errors.New("missing from/to stop id")
+	}
+	fromStopID, toStopID = v.PrefixID(fromStopID), v.PrefixID(toStopID)
+
+	location := v.locationFor(fromStopID, "")
+	serviceDay := Today(location)
+	if date != "" {
+		parsed, err := ParseServiceDay(date, location)
+		if err != nil {
+			return nil, err
 		}
+		serviceDay = parsed
+	}
 
-		// Append the result
-		results = append(results, stopTimeData)
+	servicesQuery, args := activeServicesQuery(serviceDay)
+	query := servicesQuery + `
+	SELECT
+		t.trip_id,
+		t.route_id,
+		t.service_id,
+		t.trip_headsign,
+		t.direction_id,
+		t.shape_id,
+		t.wheelchair_accessible,
+		t.bikes_allowed,
+		r.route_color,
+		f.stop_id AS from_stop_id,
+		f.departure_time,
+		d.stop_id AS to_stop_id,
+		d.arrival_time,
+		d.stop_sequence - f.stop_sequence AS stops
+	FROM trips t
+	JOIN adjusted_services a ON t.service_id = a.service_id
+	JOIN routes r ON t.route_id = r.route_id
+	JOIN stop_times f ON f.trip_id = t.trip_id
+	JOIN stops fs ON fs.stop_id = f.stop_id
+	JOIN stop_times d ON d.trip_id = t.trip_id AND d.stop_sequence > f.stop_sequence
+	JOIN stops ds ON ds.stop_id = d.stop_id
+	WHERE (f.stop_id = ? OR fs.parent_station = ?)
+	  AND (d.stop_id = ? OR ds.parent_station = ?)
+	ORDER BY f.departure_sec ASC, f.stop_sequence ASC, d.stop_sequence ASC
+	`
+	args = append(args, fromStopID, fromStopID, toStopID, toStopID)
+
+	var rows []struct {
+		Trip
+		RouteColor    string `db:"route_color"`
+		FromStopID    string `db:"from_stop_id"`
+		DepartureTime string `db:"departure_time"`
+		ToStopID      string `db:"to_stop_id"`
+		ArrivalTime   string `db:"arrival_time"`
+		Stops         int    `db:"stops"`
+	}
+	if err := v.db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	// A trip could visit the stops more than once (loops), only keep its first departure and the first arrival after it
+	var results []StopTimesBetween
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		if seen[row.TripID] {
+			continue
+		}
+		seen[row.TripID] = true
+		results = append(results, StopTimesBetween{
+			Trip:          row.Trip,
+			RouteColor:    row.RouteColor,
+			FromStopID:    row.FromStopID,
+			DepartureTime: row.DepartureTime,
+			ToStopID:      row.ToStopID,
+			ArrivalTime:   row.ArrivalTime,
+			Stops:         row.Stops,
+		})
 	}
 
-	// Check for any error during iteration
-	if err := rows.Err(); err != nil {
-		fmt.Println(err)
-		return nil, errors.New("an error occurred going through the retrieved data")
+	if len(results) == 0 {
+		return nil, errors.New("no services found between stops")
 	}
+
+	v.stripIDs(&results)
 	return results, nil
 }
 
@@ -250,6 +499,16 @@ Get the service stopping at a given stop, based on its trip id
 Because it's searching by trip id only one service will be returned (if found)
 */
 func (v Database) GetServiceByTripAndStop(tripID, stopId, departureTimeFilter string) (StopTimes, error) {
+	defer v.observeQuery("GetServiceByTripAndStop", time.Now())
+	service, err := v.serviceByTripAndStop(v.PrefixID(tripID), v.PrefixID(stopId), departureTimeFilter)
+	if err != nil {
+		return StopTimes{}, err
+	}
+	v.stripIDs(&service)
+	return service, nil
+}
+
+func (v Database) serviceByTripAndStop(tripID, stopId, departureTimeFilter string) (StopTimes, error) {
 	if tripID == "" {
 		return StopTimes{}, errors.New("missing trip id")
 	}
@@ -278,7 +537,10 @@ func (v Database) GetServiceByTripAndStop(tripID, stopId, departureTimeFilter st
 			s.stop_code, 
 			s.location_type, 
 			s.parent_station,
-			s.platform_code
+			s.platform_code,
+			s.zone_id,
+			st.stop_sequence = (SELECT MIN(o.stop_sequence) FROM stop_times o WHERE o.trip_id = st.trip_id) AS is_origin,
+			st.stop_sequence = (SELECT MAX(o.stop_sequence) FROM stop_times o WHERE o.trip_id = st.trip_id) AS is_terminus
 		FROM trips t
 		JOIN stop_times st ON t.trip_id = st.trip_id
 		JOIN stops s ON st.stop_id = s.stop_id
@@ -287,120 +549,49 @@ func (v Database) GetServiceByTripAndStop(tripID, stopId, departureTimeFilter st
 		AND st.stop_id = ? -- Filter by stop_id
 	`
 
+	args := []interface{}{tripID, stopId}
 	if departureTimeFilter != "" {
-		query += " AND st.departure_time > ?"
+		departureAfter, err := parseGTFSTime(departureTimeFilter)
+		if err != nil {
+			return StopTimes{}, errors.New("invalid departure time filter")
+		}
+		query += " AND st.departure_sec > ?"
+		args = append(args, departureAfter)
 	}
 
-	query += " ORDER BY st.departure_time ASC"
+	query += " ORDER BY st.departure_sec ASC"
 
 	// Execute the query with the provided trip_id
-	rows := db.QueryRow(query, tripID, stopId, departureTimeFilter)
+	var row stopTimeRow
+	if err := db.Get(&row, query, args...); err != nil {
+		return StopTimes{}, err
+	}
 
 	// Regular expressions for platform determination
 	reStationPlatform := regexp.MustCompile(`Train Station (\d)$`)
 	reCapitalLetter := regexp.MustCompile(`[A-Z]$`)
 
-	// Struct to hold the result data
-	var result struct {
-		TripId              string
-		ServiceId           string
-		RouteId             string
-		DirectionId         int
-		ShapeId             string
-		TripHeadsign        string
-		ArrivalTime         string
-		DepartureTime       string
-		StopId              string
-		StopSequence        int
-		StopHeadsign        string
-		RouteColor          string
-		StopName            string
-		StopLat             float64
-		StopLon             float64
-		StopCode            string
-		StopLocationType    int
-		StopParentStationId string
-		Platform            string
-	}
-
-	// Scan the result into the struct
-	if err := rows.Scan(
-		&result.TripId,
-		&result.ServiceId,
-		&result.RouteId,
-		&result.DirectionId,
-		&result.ShapeId,
-		&result.TripHeadsign,
-		&result.ArrivalTime,
-		&result.DepartureTime,
-		&result.StopId,
-		&result.StopSequence,
-		&result.StopHeadsign,
-		&result.RouteColor,
-		&result.StopName,
-		&result.StopLat,
-		&result.StopLon,
-		&result.StopCode,
-		&result.StopLocationType,
-		&result.StopParentStationId,
-		&result.Platform,
-	); err != nil {
-		return StopTimes{}, err
-	}
+	results := []StopTimes{row.toStopTimes(reStationPlatform, reCapitalLetter)}
+	v.setStopTimesModes(results)
 
-	// If platform is empty, use the helper function to determine the platform
-	if result.Platform == "" {
-		result.Platform = determinePlatform(result.StopName, reStationPlatform, reCapitalLetter)
-	}
-
-	// Create Stop data
-	var stopData = Stop{
-		LocationType:       result.StopLocationType,
-		ParentStation:      result.StopParentStationId,
-		StopCode:           result.StopCode,
-		StopId:             result.StopId,
-		StopLat:            result.StopLat,
-		StopLon:            result.StopLon,
-		StopName:           result.StopName,
-		WheelChairBoarding: 0,
-		PlatformNumber:     result.Platform,
-		StopType:           typeOfStop(result.StopName),
-		Sequence:           result.StopSequence,
-	}
-
-	// Create Trip data
-	var tripData = Trip{
-		BikesAllowed:         0,
-		DirectionID:          result.DirectionId,
-		RouteID:              result.RouteId,
-		ServiceID:            result.ServiceId,
-		ShapeID:              result.ShapeId,
-		TripHeadsign:         result.TripHeadsign,
-		TripID:               result.TripId,
-		WheelchairAccessible: 0,
-	}
+	return results[0], nil
+}
 
-	// Combine the data into StopTimes struct
-	var stopTimeData StopTimes = StopTimes{
-		TripID:        result.TripId,
-		ArrivalTime:   result.ArrivalTime,
-		DepartureTime: result.DepartureTime,
-		StopId:        result.StopId,
-		StopSequence:  result.StopSequence,
-		StopHeadsign:  result.StopHeadsign,
-		Platform:      result.Platform,
-		StopData:      stopData,
-		TripData:      tripData,
+/*
+Set the modes of the stops the services are stopping at
+*/
+func (v Database) setStopTimesModes(stopTimes []StopTimes) {
+	var stopIDs []string
+	for _, stopTime := range stopTimes {
+		stopIDs = append(stopIDs, stopTime.StopId)
 	}
+	modes := v.getStopModes(stopIDs)
 
-	// Check for any error during the query execution
-	if err := rows.Err(); err != nil {
-		fmt.Println(err)
-		return StopTimes{}, errors.New("an error occurred building for the data")
+	for i := range stopTimes {
+		stopData := &stopTimes[i].StopData
+		stopData.StopModes = modes[stopData.StopId]
+		stopData.StopType = stopTypeFromModes(stopData.StopModes, stopData.StopName)
 	}
-
-	// Return the result
-	return stopTimeData, nil
 }
 
 /*
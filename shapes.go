@@ -0,0 +1,215 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+type ShapePoint struct {
+	Lat               float64 `json:"lat" db:"shape_pt_lat"`
+	Lon               float64 `json:"lon" db:"shape_pt_lon"`
+	Sequence          int     `json:"sequence" db:"shape_pt_sequence"`
+	ShapeDistTraveled float64 `json:"shape_dist_traveled" db:"shape_dist_traveled"`
+}
+
+/*
+Get the points of a shape in order
+*/
+func (v Database) GetShape(shapeID string) ([]ShapePoint, error) {
+	return v.shape(v.PrefixID(shapeID))
+}
+
+func (v Database) shape(shapeID string) ([]ShapePoint, error) {
+	var points []ShapePoint
+	err := v.db.Select(&points, `
+		SELECT shape_pt_lat, shape_pt_lon, shape_pt_sequence, COALESCE(shape_dist_traveled, 0) AS shape_dist_traveled
+		FROM shapes
+		WHERE shape_id = ?
+		ORDER BY shape_pt_sequence
+	`, shapeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, errors.New("no shape found with id")
+	}
+	return points, nil
+}
+
+/*
+Get the part of a trip's shape between two stops, e.g for drawing a leg of a journey on a map
+
+The stops can be parent stations. Trips without a shape get straight lines between their stops. The points are numbered
+from 1 and their ShapeDistTraveled is how far along the segment they are (km)
+*/
+func (v Database) GetShapeSegment(tripID, fromStopID, toStopID string) ([]ShapePoint, error) {
+	defer v.observeQuery("GetShapeSegment", time.Now())
+
+	trip, stopTimes, from, to, err := v.getTripLeg(tripID, fromStopID, toStopID)
+	if err != nil {
+		return nil, err
+	}
+	line, err := v.tripPolyline(trip)
+	if err != nil {
+		return nil, err
+	}
+	fromAlong, toAlong, _, err := v.legAlong(trip, line, stopTimes, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	lats, lons := line.between(fromAlong, toAlong)
+	points := make([]ShapePoint, len(lats))
+	for i := range lats {
+		points[i] = ShapePoint{Lat: lats[i], Lon: lons[i], Sequence: i + 1}
+		if i > 0 {
+			points[i].ShapeDistTraveled = points[i-1].ShapeDistTraveled + calculateDistance(lats[i-1], lons[i-1], lats[i], lons[i])
+		}
+	}
+	return points, nil
+}
+
+/*
+A line (e.g a trip's shape) positions can be measured along
+*/
+type polyline struct {
+	lats, lons []float64
+	distances  []float64 // The distance (km) along the line to each point
+}
+
+func newPolyline(lats, lons []float64) polyline {
+	line := polyline{lats: lats, lons: lons, distances: make([]float64, len(lats))}
+	for i := 1; i < len(lats); i++ {
+		line.distances[i] = line.distances[i-1] + calculateDistance(lats[i-1], lons[i-1], lats[i], lons[i])
+	}
+	return line
+}
+
+/*
+Get the line of a trip, its shape or else the line between its stops
+*/
+func (v Database) tripPolyline(trip Trip) (polyline, error) {
+	var lats, lons []float64
+	if trip.ShapeID != "" {
+		if points, err := v.shape(trip.ShapeID); err == nil {
+			for _, point := range points {
+				lats = append(lats, point.Lat)
+				lons = append(lons, point.Lon)
+			}
+			return newPolyline(lats, lons), nil
+		}
+	}
+
+	stops, err := v.stopsForTrip(trip.TripID)
+	if err != nil {
+		return polyline{}, err
+	}
+	for _, stop := range stops {
+		lats = append(lats, stop.StopLat)
+		lons = append(lons, stop.StopLon)
+	}
+	return newPolyline(lats, lons), nil
+}
+
+func (p polyline) length() float64 {
+	if len(p.distances) == 0 {
+		return 0
+	}
+	return p.distances[len(p.distances)-1]
+}
+
+/*
+Get how far along the line (km) the closest point to a position is, only considering the line from minAlong on
+(so positions further along a trip aren't matched to an earlier part of a looping shape)
+
+Also returns how far the position is from the line (km)
+*/
+func (p polyline) project(lat, lon float64, minAlong float64) (float64, float64) {
+	if len(p.lats) == 0 {
+		return 0, math.Inf(1)
+	}
+	if len(p.lats) == 1 {
+		return 0, calculateDistance(lat, lon, p.lats[0], p.lons[0])
+	}
+
+	// Project onto a flat plane around the position, accurate enough over the length of a segment
+	const kmPerDegree = 6371.0 * math.Pi / 180
+	xScale := math.Cos(lat*math.Pi/180) * kmPerDegree
+
+	bestAlong, bestOffset := minAlong, math.Inf(1)
+	for i := 1; i < len(p.lats); i++ {
+		if p.distances[i] < minAlong {
+			continue
+		}
+
+		ax, ay := (p.lons[i-1]-lon)*xScale, (p.lats[i-1]-lat)*kmPerDegree
+		bx, by := (p.lons[i]-lon)*xScale, (p.lats[i]-lat)*kmPerDegree
+		dx, dy := bx-ax, by-ay
+
+		t := 0.0
+		if lengthSquared := dx*dx + dy*dy; lengthSquared > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSquared))
+		}
+		along := p.distances[i-1] + t*(p.distances[i]-p.distances[i-1])
+		if along < minAlong {
+			along = minAlong
+			t = (minAlong - p.distances[i-1]) / math.Max(p.distances[i]-p.distances[i-1], 1e-9)
+		}
+		offset := math.Hypot(ax+t*dx, ay+t*dy)
+
+		if offset < bestOffset {
+			bestAlong, bestOffset = along, offset
+		}
+	}
+	return bestAlong, bestOffset
+}
+
+/*
+Get the position a distance (km) along the line, the ends of the line for distances off it
+*/
+func (p polyline) pointAt(along float64) (float64, float64) {
+	if len(p.lats) == 0 {
+		return 0, 0
+	}
+	if along <= 0 {
+		return p.lats[0], p.lons[0]
+	}
+	for i := 1; i < len(p.lats); i++ {
+		if p.distances[i] < along {
+			continue
+		}
+		t := 0.0
+		if segment := p.distances[i] - p.distances[i-1]; segment > 0 {
+			t = (along - p.distances[i-1]) / segment
+		}
+		return p.lats[i-1] + t*(p.lats[i]-p.lats[i-1]), p.lons[i-1] + t*(p.lons[i]-p.lons[i-1])
+	}
+	last := len(p.lats) - 1
+	return p.lats[last], p.lons[last]
+}
+
+/*
+Get the points of the line between two distances along it (km), starting and ending exactly at the distances
+*/
+func (p polyline) between(from, to float64) ([]float64, []float64) {
+	if len(p.lats) == 0 {
+		return nil, nil
+	}
+	if to < from {
+		from, to = to, from
+	}
+
+	lat, lon := p.pointAt(from)
+	lats, lons := []float64{lat}, []float64{lon}
+	for i := range p.lats {
+		if p.distances[i] > from && p.distances[i] < to {
+			lats = append(lats, p.lats[i])
+			lons = append(lons, p.lons[i])
+		}
+	}
+	lat, lon = p.pointAt(to)
+	lats = append(lats, lat)
+	lons = append(lons, lon)
+	return lats, lons
+}
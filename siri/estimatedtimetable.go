@@ -0,0 +1,106 @@
+package siri
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+type EstimatedTimetableDelivery struct {
+	Version                      string                       `xml:"version,attr" json:"version"`
+	ResponseTimestamp            time.Time                    `xml:"ResponseTimestamp" json:"ResponseTimestamp"`
+	EstimatedJourneyVersionFrame EstimatedJourneyVersionFrame `xml:"EstimatedJourneyVersionFrame" json:"EstimatedJourneyVersionFrame"`
+}
+
+type EstimatedJourneyVersionFrame struct {
+	RecordedAtTime          time.Time                 `xml:"RecordedAtTime" json:"RecordedAtTime"`
+	EstimatedVehicleJourney []EstimatedVehicleJourney `xml:"EstimatedVehicleJourney" json:"EstimatedVehicleJourney"`
+}
+
+type EstimatedVehicleJourney struct {
+	LineRef                 string                  `xml:"LineRef" json:"LineRef"`
+	DirectionRef            string                  `xml:"DirectionRef" json:"DirectionRef"`
+	FramedVehicleJourneyRef FramedVehicleJourneyRef `xml:"FramedVehicleJourneyRef" json:"FramedVehicleJourneyRef"`
+	Cancellation            bool                    `xml:"Cancellation,omitempty" json:"Cancellation,omitempty"`
+	VehicleRef              string                  `xml:"VehicleRef,omitempty" json:"VehicleRef,omitempty"`
+	RecordedAtTime          time.Time               `xml:"RecordedAtTime" json:"RecordedAtTime"`
+	EstimatedCalls          EstimatedCalls          `xml:"EstimatedCalls" json:"EstimatedCalls"`
+}
+
+type EstimatedCalls struct {
+	EstimatedCall []EstimatedCall `xml:"EstimatedCall" json:"EstimatedCall"`
+}
+
+type EstimatedCall struct {
+	StopPointRef          string     `xml:"StopPointRef" json:"StopPointRef"`
+	Order                 int64      `xml:"Order" json:"Order"`
+	Cancellation          bool       `xml:"Cancellation,omitempty" json:"Cancellation,omitempty"`
+	ExpectedArrivalTime   *time.Time `xml:"ExpectedArrivalTime,omitempty" json:"ExpectedArrivalTime,omitempty"`
+	ExpectedDepartureTime *time.Time `xml:"ExpectedDepartureTime,omitempty" json:"ExpectedDepartureTime,omitempty"`
+}
+
+// Gtfs-realtime schedule relationships
+const (
+	tripCanceled = 3
+	stopSkipped  = 1
+)
+
+/*
+Build a SIRI EstimatedTimetable document from the realtime trip updates, ordered by trip id
+
+  - producer: the ProducerRef identifying who made the document
+*/
+func EstimatedTimetable(producer string, updates realtime.TripUpdatesMap, now time.Time) Siri {
+	document := newSiri(producer, now)
+
+	tripIDs := make([]string, 0, len(updates))
+	for tripID := range updates {
+		tripIDs = append(tripIDs, tripID)
+	}
+	sort.Strings(tripIDs)
+
+	var journeys []EstimatedVehicleJourney
+	for _, tripID := range tripIDs {
+		update := updates[tripID]
+		stopUpdate := update.StopTimeUpdate
+
+		call := EstimatedCall{
+			StopPointRef: stopUpdate.StopID,
+			Order:        stopUpdate.StopSequence,
+			Cancellation: stopUpdate.ScheduleRelationship == stopSkipped,
+		}
+		if stopUpdate.Arrival.Time > 0 {
+			expected := time.Unix(stopUpdate.Arrival.Time, 0)
+			call.ExpectedArrivalTime = &expected
+		}
+		if stopUpdate.Departure.Time > 0 {
+			expected := time.Unix(stopUpdate.Departure.Time, 0)
+			call.ExpectedDepartureTime = &expected
+		}
+
+		journeys = append(journeys, EstimatedVehicleJourney{
+			LineRef:      string(update.Trip.RouteID),
+			DirectionRef: strconv.FormatInt(update.Trip.DirectionID, 10),
+			FramedVehicleJourneyRef: FramedVehicleJourneyRef{
+				DataFrameRef:           dataFrameRef(update.Trip.StartDate),
+				DatedVehicleJourneyRef: update.Trip.TripID,
+			},
+			Cancellation:   update.Trip.ScheduleRelationship == tripCanceled,
+			VehicleRef:     update.Vehicle.ID,
+			RecordedAtTime: time.Unix(update.Timestamp, 0),
+			EstimatedCalls: EstimatedCalls{EstimatedCall: []EstimatedCall{call}},
+		})
+	}
+
+	document.ServiceDelivery.EstimatedTimetableDelivery = &EstimatedTimetableDelivery{
+		Version:           version,
+		ResponseTimestamp: now,
+		EstimatedJourneyVersionFrame: EstimatedJourneyVersionFrame{
+			RecordedAtTime:          now,
+			EstimatedVehicleJourney: journeys,
+		},
+	}
+	return document
+}
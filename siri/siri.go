@@ -0,0 +1,110 @@
+/*
+Serializers turning the departures and trip updates into SIRI (Service Interface for Real Time Information) documents,
+for displays and data platforms which only accept SIRI
+
+	board, _ := db.GetActiveTripsWithOptions(gtfs.ActiveTripsOptions{StopID: stopID, TripUpdates: updates})
+	document := siri.StopMonitoring("my-agency", stopID, board, location, time.Now())
+	body, _ := document.XML()
+
+Only the commonly used elements of SIRI 2.0 StopMonitoring (SIRI-SM) and EstimatedTimetable (SIRI-ET) are included
+*/
+package siri
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	namespace = "http://www.siri.org.uk/siri"
+	version   = "2.0"
+)
+
+type Siri struct {
+	XMLName         xml.Name        `xml:"Siri" json:"-"`
+	Xmlns           string          `xml:"xmlns,attr" json:"-"`
+	Version         string          `xml:"version,attr" json:"version"`
+	ServiceDelivery ServiceDelivery `xml:"ServiceDelivery" json:"ServiceDelivery"`
+}
+
+type ServiceDelivery struct {
+	ResponseTimestamp          time.Time                   `xml:"ResponseTimestamp" json:"ResponseTimestamp"`
+	ProducerRef                string                      `xml:"ProducerRef" json:"ProducerRef"`
+	StopMonitoringDelivery     *StopMonitoringDelivery     `xml:"StopMonitoringDelivery,omitempty" json:"StopMonitoringDelivery,omitempty"`
+	EstimatedTimetableDelivery *EstimatedTimetableDelivery `xml:"EstimatedTimetableDelivery,omitempty" json:"EstimatedTimetableDelivery,omitempty"`
+}
+
+type FramedVehicleJourneyRef struct {
+	DataFrameRef           string `xml:"DataFrameRef" json:"DataFrameRef"`                     // The service date "2006-01-02"
+	DatedVehicleJourneyRef string `xml:"DatedVehicleJourneyRef" json:"DatedVehicleJourneyRef"` // The trip id
+}
+
+/*
+Encode the document as SIRI XML
+*/
+func (s Siri) XML() ([]byte, error) {
+	body, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+/*
+Encode the document as SIRI JSON ({"Siri": {...}})
+*/
+func (s Siri) JSON() ([]byte, error) {
+	return json.Marshal(map[string]Siri{"Siri": s})
+}
+
+func newSiri(producer string, now time.Time) Siri {
+	return Siri{
+		Xmlns:   namespace,
+		Version: version,
+		ServiceDelivery: ServiceDelivery{
+			ResponseTimestamp: now,
+			ProducerRef:       producer,
+		},
+	}
+}
+
+/*
+Get the time of a gtfs time ("15:04:05", can be over 24:00:00) on a service date ("20060102")
+
+Gtfs times are from noon minus 12h, so they're right on days when the clocks change
+*/
+func serviceTime(serviceDate, clock string, location *time.Location) (time.Time, bool) {
+	date, err := time.ParseInLocation("20060102", serviceDate, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	parts := strings.Split(clock, ":")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	var seconds int
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = seconds*60 + n
+	}
+
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, location)
+	return noon.Add(-12 * time.Hour).Add(time.Duration(seconds) * time.Second), true
+}
+
+/*
+Format a service date ("20060102") as a SIRI date ("2006-01-02")
+*/
+func dataFrameRef(serviceDate string) string {
+	if date, err := time.Parse("20060102", serviceDate); err == nil {
+		return date.Format("2006-01-02")
+	}
+	return serviceDate
+}
@@ -0,0 +1,118 @@
+package siri
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jfmow/gtfs"
+)
+
+type StopMonitoringDelivery struct {
+	Version            string               `xml:"version,attr" json:"version"`
+	ResponseTimestamp  time.Time            `xml:"ResponseTimestamp" json:"ResponseTimestamp"`
+	MonitoredStopVisit []MonitoredStopVisit `xml:"MonitoredStopVisit" json:"MonitoredStopVisit"`
+}
+
+type MonitoredStopVisit struct {
+	RecordedAtTime          time.Time               `xml:"RecordedAtTime" json:"RecordedAtTime"`
+	MonitoringRef           string                  `xml:"MonitoringRef" json:"MonitoringRef"`
+	MonitoredVehicleJourney MonitoredVehicleJourney `xml:"MonitoredVehicleJourney" json:"MonitoredVehicleJourney"`
+}
+
+type MonitoredVehicleJourney struct {
+	LineRef                 string                  `xml:"LineRef" json:"LineRef"`
+	DirectionRef            string                  `xml:"DirectionRef" json:"DirectionRef"`
+	FramedVehicleJourneyRef FramedVehicleJourneyRef `xml:"FramedVehicleJourneyRef" json:"FramedVehicleJourneyRef"`
+	DestinationName         string                  `xml:"DestinationName,omitempty" json:"DestinationName,omitempty"`
+	Monitored               bool                    `xml:"Monitored" json:"Monitored"` // There's a realtime update for the trip
+	VehicleRef              string                  `xml:"VehicleRef,omitempty" json:"VehicleRef,omitempty"`
+	MonitoredCall           MonitoredCall           `xml:"MonitoredCall" json:"MonitoredCall"`
+}
+
+type MonitoredCall struct {
+	StopPointRef          string     `xml:"StopPointRef" json:"StopPointRef"`
+	Order                 int        `xml:"Order" json:"Order"`
+	StopPointName         string     `xml:"StopPointName,omitempty" json:"StopPointName,omitempty"`
+	AimedArrivalTime      *time.Time `xml:"AimedArrivalTime,omitempty" json:"AimedArrivalTime,omitempty"`
+	ExpectedArrivalTime   *time.Time `xml:"ExpectedArrivalTime,omitempty" json:"ExpectedArrivalTime,omitempty"`
+	AimedDepartureTime    *time.Time `xml:"AimedDepartureTime,omitempty" json:"AimedDepartureTime,omitempty"`
+	ExpectedDepartureTime *time.Time `xml:"ExpectedDepartureTime,omitempty" json:"ExpectedDepartureTime,omitempty"`
+	ArrivalPlatformName   string     `xml:"ArrivalPlatformName,omitempty" json:"ArrivalPlatformName,omitempty"`
+}
+
+/*
+Build a SIRI StopMonitoring document from the departures at a stop (e.g from GetActiveTripsWithOptions with TripUpdates set)
+
+  - producer: the ProducerRef identifying who made the document
+  - stopID: the MonitoringRef, the stop the departures are from
+  - location: the timezone the feed's times are in
+*/
+func StopMonitoring(producer string, stopID string, departures []gtfs.StopTimes, location *time.Location, now time.Time) Siri {
+	document := newSiri(producer, now)
+	delivery := &StopMonitoringDelivery{
+		Version:            version,
+		ResponseTimestamp:  now,
+		MonitoredStopVisit: []MonitoredStopVisit{},
+	}
+
+	for _, departure := range departures {
+		serviceDate := departure.Instance.ServiceDate
+		if serviceDate == "" {
+			serviceDate = now.In(location).Format("20060102")
+		}
+
+		call := MonitoredCall{
+			StopPointRef:        departure.StopId,
+			Order:               departure.StopSequence,
+			StopPointName:       departure.StopData.StopName,
+			ArrivalPlatformName: departure.Platform,
+		}
+		if aimed, ok := serviceTime(serviceDate, departure.ArrivalTime, location); ok && !departure.IsOrigin {
+			call.AimedArrivalTime = &aimed
+		}
+		if aimed, ok := serviceTime(serviceDate, departure.DepartureTime, location); ok && !departure.IsTerminus {
+			call.AimedDepartureTime = &aimed
+		}
+
+		journey := MonitoredVehicleJourney{
+			LineRef:      departure.TripData.RouteID,
+			DirectionRef: strconv.Itoa(departure.TripData.DirectionID),
+			FramedVehicleJourneyRef: FramedVehicleJourneyRef{
+				DataFrameRef:           dataFrameRef(serviceDate),
+				DatedVehicleJourneyRef: departure.TripID,
+			},
+			DestinationName: departure.TripData.TripHeadsign,
+		}
+
+		// The realtime delay is carried on to the stop (the update may be for an earlier stop)
+		if update := departure.Realtime; update != nil {
+			journey.Monitored = true
+			journey.VehicleRef = update.Vehicle.ID
+
+			delay := time.Duration(update.Delay) * time.Second
+			if update.StopTimeUpdate.Departure.Delay != 0 {
+				delay = time.Duration(update.StopTimeUpdate.Departure.Delay) * time.Second
+			} else if update.StopTimeUpdate.Arrival.Delay != 0 {
+				delay = time.Duration(update.StopTimeUpdate.Arrival.Delay) * time.Second
+			}
+			if call.AimedArrivalTime != nil {
+				expected := call.AimedArrivalTime.Add(delay)
+				call.ExpectedArrivalTime = &expected
+			}
+			if call.AimedDepartureTime != nil {
+				expected := call.AimedDepartureTime.Add(delay)
+				call.ExpectedDepartureTime = &expected
+			}
+		}
+		journey.MonitoredCall = call
+
+		delivery.MonitoredStopVisit = append(delivery.MonitoredStopVisit, MonitoredStopVisit{
+			RecordedAtTime:          now,
+			MonitoringRef:           stopID,
+			MonitoredVehicleJourney: journey,
+		})
+	}
+
+	document.ServiceDelivery.StopMonitoringDelivery = delivery
+	return document
+}
@@ -0,0 +1,60 @@
+package gtfs
+
+import (
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+Prepared statements for hot queries by their sql, so they aren't prepared again on every call
+*/
+type statementCache struct {
+	mutex      sync.Mutex
+	statements map[string]*sqlx.Stmt
+}
+
+/*
+Get a prepared statement for a query, preparing it the first time it's used
+
+Falls back to the error of preparing it, so callers can run the query unprepared if they want
+*/
+func (v Database) prepared(query string) (*sqlx.Stmt, error) {
+	if v.state == nil {
+		return v.db.Preparex(query)
+	}
+
+	cache := &v.state.statements
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if statement, found := cache.statements[query]; found {
+		return statement, nil
+	}
+
+	statement, err := v.db.Preparex(query)
+	if err != nil {
+		return nil, err
+	}
+	if cache.statements == nil {
+		cache.statements = make(map[string]*sqlx.Stmt)
+	}
+	cache.statements[query] = statement
+	return statement, nil
+}
+
+/*
+Close the prepared statements, so the tables they use can be replaced (e.g by a refresh or restore)
+*/
+func (v Database) resetStatements() {
+	if v.state == nil {
+		return
+	}
+
+	cache := &v.state.statements
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, statement := range cache.statements {
+		statement.Close()
+	}
+	cache.statements = nil
+}
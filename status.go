@@ -0,0 +1,97 @@
+package gtfs
+
+import (
+	"fmt"
+	"time"
+)
+
+type Status struct {
+	Name             string         `json:"name"`         // The database name the feed was created with
+	FeedVersion      string         `json:"feed_version"` // From feed_info
+	FeedStartDate    string         `json:"feed_start_date"`
+	FeedEndDate      string         `json:"feed_end_date"`
+	UpToDate         bool           `json:"up_to_date"`  // The feed end date hasn't passed
+	LastImport       time.Time      `json:"last_import"` // The last successful refresh by this process, zero if there hasn't been one
+	LastRefreshError string         `json:"last_refresh_error"`
+	RowCounts        map[string]int `json:"row_counts"`    // The amount of rows in each core gtfs table
+	DatabaseSize     int64          `json:"database_size"` // Bytes
+}
+
+/*
+Get the status of the database and its feed data, e.g for a health check endpoint
+*/
+func (v Database) Status() (Status, error) {
+	status := Status{
+		RowCounts: make(map[string]int),
+	}
+
+	if v.state != nil {
+		v.state.mutex.Lock()
+		status.Name = v.state.name
+		status.LastImport = v.state.lastImport
+		status.LastRefreshError = v.state.lastRefreshError
+		v.state.mutex.Unlock()
+	}
+
+	var feedInfo struct {
+		FeedVersion   string `db:"feed_version"`
+		FeedStartDate string `db:"feed_start_date"`
+		FeedEndDate   string `db:"feed_end_date"`
+	}
+	err := v.db.Get(&feedInfo, `
+		SELECT
+			COALESCE(feed_version, '') AS feed_version,
+			COALESCE(feed_start_date, '') AS feed_start_date,
+			COALESCE(feed_end_date, '') AS feed_end_date
+		FROM feed_info
+		LIMIT 1
+	`)
+	if err == nil {
+		status.FeedVersion = feedInfo.FeedVersion
+		status.FeedStartDate = feedInfo.FeedStartDate
+		status.FeedEndDate = feedInfo.FeedEndDate
+	}
+	status.UpToDate, _ = v.IsFeedDataUpToDate()
+
+	for _, table := range defaultTableNames {
+		var count int
+		if err := v.db.Get(&count, fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)); err != nil {
+			return status, err
+		}
+		status.RowCounts[table] = count
+	}
+
+	var pageCount, pageSize int64
+	if err := v.db.Get(&pageCount, `PRAGMA page_count`); err != nil {
+		return status, err
+	}
+	if err := v.db.Get(&pageSize, `PRAGMA page_size`); err != nil {
+		return status, err
+	}
+	status.DatabaseSize = pageCount * pageSize
+
+	return status, nil
+}
+
+/*
+Record the result of a refresh for Status, and tell the RefreshFailureNotifier subscribers when it failed
+*/
+func (v Database) setRefreshResult(err error) {
+	if v.state == nil {
+		return
+	}
+	v.state.mutex.Lock()
+	defer v.state.mutex.Unlock()
+	if err != nil {
+		v.state.lastRefreshError = err.Error()
+		for notify := range v.state.failureSubscribers {
+			select {
+			case notify <- err:
+			default:
+			}
+		}
+		return
+	}
+	v.state.lastImport = time.Now()
+	v.state.lastRefreshError = ""
+}
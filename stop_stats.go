@@ -0,0 +1,157 @@
+package gtfs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+How important a stop is on a date, e.g for ranking stops in search results
+*/
+type StopStats struct {
+	StopID        string   `json:"stop_id" db:"stop_id"`
+	Date          string   `json:"date" db:"-"`                          // "20060102"
+	Routes        int      `json:"routes" db:"routes"`                   // Distinct routes serving the stop that day
+	Trips         int      `json:"trips" db:"trips"`                     // Scheduled trips stopping there that day
+	Modes         []string `json:"modes" db:"-"`                         // The modes of transport serving the stop, see Stop.StopModes
+	PeakHour      int      `json:"peak_hour" db:"peak_hour"`             // The hour of the day (0-23) with the most trips
+	PeakHourTrips int      `json:"peak_hour_trips" db:"peak_hour_trips"` // How many trips stop there in the peak hour
+}
+
+/*
+Build the query for stop stats from a query starting with the CTE of the services to count (ending with a "services" CTE)
+
+Parent stations get the stats of all their platforms together, frequency based trips are counted once
+*/
+func stopStatsQuery(servicesQuery string, stopFilter string) string {
+	return servicesQuery + fmt.Sprintf(`,
+	stop_keys AS (
+		SELECT stop_id AS key, stop_id FROM stops
+		UNION ALL
+		SELECT parent_station AS key, stop_id FROM stops WHERE COALESCE(parent_station, '') != ''
+	),
+	visits AS (
+		SELECT DISTINCT k.key, t.trip_id, t.route_id, (COALESCE(st.departure_sec, st.arrival_sec, 0) / 3600) %% 24 AS hour
+		FROM stop_keys k
+		JOIN stop_times st ON st.stop_id = k.stop_id
+		JOIN trips t ON t.trip_id = st.trip_id
+		JOIN services s ON s.service_id = t.service_id
+		%s
+	),
+	hours AS (
+		SELECT key, hour, COUNT(DISTINCT trip_id) AS trips FROM visits GROUP BY key, hour
+	),
+	peaks AS (
+		SELECT key, hour, trips, ROW_NUMBER() OVER (PARTITION BY key ORDER BY trips DESC, hour) AS n FROM hours
+	)
+	SELECT v.key AS stop_id, COUNT(DISTINCT v.route_id) AS routes, COUNT(DISTINCT v.trip_id) AS trips,
+		p.hour AS peak_hour, p.trips AS peak_hour_trips
+	FROM visits v
+	JOIN peaks p ON p.key = v.key AND p.n = 1
+	GROUP BY v.key
+	`, stopFilter)
+}
+
+var weekdayColumns = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+/*
+Store each stop's stats for each day of the week from the calendar, used by GetStopStats for dates without exceptions
+*/
+func (v Database) buildStopStats() error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM stop_stats`); err != nil {
+		return fmt.Errorf("failed to clear stop stats: %w", err)
+	}
+	for weekday, column := range weekdayColumns {
+		servicesQuery := fmt.Sprintf(`WITH services AS (SELECT service_id FROM calendar WHERE %s = 1)`, column)
+		query := `
+			INSERT INTO stop_stats (stop_id, routes, trips, peak_hour, peak_hour_trips, weekday)
+			SELECT *, ? FROM (` + stopStatsQuery(servicesQuery, "") + `)`
+		if _, err := tx.Exec(query, weekday); err != nil {
+			return fmt.Errorf("failed to build stop stats: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+Get the number of routes and trips serving a stop (or station, including its platforms) on a date ("20060102", "" for
+today), the modes serving it and its busiest hour
+
+Dates without calendar exceptions use the stats stored at import, others are counted from the timetable
+*/
+func (v Database) GetStopStats(stopID string, date string) (StopStats, error) {
+	defer v.observeQuery("GetStopStats", time.Now())
+	stopID = v.PrefixID(stopID)
+
+	stop, err := v.stopByID(stopID)
+	if err != nil {
+		return StopStats{}, errors.New("stop not found")
+	}
+
+	location := v.locationFor(stopID, "")
+	day := Today(location)
+	if date != "" {
+		day, err = ParseServiceDay(date, location)
+		if err != nil {
+			return StopStats{}, err
+		}
+	}
+
+	stats := StopStats{StopID: stopID, Date: day.String(), Modes: stop.StopModes}
+	if stats.Modes == nil {
+		stats.Modes = []string{}
+	}
+
+	// The stored stats are only right when the services running are just the calendar's for the day of the week
+	var exceptional bool
+	column := weekdayColumns[day.Weekday()]
+	err = v.db.Get(&exceptional, fmt.Sprintf(`
+		SELECT EXISTS (SELECT 1 FROM calendar_dates WHERE date = ?)
+			OR EXISTS (SELECT 1 FROM calendar WHERE %s = 1 AND (start_date > ? OR end_date < ?))
+	`, column), day.String(), day.String(), day.String())
+	if err != nil {
+		return StopStats{}, err
+	}
+
+	if !exceptional {
+		err = v.db.Get(&stats, `
+			SELECT stop_id, routes, trips, peak_hour, peak_hour_trips FROM stop_stats WHERE stop_id = ? AND weekday = ?
+		`, stopID, int(day.Weekday()))
+		if err == nil {
+			stats.Date = day.String()
+			v.stripIDs(&stats)
+			return stats, nil
+		}
+		// Stops without services that day don't have stats stored, and databases imported before stop stats were added
+		// don't have any, so they're counted
+		if !errors.Is(err, sql.ErrNoRows) {
+			v.logger().Warn("failed to get stored stop stats", "stop_id", stopID, "error", err)
+		}
+	}
+
+	servicesQuery, args := activeServicesQuery(day)
+	servicesQuery = strings.TrimRight(servicesQuery, " \n\t") + `,
+	services AS (SELECT service_id FROM adjusted_services)`
+	err = v.db.Get(&stats, stopStatsQuery(servicesQuery, "WHERE k.key = ?"), append(args, stopID)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Nothing stops there that day
+		v.stripIDs(&stats)
+		return stats, nil
+	}
+	if err != nil {
+		return StopStats{}, err
+	}
+	stats.Date = day.String()
+	v.stripIDs(&stats)
+	return stats, nil
+}
@@ -6,84 +6,101 @@ import (
 	"math"
 	"sort"
 	"strings"
+	"time"
 )
 
 type Stop struct {
-	LocationType       int     `json:"location_type"`
-	ParentStation      string  `json:"parent_station"`
-	StopCode           string  `json:"stop_code"`
-	StopId             string  `json:"stop_id"`
-	StopLat            float64 `json:"stop_lat"`
-	StopLon            float64 `json:"stop_lon"`
-	StopName           string  `json:"stop_name"`
-	WheelChairBoarding int     `json:"wheelchair_boarding"`
-	PlatformNumber     string  `json:"platform_number"`
-	StopType           string  `json:"stop_type"`
-	Sequence           int     `json:"stop_sequence"`
+	LocationType       int      `json:"location_type" db:"location_type"`
+	ParentStation      string   `json:"parent_station" db:"parent_station"`
+	StopCode           string   `json:"stop_code" db:"stop_code"`
+	StopId             string   `json:"stop_id" db:"stop_id"`
+	StopLat            float64  `json:"stop_lat" db:"stop_lat"`
+	StopLon            float64  `json:"stop_lon" db:"stop_lon"`
+	StopName           string   `json:"stop_name" db:"stop_name"`
+	WheelChairBoarding int      `json:"wheelchair_boarding" db:"wheelchair_boarding"`
+	PlatformNumber     string   `json:"platform_number" db:"platform_code"`
+	StopType           string   `json:"stop_type" db:"-"`  // The preferred mode of the stop, see StopModes
+	StopModes          []string `json:"stop_modes" db:"-"` // The modes of transport serving the stop e.g ["train", "bus"]
+	Sequence           int      `json:"stop_sequence" db:"stop_sequence"`
+	ZoneID             string   `json:"zone_id" db:"zone_id"` // The fare zone the stop is in
 }
 
 type StopSearch struct {
-	Name       string `json:"name"`
-	TypeOfStop string `json:"type_of_stop"`
+	Name         string `json:"name"` // The stop's name and code, for display
+	TypeOfStop   string `json:"type_of_stop"`
+	Stop         Stop   `json:"stop"`
+	MatchedField string `json:"matched_field"` // "name" or "code", which of the stop's fields matched the search
 }
 
 /*
 Get all the stored stops
+
+  - page: optionally only get a page of the stops
 */
-func (v Database) GetStops(includeChildStops bool) ([]Stop, error) {
+func (v Database) GetStops(includeChildStops bool, page ...Page) ([]Stop, error) {
+	stops, err := v.queryStops(includeChildStops, false, page)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&stops)
+	return stops, nil
+}
+
+/*
+Get the stops which are wheelchair accessible (child stops inherit their parent station's accessibility if they don't set it)
+
+  - page: optionally only get a page of the stops
+*/
+func (v Database) GetAccessibleStops(includeChildStops bool, page ...Page) ([]Stop, error) {
+	stops, err := v.queryStops(includeChildStops, true, page)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&stops)
+	return stops, nil
+}
+
+func (v Database) queryStops(includeChildStops bool, accessibleOnly bool, page []Page) ([]Stop, error) {
+	defer v.observeQuery("GetStops", time.Now())
+
 	db := v.db
 	query := `
 		SELECT
-			stop_id,
-			stop_code,
-			stop_name,
-			stop_lat,
-			stop_lon,
-			location_type,
-			parent_station,
-			platform_code,
-			wheelchair_boarding
+			s.stop_id,
+			s.stop_code,
+			s.stop_name,
+			s.stop_lat,
+			s.stop_lon,
+			s.location_type,
+			s.parent_station,
+			s.platform_code,
+			s.zone_id,
+			s.wheelchair_boarding
 		FROM
-			stops
+			stops s
 	`
+	var filters []string
 	if !includeChildStops {
 		// Add filtering to exclude child stops
-		query += ` WHERE (location_type == 1 OR parent_station = '')`
+		filters = append(filters, `(s.location_type == 1 OR s.parent_station = '')`)
 	}
-
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
+	if accessibleOnly {
+		filters = append(filters, `(s.wheelchair_boarding = 1 OR (COALESCE(s.wheelchair_boarding, 0) = 0 AND s.parent_station != '' AND
+			(SELECT p.wheelchair_boarding FROM stops p WHERE p.stop_id = s.parent_station) = 1))`)
 	}
-	defer rows.Close() // Ensure the rows are closed after usage
-
-	var stops Stops
-
-	// Iterate over the rows
-	for rows.Next() {
-		var stop Stop
-		err := rows.Scan(
-			&stop.StopId,
-			&stop.StopCode,
-			&stop.StopName,
-			&stop.StopLat,
-			&stop.StopLon,
-			&stop.LocationType,
-			&stop.ParentStation,
-			&stop.PlatformNumber,
-			&stop.WheelChairBoarding,
-		)
-		if err != nil {
-			return nil, err
-		}
-		stop.StopType = typeOfStop(stop.StopName)
-		stops = append(stops, stop)
+	if len(filters) > 0 {
+		query += ` WHERE ` + strings.Join(filters, " AND ")
+	}
+	if len(page) > 0 {
+		query += ` ORDER BY s.stop_id` + pageClause(page)
 	}
 
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
+	var stops Stops
+	err := db.Select(&stops, query)
+	if err != nil {
 		return nil, err
 	}
+	v.setStopModes(stops)
 
 	if len(stops) == 0 {
 		return nil, errors.New("no stops found")
@@ -96,6 +113,15 @@ func (v Database) GetStops(includeChildStops bool) ([]Stop, error) {
 Get the child stops of a parent stop
 */
 func (v Database) GetChildStopsByParentStopID(stopID string) ([]Stop, error) {
+	stops, err := v.childStops(v.PrefixID(stopID))
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&stops)
+	return stops, nil
+}
+
+func (v Database) childStops(stopID string) ([]Stop, error) {
 	db := v.db
 
 	// Query to fetch parent stop and its children
@@ -109,6 +135,7 @@ func (v Database) GetChildStopsByParentStopID(stopID string) ([]Stop, error) {
 			location_type,
 			parent_station,
 			platform_code,
+			zone_id,
 			wheelchair_boarding
 		FROM
 			stops
@@ -116,37 +143,12 @@ func (v Database) GetChildStopsByParentStopID(stopID string) ([]Stop, error) {
 			(stop_id = ? AND parent_station = '' AND location_type == 0) OR parent_station = ?
 	`
 
-	rows, err := db.Query(query, stopID, stopID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close() // Ensure the rows are closed after usage
-
 	var stops Stops
-
-	for rows.Next() {
-		var stop Stop
-		err := rows.Scan(
-			&stop.StopId,
-			&stop.StopCode,
-			&stop.StopName,
-			&stop.StopLat,
-			&stop.StopLon,
-			&stop.LocationType,
-			&stop.ParentStation,
-			&stop.PlatformNumber,
-			&stop.WheelChairBoarding,
-		)
-		if err != nil {
-			return nil, err
-		}
-		stop.StopType = typeOfStop(stop.StopName)
-		stops = append(stops, stop)
-	}
-
-	if err = rows.Err(); err != nil {
+	err := db.Select(&stops, query, stopID, stopID)
+	if err != nil {
 		return nil, err
 	}
+	v.setStopModes(stops)
 
 	if len(stops) == 0 {
 		return nil, errors.New("no child stops found")
@@ -157,8 +159,19 @@ func (v Database) GetChildStopsByParentStopID(stopID string) ([]Stop, error) {
 
 /*
 Get the stops for a trip
+
+  - page: optionally only get a page of the stops
 */
-func (v Database) GetStopsForTripID(tripID string) ([]Stop, error) {
+func (v Database) GetStopsForTripID(tripID string, page ...Page) ([]Stop, error) {
+	stops, err := v.stopsForTrip(v.PrefixID(tripID), page...)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&stops)
+	return stops, nil
+}
+
+func (v Database) stopsForTrip(tripID string, page ...Page) ([]Stop, error) {
 	db := v.db
 
 	query := `
@@ -171,6 +184,7 @@ func (v Database) GetStopsForTripID(tripID string) ([]Stop, error) {
 			s.location_type,
 			s.parent_station,
 			s.platform_code,
+			s.zone_id,
 			s.wheelchair_boarding,
 			st.stop_sequence
 		FROM
@@ -181,46 +195,15 @@ func (v Database) GetStopsForTripID(tripID string) ([]Stop, error) {
 			st.trip_id = ?
 		ORDER BY
 			st.stop_sequence
-	`
+	` + pageClause(page)
 
 	// Execute the query
-	rows, err := db.Query(query, tripID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Slice to hold the stops
 	var stops Stops
-
-	// Iterate over the rows
-	for rows.Next() {
-		var stop Stop
-		// Scan the row data into the Stop struct
-		err := rows.Scan(
-			&stop.StopId,
-			&stop.StopCode,
-			&stop.StopName,
-			&stop.StopLat,
-			&stop.StopLon,
-			&stop.LocationType,
-			&stop.ParentStation,
-			&stop.PlatformNumber,
-			&stop.WheelChairBoarding,
-			&stop.Sequence,
-		)
-		if err != nil {
-			return nil, err
-		}
-		stop.StopType = typeOfStop(stop.StopName)
-		// Append each stop to the slice
-		stops = append(stops, stop)
-	}
-
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
+	err := db.Select(&stops, query, tripID)
+	if err != nil {
 		return nil, err
 	}
+	v.setStopModes(stops)
 
 	// If no stops were found, return a custom error
 	if len(stops) == 0 {
@@ -246,6 +229,7 @@ func (v Database) GetStopByNameOrCode(nameOrCode string) (*Stop, error) {
 			location_type,
 			parent_station,
 			platform_code,
+			zone_id,
 			wheelchair_boarding
 		FROM
 			STOPS
@@ -258,22 +242,8 @@ func (v Database) GetStopByNameOrCode(nameOrCode string) (*Stop, error) {
 	`
 
 	// Execute the query
-	rows := db.QueryRow(query, nameOrCode, nameOrCode, nameOrCode)
-
-	// Slice to hold all the stops
 	var stop Stop
-	// Scan the row data into the Stop struct
-	err := rows.Scan(
-		&stop.StopId,
-		&stop.StopCode,
-		&stop.StopName,
-		&stop.StopLat,
-		&stop.StopLon,
-		&stop.LocationType,
-		&stop.ParentStation,
-		&stop.PlatformNumber,
-		&stop.WheelChairBoarding,
-	)
+	err := db.Get(&stop, query, nameOrCode, nameOrCode, nameOrCode)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.New("no stop found")
@@ -281,7 +251,8 @@ func (v Database) GetStopByNameOrCode(nameOrCode string) (*Stop, error) {
 		return nil, err
 	}
 
-	stop.StopType = typeOfStop(stop.StopName)
+	v.setStopMode(&stop)
+	v.stripIDs(&stop)
 
 	return &stop, nil
 }
@@ -290,8 +261,19 @@ func (v Database) GetStopByNameOrCode(nameOrCode string) (*Stop, error) {
 Get a stop by its id
 */
 func (v Database) GetStopByStopID(stopID string) (*Stop, error) {
-	db := v.db
+	defer v.observeQuery("GetStopByStopID", time.Now())
+	stop, err := v.stopByID(v.PrefixID(stopID))
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&stop)
+	return stop, nil
+}
 
+/*
+Get a stop by its id in the database (with the id prefix, see WithIDPrefix)
+*/
+func (v Database) stopByID(stopID string) (*Stop, error) {
 	query := `
 		SELECT
 			stop_id,
@@ -302,6 +284,7 @@ func (v Database) GetStopByStopID(stopID string) (*Stop, error) {
 			location_type,
 			parent_station,
 			platform_code,
+			zone_id,
 			wheelchair_boarding
 		FROM 
 			stops
@@ -309,26 +292,17 @@ func (v Database) GetStopByStopID(stopID string) (*Stop, error) {
 			stop_id = ?
 	`
 
-	// Execute the query
-	rows := db.QueryRow(query, stopID)
+	statement, err := v.prepared(query)
+	if err != nil {
+		return nil, err
+	}
 
 	var stop Stop
-	// Scan the row data into the Stop struct
-	err := rows.Scan(
-		&stop.StopId,
-		&stop.StopCode,
-		&stop.StopName,
-		&stop.StopLat,
-		&stop.StopLon,
-		&stop.LocationType,
-		&stop.ParentStation,
-		&stop.PlatformNumber,
-		&stop.WheelChairBoarding,
-	)
+	err = statement.Get(&stop, stopID)
 	if err != nil {
 		return nil, err
 	}
-	stop.StopType = typeOfStop(stop.StopName)
+	v.setStopMode(&stop)
 
 	return &stop, nil
 }
@@ -337,6 +311,7 @@ func (v Database) GetStopByStopID(stopID string) (*Stop, error) {
 Get the parent stop to a child stop (if the child is its own parent you just get back the child)
 */
 func (v Database) GetParentStopByChildStopID(childStopID string) (*Stop, error) {
+	childStopID = v.PrefixID(childStopID)
 	db := v.db
 
 	// Query to fetch either the parent stop or the stop itself if it has no parent
@@ -350,6 +325,7 @@ func (v Database) GetParentStopByChildStopID(childStopID string) (*Stop, error)
 			location_type,
 			parent_station,
 			platform_code,
+			zone_id,
 			wheelchair_boarding
 		FROM
 			stops
@@ -368,20 +344,8 @@ func (v Database) GetParentStopByChildStopID(childStopID string) (*Stop, error)
 	`
 
 	// Execute the query with the child stop ID
-	row := db.QueryRow(query, childStopID)
-
 	var stop Stop
-	err := row.Scan(
-		&stop.StopId,
-		&stop.StopCode,
-		&stop.StopName,
-		&stop.StopLat,
-		&stop.StopLon,
-		&stop.LocationType,
-		&stop.ParentStation,
-		&stop.PlatformNumber,
-		&stop.WheelChairBoarding,
-	)
+	err := db.Get(&stop, query, childStopID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.New("no parent stop or self stop found for the given stop ID")
@@ -389,76 +353,154 @@ func (v Database) GetParentStopByChildStopID(childStopID string) (*Stop, error)
 		return nil, err
 	}
 
-	// Determine the stop type (optional, based on your existing logic)
-	stop.StopType = typeOfStop(stop.StopName)
+	// Determine the stop type
+	v.setStopMode(&stop)
+	v.stripIDs(&stop)
 
 	return &stop, nil
 }
 
 /*
 Get the stops for a given route
+
+  - page: optionally only get a page of the stops
 */
-func (v Database) GetStopsByRouteId(routeId string) ([]Stop, error) {
+func (v Database) GetStopsByRouteId(routeId string, page ...Page) ([]Stop, error) {
+	routeId = v.PrefixID(routeId)
 	query := `
-	SELECT DISTINCT s.stop_id, s.stop_code, s.stop_name, s.stop_lat, s.stop_lon, s.location_type, s.parent_station, s.platform_code, s.wheelchair_boarding, st.stop_sequence
+	SELECT DISTINCT s.stop_id, s.stop_code, s.stop_name, s.stop_lat, s.stop_lon, s.location_type, s.parent_station, s.platform_code, s.zone_id, s.wheelchair_boarding, st.stop_sequence
 	FROM routes r
 	JOIN trips t ON r.route_id = t.route_id
 	JOIN stop_times st ON t.trip_id = st.trip_id
 	JOIN stops s ON st.stop_id = s.stop_id
 	WHERE r.route_id = ?
-	ORDER BY s.stop_id;
-	`
-	rows, err := v.db.Query(query, routeId)
+	ORDER BY s.stop_id
+	` + pageClause(page)
+	var stops Stops
+	err := v.db.Select(&stops, query, routeId)
 	if err != nil {
 		return nil, errors.New("no stops found for route")
 	}
+	v.setStopModes(stops)
 
-	defer rows.Close()
+	// If no stops were found, return a custom error
+	if len(stops) == 0 {
+		return nil, errors.New("no stops found for the given trip ID")
+	}
 
-	// Slice to hold the stops
-	var stops Stops
+	v.stripIDs(&stops)
+	return stops, nil
+}
+
+/*
+Get the stops for a route going in a direction, in the order they are travelled
+
+Uses the stops of the route's longest trip in that direction, as it's the most likely to include every stop
+*/
+func (v Database) GetOrderedStopsForRouteDirection(routeID string, directionID int) ([]Stop, error) {
+	stops, err := v.orderedStopsForRouteDirection(v.PrefixID(routeID), directionID)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&stops)
+	return stops, nil
+}
 
-	// Iterate over the rows
-	for rows.Next() {
-		var stop Stop
-		// Scan the row data into the Stop struct
-		err := rows.Scan(
-			&stop.StopId,
-			&stop.StopCode,
-			&stop.StopName,
-			&stop.StopLat,
-			&stop.StopLon,
-			&stop.LocationType,
-			&stop.ParentStation,
-			&stop.PlatformNumber,
-			&stop.WheelChairBoarding,
-			&stop.Sequence,
-		)
-		if err != nil {
-			return nil, err
+func (v Database) orderedStopsForRouteDirection(routeID string, directionID int) ([]Stop, error) {
+	query := `
+		SELECT t.trip_id
+		FROM trips t
+		JOIN stop_times st ON t.trip_id = st.trip_id
+		WHERE t.route_id = ? AND t.direction_id = ?
+		GROUP BY t.trip_id
+		ORDER BY COUNT(st.stop_id) DESC, t.trip_id
+		LIMIT 1
+	`
+	var tripID string
+	err := v.db.Get(&tripID, query, routeID, directionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("no trips found for route and direction")
 		}
-		stop.StopType = typeOfStop(stop.StopName)
-		// Append each stop to the slice
-		stops = append(stops, stop)
+		return nil, err
 	}
 
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
+	return v.stopsForTrip(tripID)
+}
+
+/*
+Get the stops in a fare zone
+
+  - page: optionally only get a page of the stops
+*/
+func (v Database) GetStopsByZone(zoneID string, page ...Page) ([]Stop, error) {
+	zoneID = v.PrefixID(zoneID)
+	query := `
+		SELECT
+			stop_id,
+			stop_code,
+			stop_name,
+			stop_lat,
+			stop_lon,
+			location_type,
+			parent_station,
+			platform_code,
+			zone_id,
+			wheelchair_boarding
+		FROM
+			stops
+		WHERE
+			zone_id = ?
+		ORDER BY stop_id
+	` + pageClause(page)
+
+	var stops Stops
+	err := v.db.Select(&stops, query, zoneID)
+	if err != nil {
 		return nil, err
 	}
+	v.setStopModes(stops)
 
-	// If no stops were found, return a custom error
 	if len(stops) == 0 {
-		return nil, errors.New("no stops found for the given trip ID")
+		return nil, errors.New("no stops found for zone")
 	}
 
+	v.stripIDs(&stops)
 	return stops, nil
 }
 
 /*
-Search the db of stops for a partial name match of a stop
+Get the fare zones a route's stops are in
 */
-func (v Database) SearchForStopsByName(searchText string, includeChildStops bool) ([]StopSearch, error) {
+func (v Database) GetZonesForRoute(routeID string) ([]string, error) {
+	routeID = v.PrefixID(routeID)
+	query := `
+		SELECT DISTINCT s.zone_id
+		FROM trips t
+		JOIN stop_times st ON t.trip_id = st.trip_id
+		JOIN stops s ON st.stop_id = s.stop_id
+		WHERE t.route_id = ? AND s.zone_id != ''
+		ORDER BY s.zone_id
+	`
+	var zones []string
+	err := v.db.Select(&zones, query, routeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(zones) == 0 {
+		return nil, errors.New("no zones found for route")
+	}
+
+	return v.stripIDPrefixes(zones), nil
+}
+
+/*
+Search the db of stops for a partial name match of a stop, or an exact match of its code
+
+  - page: optionally only get a page of the results
+*/
+func (v Database) SearchForStopsByName(searchText string, includeChildStops bool, page ...Page) ([]StopSearch, error) {
 	// Normalize the input search text and make it lowercase
 	normalizedSearchText := strings.ToLower(searchText)
 
@@ -467,51 +509,61 @@ func (v Database) SearchForStopsByName(searchText string, includeChildStops bool
 			stop_id,
 			stop_code,
 			stop_name,
+			stop_lat,
+			stop_lon,
+			location_type,
 			parent_station,
-			location_type
+			platform_code,
+			zone_id,
+			wheelchair_boarding
 		FROM
 			stops
 		WHERE
-			LOWER(stop_name) LIKE ?
+			(LOWER(stop_name) LIKE ? OR LOWER(stop_code) = ?)
 	`
+	if !includeChildStops {
+		// Filter the child stops in the query so pages aren't short
+		query += ` AND NOT (location_type = 0 AND parent_station != '')`
+	}
+	if len(page) > 0 {
+		query += ` ORDER BY stop_name, stop_id` + pageClause(page)
+	}
 
 	// Run the query
-	rows, err := v.db.Query(query, "%"+normalizedSearchText+"%")
+	var stops []Stop
+	err := v.db.Select(&stops, query, "%"+normalizedSearchText+"%", normalizedSearchText)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var stopSearchResults []StopSearch
+	v.setStopModes(stops)
 
-	// Iterate over the rows
-	for rows.Next() {
-		var stop Stop
-		err := rows.Scan(&stop.StopId, &stop.StopCode, &stop.StopName, &stop.ParentStation, &stop.LocationType)
-		if err != nil {
-			return nil, err
-		}
-		if stop.LocationType == 0 && stop.ParentStation != "" && !includeChildStops {
-			continue
+	var stopSearchResults []StopSearch
+	for _, stop := range stops {
+		matchedField := "name"
+		if !strings.Contains(strings.ToLower(stop.StopName), normalizedSearchText) {
+			matchedField = "code"
 		}
-		stop.StopType = typeOfStop(stop.StopName) // Set the stop type
-		stopSearchResults = append(stopSearchResults, StopSearch{Name: stop.StopName + " " + stop.StopCode, TypeOfStop: stop.StopType})
-	}
-
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
-		return nil, err
+		stopSearchResults = append(stopSearchResults, StopSearch{
+			Name:         stop.StopName + " " + stop.StopCode,
+			TypeOfStop:   stop.StopType,
+			Stop:         stop,
+			MatchedField: matchedField,
+		})
 	}
 
 	if len(stopSearchResults) == 0 {
 		return nil, errors.New("no stops found for search")
 	}
 
+	v.stripIDs(&stopSearchResults)
 	return stopSearchResults, nil
 }
 
 /*
 Try to figure out the type of stop based on name
+
+Only used when no routes serve the stop, see stopTypeFromModes
 */
 func typeOfStop(stopName string) string {
 	isFerryTerminal := strings.Contains(stopName, "Ferry Terminal")
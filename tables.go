@@ -0,0 +1,156 @@
+package gtfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Get the names of the tables imported from the feed which aren't part of the default gtfs schema (e.g vehicle_categories)
+*/
+func (v Database) GetExtensionTables() ([]string, error) {
+	var tables []string
+	err := v.db.Select(&tables, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	var extensionTables []string
+	for _, table := range tables {
+		if contains(defaultTableNames, table) || contains(nonFeedTableNames, table) || contains(derivedTableNames, table) || contains(rtreeShadowTableNames, table) {
+			continue
+		}
+		extensionTables = append(extensionTables, table)
+	}
+
+	return extensionTables, nil
+}
+
+/*
+Get the rows of any feed table (including extension tables like vehicle_categories), other tables (e.g notifications)
+can't be read
+
+  - tableName: the name of the table (the file name without .txt)
+  - filters: only rows where each column equals the value, can be nil
+  - page: optionally only get a page of the rows
+*/
+func (v Database) QueryTable(tableName string, filters map[string]string, page ...Page) ([]map[string]string, error) {
+	query, args, err := v.buildTableQuery(tableName, filters, page)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := v.db.Queryx(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []map[string]string
+	for rows.Next() {
+		row := make(map[string]interface{})
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+
+		result := make(map[string]string, len(row))
+		for column, value := range row {
+			switch value := value.(type) {
+			case nil:
+				result[column] = ""
+			case []byte:
+				result[column] = string(value)
+			default:
+				result[column] = fmt.Sprint(value)
+			}
+		}
+		results = append(results, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	v.stripIDs(&results)
+	return results, nil
+}
+
+/*
+Get the rows of any feed table scanned into a struct with `db` tags matching the column names
+
+e.g
+
+	type VehicleCategory struct {
+		ID   string `db:"category_id"`
+		Name string `db:"name"`
+	}
+	categories, err := gtfs.QueryTableInto[VehicleCategory](db, "vehicle_categories", nil)
+*/
+func QueryTableInto[T any](v Database, tableName string, filters map[string]string, page ...Page) ([]T, error) {
+	query, args, err := v.buildTableQuery(tableName, filters, page)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []T
+	if err := v.db.Unsafe().Select(&results, query, args...); err != nil {
+		return nil, err
+	}
+	v.stripIDs(&results)
+	return results, nil
+}
+
+func (v Database) buildTableQuery(tableName string, filters map[string]string, page []Page) (string, []interface{}, error) {
+	// Only feed tables can be read, not the clients' notifications and saved items
+	if !contains(defaultTableNames, tableName) {
+		extensionTables, err := v.GetExtensionTables()
+		if err != nil {
+			return "", nil, err
+		}
+		if !contains(extensionTables, tableName) {
+			return "", nil, errors.New("no feed table found with name")
+		}
+	}
+
+	// Also validates the table name, so it's safe to use in the query
+	columns, err := v.getTableColumns(tableName)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(columns) == 0 {
+		return "", nil, errors.New("no table found with name")
+	}
+
+	query := fmt.Sprintf(`SELECT * FROM %s`, tableName)
+
+	// Sort the filters so the query is the same each time
+	var filterColumns []string
+	for column := range filters {
+		if !contains(columns, column) {
+			return "", nil, fmt.Errorf("no column %s in table %s", column, tableName)
+		}
+		filterColumns = append(filterColumns, column)
+	}
+	sort.Strings(filterColumns)
+
+	var where []string
+	var args []interface{}
+	for _, column := range filterColumns {
+		where = append(where, column+" = ?")
+		if isIDField(column) {
+			args = append(args, v.PrefixID(filters[column]))
+		} else {
+			args = append(args, filters[column])
+		}
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if len(page) > 0 {
+		query += " ORDER BY rowid" + pageClause(page)
+	}
+
+	return query, args, nil
+}
@@ -0,0 +1,166 @@
+package gtfs
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+type TimetableDeparture struct {
+	Time        string `json:"time"`   // The clock time "15:04"
+	Minute      int    `json:"minute"` // The minute past the hour, for printing under the hour
+	TripID      string `json:"trip_id"`
+	Headsign    string `json:"headsign"` // Only set when it's not the route direction's usual headsign
+	Platform    string `json:"platform"`
+	ServiceDate string `json:"service_date"` // The previous day for services running after midnight
+}
+
+type TimetableHour struct {
+	Hour       int                  `json:"hour"` // The clock hour, 0-23
+	Departures []TimetableDeparture `json:"departures"`
+}
+
+type TimetableRoute struct {
+	Route       Route           `json:"route"`
+	DirectionID int             `json:"direction_id"`
+	Headsign    string          `json:"headsign"` // The most common headsign of the departures
+	Hours       []TimetableHour `json:"hours"`    // Only the hours with departures, in order
+}
+
+type StopTimetable struct {
+	Stop   Stop             `json:"stop"`
+	Date   string           `json:"date"` // "20060102"
+	Routes []TimetableRoute `json:"routes"`
+}
+
+/*
+Get every departure from a stop (or station, including its platforms) on a date, grouped by route and direction and then
+by hour, e.g for printable timetables
+
+The date is the calendar date, so services from the previous day's timetable which run after midnight (e.g 25:10:00)
+are included in the early hours, and the day's own services after midnight are left for the next date
+*/
+func (v Database) GetStopTimetable(stopID string, date string) (StopTimetable, error) {
+	defer v.observeQuery("GetStopTimetable", time.Now())
+	stopID = v.PrefixID(stopID)
+
+	stop, err := v.stopByID(stopID)
+	if err != nil {
+		return StopTimetable{}, errors.New("stop not found")
+	}
+
+	location := v.locationFor(stopID, "")
+	day := Today(location)
+	if date != "" {
+		day, err = ParseServiceDay(date, location)
+		if err != nil {
+			return StopTimetable{}, err
+		}
+	}
+	previousDay := day.AddDays(-1)
+
+	// The day's services before midnight, and the previous day's after it
+	departures, err := v.activeTrips(ActiveTripsOptions{StopID: stopID, ByStation: true, Date: day.String(), To: formatGTFSTime(day.Seconds(day.AddDays(1).Start()))})
+	if err != nil {
+		return StopTimetable{}, err
+	}
+	overnight, err := v.activeTrips(ActiveTripsOptions{StopID: stopID, ByStation: true, Date: previousDay.String(), From: formatGTFSTime(previousDay.Seconds(day.Start()) - 1)})
+	if err != nil {
+		return StopTimetable{}, err
+	}
+
+	type routeKey struct {
+		routeID     string
+		directionID int
+	}
+	type timedDeparture struct {
+		at        time.Time
+		departure TimetableDeparture
+		headsign  string
+	}
+	grouped := make(map[routeKey][]timedDeparture)
+	var keys []routeKey
+	add := func(stopTimes []StopTimes, serviceDay ServiceDay) {
+		for _, stopTime := range stopTimes {
+			// Passengers can't board at the end of the trip
+			if stopTime.IsTerminus {
+				continue
+			}
+			at, err := serviceDay.ParseTime(stopTime.DepartureTime)
+			if err != nil {
+				continue
+			}
+			at = at.In(location)
+
+			headsign := stopTime.StopHeadsign
+			if headsign == "" {
+				headsign = stopTime.TripData.TripHeadsign
+			}
+			key := routeKey{stopTime.TripData.RouteID, stopTime.TripData.DirectionID}
+			if _, found := grouped[key]; !found {
+				keys = append(keys, key)
+			}
+			grouped[key] = append(grouped[key], timedDeparture{
+				at: at,
+				departure: TimetableDeparture{
+					Time:        at.Format("15:04"),
+					Minute:      at.Minute(),
+					TripID:      stopTime.TripID,
+					Platform:    stopTime.Platform,
+					ServiceDate: serviceDay.String(),
+				},
+				headsign: headsign,
+			})
+		}
+	}
+	add(overnight, previousDay)
+	add(departures, day)
+
+	timetable := StopTimetable{Stop: *stop, Date: day.String(), Routes: []TimetableRoute{}}
+	for _, key := range keys {
+		route, err := v.routeByID(key.routeID)
+		if err != nil {
+			route = Route{RouteId: key.routeID}
+		}
+		timedDepartures := grouped[key]
+		sort.SliceStable(timedDepartures, func(i, j int) bool {
+			return timedDepartures[i].at.Before(timedDepartures[j].at)
+		})
+
+		// The usual headsign is left out of the departures, so only the odd ones stand out
+		headsignCounts := make(map[string]int)
+		headsign := ""
+		for _, timed := range timedDepartures {
+			headsignCounts[timed.headsign]++
+			if headsignCounts[timed.headsign] > headsignCounts[headsign] {
+				headsign = timed.headsign
+			}
+		}
+
+		timetableRoute := TimetableRoute{Route: route, DirectionID: key.directionID, Headsign: headsign, Hours: []TimetableHour{}}
+		for _, timed := range timedDepartures {
+			departure := timed.departure
+			if timed.headsign != headsign {
+				departure.Headsign = timed.headsign
+			}
+			hour := timed.at.Hour()
+			if last := len(timetableRoute.Hours) - 1; last < 0 || timetableRoute.Hours[last].Hour != hour {
+				timetableRoute.Hours = append(timetableRoute.Hours, TimetableHour{Hour: hour})
+			}
+			last := len(timetableRoute.Hours) - 1
+			timetableRoute.Hours[last].Departures = append(timetableRoute.Hours[last].Departures, departure)
+		}
+		timetable.Routes = append(timetable.Routes, timetableRoute)
+	}
+
+	sort.SliceStable(timetable.Routes, func(i, j int) bool {
+		a, b := timetable.Routes[i], timetable.Routes[j]
+		if a.Route.RouteShortName != b.Route.RouteShortName {
+			return a.Route.RouteShortName < b.Route.RouteShortName
+		}
+		return a.DirectionID < b.DirectionID
+	})
+
+	v.stripIDs(&timetable)
+	return timetable, nil
+}
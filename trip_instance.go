@@ -0,0 +1,136 @@
+package gtfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+A single run of a trip, trips can run on many days (and many times a day for frequency based trips)
+so a trip id alone doesn't identify which run is meant. Matches the gtfs-realtime TripDescriptor.
+*/
+type TripInstance struct {
+	TripID      string `json:"trip_id"`
+	ServiceDate string `json:"service_date"` // "20060102"
+	StartTime   string `json:"start_time"`   // "15:04:05" when the run leaves its first stop
+}
+
+/*
+A key unique to the trip instance, e.g for use in maps
+*/
+func (i TripInstance) Key() string {
+	return strings.Join([]string{i.TripID, i.ServiceDate, i.StartTime}, "|")
+}
+
+/*
+Check if a realtime trip descriptor refers to this trip instance
+
+The descriptors start date/time are only compared when the feed sets them
+*/
+func (i TripInstance) Matches(trip realtime.Trip) bool {
+	if trip.TripID != i.TripID {
+		return false
+	}
+	if trip.StartDate != "" && i.ServiceDate != "" && trip.StartDate != i.ServiceDate {
+		return false
+	}
+	if trip.StartTime != "" && i.StartTime != "" {
+		a, errA := parseGTFSTime(trip.StartTime)
+		b, errB := parseGTFSTime(i.StartTime)
+		if errA == nil && errB == nil && a != b {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Get the instances of a trip running on a date ("20060102")
+
+Normal trips have one instance, frequency based trips have one for each headway in their frequencies
+*/
+func (v Database) GetTripInstances(tripID string, date string) ([]TripInstance, error) {
+	instances, err := v.tripInstances(v.PrefixID(tripID), date)
+	if err != nil {
+		return nil, err
+	}
+	v.stripIDs(&instances)
+	return instances, nil
+}
+
+func (v Database) tripInstances(tripID string, date string) ([]TripInstance, error) {
+	trip, err := v.tripByID(tripID)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := v.isServiceActive(trip.ServiceID, date)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, errors.New("trip doesn't run on date")
+	}
+
+	var frequencies []struct {
+		StartTime   string `db:"start_time"`
+		EndTime     string `db:"end_time"`
+		HeadwaySecs int    `db:"headway_secs"`
+	}
+	err = v.db.Select(&frequencies, `SELECT start_time, end_time, headway_secs FROM frequencies WHERE trip_id = ? ORDER BY start_sec`, tripID)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []TripInstance
+	for _, frequency := range frequencies {
+		start, err := parseGTFSTime(frequency.StartTime)
+		if err != nil {
+			continue
+		}
+		end, err := parseGTFSTime(frequency.EndTime)
+		if err != nil || frequency.HeadwaySecs <= 0 {
+			continue
+		}
+		for t := start; t < end; t += frequency.HeadwaySecs {
+			instances = append(instances, TripInstance{TripID: tripID, ServiceDate: date, StartTime: formatGTFSTime(t)})
+		}
+	}
+
+	if len(instances) == 0 {
+		var startTime string
+		err := v.db.Get(&startTime, `SELECT departure_time FROM stop_times WHERE trip_id = ? ORDER BY stop_sequence LIMIT 1`, tripID)
+		if err != nil {
+			return nil, errors.New("no stop times found for trip")
+		}
+		instances = append(instances, TripInstance{TripID: tripID, ServiceDate: date, StartTime: startTime})
+	}
+
+	return instances, nil
+}
+
+/*
+Check if a service (service_id) runs on a date ("20060102"), using calendar and calendar_dates
+*/
+func (v Database) isServiceActive(serviceID string, date string) (bool, error) {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return false, errors.New("invalid date")
+	}
+
+	var exceptionType int
+	err = v.db.Get(&exceptionType, `SELECT exception_type FROM calendar_dates WHERE service_id = ? AND date = ? LIMIT 1`, serviceID, date)
+	if err == nil {
+		return exceptionType == 1, nil
+	}
+
+	var count int
+	query := `SELECT COUNT(*) FROM calendar WHERE service_id = ? AND start_date <= ? AND end_date >= ? AND ` + strings.ToLower(day.Weekday().String()) + ` = 1`
+	if err := v.db.Get(&count, query, serviceID, date, date); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
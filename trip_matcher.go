@@ -0,0 +1,224 @@
+package gtfs
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+Resolves realtime trip descriptors to the static trip runs they're for
+
+Feeds identify a trip by its trip_id, or by its route_id, direction_id, start_time and start_date (e.g frequency based
+trips, or feeds whose trip ids don't match the static feed's). Resolutions are cached for the matcher's life, so it isn't
+safe to use from more than one goroutine
+*/
+type TripMatcher struct {
+	db     Database
+	prefix string // Added to the realtime feed's ids, see WithIDPrefix and MergedFeedTripMatcher
+	cache  map[string]tripMatch
+}
+
+type tripMatch struct {
+	trip     Trip
+	instance TripInstance
+	err      error
+}
+
+/*
+Create a matcher for resolving realtime trips to this database's trips, e.g for a departure board's trip updates
+*/
+func (v Database) TripMatcher() TripMatcher {
+	return TripMatcher{db: v, prefix: v.IDPrefix(), cache: make(map[string]tripMatch)}
+}
+
+/*
+Create a matcher for resolving the realtime trips of one of the feeds merged into this database (see MergeFeeds), as
+each feed's realtime data uses its own unprefixed ids
+
+  - feed: the feed's number, 1 for the first feed given to MergeFeeds
+*/
+func (v Database) MergedFeedTripMatcher(feed int) TripMatcher {
+	return TripMatcher{db: v, prefix: v.IDPrefix() + MergedFeedPrefix(feed), cache: make(map[string]tripMatch)}
+}
+
+/*
+Get the matcher for a merged feed's realtime data, or the database's own when feed is 0
+*/
+func (v Database) tripMatcherFor(feed int) TripMatcher {
+	if feed > 0 {
+		return v.MergedFeedTripMatcher(feed)
+	}
+	return v.TripMatcher()
+}
+
+/*
+Add the matcher's prefix to one of the realtime feed's ids
+*/
+func (m TripMatcher) prefixID(id string) string {
+	if m.prefix == "" || id == "" {
+		return id
+	}
+	return m.prefix + id
+}
+
+/*
+Remove the matcher's prefix from one of the database's ids, to find it in the realtime feed (e.g alerts' entities)
+*/
+func (m TripMatcher) feedID(id string) string {
+	return strings.TrimPrefix(id, m.prefix)
+}
+
+/*
+Get the static trip and the run of it a realtime trip descriptor is for
+
+Descriptors with a trip id in the static feed are matched by it, others by their route, start time and start date
+(today in the route's timezone when it's not set), preferring trips in the descriptor's direction
+*/
+func (m TripMatcher) Match(trip realtime.Trip) (Trip, TripInstance, error) {
+	staticTrip, instance, err := m.resolve(trip)
+	m.db.stripIDs(&staticTrip)
+	m.db.stripIDs(&instance)
+	return staticTrip, instance, err
+}
+
+/*
+The same as Match, but with the ids as they are stored (see WithIDPrefix)
+*/
+func (m TripMatcher) resolve(trip realtime.Trip) (Trip, TripInstance, error) {
+	key := strings.Join([]string{trip.TripID, string(trip.RouteID), strconv.FormatInt(trip.DirectionID, 10), trip.StartTime, trip.StartDate}, "|")
+	if match, found := m.cache[key]; found {
+		return match.trip, match.instance, match.err
+	}
+
+	var match tripMatch
+	match.trip, match.instance, match.err = m.match(trip)
+	m.cache[key] = match
+	return match.trip, match.instance, match.err
+}
+
+func (m TripMatcher) match(trip realtime.Trip) (Trip, TripInstance, error) {
+	// Realtime feeds use the feed's own ids
+	trip.TripID = m.prefixID(trip.TripID)
+	trip.RouteID = realtime.RouteID(m.prefixID(string(trip.RouteID)))
+
+	// The start date is in the timezone of the trip's agency, realtime feeds can leave out the route
+	routeID := string(trip.RouteID)
+	if routeID == "" && trip.TripID != "" {
+		if staticTrip, err := m.db.tripByID(trip.TripID); err == nil {
+			routeID = staticTrip.RouteID
+		}
+	}
+	location := m.db.locationFor("", routeID)
+	day := Today(location)
+	if trip.StartDate != "" {
+		parsed, err := ParseServiceDay(trip.StartDate, location)
+		if err != nil {
+			return Trip{}, TripInstance{}, err
+		}
+		day = parsed
+	}
+
+	if trip.TripID != "" {
+		if staticTrip, err := m.db.tripByID(trip.TripID); err == nil {
+			return staticTrip, m.instanceOf(staticTrip, day, trip.StartTime), nil
+		}
+	}
+
+	if trip.RouteID == "" || trip.StartTime == "" {
+		return Trip{}, TripInstance{}, errors.New("no static trip found for the realtime trip")
+	}
+	startTime, err := parseGTFSTime(trip.StartTime)
+	if err != nil {
+		return Trip{}, TripInstance{}, errors.New("invalid start time")
+	}
+
+	// Trips leaving their first stop at the start time, or frequency based trips with a run starting then
+	servicesQuery, args := activeServicesQuery(day)
+	var candidates []Trip
+	err = m.db.db.Select(&candidates, servicesQuery+`
+		SELECT t.trip_id, t.route_id, t.service_id, COALESCE(t.trip_headsign, '') AS trip_headsign, COALESCE(t.direction_id, 0) AS direction_id,
+			COALESCE(t.shape_id, '') AS shape_id, COALESCE(t.wheelchair_accessible, 0) AS wheelchair_accessible, COALESCE(t.bikes_allowed, 0) AS bikes_allowed
+		FROM trips t
+		JOIN adjusted_services a ON t.service_id = a.service_id
+		WHERE t.route_id = ? AND (
+			(
+				NOT EXISTS (SELECT 1 FROM frequencies f WHERE f.trip_id = t.trip_id)
+				AND (SELECT MIN(st.departure_sec) FROM stop_times st WHERE st.trip_id = t.trip_id) = ?
+			) OR EXISTS (
+				SELECT 1 FROM frequencies f
+				WHERE f.trip_id = t.trip_id AND ? >= f.start_sec AND ? < f.end_sec
+					AND (COALESCE(f.exact_times, 0) = 0 OR (? - f.start_sec) % f.headway_secs = 0)
+			)
+		)
+		ORDER BY t.trip_id
+	`, append(args, string(trip.RouteID), startTime, startTime, startTime, startTime)...)
+	if err != nil {
+		return Trip{}, TripInstance{}, err
+	}
+
+	var inDirection []Trip
+	for _, candidate := range candidates {
+		if int64(candidate.DirectionID) == trip.DirectionID {
+			inDirection = append(inDirection, candidate)
+		}
+	}
+	// Feeds which leave the direction out match either direction
+	if len(inDirection) == 0 {
+		inDirection = candidates
+	}
+	switch len(inDirection) {
+	case 0:
+		return Trip{}, TripInstance{}, errors.New("no static trip found for the realtime trip")
+	case 1:
+		instance := TripInstance{TripID: inDirection[0].TripID, ServiceDate: day.String(), StartTime: formatGTFSTime(startTime)}
+		return inDirection[0], instance, nil
+	default:
+		return Trip{}, TripInstance{}, errors.New("more than one static trip matches the realtime trip")
+	}
+}
+
+/*
+Get the run of a static trip a descriptor is for, frequency based trips need the descriptor's start time to tell their
+runs apart
+*/
+func (m TripMatcher) instanceOf(trip Trip, day ServiceDay, startTime string) TripInstance {
+	if startTime != "" {
+		return TripInstance{TripID: trip.TripID, ServiceDate: day.String(), StartTime: startTime}
+	}
+	if instances, err := m.db.tripInstances(trip.TripID, day.String()); err == nil && len(instances) == 1 {
+		return instances[0]
+	}
+	return TripInstance{TripID: trip.TripID, ServiceDate: day.String()}
+}
+
+/*
+Get the trip updates by the static trip id they're for, resolving the ones which identify their trip by route and start
+time instead of trip id (and adding the matcher's prefix, see WithIDPrefix and MergedFeedTripMatcher)
+*/
+func (m TripMatcher) TripUpdatesByTripID(updates realtime.TripUpdatesMap) realtime.TripUpdatesMap {
+	unresolved := m.prefix != ""
+	for _, update := range updates {
+		if update.Trip.TripID == "" {
+			unresolved = true
+			break
+		}
+	}
+	if !unresolved {
+		return updates
+	}
+
+	resolved := make(realtime.TripUpdatesMap, len(updates))
+	for key, update := range updates {
+		if update.Trip.TripID != "" {
+			resolved[m.prefixID(key)] = update
+			continue
+		}
+		if trip, _, err := m.resolve(update.Trip); err == nil {
+			resolved[trip.TripID] = update
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,231 @@
+package gtfs
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/jfmow/gtfs/realtime"
+)
+
+/*
+The realtime data to reconcile a trip's schedule with, any can be nil
+*/
+type TripRealtime struct {
+	TripUpdates realtime.TripUpdatesMap
+	Vehicles    realtime.VehiclesMap
+	Alerts      realtime.AlertMap
+}
+
+type TripProgressStop struct {
+	Stop               Stop       `json:"stop"`
+	StopSequence       int        `json:"stop_sequence"`
+	ArrivalTime        string     `json:"arrival_time"`   // Scheduled, "15:04:05"
+	DepartureTime      string     `json:"departure_time"` // Scheduled, "15:04:05"
+	PredictedArrival   *time.Time `json:"predicted_arrival,omitempty"`
+	PredictedDeparture *time.Time `json:"predicted_departure,omitempty"`
+	Distance           float64    `json:"distance"` // How far along the trip the stop is (km)
+}
+
+type TripProgress struct {
+	TripID      string `json:"trip_id"`
+	ServiceDate string `json:"service_date"` // "20060102"
+
+	PassedStops   []TripProgressStop `json:"passed_stops"`
+	CurrentStop   *TripProgressStop  `json:"current_stop,omitempty"` // The stop the vehicle is at, if it's at one
+	NextStop      *TripProgressStop  `json:"next_stop,omitempty"`    // Unset once the trip has finished
+	UpcomingStops []TripProgressStop `json:"upcoming_stops"`         // The stops after the next stop
+
+	Delay             int64             `json:"delay"`    // Seconds, negative when early
+	Distance          float64           `json:"distance"` // How far along the trip the vehicle is (km)
+	DistanceRemaining float64           `json:"distance_remaining"`
+	Progress          float64           `json:"progress"` // 0-100 (%)
+	Vehicle           *realtime.Vehicle `json:"vehicle,omitempty"`
+	Realtime          bool              `json:"realtime"` // If the progress is from realtime data, else it's from the schedule
+}
+
+/*
+How close (km) a vehicle has to be to a stop to be at it
+*/
+const atStopDistance = 0.05
+
+/*
+Get where a trip is along its stops (where is my bus), from the vehicle's position if there is one, else the trip update's
+stop, else the schedule (with the trip update's delay)
+
+The predicted times are the scheduled times plus the delay, or the trip update's time for the stop it's for
+*/
+func (v Database) GetTripProgress(tripID string, rt TripRealtime) (TripProgress, error) {
+	defer v.observeQuery("GetTripProgress", time.Now())
+
+	trip, err := v.tripByID(v.PrefixID(tripID))
+	if err != nil {
+		return TripProgress{}, errors.New("trip not found")
+	}
+
+	var stopTimes []struct {
+		StopID        string `db:"stop_id"`
+		StopSequence  int    `db:"stop_sequence"`
+		ArrivalTime   string `db:"arrival_time"`
+		DepartureTime string `db:"departure_time"`
+	}
+	err = v.db.Select(&stopTimes, `
+		SELECT stop_id, stop_sequence, COALESCE(arrival_time, '') AS arrival_time, COALESCE(departure_time, '') AS departure_time
+		FROM stop_times
+		WHERE trip_id = ?
+		ORDER BY stop_sequence
+	`, trip.TripID)
+	if err != nil {
+		return TripProgress{}, err
+	}
+	stops, err := v.stopsForTrip(trip.TripID)
+	if err != nil || len(stops) != len(stopTimes) {
+		return TripProgress{}, errors.New("no stops found for trip")
+	}
+
+	progress := TripProgress{TripID: trip.TripID, PassedStops: []TripProgressStop{}, UpcomingStops: []TripProgressStop{}}
+
+	var update *realtime.TripUpdate
+	if found, err := rt.TripUpdates.ByTripID(tripID); err == nil {
+		update = &found
+	}
+	if found, err := rt.Vehicles.GetVehicleByTripID(tripID); err == nil {
+		progress.Vehicle = &found
+	}
+
+	// The service date from the realtime data, else today
+	location := v.locationFor(stops[0].StopId, trip.RouteID)
+	day := Today(location)
+	for _, startDate := range []string{realtimeStartDate(update), vehicleStartDate(progress.Vehicle)} {
+		if parsed, err := ParseServiceDay(startDate, location); err == nil {
+			day = parsed
+			break
+		}
+	}
+	progress.ServiceDate = day.String()
+
+	if update != nil {
+		progress.Realtime = true
+		progress.Delay = update.Delay
+		if update.StopTimeUpdate.Departure.Delay != 0 {
+			progress.Delay = update.StopTimeUpdate.Departure.Delay
+		} else if update.StopTimeUpdate.Arrival.Delay != 0 {
+			progress.Delay = update.StopTimeUpdate.Arrival.Delay
+		}
+	}
+
+	line, err := v.tripPolyline(trip)
+	if err != nil {
+		return TripProgress{}, err
+	}
+	distances := stopDistancesAlong(line, stops)
+
+	progressStops := make([]TripProgressStop, len(stops))
+	delay := time.Duration(progress.Delay) * time.Second
+	for i, stopTime := range stopTimes {
+		progressStop := TripProgressStop{
+			Stop:          stops[i],
+			StopSequence:  stopTime.StopSequence,
+			ArrivalTime:   stopTime.ArrivalTime,
+			DepartureTime: stopTime.DepartureTime,
+			Distance:      math.Round(distances[i]*1000) / 1000,
+		}
+		if arrival, err := day.ParseTime(stopTime.ArrivalTime); err == nil {
+			predicted := arrival.Add(delay)
+			progressStop.PredictedArrival = &predicted
+		}
+		if departure, err := day.ParseTime(stopTime.DepartureTime); err == nil {
+			predicted := departure.Add(delay)
+			progressStop.PredictedDeparture = &predicted
+		}
+
+		// The feed's own prediction for the stop it's updating
+		if update != nil && int64(stopTime.StopSequence) == update.StopTimeUpdate.StopSequence {
+			if update.StopTimeUpdate.Arrival.Time > 0 {
+				predicted := time.Unix(update.StopTimeUpdate.Arrival.Time, 0).In(location)
+				progressStop.PredictedArrival = &predicted
+			}
+			if update.StopTimeUpdate.Departure.Time > 0 {
+				predicted := time.Unix(update.StopTimeUpdate.Departure.Time, 0).In(location)
+				progressStop.PredictedDeparture = &predicted
+			}
+		}
+		progressStops[i] = progressStop
+	}
+
+	// Work out which stop is next
+	next := len(progressStops)
+	current := -1
+	switch {
+	case progress.Vehicle != nil:
+		progress.Realtime = true
+		along, _ := line.project(progress.Vehicle.Position.Latitude, progress.Vehicle.Position.Longitude, 0)
+		progress.Distance = along
+		for i, distance := range distances {
+			if math.Abs(distance-along) <= atStopDistance && current == -1 {
+				current = i
+			}
+			if distance > along+atStopDistance {
+				next = i
+				break
+			}
+		}
+	case update != nil && update.StopTimeUpdate.StopSequence > 0:
+		for i, stopTime := range stopTimes {
+			if int64(stopTime.StopSequence) >= update.StopTimeUpdate.StopSequence {
+				next = i
+				break
+			}
+		}
+	default:
+		now := time.Now()
+		for i, progressStop := range progressStops {
+			if progressStop.PredictedDeparture == nil || progressStop.PredictedDeparture.After(now) {
+				next = i
+				break
+			}
+		}
+	}
+
+	for i, progressStop := range progressStops {
+		switch {
+		case i == current:
+			stop := progressStop
+			progress.CurrentStop = &stop
+		case i < next:
+			progress.PassedStops = append(progress.PassedStops, progressStop)
+		case i == next:
+			stop := progressStop
+			progress.NextStop = &stop
+		default:
+			progress.UpcomingStops = append(progress.UpcomingStops, progressStop)
+		}
+	}
+
+	// Without a position the vehicle is taken to be at the last stop it passed
+	if progress.Vehicle == nil && next > 0 {
+		progress.Distance = distances[next-1]
+	}
+	if length := line.length(); length > 0 {
+		progress.Progress = math.Round(progress.Distance/length*1000) / 10
+		progress.DistanceRemaining = math.Round((length-progress.Distance)*1000) / 1000
+	}
+	progress.Distance = math.Round(progress.Distance*1000) / 1000
+
+	v.stripIDs(&progress)
+	return progress, nil
+}
+
+func realtimeStartDate(update *realtime.TripUpdate) string {
+	if update == nil {
+		return ""
+	}
+	return update.Trip.StartDate
+}
+
+func vehicleStartDate(vehicle *realtime.Vehicle) string {
+	if vehicle == nil {
+		return ""
+	}
+	return vehicle.Trip.StartDate
+}
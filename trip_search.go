@@ -0,0 +1,130 @@
+package gtfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+/*
+What trips to find with FindTrips, the filters which are set are all applied
+*/
+type TripFilter struct {
+	RouteID              string // Only trips on this route
+	Date                 string // Only trips running on this service date "20060102"
+	DirectionID          *int   // Only trips going in this direction
+	Headsign             string // Only trips with this in their headsign (case-insensitive)
+	WheelchairAccessible bool   // Only trips which can fit a wheelchair (wheelchair_accessible = 1)
+	BikesAllowed         bool   // Only trips which allow bikes (bikes_allowed = 1)
+	From                 string // Only trips which start (leave their first stop) at or after this time "15:04:05"
+	To                   string // Only trips which start before this time "15:04:05"
+}
+
+type TripSearchResult struct {
+	Trip
+	StartTime string `json:"start_time"` // When the trip leaves its first stop
+	EndTime   string `json:"end_time"`   // When the trip gets to its last stop
+}
+
+/*
+Find the trips matching a filter, ordered by when they start. Trips without any stop times aren't found
+
+  - page: optionally only get a page of the trips
+*/
+func (v Database) FindTrips(filter TripFilter, page ...Page) ([]TripSearchResult, error) {
+	defer v.observeQuery("FindTrips", time.Now())
+
+	query := `
+		SELECT
+			t.trip_id,
+			t.route_id,
+			COALESCE(t.trip_headsign, '') AS trip_headsign,
+			COALESCE(t.shape_id, '') AS shape_id,
+			t.service_id,
+			COALESCE(t.direction_id, 0) AS direction_id,
+			COALESCE(t.wheelchair_accessible, 0) AS wheelchair_accessible,
+			COALESCE(t.bikes_allowed, 0) AS bikes_allowed,
+			COALESCE(MIN(st.departure_sec), MIN(st.arrival_sec), 0) AS start_sec,
+			COALESCE(MAX(st.arrival_sec), MAX(st.departure_sec), 0) AS end_sec
+		FROM trips t
+		JOIN stop_times st ON st.trip_id = t.trip_id
+	`
+	var args []interface{}
+
+	if filter.Date != "" {
+		serviceDay, err := ParseServiceDay(filter.Date, v.locationFor("", v.PrefixID(filter.RouteID)))
+		if err != nil {
+			return nil, err
+		}
+		servicesQuery, servicesArgs := activeServicesQuery(serviceDay)
+		query = servicesQuery + query + ` JOIN adjusted_services a ON t.service_id = a.service_id`
+		args = append(args, servicesArgs...)
+	}
+
+	var filters []string
+	if filter.RouteID != "" {
+		filters = append(filters, "t.route_id = ?")
+		args = append(args, v.PrefixID(filter.RouteID))
+	}
+	if filter.DirectionID != nil {
+		filters = append(filters, "COALESCE(t.direction_id, 0) = ?")
+		args = append(args, *filter.DirectionID)
+	}
+	if headsign := strings.ToLower(strings.TrimSpace(filter.Headsign)); headsign != "" {
+		filters = append(filters, "INSTR(LOWER(t.trip_headsign), ?) > 0")
+		args = append(args, headsign)
+	}
+	if filter.WheelchairAccessible {
+		filters = append(filters, "t.wheelchair_accessible = 1")
+	}
+	if filter.BikesAllowed {
+		filters = append(filters, "t.bikes_allowed = 1")
+	}
+	if len(filters) > 0 {
+		query += " WHERE " + strings.Join(filters, " AND ")
+	}
+	query += " GROUP BY t.trip_id"
+
+	// The times are compared as seconds, as not every feed pads the hours ("8:00:00")
+	var having []string
+	if filter.From != "" {
+		from, err := parseGTFSTime(filter.From)
+		if err != nil {
+			return nil, errors.New("invalid from time")
+		}
+		having = append(having, "start_sec >= ?")
+		args = append(args, from)
+	}
+	if filter.To != "" {
+		to, err := parseGTFSTime(filter.To)
+		if err != nil {
+			return nil, errors.New("invalid to time")
+		}
+		having = append(having, "start_sec < ?")
+		args = append(args, to)
+	}
+	if len(having) > 0 {
+		query += " HAVING " + strings.Join(having, " AND ")
+	}
+	query += " ORDER BY start_sec, t.trip_id" + pageClause(page)
+
+	var rows []struct {
+		Trip
+		StartSec int `db:"start_sec"`
+		EndSec   int `db:"end_sec"`
+	}
+	if err := v.db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	trips := make([]TripSearchResult, len(rows))
+	for i, row := range rows {
+		trips[i] = TripSearchResult{
+			Trip:      row.Trip,
+			StartTime: formatGTFSTime(row.StartSec),
+			EndTime:   formatGTFSTime(row.EndSec),
+		}
+	}
+	v.stripIDs(&trips)
+	return trips, nil
+}
@@ -1,27 +1,40 @@
 package gtfs
 
 import (
+	"database/sql"
 	"errors"
-	"fmt"
+	"time"
 )
 
 type Trip struct {
-	BikesAllowed         int    `json:"bikes_allowed"`
-	DirectionID          int    `json:"direction_id"`
-	RouteID              string `json:"route_id"`
-	ServiceID            string `json:"service_id"`
-	ShapeID              string `json:"shape_id"`
-	TripHeadsign         string `json:"trip_headsign"`
-	TripID               string `json:"trip_id"`
-	WheelchairAccessible int    `json:"wheelchair_accessible"`
+	BikesAllowed         int    `json:"bikes_allowed" db:"bikes_allowed"`
+	DirectionID          int    `json:"direction_id" db:"direction_id"`
+	RouteID              string `json:"route_id" db:"route_id"`
+	ServiceID            string `json:"service_id" db:"service_id"`
+	ShapeID              string `json:"shape_id" db:"shape_id"`
+	TripHeadsign         string `json:"trip_headsign" db:"trip_headsign"`
+	TripID               string `json:"trip_id" db:"trip_id"`
+	WheelchairAccessible int    `json:"wheelchair_accessible" db:"wheelchair_accessible"`
 }
 
 /*
 Get a trip by it's trip id
 */
 func (v Database) GetTripByID(tripID string) (Trip, error) {
-	db := v.db
+	defer v.observeQuery("GetTripByID", time.Now())
 
+	trip, err := v.tripByID(v.PrefixID(tripID))
+	if err != nil {
+		return Trip{}, err
+	}
+	v.stripIDs(&trip)
+	return trip, nil
+}
+
+/*
+Get a trip by its id in the database (with the id prefix, see WithIDPrefix)
+*/
+func (v Database) tripByID(tripID string) (Trip, error) {
 	query := `
 		SELECT
 			trip_id,
@@ -38,21 +51,13 @@ func (v Database) GetTripByID(tripID string) (Trip, error) {
 			trip_id = ?
 	`
 
-	row := db.QueryRow(query, tripID)
+	statement, err := v.prepared(query)
+	if err != nil {
+		return Trip{}, err
+	}
 
 	var trip Trip
-
-	err := row.Scan(
-		&trip.TripID,
-		&trip.RouteID,
-		&trip.TripHeadsign,
-		&trip.ShapeID,
-		&trip.ServiceID,
-		&trip.DirectionID,
-		&trip.WheelchairAccessible,
-		&trip.BikesAllowed,
-	)
-
+	err = statement.Get(&trip, tripID)
 	if err != nil {
 		return Trip{}, errors.New("no trip found with id")
 	}
@@ -61,58 +66,160 @@ func (v Database) GetTripByID(tripID string) (Trip, error) {
 }
 
 /*
-Get the stops for a
+Get the stops a trip serves, as their parent stations (or the stop itself when it isn't in a station)
 
-Returns an array of stopIds (parent stops)
+Returns the stop ids in the order the trip serves them, each only once (e.g loops back through a station)
 */
 func (v Database) GetServicesStopsByTrip(tripId string) ([]string, error) {
+	stopIDs, err := v.servicesStopsByTrip(v.PrefixID(tripId))
+	if err != nil {
+		return nil, err
+	}
+	return v.stripIDPrefixes(stopIDs), nil
+}
+
+func (v Database) servicesStopsByTrip(tripId string) ([]string, error) {
+	// Each stop's parent station is joined in, rather than looked up for each stop
 	query := `
-		SELECT 
-			stop_id 
-		FROM 
-			stop_times 
-		WHERE 
-			trip_id = ?
+		SELECT
+			COALESCE(NULLIF(s.parent_station, ''), s.stop_id) AS stop_id
+		FROM
+			stop_times st
+		LEFT JOIN
+			stops s ON s.stop_id = st.stop_id
+		WHERE
+			st.trip_id = ?
+		ORDER BY
+			st.stop_sequence
 	`
 
-	rows, err := v.db.Query(query, tripId)
+	var stops []sql.NullString
+	err := v.db.Select(&stops, query, tripId)
 	if err != nil {
-		fmt.Println(err)
+		v.logger().Error("failed to query trip stops", "trip_id", tripId, "error", err)
 		return nil, errors.New("problem querying db")
 	}
 
-	defer rows.Close()
+	stopIDs := make([]string, 0, len(stops))
+	seen := make(map[string]bool, len(stops))
+	for _, stop := range stops {
+		if !stop.Valid {
+			return nil, errors.New("invalid stop id")
+		}
+		if seen[stop.String] {
+			continue
+		}
+		seen[stop.String] = true
+		stopIDs = append(stopIDs, stop.String)
+	}
 
-	var stops []string
+	if len(stopIDs) == 0 {
+		return nil, errors.New("no stops found")
+	}
 
-	for rows.Next() {
-		var stopId string
+	return stopIDs, nil
+}
 
-		err := rows.Scan(
-			&stopId,
-		)
-		if err != nil {
-			fmt.Println(err)
-			return nil, errors.New("unable to scan row")
-		}
+/*
+The same as GetServicesStopsByTrip, but with the stops instead of their ids
+*/
+func (v Database) GetServicesStopsByTripDetailed(tripId string) ([]Stop, error) {
+	stopIDs, err := v.servicesStopsByTrip(v.PrefixID(tripId))
+	if err != nil {
+		return nil, err
+	}
 
-		var allStops Stops
+	stopsByID, err := v.stopsByIDs(stopIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		parentStop, err := v.GetParentStopByChildStopID(stopId)
-		if err != nil {
-			return nil, errors.New("invalid stop id")
+	stops := make([]Stop, 0, len(stopIDs))
+	for _, stopID := range stopIDs {
+		if stop, found := stopsByID[stopID]; found {
+			stops = append(stops, stop)
 		}
-		allStops = append(allStops, *parentStop)
+	}
+	v.stripIDs(&stops)
+	return stops, nil
+}
 
-		for _, stop := range allStops {
-			stops = append(stops, stop.StopId)
-		}
+type TripContinuation struct {
+	Trip          Trip   `json:"trip"`
+	Route         Route  `json:"route"`
+	DepartureTime string `json:"departure_time"` // When the next trip departs its first stop
+}
 
+/*
+Get the next trip operated by the same vehicle (same block_id) after a trip, so riders know they can stay on board
+*/
+func (v Database) GetTripContinuation(tripID string) (TripContinuation, error) {
+	continuation, err := v.tripContinuation(v.PrefixID(tripID))
+	if err != nil {
+		return TripContinuation{}, err
 	}
+	v.stripIDs(&continuation)
+	return continuation, nil
+}
 
-	if len(stops) == 0 {
-		return nil, errors.New("no stops found")
+func (v Database) tripContinuation(tripID string) (TripContinuation, error) {
+	query := `
+		WITH current AS (
+			SELECT
+				t.block_id,
+				t.service_id,
+				MAX(st.arrival_sec) AS end_sec
+			FROM
+				trips t
+			JOIN
+				stop_times st ON st.trip_id = t.trip_id
+			WHERE
+				t.trip_id = ? AND t.block_id != ''
+			GROUP BY
+				t.block_id, t.service_id
+		)
+		SELECT
+			n.trip_id,
+			MIN(st.departure_sec) AS start_sec,
+			st.departure_time AS start_time -- From the row with the min departure_sec
+		FROM
+			trips n
+		JOIN
+			current c ON n.block_id = c.block_id AND n.service_id = c.service_id
+		JOIN
+			stop_times st ON st.trip_id = n.trip_id
+		WHERE
+			n.trip_id != ?
+		GROUP BY
+			n.trip_id
+		HAVING
+			start_sec >= (SELECT end_sec FROM current)
+		ORDER BY
+			start_sec
+		LIMIT 1
+	`
+
+	var next struct {
+		TripID    string `db:"trip_id"`
+		StartSec  int    `db:"start_sec"`
+		StartTime string `db:"start_time"`
+	}
+	if err := v.db.Get(&next, query, tripID, tripID); err != nil {
+		return TripContinuation{}, errors.New("no continuation found for trip")
 	}
 
-	return stops, nil
+	trip, err := v.tripByID(next.TripID)
+	if err != nil {
+		return TripContinuation{}, err
+	}
+	route, err := v.routeByID(trip.RouteID)
+	if err != nil {
+		return TripContinuation{}, err
+	}
+
+	return TripContinuation{
+		Trip:          trip,
+		Route:         route,
+		DepartureTime: next.StartTime,
+	}, nil
 }
@@ -0,0 +1,293 @@
+package gtfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WebhookEventType string
+
+const (
+	WebhookFeedRefreshed  WebhookEventType = "feed_refreshed"   // The feed data was refreshed
+	WebhookNewFeedVersion WebhookEventType = "new_feed_version" // A refresh changed feed_info's feed_version
+	WebhookImportFailed   WebhookEventType = "import_failed"    // Refreshing the feed data failed
+	WebhookFeedExpiry     WebhookEventType = "feed_expiry"      // A problem found by WatchFeedExpiry, e.g the feed is nearing its end date
+)
+
+type WebhookEvent struct {
+	Type                WebhookEventType `json:"type"`
+	Feed                string           `json:"feed"` // The database's name
+	Time                time.Time        `json:"time"`
+	FeedVersion         string           `json:"feed_version,omitempty"`
+	PreviousFeedVersion string           `json:"previous_feed_version,omitempty"` // Set for WebhookNewFeedVersion
+	Error               string           `json:"error,omitempty"`                 // Set for WebhookImportFailed
+	Report              *ImportReport    `json:"report,omitempty"`                // Set for WebhookFeedRefreshed
+	Expiry              *FeedEvent       `json:"expiry,omitempty"`                // Set for WebhookFeedExpiry
+}
+
+/*
+A url to POST events to
+
+The event json is POSTed with a "X-Signature-256: sha256=<hex hmac of the body>" header made with the secret (if set),
+the same as webhook notification clients
+*/
+type Webhook struct {
+	URL    string
+	Secret string
+	Events []WebhookEventType // The events to send, all of them when empty
+}
+
+func (w Webhook) wants(eventType WebhookEventType) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, wanted := range w.Events {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Sends feed refresh and data change events to webhooks, so downstream systems can react without polling Status
+*/
+type WebhookPublisher struct {
+	db         Database
+	expiry     FeedExpiryOptions
+	httpClient *http.Client
+
+	maxRetries   int
+	retryBackoff time.Duration
+
+	mutex    sync.Mutex
+	webhooks []Webhook
+	running  bool
+	stop     func()
+}
+
+/*
+Create a publisher which sends the database's events to webhooks once started
+
+  - expiry: when to send WebhookFeedExpiry events, see WatchFeedExpiry
+*/
+func (v Database) NewWebhookPublisher(expiry FeedExpiryOptions, webhooks ...Webhook) (*WebhookPublisher, error) {
+	for _, webhook := range webhooks {
+		if err := webhook.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &WebhookPublisher{
+		db:           v,
+		expiry:       expiry,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		maxRetries:   3,
+		retryBackoff: time.Second,
+		webhooks:     webhooks,
+	}, nil
+}
+
+func (w Webhook) validate() error {
+	if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+		return errors.New("invalid webhook url")
+	}
+	return nil
+}
+
+/*
+Add a webhook to send events to
+*/
+func (p *WebhookPublisher) AddWebhook(webhook Webhook) error {
+	if err := webhook.validate(); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.webhooks = append(p.webhooks, webhook)
+	return nil
+}
+
+/*
+Stop sending events to a webhook
+*/
+func (p *WebhookPublisher) RemoveWebhook(url string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var webhooks []Webhook
+	for _, webhook := range p.webhooks {
+		if webhook.URL != url {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	p.webhooks = webhooks
+}
+
+/*
+Set how many times a failed event is retried and the delay before the first retry, which doubles each retry (default 3, 1s)
+*/
+func (p *WebhookPublisher) SetRetry(maxRetries int, backoff time.Duration) {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	p.maxRetries = maxRetries
+	p.retryBackoff = backoff
+}
+
+/*
+Start sending events, from the refreshes (see RefreshNotifier and RefreshFailureNotifier) and WatchFeedExpiry
+*/
+func (p *WebhookPublisher) Start() {
+	p.mutex.Lock()
+	if p.running {
+		p.mutex.Unlock()
+		return
+	}
+	p.running = true
+	done := make(chan struct{})
+	refreshed, stopRefreshes := p.db.RefreshNotifier()
+	failed, stopFailures := p.db.RefreshFailureNotifier()
+	expiry, stopExpiry := p.db.WatchFeedExpiry(p.expiry)
+	var once sync.Once
+	p.stop = func() {
+		once.Do(func() {
+			close(done)
+			stopRefreshes()
+			stopFailures()
+			stopExpiry()
+		})
+	}
+	p.mutex.Unlock()
+
+	go func() {
+		feedVersion := p.feedVersion()
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-refreshed:
+				if !ok {
+					return
+				}
+				previous := feedVersion
+				feedVersion = p.feedVersion()
+				event := p.event(WebhookFeedRefreshed)
+				if report, found := p.db.LastImportReport(); found {
+					event.Report = &report
+				}
+				p.Publish(event)
+				if feedVersion != previous {
+					event := p.event(WebhookNewFeedVersion)
+					event.PreviousFeedVersion = previous
+					p.Publish(event)
+				}
+			case err, ok := <-failed:
+				if !ok {
+					return
+				}
+				event := p.event(WebhookImportFailed)
+				event.Error = err.Error()
+				p.Publish(event)
+			case feedEvent, ok := <-expiry:
+				if !ok {
+					return
+				}
+				event := p.event(WebhookFeedExpiry)
+				event.Expiry = &feedEvent
+				p.Publish(event)
+			}
+		}
+	}()
+}
+
+/*
+Stop sending events, events already being sent are still sent
+*/
+func (p *WebhookPublisher) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.running {
+		return
+	}
+	p.running = false
+	p.stop()
+}
+
+/*
+Send an event to the webhooks which want it, in the background with retries
+*/
+func (p *WebhookPublisher) Publish(event WebhookEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		p.db.logger().Warn("webhooks: failed to encode event", "type", event.Type, "error", err)
+		return
+	}
+
+	p.mutex.Lock()
+	webhooks := append([]Webhook(nil), p.webhooks...)
+	p.mutex.Unlock()
+
+	for _, webhook := range webhooks {
+		if !webhook.wants(event.Type) {
+			continue
+		}
+		go p.sendWithRetry(webhook, event.Type, payload)
+	}
+}
+
+func (p *WebhookPublisher) event(eventType WebhookEventType) WebhookEvent {
+	return WebhookEvent{Type: eventType, Feed: p.db.state.name, Time: time.Now(), FeedVersion: p.feedVersion()}
+}
+
+func (p *WebhookPublisher) feedVersion() string {
+	var feedVersion string
+	p.db.db.Get(&feedVersion, `SELECT COALESCE(feed_version, '') FROM feed_info LIMIT 1`)
+	return feedVersion
+}
+
+func (p *WebhookPublisher) sendWithRetry(webhook Webhook, eventType WebhookEventType, payload []byte) {
+	backoff := p.retryBackoff
+	var err error
+	for attempt := 0; attempt <= p.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = p.send(webhook, payload); err == nil {
+			return
+		}
+	}
+	p.db.logger().Warn("webhooks: giving up sending event", "type", eventType, "url", webhook.URL, "error", err)
+}
+
+func (p *WebhookPublisher) send(webhook Webhook, payload []byte) error {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}